@@ -0,0 +1,79 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func clone(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	from, to := ctx.String("from"), ctx.String("to")
+	if from == "" || to == "" {
+		return fmt.Errorf("both --from and --to are needed")
+	}
+	src := meta.NewClient(from, &meta.Config{Retries: 10, Strict: true})
+	dst := meta.NewClient(to, &meta.Config{Retries: 10, Strict: true})
+	dopt := meta.DumpOption{
+		Threads: ctx.Int("threads"),
+
+		ProgressInterval: ctx.Duration("progress-interval"),
+	}
+	lopt := meta.LoadOption{
+		Resume: ctx.Bool("resume"),
+
+		ProgressInterval: ctx.Duration("progress-interval"),
+	}
+	if err := meta.CloneMeta(src, dst, dopt, lopt); err != nil {
+		return err
+	}
+	logger.Infof("Clone metadata from %s into %s succeed", src.Name(), dst.Name())
+	return nil
+}
+
+func cloneFlags() *cli.Command {
+	return &cli.Command{
+		Name:   "clone",
+		Usage:  "clone metadata into another engine without an intermediate file",
+		Action: clone,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "from",
+				Usage: "META-URL of the source volume",
+			},
+			&cli.StringFlag{
+				Name:  "to",
+				Usage: "META-URL of the target, which should be empty",
+			},
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 10,
+				Usage: "number of entries read from the source concurrently",
+			},
+			&cli.BoolFlag{
+				Name:  "resume",
+				Usage: "resume an interrupted clone from the checkpoint in the target",
+			},
+			&cli.DurationFlag{
+				Name:  "progress-interval",
+				Usage: "refresh interval of the progress, which is also logged at this interval when stderr is not a terminal (0 for the default refresh and no log)",
+			},
+		},
+	}
+}
@@ -16,22 +16,395 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/sync"
 	"github.com/urfave/cli/v2"
 )
 
+// createDumpObject returns the storage and key of a dump in object storage, the URL
+// is the same as SRC and DST of sync, e.g. s3://ACCESS_KEY:SECRET_KEY@bucket/path/meta.dump
+func createDumpObject(uri string) (object.ObjectStorage, string, error) {
+	i := strings.LastIndex(uri, "/")
+	if i < strings.Index(uri, "://")+3 || i == len(uri)-1 {
+		return nil, "", fmt.Errorf("no object key in %s", uri)
+	}
+	store, err := createSyncStorage(uri[:i+1], &sync.Config{})
+	if err != nil {
+		return nil, "", err
+	}
+	return store, uri[i+1:], nil
+}
+
+// openDump opens a dump in a local file or object storage.
+func openDump(path string) (io.ReadCloser, error) {
+	if !strings.Contains(path, "://") {
+		return os.Open(path)
+	}
+	store, key, err := createDumpObject(path)
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(key, 0, -1)
+}
+
+// dumpKey returns the key to encrypt or decrypt a dump, read from --key-file, or the passphrase
+// in the environment variable JFS_DUMP_PASSPHRASE. It's nil if none of them is provided.
+func dumpKey(ctx *cli.Context) (*meta.DumpKey, error) {
+	if path := ctx.String("key-file"); path != "" {
+		key, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read key file: %s", err)
+		}
+		return &meta.DumpKey{Key: key}, nil
+	}
+	if passphrase := os.Getenv("JFS_DUMP_PASSPHRASE"); passphrase != "" {
+		return &meta.DumpKey{Passphrase: passphrase}, nil
+	}
+	return nil, nil
+}
+
+// storageRetry retries a request to the object storage for dump --verify-data and --with-data,
+// so that a transient error or throttling neither fails the dump nor makes a block missing. The
+// delay before every retry is doubled from the first one, and the retried keys are logged.
+type storageRetry struct {
+	ctx     context.Context // no more retries once it's done
+	retries int             // after the first attempt, 0 for none
+	delay   time.Duration   // before the first retry
+}
+
+// newStorageRetry returns the retries set by --io-retries and --io-retry-delay of ctx.
+func newStorageRetry(c context.Context, ctx *cli.Context) storageRetry {
+	return storageRetry{c, ctx.Int("io-retries"), ctx.Duration("io-retry-delay")}
+}
+
+// do calls f until it succeeds or the retries are exhausted, the last error is returned.
+func (r storageRetry) do(what string, f func() error) error {
+	delay := r.delay
+	for tried := 1; ; tried++ {
+		err := f()
+		if err == nil || tried > r.retries || r.ctx.Err() != nil {
+			return err
+		}
+		logger.Warnf("%s: %s, retry in %s (tried %d)", what, err, delay, tried)
+		select {
+		case <-time.After(delay):
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// sliceStore reads and writes the contents of slices in the object storage of a volume,
+// for a dump with data. Only the reads are retried, the writes are by chunk.CachedStore.
+type sliceStore struct {
+	store chunk.ChunkStore
+	retry storageRetry
+}
+
+// newSliceStore creates the store of slices for the volume in format, of which the reads and
+// writes are limited to limit bytes per second if it's not 0.
+func newSliceStore(format *meta.Format, limit int64, retry storageRetry) (*sliceStore, error) {
+	blob, err := createStorage(format)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 {
+		blob = object.NewLimited(blob, limit, limit)
+	}
+	logger.Infof("Data use %s", blob)
+	chunkConf := chunk.Config{
+		BlockSize: format.BlockSize * 1024,
+		Compress:  format.Compression,
+
+		GetTimeout: time.Second * 60,
+		PutTimeout: time.Second * 60,
+		MaxUpload:  20,
+		Prefetch:   0,
+		BufferSize: 300,
+		CacheDir:   "memory",
+		CacheSize:  0,
+	}
+	return &sliceStore{chunk.NewCachedStore(blob, chunkConf), retry}, nil
+}
+
+func (s *sliceStore) ReadSlice(id uint64, size uint32) ([]byte, error) {
+	data := make([]byte, size)
+	var n int
+	err := s.retry.do(fmt.Sprintf("read slice %d", id), func() (err error) {
+		n, err = s.store.NewReader(id, int(size)).ReadAt(context.Background(), chunk.NewPage(data), 0)
+		if n == len(data) {
+			err = nil
+		}
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (s *sliceStore) WriteSlice(id uint64, data []byte) error {
+	w := s.store.NewWriter(id)
+	if _, err := w.WriteAt(data, 0); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Finish(len(data))
+}
+
+// parseBandwidth parses a bandwidth like 100MiB/s, 1.5G or 800K into bytes per second, the units
+// are binary and a bare number is in MiB/s. It's 0 for no limit, or if s is empty.
+func parseBandwidth(s string) (int64, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S")
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	unit := float64(1 << 20)
+	if n := len(v); n > 0 {
+		if i := strings.IndexByte("KMGT", v[n-1]); i >= 0 {
+			unit, v = float64(int64(1)<<(10*(i+1))), v[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid bandwidth: %s", s)
+	}
+	return int64(f * unit), nil
+}
+
+// cancelContext returns a context canceled by SIGINT or SIGTERM, or after --timeout if it's set,
+// and the function to release it. Only the first signal is caught, another one kills it.
+func cancelContext(ctx *cli.Context) (context.Context, func()) {
+	var c context.Context
+	var cancel context.CancelFunc
+	if t := ctx.Duration("timeout"); t > 0 {
+		c, cancel = context.WithTimeout(context.Background(), t)
+	} else {
+		c, cancel = context.WithCancel(context.Background())
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case s := <-sig:
+			logger.Warnf("Received %s, canceling", s)
+			cancel()
+		case <-c.Done():
+		}
+		signal.Stop(sig)
+	}()
+	return c, cancel
+}
+
+// sliceVerifier checks the blocks of slices in the object storage of a volume by HEAD requests,
+// named by chunk.BlockKey, for dump --verify-data.
+type sliceVerifier struct {
+	ctx        context.Context // a hung request is abandoned once it's done
+	blob       object.ObjectStorage
+	blockSize  int
+	partitions int
+	retry      storageRetry // a block is missing only if it's not found after all the retries
+}
+
+func newSliceVerifier(ctx context.Context, format *meta.Format, retry storageRetry) (*sliceVerifier, error) {
+	blob, err := createStorage(format)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Data use %s", blob)
+	return &sliceVerifier{ctx, blob, format.BlockSize * 1024, format.Partitions, retry}, nil
+}
+
+func (v *sliceVerifier) head(key string) error {
+	return v.retry.do("HEAD "+key, func() error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := v.blob.Head(key)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-v.ctx.Done():
+			return v.ctx.Err()
+		}
+	})
+}
+
+func (v *sliceVerifier) MissingBlocks(id uint64, size uint32) ([]string, error) {
+	var missing []string
+	for i := 0; i*v.blockSize < int(size); i++ {
+		key := chunk.BlockKey(id, i, int(size), v.blockSize, v.partitions > 1)
+		if err := v.head(key); err != nil && v.ctx.Err() != nil {
+			return nil, v.ctx.Err()
+		} else if err != nil {
+			logger.Debugf("can't find block %s: %s", key, err)
+			missing = append(missing, key)
+		}
+	}
+	return missing, nil
+}
+
+// printMissingData prints the files whose data is missing found by dump --verify-data to stderr.
+func printMissingData(missing []*meta.DumpedMissingData) {
+	fmt.Fprintf(os.Stderr, "Files with missing data: %d\n", len(missing))
+	for _, m := range missing {
+		fmt.Fprintf(os.Stderr, "  %12d  %d slices %d blocks missing  %s\n", m.Inode, len(m.Slices), len(m.Blocks), m.Path)
+	}
+}
+
+// printCaseCollisions prints the names differing only by case found by dump --warn-case-collisions to stderr.
+func printCaseCollisions(collisions []*meta.DumpedCaseCollision) {
+	fmt.Fprintf(os.Stderr, "Names colliding by case: %d\n", len(collisions))
+	for _, c := range collisions {
+		names := make([]string, len(c.Names))
+		for i, n := range c.Names {
+			names[i] = strconv.Quote(n)
+		}
+		fmt.Fprintf(os.Stderr, "  %s: %s\n", c.Path, strings.Join(names, ", "))
+	}
+}
+
+// printDumpStat prints the summary of a dump to stderr, so that it's not mixed with a dump to stdout.
+func printDumpStat(st *meta.DumpStat, asJSON bool) error {
+	if asJSON {
+		data, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(os.Stderr, "%s\n", data)
+		return err
+	}
+	var total int64
+	types := make([]string, 0, len(st.Inodes))
+	for typ, n := range st.Inodes {
+		total += n
+		types = append(types, fmt.Sprintf("%s %d", typ, n))
+	}
+	sort.Strings(types)
+	fmt.Fprintf(os.Stderr, "Inodes: %d (%s)\n", total, strings.Join(types, ", "))
+	fmt.Fprintf(os.Stderr, "Used space: %s\n", formatSize(uint64(st.UsedSpace)))
+	fmt.Fprintf(os.Stderr, "Hard-linked inodes: %d\n", st.HardLinked)
+	fmt.Fprintf(os.Stderr, "Files to be deleted: %d\n", st.DelFiles)
+	fmt.Fprintf(os.Stderr, "Deepest path: %s (depth %d)\n", st.DeepestPath, st.Depth)
+	fmt.Fprintf(os.Stderr, "Largest files:\n")
+	for _, f := range st.LargestFiles {
+		fmt.Fprintf(os.Stderr, "  %10s, modified %s  %s\n", formatSize(f.Size), formatTime(f.Mtime), f.Path)
+	}
+	fmt.Fprintf(os.Stderr, "Oldest files:\n")
+	for _, f := range st.OldestFiles {
+		fmt.Fprintf(os.Stderr, "  %10s, modified %s  %s\n", formatSize(f.Size), formatTime(f.Mtime), f.Path)
+	}
+	return nil
+}
+
+// formatSize formats a size in bytes with the binary units, e.g. "3.2 GiB".
+func formatSize(n uint64) string {
+	if n < 1<<10 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v, unit := float64(n)/(1<<10), 0
+	for v >= 1<<10 && unit < 5 {
+		v /= 1 << 10
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", v, "KMGTPE"[unit])
+}
+
+// printEstimate prints the projected size and time of a dump by dump --estimate.
+func printEstimate(est *meta.DumpEstimate) {
+	fmt.Printf("~%s, ~%s at current rate\n", formatSize(uint64(est.Size)), formatDuration(est.Duration))
+	fmt.Printf("Sampled %d of %d entries in %s, %s written\n", est.Sampled, est.Entries, est.Elapsed.Round(time.Millisecond), formatSize(uint64(est.Bytes)))
+}
+
+// formatDuration formats a duration roughly, e.g. "45 s", "22 min" or "3.5 h".
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%d s", int(d.Round(time.Second)/time.Second))
+	case d < time.Hour:
+		return fmt.Sprintf("%d min", int(d.Round(time.Minute)/time.Minute))
+	default:
+		return fmt.Sprintf("%.1f h", d.Hours())
+	}
+}
+
+// formatTime formats a timestamp in seconds as RFC3339 in UTC.
+func formatTime(sec int64) string {
+	return time.Unix(sec, 0).UTC().Format(time.RFC3339)
+}
+
+// printOrphans prints the orphaned inodes found by a dump to stderr.
+func printOrphans(orphans []*meta.DumpedOrphan) {
+	var space int64
+	for _, o := range orphans {
+		space += o.Space
+	}
+	fmt.Fprintf(os.Stderr, "Orphaned inodes: %d (%d bytes)\n", len(orphans), space)
+	for _, o := range orphans {
+		a := o.Attr
+		fmt.Fprintf(os.Stderr, "  %12d  %-9s %12d bytes  uid %d gid %d  mode %o  ctime %s  %s\n", a.Inode, a.Type, o.Space,
+			a.Uid, a.Gid, a.Mode, time.Unix(a.Ctime, int64(a.Ctimensec)).Format(time.RFC3339), o.Path)
+	}
+}
+
 func dump(ctx *cli.Context) error {
 	setLoggerLevel(ctx)
+	if ctx.Bool("schema") {
+		fmt.Print(meta.DumpSchema)
+		return nil
+	}
 	if ctx.Args().Len() < 1 {
 		return fmt.Errorf("META-URL is needed")
 	}
+	estimate := ctx.Bool("estimate")
+	if estimate && (ctx.IsSet("snapshot") || ctx.IsSet("index") || ctx.IsSet("chunk-manifest")) {
+		return fmt.Errorf("nothing is written by --estimate, it can't be used with --snapshot, --index or --chunk-manifest")
+	}
+	reportFile := ctx.String("report-file")
+	if reportFile != "" && !ctx.Bool("verify-data") {
+		return fmt.Errorf("--report-file can only be used with --verify-data")
+	}
 	var fp io.WriteCloser
-	if ctx.Args().Len() == 1 {
+	var upload *object.Writer
+	var container *os.File
+	if estimate {
+		// nothing is written into FILE
+	} else if snapshot := ctx.String("snapshot"); snapshot != "" {
+		if ctx.Args().Len() == 1 || strings.Contains(ctx.Args().Get(1), "://") {
+			return fmt.Errorf("snapshots can only be appended into a local FILE")
+		}
+		var err error
+		if container, err = os.OpenFile(ctx.Args().Get(1), os.O_CREATE|os.O_RDWR, 0644); err != nil {
+			return err
+		}
+		defer container.Close()
+	} else if ctx.Args().Len() == 1 {
 		fp = os.Stdout
+	} else if dst := ctx.Args().Get(1); strings.Contains(dst, "://") {
+		store, key, err := createDumpObject(dst)
+		if err != nil {
+			return err
+		}
+		upload = object.NewWriter(store, key)
+		fp = upload
 	} else {
 		var err error
 		fp, err = os.OpenFile(ctx.Args().Get(1), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
@@ -41,10 +414,198 @@ func dump(ctx *cli.Context) error {
 		defer fp.Close()
 	}
 	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true, Subdir: ctx.String("subdir")})
-	if err := m.DumpMeta(fp); err != nil {
+	c, cancel := cancelContext(ctx)
+	defer cancel()
+	opt := meta.DumpOption{
+		Context:  c,
+		Format:   ctx.String("format"),
+		Compress: ctx.String("compress"),
+		Compact:  ctx.Bool("compact"),
+		Threads:  ctx.Int("threads"),
+		NoData:   ctx.Bool("no-data"),
+		DirsOnly: ctx.Bool("dirs-only"),
+		Xattrs:   ctx.StringSlice("xattr"),
+		Exclude:  ctx.StringSlice("exclude"),
+		Include:  ctx.StringSlice("include"),
+
+		CompressLevel:    ctx.Int("compress-level"),
+		SkipEmptyFiles:   ctx.Bool("skip-empty-files"),
+		SkipEmptyDirs:    ctx.Bool("skip-empty-dirs"),
+		AdoptOrphans:     ctx.Bool("adopt-orphans"),
+		DirStats:         ctx.Bool("with-dir-stats"),
+		Locks:            ctx.Bool("with-locks"),
+		EntryHash:        ctx.Bool("per-entry-hash"),
+		Consistent:       ctx.Bool("consistent"),
+		StandardEscape:   ctx.Bool("standard-json-escape"),
+		StringBignums:    ctx.Bool("string-bignums"),
+		KeepSecrets:      ctx.Bool("keep-secrets"),
+		ProgressInterval: ctx.Duration("progress-interval"),
+	}
+	bwlimit, err := parseBandwidth(ctx.String("bwlimit"))
+	if err != nil {
 		return err
 	}
+	opt.BWLimit = bwlimit
+	metrics := newDumpMetrics(ctx.String("metrics-addr"), "dump")
+	if metrics != nil {
+		defer metrics.close()
+		opt.Progress = metrics.progress
+	}
+	if uri := ctx.String("read-from"); uri != "" {
+		opt.ReadFrom = meta.NewClient(uri, &meta.Config{Retries: 10, Strict: true, ReadOnly: true, Subdir: ctx.String("subdir")})
+	}
+	for _, r := range ctx.StringSlice("root") {
+		ps := strings.SplitN(r, "=", 2)
+		if len(ps) != 2 || ps[0] == "" {
+			return fmt.Errorf("invalid root: %s, it should be NAME=PATH", r)
+		}
+		if opt.Roots == nil {
+			opt.Roots = make(map[string]string)
+		}
+		if _, ok := opt.Roots[ps[0]]; ok {
+			return fmt.Errorf("root %s is given more than once", ps[0])
+		}
+		opt.Roots[ps[0]] = ps[1]
+	}
+	if fields := ctx.String("fields"); fields != "" {
+		for _, f := range strings.Split(fields, ",") {
+			opt.Fields = append(opt.Fields, strings.TrimSpace(f))
+		}
+	}
+	if ctx.Bool("encrypt") {
+		key, err := dumpKey(ctx)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return fmt.Errorf("--encrypt needs a key in --key-file or a passphrase in JFS_DUMP_PASSPHRASE")
+		}
+		opt.Encrypt = key
+	}
+	if ctx.Bool("stat") || ctx.Bool("stat-json") {
+		opt.Stat = &meta.DumpStat{Top: ctx.Int("stat-top")}
+	}
+	if path := ctx.String("index"); path != "" {
+		index, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		defer index.Close()
+		opt.Index = index
+	}
+	if path := ctx.String("chunk-manifest"); path != "" {
+		manifest, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		defer manifest.Close()
+		opt.Manifest = manifest
+	}
+	var collisions []*meta.DumpedCaseCollision
+	if ctx.Bool("warn-case-collisions") {
+		opt.CaseCollisions = &collisions
+	}
+	var orphans []*meta.DumpedOrphan
+	if ctx.Bool("report-orphans") || opt.AdoptOrphans {
+		opt.Orphans = &orphans
+	}
+	if r := ctx.String("inode-range"); r != "" {
+		ps := strings.SplitN(r, "-", 2)
+		if len(ps) != 2 {
+			return fmt.Errorf("invalid inode range: %s", r)
+		}
+		start, err1 := strconv.ParseUint(ps[0], 10, 64)
+		end, err2 := strconv.ParseUint(ps[1], 10, 64)
+		if err1 != nil || err2 != nil || start >= end {
+			return fmt.Errorf("invalid inode range: %s", r)
+		}
+		opt.InodeRange = []meta.Ino{meta.Ino(start), meta.Ino(end)}
+	}
+	if ctx.Bool("with-data") {
+		format, err := m.Load()
+		if err != nil {
+			return fmt.Errorf("load setting: %s", err)
+		}
+		if opt.Data, err = newSliceStore(format, opt.BWLimit, newStorageRetry(c, ctx)); err != nil {
+			return fmt.Errorf("object storage: %s", err)
+		}
+		opt.MaxDataSize = ctx.Int64("max-data-size") << 20
+	}
+	var missing []*meta.DumpedMissingData
+	if ctx.Bool("verify-data") {
+		format, err := m.Load()
+		if err != nil {
+			return fmt.Errorf("load setting: %s", err)
+		}
+		if opt.VerifyData, err = newSliceVerifier(c, format, newStorageRetry(c, ctx)); err != nil {
+			return fmt.Errorf("object storage: %s", err)
+		}
+		opt.VerifySample = ctx.Float64("verify-sample")
+		opt.MissingData = &missing
+	}
+	if since := ctx.String("since"); since != "" {
+		base, err := openDump(since)
+		if err != nil {
+			return err
+		}
+		defer base.Close()
+		opt.Since = base
+	}
+	if diff := ctx.String("diff"); diff != "" {
+		golden, err := openDump(diff)
+		if err != nil {
+			return err
+		}
+		defer golden.Close()
+		opt.Diff = golden
+	}
+	if estimate {
+		opt.Estimate = &meta.DumpEstimate{Sample: ctx.Int64("estimate-sample")}
+		if err := m.DumpMeta(ioutil.Discard, opt); err != nil {
+			return err
+		}
+		printEstimate(opt.Estimate)
+		return nil
+	}
+	if container != nil {
+		st, err := container.Stat()
+		if err != nil {
+			return err
+		}
+		if err = meta.AppendSnapshot(container, st.Size(), ctx.String("snapshot"), func(w io.Writer) error {
+			return m.DumpMeta(metrics.writer(w), opt)
+		}); err != nil {
+			return err
+		}
+	} else if err := m.DumpMeta(metrics.writer(fp), opt); err != nil {
+		if upload != nil {
+			upload.Abort()
+		}
+		return err
+	}
+	if upload != nil {
+		if err := upload.Close(); err != nil {
+			return err
+		}
+	}
 	logger.Infof("Dump metadata into %s succeed", ctx.Args().Get(1))
+	if opt.Orphans != nil {
+		printOrphans(orphans)
+	}
+	if opt.MissingData != nil {
+		printMissingData(missing)
+		if reportFile != "" {
+			if err := writeReport(reportFile, newDumpReport(ctx.Args().Get(1), missing)); err != nil {
+				return err
+			}
+		}
+	}
+	if opt.CaseCollisions != nil {
+		printCaseCollisions(collisions)
+	}
+	if opt.Stat != nil {
+		return printDumpStat(opt.Stat, ctx.Bool("stat-json"))
+	}
 	return nil
 }
 
@@ -56,8 +617,218 @@ func dumpFlags() *cli.Command {
 		Action:    dump,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
-				Name:  "subdir",
-				Usage: "only dump a sub-directory.",
+				Name:    "subdir",
+				Aliases: []string{"subtree"},
+				Usage:   "only dump a sub-directory, which becomes the root when loaded",
+			},
+			&cli.StringSliceFlag{
+				Name:  "root",
+				Usage: "dump the directory at PATH as a named root in NAME=PATH instead of the whole tree, any of which can be loaded by load --root, can be used multiple times",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "format of the dumped file (json, binary, ndjson, csv), csv is for analysis only and can't be loaded",
+			},
+			&cli.BoolFlag{
+				Name:  "compact",
+				Usage: "dump JSON without indentation or newlines, which is smaller but hard to read",
+			},
+			&cli.BoolFlag{
+				Name:  "standard-json-escape",
+				Usage: "dump names in JSON or ndjson as they are with the standard JSON escaping instead of %XX, for other tools, names of invalid UTF-8 are in base64 with a prefix",
+			},
+			&cli.BoolFlag{
+				Name:  "string-bignums",
+				Usage: "dump the counters and the IDs of slices in JSON or ndjson as strings, for the tools which lose the precision of numbers above 2^53",
+			},
+			&cli.StringFlag{
+				Name:  "compress",
+				Value: "none",
+				Usage: "compression algorithm of the dumped file (none, gzip, zstd, lz4)",
+			},
+			&cli.IntFlag{
+				Name:  "compress-level",
+				Usage: "level of --compress, gzip 1-9, zstd 1-20 and lz4 0-65536 (the depth of its high compression mode), from the fastest to the smallest (0 for the default of the algorithm)",
+			},
+			&cli.StringFlag{
+				Name:  "since",
+				Usage: "only dump the changes since a previous full dump in this file",
+			},
+			&cli.StringFlag{
+				Name:  "diff",
+				Usage: "compare with a previous full dump in this file, and dump the added, removed and changed inodes in JSON instead",
+			},
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 10,
+				Usage: "number of entries read from the metadata engine concurrently",
+			},
+			&cli.DurationFlag{
+				Name:  "progress-interval",
+				Usage: "refresh interval of the progress, which is also logged at this interval when stderr is not a terminal (0 for the default refresh and no log)",
+			},
+			&cli.StringFlag{
+				Name:  "metrics-addr",
+				Usage: "address to export the metrics of the dump in Prometheus format at /metrics until it's done, e.g. 127.0.0.1:9567",
+			},
+			&cli.StringFlag{
+				Name:  "bwlimit",
+				Usage: "limit the bandwidth of writing FILE and reading the data for --with-data, e.g. 100MiB/s, a bare number is in MiB/s (0 for no limit)",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "cancel the dump if it's not finished in this time, like Ctrl-C (0 for no timeout)",
+			},
+			&cli.StringFlag{
+				Name:  "inode-range",
+				Usage: "only dump the entries with inodes in START-END (END excluded) as a shard, which can be merged by load --merge",
+			},
+			&cli.BoolFlag{
+				Name:  "no-data",
+				Usage: "do not dump the slices of files, which can only be loaded with load --metadata-only",
+			},
+			&cli.BoolFlag{
+				Name:  "dirs-only",
+				Usage: "only dump the directories with their attributes as a skeleton of the tree, without files, symlinks or xattrs",
+			},
+			&cli.BoolFlag{
+				Name:  "with-data",
+				Usage: "embed the contents of files read from the object storage, to restore the volume without it by load --with-data",
+			},
+			&cli.Int64Flag{
+				Name:  "max-data-size",
+				Value: 1024,
+				Usage: "max size in MiB of the data embedded by --with-data, the dump fails if it's exceeded (0 for no limit)",
+			},
+			&cli.IntFlag{
+				Name:  "io-retries",
+				Value: 3,
+				Usage: "number of retries of a failed request to the object storage for --verify-data and --with-data",
+			},
+			&cli.DurationFlag{
+				Name:  "io-retry-delay",
+				Value: time.Second,
+				Usage: "delay before the first retry of --io-retries, which is doubled for every next one",
+			},
+			&cli.StringFlag{
+				Name:  "snapshot",
+				Usage: "append the dump as a snapshot of this name, like 2024-01-07, into FILE, which is a container of snapshots created if not exist",
+			},
+			&cli.StringFlag{
+				Name:  "index",
+				Usage: "write an index of the paths of entries to their inodes and offsets in the dump into this file, only for JSON and ndjson",
+			},
+			&cli.StringFlag{
+				Name:  "chunk-manifest",
+				Usage: "write the sorted ids and object keys of the blocks referred to by the dump into this file, to keep them in the object storage, not for --no-data, --since or --diff",
+			},
+			&cli.BoolFlag{
+				Name:  "with-dir-stats",
+				Usage: "dump the total size and numbers of files and sub-directories under every directory with it, which are counted by another walk of the tree before dumping",
+			},
+			&cli.BoolFlag{
+				Name:  "with-locks",
+				Usage: "dump the BSD and POSIX locks held by the sessions for audit, which are not loaded",
+			},
+			&cli.BoolFlag{
+				Name:  "per-entry-hash",
+				Usage: "write a hash of the attributes, xattrs and chunks of every entry into it, to find the entries corrupted in the dump by load --check-entries, not for csv",
+			},
+			&cli.BoolFlag{
+				Name:  "consistent",
+				Usage: "dump all the metadata read at one moment, which is kept in memory, only for tkv engines (e.g. TiKV)",
+			},
+			&cli.StringFlag{
+				Name:  "read-from",
+				Usage: "read the tree from a replica of the engine at this META-URL to keep the load off the primary, which may lag behind it, not for --consistent",
+			},
+			&cli.BoolFlag{
+				Name:  "verify-data",
+				Usage: "check the blocks of slices in the object storage by HEAD requests, the files with missing data are printed to stderr and the dump is marked as partial",
+			},
+			&cli.Float64Flag{
+				Name:  "verify-sample",
+				Value: 1,
+				Usage: "fraction of slices checked by --verify-data, chosen by their ids, in (0, 1]",
+			},
+			&cli.StringFlag{
+				Name:  "report-file",
+				Usage: "write the files with missing data found by --verify-data into this file in JSON, besides the summary on stderr",
+			},
+			&cli.StringSliceFlag{
+				Name:  "exclude",
+				Usage: "drop the entries matching this pattern (a glob like *.tmp or **/node_modules/**, or re:REGEXP) with all under them, can be used multiple times",
+			},
+			&cli.StringSliceFlag{
+				Name:  "include",
+				Usage: "only dump the files matching this pattern or under a directory matching it, can be used multiple times, --exclude takes precedence",
+			},
+			&cli.BoolFlag{
+				Name:  "skip-empty-files",
+				Usage: "drop the files of zero length, which are found by another walk of the tree before dumping",
+			},
+			&cli.BoolFlag{
+				Name:  "skip-empty-dirs",
+				Usage: "drop the directories with nothing left under them after the others are dropped, including those excluded, except the root",
+			},
+			&cli.StringFlag{
+				Name:  "fields",
+				Usage: "comma-separated attributes exported as columns in csv format, e.g. path,size,mtime, all of path, inode, type, mode, uid, gid, size, atime, mtime, ctime and nlink by default",
+			},
+			&cli.StringSliceFlag{
+				Name:  "xattr",
+				Usage: "name of an xattr to be exported as a column in csv format, can be used multiple times",
+			},
+			&cli.BoolFlag{
+				Name:  "report-orphans",
+				Usage: "scan all the inodes for the ones no directory refers to, and print them to stderr, which needs a full dump",
+			},
+			&cli.BoolFlag{
+				Name:  "warn-case-collisions",
+				Usage: "print the names in a directory differing only by case to stderr, which collide on a case-insensitive target",
+			},
+			&cli.BoolFlag{
+				Name:  "adopt-orphans",
+				Usage: "dump the inodes no directory refers to in a new directory lost+found under the root, they're also printed like --report-orphans",
+			},
+			&cli.BoolFlag{
+				Name:  "keep-secrets",
+				Usage: "keep the credentials of the object storage and the encryption key in the dumped setting, which are redacted by default, only for a trusted backup",
+			},
+			&cli.BoolFlag{
+				Name:  "encrypt",
+				Usage: "encrypt the dumped file by AES-256-GCM with the key in --key-file or the passphrase in JFS_DUMP_PASSPHRASE",
+			},
+			&cli.StringFlag{
+				Name:  "key-file",
+				Usage: "file of the key (32 bytes) to encrypt the dumped file",
+			},
+			&cli.BoolFlag{
+				Name:  "stat",
+				Usage: "print a summary of the dump to stderr",
+			},
+			&cli.BoolFlag{
+				Name:  "stat-json",
+				Usage: "print a summary of the dump to stderr in JSON",
+			},
+			&cli.IntFlag{
+				Name:  "stat-top",
+				Value: 10,
+				Usage: "number of the largest and oldest files in the summary",
+			},
+			&cli.BoolFlag{
+				Name:  "estimate",
+				Usage: "print the size and time of the dump projected by the counters and a sample of the first entries, which are dumped into nowhere, and exit without dumping",
+			},
+			&cli.Int64Flag{
+				Name:  "estimate-sample",
+				Value: 1000,
+				Usage: "number of entries sampled by --estimate, a larger sample takes longer but is more accurate",
+			},
+			&cli.BoolFlag{
+				Name:  "schema",
+				Usage: "print the JSON Schema of dumped files and exit",
 			},
 		},
 	}
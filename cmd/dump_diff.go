@@ -0,0 +1,105 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func dumpDiffFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "dump-diff",
+		Usage:     "compare two full dumps offline by path, the differences are printed in JSON with a summary to stderr",
+		ArgsUsage: "OLD-FILE NEW-FILE",
+		Action:    dumpDiff,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "key-file",
+				Usage: "file of the key to decrypt encrypted FILEs, or the passphrase in JFS_DUMP_PASSPHRASE is used",
+			},
+		},
+	}
+}
+
+func dumpDiff(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() != 2 {
+		return fmt.Errorf("OLD-FILE and NEW-FILE are needed")
+	}
+	key, err := dumpKey(ctx)
+	if err != nil {
+		return err
+	}
+	var readers [2]*meta.DumpReader
+	for i := range readers {
+		fp, err := openDump(ctx.Args().Get(i))
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		if readers[i], err = meta.NewDumpReader(fp, key); err != nil {
+			return fmt.Errorf("open %s: %s", ctx.Args().Get(i), err)
+		}
+		defer readers[i].Close()
+	}
+	diff, err := meta.DiffDumps(readers[0], readers[1])
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Printf("%s\n", data); err != nil {
+		return err
+	}
+	printDumpDiff(diff)
+	return nil
+}
+
+// printDumpDiff prints a summary of the diff to stderr, so that it's not mixed with the JSON.
+func printDumpDiff(diff *meta.DumpedDiff) {
+	fmt.Fprintf(os.Stderr, "Added: %d\n", len(diff.Added))
+	fmt.Fprintf(os.Stderr, "Removed: %d\n", len(diff.Removed))
+	fields := make(map[string]int)
+	for _, c := range diff.Changed {
+		for _, f := range c.Fields {
+			fields[f.Field]++
+		}
+	}
+	changed := make([]string, 0, len(fields))
+	for f, n := range fields {
+		changed = append(changed, fmt.Sprintf("%s %d", f, n))
+	}
+	sort.Strings(changed)
+	if len(changed) > 0 {
+		fmt.Fprintf(os.Stderr, "Changed: %d (%s)\n", len(diff.Changed), strings.Join(changed, ", "))
+	} else {
+		fmt.Fprintf(os.Stderr, "Changed: 0\n")
+	}
+	sign, delta := "+", diff.SizeDelta
+	if delta < 0 {
+		sign, delta = "-", -delta
+	}
+	fmt.Fprintf(os.Stderr, "Size of files: %s%s\n", sign, formatSize(uint64(delta)))
+}
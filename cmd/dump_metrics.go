@@ -0,0 +1,156 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// dumpMetrics exposes the progress of a dump or load to Prometheus, updated by the progress of
+// its stages, e.g. to alert on a backup stuck for long. It's only set up by --metrics-addr, which
+// is served until the command exits, otherwise nothing is counted.
+type dumpMetrics struct {
+	server   *http.Server
+	start    time.Time
+	entries  prometheus.Counter // of the stage of entries, "Dump dir" or "Load entries"
+	bytes    prometheus.Counter // written into the dump, nil for load
+	current  *prometheus.GaugeVec
+	total    *prometheus.GaugeVec
+	duration prometheus.Histogram
+	stages   *prometheus.HistogramVec
+
+	mu        sync.Mutex
+	stage     string // the last one reported
+	stageFrom time.Time
+	done      map[string]int64 // the current of every stage counted
+}
+
+// newDumpMetrics starts serving the metrics of cmd, "dump" or "load", at addr from --metrics-addr,
+// and returns nil if it's empty.
+func newDumpMetrics(addr, cmd string) *dumpMetrics {
+	if addr == "" {
+		return nil
+	}
+	reg := prometheus.NewRegistry()
+	wrapped := prometheus.WrapRegistererWithPrefix("juicefs_", reg)
+	d := &dumpMetrics{
+		start:     time.Now(),
+		stageFrom: time.Now(),
+		done:      make(map[string]int64),
+		entries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: cmd + "_entries_total",
+			Help: "Total number of entries in the " + cmd + ".",
+		}),
+		current: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: cmd + "_stage_current",
+			Help: "Items finished in every stage.",
+		}, []string{"stage"}),
+		total: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: cmd + "_stage_total",
+			Help: "Items found or estimated in every stage.",
+		}, []string{"stage"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    cmd + "_duration_seconds",
+			Help:    "Duration of the whole " + cmd + ".",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 20),
+		}),
+		stages: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    cmd + "_stage_duration_seconds",
+			Help:    "Duration of every stage.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 20),
+		}, []string{"stage"}),
+	}
+	wrapped.MustRegister(d.entries, d.current, d.total, d.duration, d.stages)
+	if cmd == "dump" {
+		d.bytes = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dump_bytes_written",
+			Help: "Bytes written into the dump, after it's compressed and encrypted.",
+		})
+		wrapped.MustRegister(d.bytes)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	d.server = &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := d.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("listen and serve for metrics: %s", err)
+		}
+	}()
+	return d
+}
+
+// progress is the Progress of the dump or load options.
+func (d *dumpMetrics) progress(stage string, current, total int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if stage != d.stage {
+		d.endStage()
+		d.stage, d.stageFrom = stage, time.Now()
+	}
+	d.current.WithLabelValues(stage).Set(float64(current))
+	d.total.WithLabelValues(stage).Set(float64(total))
+	if stage != "Dump dir" && stage != "Load entries" {
+		return
+	}
+	if last := d.done[stage]; current > last {
+		d.entries.Add(float64(current - last))
+		d.done[stage] = current
+	} else if current < last { // started again, e.g. by another phase
+		d.entries.Add(float64(current))
+		d.done[stage] = current
+	}
+}
+
+func (d *dumpMetrics) endStage() {
+	if d.stage != "" {
+		d.stages.WithLabelValues(d.stage).Observe(time.Since(d.stageFrom).Seconds())
+	}
+}
+
+// writer counts the bytes written into w, which is returned as is without metrics.
+func (d *dumpMetrics) writer(w io.Writer) io.Writer {
+	if d == nil {
+		return w
+	}
+	return &countedWriter{w, d.bytes}
+}
+
+// close observes the durations and stops serving the metrics.
+func (d *dumpMetrics) close() {
+	d.mu.Lock()
+	d.endStage()
+	d.stage = ""
+	d.mu.Unlock()
+	d.duration.Observe(time.Since(d.start).Seconds())
+	_ = d.server.Close()
+}
+
+type countedWriter struct {
+	w io.Writer
+	c prometheus.Counter
+}
+
+func (c *countedWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.c.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,180 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// flakyStore fails the first fails requests for every key.
+type flakyStore struct {
+	object.ObjectStorage
+	fails int
+	tried map[string]int
+}
+
+func (s *flakyStore) Head(key string) (object.Object, error) {
+	if s.tried[key]++; s.tried[key] <= s.fails {
+		return nil, fmt.Errorf("503 slow down")
+	}
+	return s.ObjectStorage.Head(key)
+}
+
+func TestStorageRetry(t *testing.T) {
+	mem, err := object.CreateStorage("mem", "", "", "")
+	if err != nil {
+		t.Fatalf("create storage: %s", err)
+	}
+	for _, key := range []string{"chunks/0/0/1_0_4096", "chunks/0/0/1_1_100"} {
+		if err = mem.Put(key, bytes.NewReader(make([]byte, 10))); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+	ctx := context.Background()
+	for _, c := range []struct {
+		fails, retries, missing int
+	}{
+		{0, 0, 0},
+		{2, 3, 0},
+		{3, 3, 0},
+		{4, 3, 2},
+		{1, 0, 2},
+	} {
+		flaky := &flakyStore{mem, c.fails, make(map[string]int)}
+		v := &sliceVerifier{ctx, flaky, 4096, 0, storageRetry{ctx, c.retries, time.Millisecond}}
+		missing, err := v.MissingBlocks(1, 4196)
+		if err != nil {
+			t.Fatalf("verify with %d failures and %d retries: %s", c.fails, c.retries, err)
+		}
+		if len(missing) != c.missing {
+			t.Fatalf("verify with %d failures and %d retries: expect %d missing blocks, but got %v", c.fails, c.retries, c.missing, missing)
+		}
+		expect := c.fails + 1 // the success
+		if c.fails > c.retries {
+			expect = c.retries + 1
+		}
+		if tried := flaky.tried["chunks/0/0/1_0_4096"]; tried != expect {
+			t.Fatalf("verify with %d failures and %d retries: tried %d times", c.fails, c.retries, tried)
+		}
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	var tried int
+	err = storageRetry{canceled, 3, time.Hour}.do("canceled", func() error {
+		tried++
+		return fmt.Errorf("500 internal error")
+	})
+	if err == nil || tried != 1 {
+		t.Fatalf("retry after canceled: tried %d, %v", tried, err)
+	}
+}
+
+func TestDumpMetrics(t *testing.T) {
+	if newDumpMetrics("", "dump") != nil {
+		t.Fatalf("metrics without an address")
+	}
+	d := newDumpMetrics("127.0.0.1:0", "dump")
+	defer d.close()
+	d.progress("Find orphans", 5, 10)
+	d.progress("Dump dir", 3, 10)
+	d.progress("Dump dir", 3, 10)
+	d.progress("Dump dir", 10, 10)
+	d.progress("Dump dir", 4, 4) // dumped again from the start
+	if n := testutil.ToFloat64(d.entries); n != 14 {
+		t.Fatalf("dumped entries: %v", n)
+	}
+	if n := testutil.ToFloat64(d.current.WithLabelValues("Find orphans")); n != 5 {
+		t.Fatalf("current of finding orphans: %v", n)
+	}
+	if n := testutil.CollectAndCount(d.stages); n != 1 { // only the finished stage
+		t.Fatalf("stage durations: %d", n)
+	}
+	var buf bytes.Buffer
+	if _, err := d.writer(&buf).Write(make([]byte, 100)); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if n := testutil.ToFloat64(d.bytes); n != 100 || buf.Len() != 100 {
+		t.Fatalf("bytes written: %v", n)
+	}
+}
+
+func TestParseBandwidth(t *testing.T) {
+	for s, expected := range map[string]int64{"": 0, "0": 0, "100": 100 << 20, "100MiB/s": 100 << 20, "1.5G": 3 << 29, "800K": 800 << 10} {
+		if n, err := parseBandwidth(s); err != nil || n != expected {
+			t.Fatalf("bandwidth %q: %d %v, expected %d", s, n, err, expected)
+		}
+	}
+	if _, err := parseBandwidth("fast"); err == nil {
+		t.Fatalf("invalid bandwidth is parsed")
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	skipped := meta.SkippedEntries{
+		{Inode: 3, Path: "/d1", Reason: `unknown type "door" of inode 3`, Attr: &meta.DumpedAttr{Inode: 3, Type: "door", Nlink: 2}},
+		{Path: "/f1", Reason: "no attr for entry /f1"},
+	}
+	var r struct {
+		Version int
+		Command string
+		File    string
+		Skipped []map[string]interface{}
+		Missing []interface{}
+	}
+	read := func() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read report: %s", err)
+		}
+		r.Skipped, r.Missing = nil, nil
+		if err = json.Unmarshal(data, &r); err != nil {
+			t.Fatalf("parse report %s: %s", data, err)
+		}
+	}
+	if err := writeReport(path, newLoadReport("meta.dump", skipped)); err != nil {
+		t.Fatalf("write report: %s", err)
+	}
+	read()
+	if r.Version != reportVersion || r.Command != "load" || r.File != "meta.dump" || len(r.Skipped) != 2 || r.Missing != nil {
+		t.Fatalf("load report: %+v", r)
+	}
+	if attr, ok := r.Skipped[0]["attr"].(map[string]interface{}); !ok || attr["type"] != "door" || r.Skipped[0]["inode"] != 3.0 {
+		t.Fatalf("skipped entry: %+v", r.Skipped[0])
+	}
+	if _, ok := r.Skipped[1]["attr"]; ok || r.Skipped[1]["inode"] != 0.0 {
+		t.Fatalf("skipped entry without attr: %+v", r.Skipped[1])
+	}
+	if err := writeReport(path, newDumpReport("meta.dump", nil)); err != nil {
+		t.Fatalf("write report: %s", err)
+	}
+	read()
+	if r.Command != "dump" || r.Missing == nil || len(r.Missing) != 0 || r.Skipped != nil { // an empty list but not null
+		t.Fatalf("dump report: %+v", r)
+	}
+}
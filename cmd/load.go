@@ -16,9 +16,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"strings"
 
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/urfave/cli/v2"
@@ -29,30 +33,473 @@ func load(ctx *cli.Context) error {
 	if ctx.Args().Len() < 1 {
 		return fmt.Errorf("META-URL is needed")
 	}
+	if ctx.Args().Len() > 2 && !ctx.Bool("merge") {
+		return fmt.Errorf("only one FILE is allowed without --merge")
+	}
+	if ctx.Bool("prefer-newest") && !ctx.Bool("merge") {
+		return fmt.Errorf("--prefer-newest can only be used with --merge")
+	}
+	if ctx.Bool("merge") && ctx.Bool("apply-delta") {
+		return fmt.Errorf("delta dumps are not sharded, --merge and --apply-delta can't be used together")
+	}
 	var fp io.ReadCloser
-	if ctx.Args().Len() == 1 {
+	if snapshot := ctx.String("snapshot"); snapshot != "" {
+		if ctx.Args().Len() != 2 || strings.Contains(ctx.Args().Get(1), "://") {
+			return fmt.Errorf("a snapshot can only be loaded from one local FILE")
+		}
+		f, err := os.Open(ctx.Args().Get(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		r, err := meta.OpenSnapshot(f, st.Size(), snapshot)
+		if err != nil {
+			return err
+		}
+		fp = ioutil.NopCloser(r)
+	} else if ctx.Args().Len() == 1 {
 		fp = os.Stdin
 	} else {
 		var err error
-		fp, err = os.Open(ctx.Args().Get(1))
+		fp, err = openDump(ctx.Args().Get(1))
 		if err != nil {
 			return err
 		}
 		defer fp.Close()
 	}
 	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
-	if err := m.LoadMeta(fp); err != nil {
+	c, cancel := cancelContext(ctx)
+	defer cancel()
+	opt := meta.LoadOption{
+		Context:      c,
+		Resume:       ctx.Bool("resume"),
+		ApplyDelta:   ctx.Bool("apply-delta"),
+		SkipChecksum: ctx.Bool("skip-checksum"),
+		CheckEntries: ctx.Bool("check-entries"),
+		PreferNewest: ctx.Bool("prefer-newest"),
+		MetadataOnly: ctx.Bool("metadata-only"),
+		Shadow:       ctx.Bool("shadow"),
+		DirsOnly:     ctx.Bool("dirs-only"),
+		AttrsOnly:    ctx.Bool("attrs-only"),
+		AttrsMatch:   ctx.String("match"),
+		Remap:        ctx.String("remap"),
+		TagOriginal:  ctx.Bool("tag-original"),
+		Only:         ctx.String("only"),
+		Root:         ctx.String("root"),
+		Check:        ctx.Bool("check"),
+		Force:        ctx.Bool("force"),
+		FixNlink:     ctx.Bool("fix-nlink"),
+		ResolveCase:  ctx.Bool("resolve-case"),
+		KeepCounters: ctx.Bool("keep-counters"),
+		ResetTimes:   ctx.Bool("reset-times"),
+		ResetAtime:   ctx.Bool("reset-atime-only"),
+		Strict:       ctx.Bool("strict"),
+		Phase:        ctx.String("phase"),
+		Threads:      ctx.Int("threads"),
+
+		CheckCoverage:    ctx.Bool("check-coverage"),
+		ContinueOnError:  ctx.Bool("continue-on-error"),
+		ProgressInterval: ctx.Duration("progress-interval"),
+	}
+	if opt.Force && !opt.Check && !opt.CheckCoverage && opt.Remap == "" {
+		return fmt.Errorf("--force can only be used with --check, --check-coverage or --remap")
+	}
+	if metrics := newDumpMetrics(ctx.String("metrics-addr"), "load"); metrics != nil {
+		defer metrics.close()
+		opt.Progress = metrics.progress
+	}
+	key, err := dumpKey(ctx)
+	if err != nil {
 		return err
 	}
+	opt.Key = key
+	if opt.BWLimit, err = parseBandwidth(ctx.String("bwlimit")); err != nil {
+		return err
+	}
+	if err = loadSecrets(ctx, &opt); err != nil {
+		return err
+	}
+	if opt.UidMap, err = loadIDMap(ctx.String("uid-map"), ctx.Bool("root-squash")); err != nil {
+		return fmt.Errorf("uid map: %s", err)
+	}
+	if opt.GidMap, err = loadIDMap(ctx.String("gid-map"), ctx.Bool("root-squash")); err != nil {
+		return fmt.Errorf("gid map: %s", err)
+	}
+	for _, v := range ctx.StringSlice("symlink-rewrite") {
+		r, err := meta.ParseSymlinkRewrite(v)
+		if err != nil {
+			return fmt.Errorf("symlink rewrite: %s", err)
+		}
+		opt.SymlinkRewrites = append(opt.SymlinkRewrites, r)
+	}
+	if opt.Only != "" {
+		if opt.ApplyDelta || opt.Phase != "" || ctx.Bool("merge") {
+			return fmt.Errorf("--only can't be used with --apply-delta, --phase or --merge")
+		}
+		if opt.Only = path.Clean("/" + opt.Only); opt.Only == "/" {
+			return fmt.Errorf("--only needs a sub-directory, load the whole dump without it")
+		}
+	}
+	if opt.Remap != "" && (opt.Resume || opt.ApplyDelta) {
+		return fmt.Errorf("--remap can't be used with --resume or --apply-delta")
+	}
+	if opt.TagOriginal && opt.Remap == "" {
+		return fmt.Errorf("--tag-original can only be used with --remap")
+	}
+	if opt.ContinueOnError && (opt.ApplyDelta || opt.Remap != "" || opt.Phase == "trash") {
+		return fmt.Errorf("--continue-on-error can only be used by a full load")
+	}
+	reportFile := ctx.String("report-file")
+	if reportFile != "" && !opt.ContinueOnError {
+		return fmt.Errorf("--report-file can only be used with --continue-on-error")
+	}
+	if opt.DirsOnly && (opt.ApplyDelta || opt.Shadow || opt.Phase == "trash") {
+		return fmt.Errorf("--dirs-only can't be used with --apply-delta, --shadow or --phase trash")
+	}
+	if opt.AttrsOnly && (opt.Resume || opt.ApplyDelta || opt.Remap != "" || opt.Phase != "" || opt.Shadow || opt.DirsOnly ||
+		opt.KeepCounters || opt.ContinueOnError || ctx.Bool("with-data") || ctx.Bool("dedup") || ctx.Bool("dry-run")) {
+		return fmt.Errorf("--attrs-only can't be used with --resume, --apply-delta, --remap, --phase, --shadow, --dirs-only, --keep-counters, --continue-on-error, --with-data, --dedup or --dry-run")
+	}
+	if ctx.IsSet("match") && !opt.AttrsOnly {
+		return fmt.Errorf("--match can only be used with --attrs-only")
+	}
+	if opt.KeepCounters && (opt.ApplyDelta || opt.Remap != "") {
+		return fmt.Errorf("--keep-counters can't be used with --apply-delta or --remap")
+	}
+	if opt.Shadow && (opt.ApplyDelta || opt.KeepCounters || opt.Phase == "trash" || ctx.Bool("with-data") || ctx.Bool("dedup")) {
+		return fmt.Errorf("--shadow can't be used with --apply-delta, --keep-counters, --phase trash, --with-data or --dedup")
+	}
+	if ctx.Bool("with-data") {
+		if opt.ApplyDelta || opt.Remap != "" {
+			return fmt.Errorf("--with-data can't be used with --apply-delta or --remap")
+		}
+		opt.Data = func(setting *meta.Format) (meta.SliceStore, error) {
+			return newSliceStore(setting, opt.BWLimit, storageRetry{ctx: c})
+		}
+	}
+	if ctx.Bool("dedup") {
+		if opt.ApplyDelta || opt.Remap != "" || opt.Phase != "" {
+			return fmt.Errorf("--dedup can't be used with --apply-delta, --remap or --phase")
+		}
+		opt.Dedup = func(setting *meta.Format) (meta.SliceStore, error) {
+			return newSliceStore(setting, opt.BWLimit, storageRetry{ctx: c})
+		}
+	}
+	if ctx.Bool("dry-run") {
+		if opt.Resume || opt.ApplyDelta || opt.Remap != "" {
+			return fmt.Errorf("--dry-run can't be used with --resume, --apply-delta or --remap")
+		}
+		opt.DryRun = &meta.LoadSummary{}
+	}
+	if opt.Phase != "" && (opt.ApplyDelta || opt.Remap != "") {
+		return fmt.Errorf("--phase can't be used with --apply-delta or --remap")
+	}
+	if opt.Phase == "trash" && (opt.Resume || opt.KeepCounters || opt.Data != nil || opt.DryRun != nil) {
+		return fmt.Errorf("--phase trash can't be used with --resume, --keep-counters, --with-data or --dry-run")
+	}
+	for i := 2; i < ctx.Args().Len(); i++ {
+		shard, err := openDump(ctx.Args().Get(i))
+		if err != nil {
+			return err
+		}
+		defer shard.Close()
+		opt.Shards = append(opt.Shards, shard)
+	}
+	if err := m.LoadMeta(fp, opt); err != nil {
+		var conflicts meta.InodeConflicts
+		if errors.As(err, &conflicts) {
+			printConflicts(conflicts)
+			return fmt.Errorf("%d inode conflicts are found in the dump, nothing is loaded", len(conflicts))
+		}
+		var skipped meta.SkippedEntries
+		if errors.As(err, &skipped) {
+			printSkipped(skipped)
+			if reportFile != "" {
+				if err := writeReport(reportFile, newLoadReport(ctx.Args().Get(1), skipped)); err != nil {
+					return err
+				}
+			}
+		}
+		return err
+	}
+	if reportFile != "" {
+		if err := writeReport(reportFile, newLoadReport(ctx.Args().Get(1), nil)); err != nil {
+			return err
+		}
+	}
+	if opt.DryRun != nil {
+		printLoadSummary(opt.DryRun)
+		return nil
+	}
 	logger.Infof("Load metadata from %s succeed", ctx.Args().Get(1))
 	return nil
 }
 
+// printConflicts prints the inode conflicts found by a load to stderr.
+func printConflicts(conflicts meta.InodeConflicts) {
+	fmt.Fprintf(os.Stderr, "Inode conflicts: %d\n", len(conflicts))
+	for _, c := range conflicts {
+		for i := 0; i < 2; i++ {
+			fmt.Fprintf(os.Stderr, "  %12d  %-9s  parent %-12d  %s\n", c.Inode, c.Types[i], c.Parents[i], c.Paths[i])
+		}
+	}
+}
+
+// printSkipped prints the entries skipped by a load with --continue-on-error to stderr.
+func printSkipped(skipped meta.SkippedEntries) {
+	fmt.Fprintf(os.Stderr, "Skipped entries: %d\n", len(skipped))
+	for _, s := range skipped {
+		fmt.Fprintf(os.Stderr, "  %12d  %s: %s\n", s.Inode, s.Path, s.Reason)
+	}
+}
+
+// loadSecrets reads the secrets redacted from the dumped setting, like the ones given to format.
+func loadSecrets(ctx *cli.Context, opt *meta.LoadOption) error {
+	opt.AccessKey = ctx.String("access-key")
+	if opt.AccessKey == "" {
+		opt.AccessKey = os.Getenv("ACCESS_KEY")
+	}
+	opt.SecretKey = ctx.String("secret-key")
+	if opt.SecretKey == "" {
+		opt.SecretKey = os.Getenv("SECRET_KEY")
+	}
+	if path := ctx.String("encrypt-rsa-key"); path != "" {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read RSA key: %s", err)
+		}
+		opt.EncryptKey = string(pem)
+	}
+	return nil
+}
+
+// nobody is the id root is mapped to by --root-squash, like NFS.
+const nobody = 65534
+
+// loadIDMap reads the map of ids in path, root is mapped to nobody by rootSquash unless it's
+// mapped in the file. It's nil if there is nothing to map.
+func loadIDMap(path string, rootSquash bool) (*meta.IDMap, error) {
+	m := &meta.IDMap{IDs: make(map[uint32]uint32)}
+	if path != "" {
+		fp, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		if m, err = meta.ParseIDMap(fp); err != nil {
+			return nil, err
+		}
+	} else if !rootSquash {
+		return nil, nil
+	}
+	if _, ok := m.IDs[0]; !ok && rootSquash {
+		m.IDs[0] = nobody
+	}
+	return m, nil
+}
+
+func printLoadSummary(s *meta.LoadSummary) {
+	fmt.Printf("Inodes to be created: %d (%d in dumped counters)\n", s.Inodes, s.Dumped.UsedInodes)
+	fmt.Printf("Used space to be added: %d bytes (%d in dumped counters)\n", s.Space, s.Dumped.UsedSpace)
+	fmt.Printf("Files to be deleted: %d\n", s.DelFiles)
+	fmt.Printf("Sustained inodes: %d\n", s.Sustained)
+	fmt.Printf("Warnings: %d\n", len(s.Warnings))
+	for _, w := range s.Warnings {
+		fmt.Printf("  %s\n", w)
+	}
+}
+
 func loadFlags() *cli.Command {
 	return &cli.Command{
 		Name:      "load",
 		Usage:     "load metadata from a previously dumped JSON file",
-		ArgsUsage: "META-URL [FILE]",
+		ArgsUsage: "META-URL [FILE...]",
 		Action:    load,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "resume",
+				Usage: "resume an interrupted load from its checkpoint",
+			},
+			&cli.BoolFlag{
+				Name:  "apply-delta",
+				Usage: "apply a delta dump onto the database loaded from its base",
+			},
+			&cli.BoolFlag{
+				Name:  "skip-checksum",
+				Usage: "load without verifying the checksum, to recover what's left in a corrupted dump",
+			},
+			&cli.BoolFlag{
+				Name:  "check-entries",
+				Usage: "check the hash of every entry in a dump with --per-entry-hash, and refuse it if any entry is corrupted, which doesn't detect tampering",
+			},
+			&cli.BoolFlag{
+				Name:  "merge",
+				Usage: "merge all the shards or dumps of the same volume in FILEs into one tree",
+			},
+			&cli.BoolFlag{
+				Name:  "prefer-newest",
+				Usage: "keep the one with the newest ctime if an inode is different in the merged FILEs",
+			},
+			&cli.BoolFlag{
+				Name:  "metadata-only",
+				Usage: "load a dump without the slices of files (dumped with --no-data), files read as zeros",
+			},
+			&cli.BoolFlag{
+				Name:  "shadow",
+				Usage: "load the files as empty ones without slices, with their lengths in xattr user.juicefs.orig_size, for a volume to list and search them",
+			},
+			&cli.BoolFlag{
+				Name:  "dirs-only",
+				Usage: "only load the directories in FILE without files, symlinks or xattrs, for an empty skeleton of the tree",
+			},
+			&cli.BoolFlag{
+				Name:  "attrs-only",
+				Usage: "only restore the mode, owner, atime and mtime of the entries in a non-empty volume from FILE, nothing is created or removed",
+			},
+			&cli.StringFlag{
+				Name:  "match",
+				Value: "path",
+				Usage: "match the entries in FILE with the ones in the volume by \"path\" or \"inode\", only for --attrs-only",
+			},
+			&cli.DurationFlag{
+				Name:  "progress-interval",
+				Usage: "refresh interval of the progress, which is also logged at this interval when stderr is not a terminal (0 for the default refresh and no log)",
+			},
+			&cli.StringFlag{
+				Name:  "metrics-addr",
+				Usage: "address to export the metrics of the load in Prometheus format at /metrics until it's done, e.g. 127.0.0.1:9567",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "cancel the load if it's not finished in this time, like Ctrl-C, a canceled full load can be resumed by --resume (0 for no timeout)",
+			},
+			&cli.BoolFlag{
+				Name:  "check",
+				Usage: "validate the dump before loading it, and refuse it if any problem is found",
+			},
+			&cli.BoolFlag{
+				Name:  "check-coverage",
+				Usage: "check that the slices of every file cover its length, and refuse the dump if any range is not covered",
+			},
+			&cli.BoolFlag{
+				Name:  "force",
+				Usage: "load the dump even if problems are found by --check or --check-coverage, or there isn't enough space or inodes under the quota of the volume for --remap",
+			},
+			&cli.BoolFlag{
+				Name:  "fix-nlink",
+				Usage: "set the nlink of every inode to the one counted from FILE, and log the inodes fixed",
+			},
+			&cli.BoolFlag{
+				Name:  "resolve-case",
+				Usage: "rename the names in a directory differing only by case with a numeric suffix, e.g. Foo-1.txt, and log the ones renamed",
+			},
+			&cli.BoolFlag{
+				Name:  "continue-on-error",
+				Usage: "skip the entries failing the validation with the ones under them instead of failing the load, and exit with an error after the rest is loaded",
+			},
+			&cli.StringFlag{
+				Name:  "report-file",
+				Usage: "write the entries skipped by --continue-on-error into this file in JSON, besides the summary on stderr",
+			},
+			&cli.StringFlag{
+				Name:  "bwlimit",
+				Usage: "limit the bandwidth of reading FILE and the shards, and the data for --with-data or --dedup, e.g. 100MiB/s, a bare number is in MiB/s (0 for no limit)",
+			},
+			&cli.StringFlag{
+				Name:  "key-file",
+				Usage: "file of the key to decrypt an encrypted FILE, or the passphrase in JFS_DUMP_PASSPHRASE is used",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "validate FILE and print what would be loaded without writing anything, problems are printed as warnings",
+			},
+			&cli.BoolFlag{
+				Name:  "strict",
+				Usage: "validate FILE against the schema printed by dump --schema and refuse unknown fields, which is slower and takes more memory",
+			},
+			&cli.BoolFlag{
+				Name:  "keep-counters",
+				Usage: "load the used space and inodes in the dumped counters instead of the ones counted from FILE",
+			},
+			&cli.BoolFlag{
+				Name:  "with-data",
+				Usage: "write the contents of files embedded by dump --with-data into the object storage in the dumped setting",
+			},
+			&cli.BoolFlag{
+				Name:  "dedup",
+				Usage: "read the slices of files with the same length from the object storage in the dumped setting, and let the files with the same contents share the slices",
+			},
+			&cli.StringFlag{
+				Name:  "access-key",
+				Usage: "access key for object storage, if it's redacted from the dumped setting (env ACCESS_KEY)",
+			},
+			&cli.StringFlag{
+				Name:  "secret-key",
+				Usage: "secret key for object storage, if it's redacted from the dumped setting (env SECRET_KEY)",
+			},
+			&cli.StringFlag{
+				Name:  "encrypt-rsa-key",
+				Usage: "a path to RSA private key (PEM), if it's redacted from the dumped setting",
+			},
+			&cli.IntFlag{
+				Name:    "threads",
+				Aliases: []string{"p"},
+				Value:   1,
+				Usage:   "number of concurrent threads writing the entries of a full load",
+			},
+			&cli.StringFlag{
+				Name:  "uid-map",
+				Usage: "file mapping the dumped uids to the loaded ones, a SRC:DST in every line, SRC can be * for all the unmapped ones, which are kept by default",
+			},
+			&cli.StringFlag{
+				Name:  "gid-map",
+				Usage: "file mapping the dumped gids to the loaded ones, in the same format as --uid-map",
+			},
+			&cli.BoolFlag{
+				Name:  "root-squash",
+				Usage: "map uid and gid 0 to 65534 (nobody), unless they're mapped in --uid-map or --gid-map",
+			},
+			&cli.BoolFlag{
+				Name:  "reset-times",
+				Usage: "set the atime, mtime and ctime of all the loaded entries to the time of the load, e.g. for a test volume from a production dump",
+			},
+			&cli.BoolFlag{
+				Name:  "reset-atime-only",
+				Usage: "set only the atime of all the loaded entries to the time of the load",
+			},
+			&cli.StringSliceFlag{
+				Name:  "symlink-rewrite",
+				Usage: "rewrite the prefix OLD of absolute symlink targets to NEW, given as OLD=NEW, can be repeated and the first matching one is used",
+			},
+			&cli.StringFlag{
+				Name:  "snapshot",
+				Usage: "load the snapshot of this name from FILE, which is a container written by dump --snapshot",
+			},
+			&cli.StringFlag{
+				Name:  "phase",
+				Usage: "load only a phase of FILE: \"live\" for all but the files to be deleted, to be online sooner, and \"trash\" to add them later",
+			},
+			&cli.StringFlag{
+				Name:    "remap",
+				Aliases: []string{"dest"},
+				Usage:   "load into a directory at this path of a non-empty volume with new inodes, which is created with its parents if not exist",
+			},
+			&cli.BoolFlag{
+				Name:  "tag-original",
+				Usage: "keep the inode of every entry in FILE in its xattr user.juicefs.orig_inode, only for --remap",
+			},
+			&cli.StringFlag{
+				Name:  "only",
+				Usage: "load only the directory at this path of FILE as the root, or into --dest, entries out of it are not kept in memory",
+			},
+			&cli.StringFlag{
+				Name:  "root",
+				Usage: "load the root of this name in FILE dumped by dump --root, which is needed by such a dump, --only is a path in it",
+			},
+		},
 	}
 }
@@ -85,6 +85,9 @@ func main() {
 			warmupFlags(),
 			dumpFlags(),
 			loadFlags(),
+			cloneFlags(),
+			dumpDiffFlags(),
+			verifyFlags(),
 		},
 	}
 
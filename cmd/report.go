@@ -0,0 +1,76 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// reportVersion is the version of the layout of the reports, which is bumped only if a field is
+// changed or removed, not added.
+const reportVersion = 1
+
+// report is the header of the problems found by a dump or load written to --report-file in JSON,
+// for the tools to retry or chart them, while a summary of them is still printed to stderr.
+type report struct {
+	Version int       `json:"version"`
+	Command string    `json:"command"` // dump or load
+	File    string    `json:"file"`    // the dumped or loaded one
+	Time    time.Time `json:"time"`    // when it's finished
+}
+
+// loadReport is the report of load --continue-on-error, with an empty list if nothing is skipped.
+type loadReport struct {
+	report
+	Skipped meta.SkippedEntries `json:"skipped"`
+}
+
+func newLoadReport(file string, skipped meta.SkippedEntries) *loadReport {
+	if skipped == nil {
+		skipped = meta.SkippedEntries{}
+	}
+	return &loadReport{report{reportVersion, "load", file, time.Now().UTC()}, skipped}
+}
+
+// dumpReport is the report of dump --verify-data, with an empty list if no data is missing.
+type dumpReport struct {
+	report
+	Missing []*meta.DumpedMissingData `json:"missing"`
+}
+
+func newDumpReport(file string, missing []*meta.DumpedMissingData) *dumpReport {
+	if missing == nil {
+		missing = []*meta.DumpedMissingData{}
+	}
+	return &dumpReport{report{reportVersion, "dump", file, time.Now().UTC()}, missing}
+}
+
+// writeReport writes the report r into path.
+func writeReport(path string, r interface{}) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("write report: %s", err)
+	}
+	return nil
+}
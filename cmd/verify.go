@@ -0,0 +1,111 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func verifyFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "verify",
+		Usage:     "verify a volume against a full dump by path, the mismatches are printed in JSON with a summary to stderr",
+		ArgsUsage: "META-URL FILE",
+		Action:    verify,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "subdir",
+				Aliases: []string{"subtree"},
+				Usage:   "verify a sub-directory against a dump of it, e.g. the one loaded into it",
+			},
+			&cli.StringFlag{
+				Name:  "key-file",
+				Usage: "file of the key to decrypt an encrypted FILE, or the passphrase in JFS_DUMP_PASSPHRASE is used",
+			},
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 10,
+				Usage: "number of entries read from the metadata engine concurrently",
+			},
+			&cli.IntFlag{
+				Name:  "max-mismatches",
+				Value: 100,
+				Usage: "number of mismatches printed, all of them are counted",
+			},
+			&cli.BoolFlag{
+				Name:  "ignore-ids",
+				Usage: "do not compare the inodes and the IDs of slices, which are changed by load --remap and --dedup",
+			},
+		},
+	}
+}
+
+func verify(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() != 2 {
+		return fmt.Errorf("META-URL and FILE are needed")
+	}
+	key, err := dumpKey(ctx)
+	if err != nil {
+		return err
+	}
+	fp, err := openDump(ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	r, err := meta.NewDumpReader(fp, key)
+	if err != nil {
+		return fmt.Errorf("open %s: %s", ctx.Args().Get(1), err)
+	}
+	defer r.Close()
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true, Subdir: ctx.String("subdir")})
+	v, err := meta.VerifyDump(m, r, meta.VerifyOption{
+		Threads:       ctx.Int("threads"),
+		MaxMismatches: ctx.Int("max-mismatches"),
+		IgnoreIDs:     ctx.Bool("ignore-ids"),
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Printf("%s\n", data); err != nil {
+		return err
+	}
+	printVerification(v)
+	if v.Total > 0 {
+		return fmt.Errorf("the volume doesn't match the dump")
+	}
+	return nil
+}
+
+// printVerification prints a summary of v to stderr, so that it's not mixed with the JSON.
+func printVerification(v *meta.DumpedVerification) {
+	fmt.Fprintf(os.Stderr, "Compared: %d\n", v.Entries)
+	fmt.Fprintf(os.Stderr, "Mismatches: %d (missing %d, extra %d, changed %d)", v.Total, v.Missing, v.Extra, v.Changed)
+	if v.Total > int64(len(v.Mismatches)) {
+		fmt.Fprintf(os.Stderr, ", %d printed", len(v.Mismatches))
+	}
+	fmt.Fprintln(os.Stderr)
+}
@@ -104,10 +104,20 @@ func (c *rChunk) blockSize(indx int) int {
 }
 
 func (c *rChunk) key(indx int) string {
-	if c.store.conf.Partitions > 1 {
-		return fmt.Sprintf("chunks/%02X/%v/%v_%v_%v", c.id%256, c.id/1000/1000, c.id, indx, c.blockSize(indx))
+	return BlockKey(c.id, indx, c.length, c.store.conf.BlockSize, c.store.conf.Partitions > 1)
+}
+
+// BlockKey returns the key of the indx-th block of the slice id of size bytes, which is split
+// into blocks of blockSize bytes, with a hash prefix if the volume has several partitions.
+func BlockKey(id uint64, indx, size, blockSize int, hashPrefix bool) string {
+	bsize := size - indx*blockSize
+	if bsize > blockSize {
+		bsize = blockSize
+	}
+	if hashPrefix {
+		return fmt.Sprintf("chunks/%02X/%v/%v_%v_%v", id%256, id/1000/1000, id, indx, bsize)
 	}
-	return fmt.Sprintf("chunks/%v/%v/%v_%v_%v", c.id/1000/1000, c.id/1000, c.id, indx, c.blockSize(indx))
+	return fmt.Sprintf("chunks/%v/%v/%v_%v_%v", id/1000/1000, id/1000, id, indx, bsize)
 }
 
 func (c *rChunk) index(off int) int {
@@ -0,0 +1,145 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// The ways of matching the entries in a dump with the ones in a volume by AttrsOnly.
+const (
+	MatchPath  = "path"
+	MatchInode = "inode"
+)
+
+// loadAttrsOnly restores the attrs of the entries in a non-empty volume from the dump, e.g. a
+// backup before a wrong chmod -R, without creating or removing any entry. The entries are matched
+// by path, or by inode for a volume loaded from a dump of itself without Remap, which keeps the
+// inodes. The mode, owner, atime and mtime of every matched entry of the same type are set as
+// dumped, like chmod, chown and touch, so the ctime is the time of the restore; the length, the
+// slices, the xattrs and the target of a symlink are kept. The entries missing in the volume, or
+// of another type, are skipped with the ones under them when matched by path.
+func loadAttrsOnly(m Meta, r io.Reader, opt LoadOption) error {
+	match := opt.AttrsMatch
+	if match == "" {
+		match = MatchPath
+	}
+	if match != MatchPath && match != MatchInode {
+		return fmt.Errorf("unknown way of matching entries: %s", match)
+	}
+	format, err := m.Load()
+	if err != nil {
+		return err
+	}
+	dm, err := readDump(r, opt)
+	if err != nil {
+		return err
+	}
+	if dm.BaseVersion != 0 {
+		return fmt.Errorf("attrs can't be restored from a delta dump")
+	}
+	if match == MatchInode && dm.Setting.UUID != format.UUID {
+		return fmt.Errorf("the dump is from volume %s, but the attrs of %s are matched by inode", dm.Setting.UUID, format.UUID)
+	}
+	ctx := Background
+	root, attr := Ino(1), &Attr{}
+	if opt.Only != "" { // the root of the tree is the subtree
+		for _, name := range strings.Split(strings.Trim(opt.Only, "/"), "/") {
+			if st := m.Lookup(ctx, root, name, &root, attr); st != 0 {
+				return fmt.Errorf("lookup %s: %s", opt.Only, st)
+			}
+		}
+	}
+
+	type node struct {
+		e     *DumpedEntry
+		path  string
+		inode Ino // in the volume, 0 if it's missing
+	}
+	bar := newProgress("Restore attrs progress: ", dm.Counters.UsedInodes, opt.ProgressInterval, opt.Progress)
+	done := make(map[Ino]bool) // the links of a file are restored once
+	var restored, skipped int64
+	stack := []node{{dm.FSTree, "/", root}}
+	if match == MatchInode {
+		stack[0].inode = dm.FSTree.Attr.Inode
+	}
+	for len(stack) > 0 {
+		if err = ctxErr(opt.Context); err != nil {
+			return err
+		}
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		bar.Incr(1)
+		typ := typeFromString(n.e.Attr.Type)
+		if match == MatchInode {
+			n.inode = n.e.Attr.Inode
+		}
+		var st syscall.Errno = syscall.ENOENT
+		if n.inode != 0 {
+			st = m.GetAttr(ctx, n.inode, attr)
+		}
+		if st == 0 && attr.Typ != typ {
+			logger.Debugf("Skip %s: %s in the dump but %s in the volume", n.path, n.e.Attr.Type, typeToString(attr.Typ))
+			n.inode = 0
+			skipped++
+		} else if st == syscall.ENOENT {
+			logger.Debugf("Skip %s: not found in the volume", n.path)
+			n.inode = 0
+			skipped++
+		} else if st != 0 {
+			return fmt.Errorf("get attr of %s: %s", n.path, st)
+		} else if !done[n.inode] {
+			if st = restoreAttr(m, n.inode, n.e.Attr); st != 0 {
+				return fmt.Errorf("restore attr of %s: %s", n.path, st)
+			}
+			done[n.inode] = true
+			restored++
+		}
+		names := make([]string, 0, len(n.e.Entries))
+		for name := range n.e.Entries {
+			names = append(names, name)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(names)))
+		for _, name := range names {
+			c := node{n.e.Entries[name], path.Join(n.path, name), 0}
+			if n.inode != 0 && match == MatchPath {
+				if st = m.Lookup(ctx, n.inode, name, &c.inode, attr); st != 0 && st != syscall.ENOENT {
+					return fmt.Errorf("lookup %s: %s", c.path, st)
+				}
+			}
+			stack = append(stack, c)
+		}
+	}
+	bar.Done()
+	logger.Infof("Restored attrs of %d inodes, %d entries are skipped", restored, skipped)
+	return nil
+}
+
+// restoreAttr sets the mode, owner, atime and mtime of inode to the ones in a. The owner is set
+// first, which clears setuid and setgid, and then the mode with them.
+func restoreAttr(m Meta, inode Ino, a *DumpedAttr) syscall.Errno {
+	ctx := Background
+	if st := m.SetAttr(ctx, inode, SetAttrUID|SetAttrGID, 0, &Attr{Uid: a.Uid, Gid: a.Gid}); st != 0 {
+		return st
+	}
+	attr := &Attr{Mode: a.Mode, Atime: a.Atime, Atimensec: a.Atimensec, Mtime: a.Mtime, Mtimensec: a.Mtimensec}
+	return m.SetAttr(ctx, inode, SetAttrMode|SetAttrAtime|SetAttrMtime, 0, attr)
+}
@@ -0,0 +1,204 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// A counter or the id of a slice above 2^53 can't be kept exactly by the tools decoding every
+// JSON number into a double, e.g. JavaScript. DumpOption.StringBignums writes them as strings of
+// decimal instead, in the counters, the slices of files and the ones of the files to be deleted,
+// and the dump is marked by bignumsString in Bignums. Both forms are accepted by a load, whether
+// marked or not.
+const bignumsString = "string"
+
+type bignumCounters struct {
+	UsedSpace         int64 `json:"usedSpace,string"`
+	UsedInodes        int64 `json:"usedInodes,string"`
+	NextInode         int64 `json:"nextInodes,string"`
+	NextChunk         int64 `json:"nextChunk,string"`
+	NextSession       int64 `json:"nextSession,string"`
+	NextCleanupSlices int64 `json:"nextCleanupSlices,string"`
+}
+
+type bignumSlice struct {
+	Pos     uint32 `json:"pos"`
+	Chunkid uint64 `json:"chunkid,string"`
+	Size    uint32 `json:"size"`
+	Off     uint32 `json:"off"`
+	Len     uint32 `json:"len"`
+	Data    []byte `json:"data,omitempty"`
+}
+
+type bignumChunk struct {
+	Index  uint32         `json:"index"`
+	Slices []*bignumSlice `json:"slices"`
+}
+
+type bignumDelFile struct {
+	Inode  Ino            `json:"inode"`
+	Length uint64         `json:"length"`
+	Expire int64          `json:"expire"`
+	Chunks []*bignumChunk `json:"chunks,omitempty"`
+}
+
+// bignumMeta is a header with the fields of bignums replacing the ones of DumpedMeta, which are
+// written after all the others.
+type bignumMeta struct {
+	*DumpedMeta
+	Counters *bignumCounters
+	DelFiles []*bignumDelFile
+}
+
+// bignumRecord is an ndjson record with the chunks of bignums, written after all the other fields.
+type bignumRecord struct {
+	*ndjsonRecord
+	Chunks []*bignumChunk `json:"chunks,omitempty"`
+}
+
+func toBignumChunk(c *DumpedChunk) *bignumChunk {
+	b := &bignumChunk{Index: c.Index, Slices: make([]*bignumSlice, len(c.Slices))}
+	for i, s := range c.Slices {
+		b.Slices[i] = (*bignumSlice)(s)
+	}
+	return b
+}
+
+func toBignumChunks(cs []*DumpedChunk) []*bignumChunk {
+	if cs == nil {
+		return nil
+	}
+	bs := make([]*bignumChunk, len(cs))
+	for i, c := range cs {
+		bs[i] = toBignumChunk(c)
+	}
+	return bs
+}
+
+func toBignumMeta(dm *DumpedMeta) *bignumMeta {
+	b := &bignumMeta{DumpedMeta: dm, Counters: (*bignumCounters)(dm.Counters)}
+	if dm.DelFiles != nil {
+		b.DelFiles = make([]*bignumDelFile, len(dm.DelFiles))
+		for i, f := range dm.DelFiles {
+			b.DelFiles[i] = &bignumDelFile{f.Inode, f.Length, f.Expire, toBignumChunks(f.Chunks)}
+		}
+	}
+	return b
+}
+
+// jsonChunk returns c to be marshaled, with its ids of slices as strings if bignums.
+func jsonChunk(c *DumpedChunk, bignums bool) interface{} {
+	if bignums {
+		return toBignumChunk(c)
+	}
+	return c
+}
+
+func jsonChunks(cs []*DumpedChunk, bignums bool) interface{} {
+	if bignums {
+		return toBignumChunks(cs)
+	}
+	return cs
+}
+
+// parseBignum parses a counter of a number or a string of decimal in n, which is empty for null
+// or a missing field, 0 as a number would be.
+func parseBignum(name string, n json.Number) (int64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(string(n), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %s: %s", name, n, err)
+	}
+	return v, nil
+}
+
+// parseUbignum is parseBignum of an unsigned one.
+func parseUbignum(name string, n json.Number) (uint64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(string(n), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %s: %s", name, n, err)
+	}
+	return v, nil
+}
+
+type jsonCounters struct {
+	UsedSpace         json.Number `json:"usedSpace"`
+	UsedInodes        json.Number `json:"usedInodes"`
+	NextInode         json.Number `json:"nextInodes"`
+	NextChunk         json.Number `json:"nextChunk"`
+	NextSession       json.Number `json:"nextSession"`
+	NextCleanupSlices json.Number `json:"nextCleanupSlices"`
+}
+
+// UnmarshalJSON accepts every counter as a number or a string, see bignumCounters.
+func (c *DumpedCounters) UnmarshalJSON(data []byte) error {
+	var j jsonCounters
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	var cs DumpedCounters
+	for _, f := range []struct {
+		name string
+		n    json.Number
+		v    *int64
+	}{
+		{"usedSpace", j.UsedSpace, &cs.UsedSpace},
+		{"usedInodes", j.UsedInodes, &cs.UsedInodes},
+		{"nextInodes", j.NextInode, &cs.NextInode},
+		{"nextChunk", j.NextChunk, &cs.NextChunk},
+		{"nextSession", j.NextSession, &cs.NextSession},
+		{"nextCleanupSlices", j.NextCleanupSlices, &cs.NextCleanupSlices},
+	} {
+		var err error
+		if *f.v, err = parseBignum(f.name, f.n); err != nil {
+			return err
+		}
+	}
+	*c = cs
+	return nil
+}
+
+type jsonSlice struct {
+	Pos     uint32      `json:"pos"`
+	Chunkid json.Number `json:"chunkid"`
+	Size    uint32      `json:"size"`
+	Off     uint32      `json:"off"`
+	Len     uint32      `json:"len"`
+	Data    []byte      `json:"data,omitempty"`
+}
+
+// UnmarshalJSON accepts the chunkid as a number or a string, see bignumSlice. It decodes a slice
+// about half slower than the default one, which is paid by every load of a JSON dump.
+func (s *DumpedSlice) UnmarshalJSON(data []byte) error {
+	var j jsonSlice
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	id, err := parseUbignum("chunkid", j.Chunkid)
+	if err != nil {
+		return err
+	}
+	*s = DumpedSlice{Pos: j.Pos, Chunkid: id, Size: j.Size, Off: j.Off, Len: j.Len, Data: j.Data}
+	return nil
+}
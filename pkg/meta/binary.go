@@ -0,0 +1,158 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+)
+
+// binaryMagic starts every binary dump, which is followed by a gob stream of DumpedMeta
+// (without FSTree) and all the entries in depth-first order. Every directory is followed
+// by the number of its children. Names and values are kept as raw bytes, no escaping is needed.
+// The gob stream is followed by the checksum trailer. Nothing depends on the byte order of the
+// machine: gob writes every integer as its bytes in big endian after the length, and so is the
+// checksum, so a dump written on arm64 is loaded on amd64 as is, see TestBinaryByteOrder.
+const binaryMagic = "JFSDUMP\x01"
+
+type binaryEncoder struct {
+	w   io.Writer
+	h   hash.Hash64 // of everything written through bw
+	bw  *bufio.Writer
+	enc *gob.Encoder
+}
+
+func newBinaryEncoder(w io.Writer) *binaryEncoder {
+	h := newChecksum()
+	bw := bufio.NewWriterSize(io.MultiWriter(w, h), jsonWriteSize)
+	return &binaryEncoder{w, h, bw, gob.NewEncoder(bw)}
+}
+
+func (b *binaryEncoder) writeMeta(dm *DumpedMeta) error {
+	if dm.FSTree != nil {
+		return fmt.Errorf("invalid dumped meta: FSTree should be nil")
+	}
+	if _, err := b.bw.WriteString(binaryMagic); err != nil {
+		return err
+	}
+	return b.enc.Encode(dm)
+}
+
+func (b *binaryEncoder) writeEntry(e *DumpedEntry) error {
+	if e.Attr.Type == "directory" {
+		return b.beginDir(e, 0)
+	}
+	return b.enc.Encode(e)
+}
+
+func (b *binaryEncoder) beginDir(e *DumpedEntry, n int) error {
+	if err := b.enc.Encode(e); err != nil {
+		return err
+	}
+	return b.enc.Encode(n)
+}
+
+func (b *binaryEncoder) endDir() error { return nil }
+
+func (b *binaryEncoder) finish() error {
+	if err := b.bw.Flush(); err != nil {
+		return err
+	}
+	trailer := make([]byte, len(binaryChecksum)+8)
+	copy(trailer, binaryChecksum)
+	binary.BigEndian.PutUint64(trailer[len(binaryChecksum):], b.h.Sum64())
+	_, err := b.w.Write(trailer)
+	return err
+}
+
+// decodeBinary reads a binary dump, the entries not kept by keepPath for only are decoded but dropped.
+func decodeBinary(r io.Reader, only string) (*DumpedMeta, error) {
+	magic := make([]byte, len(binaryMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != binaryMagic {
+		return nil, fmt.Errorf("invalid magic of binary dump: %q", magic)
+	}
+	dec := gob.NewDecoder(r)
+	dm := &DumpedMeta{}
+	if err := dec.Decode(dm); err != nil {
+		return nil, fmt.Errorf("decode meta: %s", err)
+	}
+	if err := upgradeDump(dm); err != nil { // before decoding entries which may be unknown
+		return nil, err
+	}
+	var err error
+	if dm.FSTree, err = decodeBinaryEntry(dec, only); err != nil {
+		return nil, fmt.Errorf("decode tree: %s", err)
+	}
+	return dm, nil
+}
+
+// decodeBinaryEntry decodes the tree, the entries which are not kept are dropped. The directories
+// being decoded are in a stack instead of recursion, which is as deep as the tree.
+func decodeBinaryEntry(dec *gob.Decoder, only string) (*DumpedEntry, error) {
+	type dir struct {
+		e    *DumpedEntry
+		p    string
+		left int // children to be decoded
+	}
+	var root *DumpedEntry
+	var stack []*dir
+	for {
+		e := &DumpedEntry{}
+		if err := dec.Decode(e); err != nil {
+			return nil, err
+		}
+		if e.Attr == nil {
+			return nil, fmt.Errorf("no attr for entry %s", e.Name)
+		}
+		p := "/"
+		if len(stack) == 0 {
+			root = e
+		} else {
+			parent := stack[len(stack)-1]
+			parent.left--
+			if only != "" { // the paths grow with depth
+				p = path.Join(parent.p, e.Name)
+			}
+			if keepPath(p, only) {
+				parent.e.Entries[e.Name] = e
+			}
+		}
+		if e.Attr.Type == "directory" {
+			var n int
+			if err := dec.Decode(&n); err != nil {
+				return nil, err
+			}
+			if n > 0 {
+				e.Entries = make(map[string]*DumpedEntry, n)
+			}
+			stack = append(stack, &dir{e, p, n})
+		}
+		for len(stack) > 0 && stack[len(stack)-1].left <= 0 {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			return root, nil
+		}
+	}
+}
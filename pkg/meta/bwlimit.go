@@ -0,0 +1,54 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"io"
+
+	"github.com/juju/ratelimit"
+)
+
+// limitedWriter writes at most limit bytes per second by a token bucket, which holds a second of
+// them, so that a burst after an idle time doesn't last longer than that.
+type limitedWriter struct {
+	w io.Writer
+	b *ratelimit.Bucket
+}
+
+func newLimitedWriter(w io.Writer, limit int64) *limitedWriter {
+	return &limitedWriter{w, ratelimit.NewBucketWithRate(float64(limit), limit)}
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.b.Wait(int64(len(p)))
+	return w.w.Write(p)
+}
+
+// limitedReader reads at most limit bytes per second, like limitedWriter.
+type limitedReader struct {
+	r io.Reader
+	b *ratelimit.Bucket
+}
+
+func newLimitedReader(r io.Reader, limit int64) *limitedReader {
+	return &limitedReader{r, ratelimit.NewBucketWithRate(float64(limit), limit)}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.b.Wait(int64(n))
+	return n, err
+}
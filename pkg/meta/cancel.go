@@ -0,0 +1,75 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"context"
+	"io"
+)
+
+// ctxDumper fails reading any entry once ctx is done, which stops every walk of a dump.
+type ctxDumper struct {
+	dumper
+	ctx context.Context
+}
+
+func (d ctxDumper) dumpEntry(inode Ino) (*DumpedEntry, error) {
+	if err := d.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.dumper.dumpEntry(inode)
+}
+
+func (d ctxDumper) dumpDir(inode Ino) ([]*Entry, error) {
+	if err := d.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.dumper.dumpDir(inode)
+}
+
+// ctxWriter fails writing once ctx is done, the written data is flushed by buffers in batches.
+type ctxWriter struct {
+	w   io.Writer
+	ctx context.Context
+}
+
+func (w *ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// ctxReader fails reading once ctx is done, so that decoding a dump is stopped.
+type ctxReader struct {
+	r   io.Reader
+	ctx context.Context
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// ctxErr returns the error of ctx, which is nil if it's not done or ctx is nil.
+func ctxErr(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Err()
+}
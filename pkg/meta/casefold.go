@@ -0,0 +1,183 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DumpedCaseCollision is a group of entries in a directory whose names differ only by case,
+// which collide on a case-insensitive file system or object storage.
+type DumpedCaseCollision struct {
+	Path  string   `json:"path"`  // of the directory
+	Names []string `json:"names"` // in the order they're dumped
+}
+
+// foldName folds the case of name by the simple case folding of Unicode, which doesn't depend
+// on the locale. A byte which is not valid UTF-8 is kept as is.
+func foldName(name string) string {
+	var b strings.Builder
+	b.Grow(len(name))
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		if r == utf8.RuneError && size == 1 {
+			b.WriteByte(name[i])
+		} else {
+			b.WriteRune(foldRune(r))
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// foldRune returns the same rune for all the ones folded to each other, the lower case one for
+// ASCII letters, e.g. 'k' for 'K' and KELVIN SIGN.
+func foldRune(r rune) rune {
+	if r >= utf8.RuneSelf {
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < r {
+				r = f
+			}
+		}
+	}
+	if 'A' <= r && r <= 'Z' {
+		r += 'a' - 'A'
+	}
+	return r
+}
+
+// caseEncoder finds the entries written through it colliding with their siblings by case.
+type caseEncoder struct {
+	dumpEncoder
+	found *[]*DumpedCaseCollision
+	dirs  []*caseDir // current directory and its parents
+}
+
+type caseDir struct {
+	path       string
+	names      map[string]string // folded to the first name
+	collisions map[string]*DumpedCaseCollision
+}
+
+func newCaseEncoder(enc dumpEncoder, found *[]*DumpedCaseCollision) *caseEncoder {
+	*found = nil
+	return &caseEncoder{dumpEncoder: enc, found: found}
+}
+
+func (c *caseEncoder) check(e *DumpedEntry) string {
+	if len(c.dirs) == 0 {
+		return "/"
+	}
+	d := c.dirs[len(c.dirs)-1]
+	p := path.Join(d.path, e.Name)
+	if e.Attr.Nlink == 0 { // stubs in delta dumps and placeholders in shards
+		return p
+	}
+	key := foldName(e.Name)
+	first, ok := d.names[key]
+	if !ok {
+		d.names[key] = e.Name
+		return p
+	}
+	if cc := d.collisions[key]; cc != nil {
+		cc.Names = append(cc.Names, e.Name)
+	} else {
+		cc = &DumpedCaseCollision{Path: d.path, Names: []string{first, e.Name}}
+		d.collisions[key] = cc
+		*c.found = append(*c.found, cc)
+	}
+	return p
+}
+
+func (c *caseEncoder) writeEntry(e *DumpedEntry) error {
+	c.check(e)
+	return c.dumpEncoder.writeEntry(e)
+}
+
+func (c *caseEncoder) beginDir(e *DumpedEntry, n int) error {
+	c.dirs = append(c.dirs, &caseDir{c.check(e), make(map[string]string, n), make(map[string]*DumpedCaseCollision)})
+	return c.dumpEncoder.beginDir(e, n)
+}
+
+func (c *caseEncoder) endDir() error {
+	c.dirs = c.dirs[:len(c.dirs)-1]
+	return c.dumpEncoder.endDir()
+}
+
+// resolveCase renames the entries in the tree colliding with their siblings by case, the first
+// one of them in byte order keeps its name, and the others get a numeric suffix before the
+// extension, e.g. Foo-1.txt. The renamed ones are returned as "old path -> new name".
+func resolveCase(root *DumpedEntry) []string {
+	var renamed []string
+	type dir struct {
+		e *DumpedEntry
+		p string
+	}
+	stack := []dir{{root, "/"}}
+	for len(stack) > 0 {
+		d := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if len(d.e.Entries) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(d.e.Entries))
+		for name := range d.e.Entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		used := make(map[string]bool, len(names))
+		var colliding []string
+		for _, name := range names {
+			if key := foldName(name); used[key] {
+				colliding = append(colliding, name)
+			} else {
+				used[key] = true
+			}
+		}
+		for _, name := range colliding {
+			ext := path.Ext(name)
+			if ext == name {
+				ext = "" // e.g. .bashrc
+			}
+			base := strings.TrimSuffix(name, ext)
+			var nn string
+			for i := 1; ; i++ {
+				nn = fmt.Sprintf("%s-%d%s", base, i, ext)
+				if _, ok := d.e.Entries[nn]; !ok && !used[foldName(nn)] {
+					break
+				}
+			}
+			used[foldName(nn)] = true
+			e := d.e.Entries[name]
+			delete(d.e.Entries, name)
+			e.Name = nn
+			d.e.Entries[nn] = e
+			renamed = append(renamed, fmt.Sprintf("%s -> %s", path.Join(d.p, name), nn))
+		}
+		for name, e := range d.e.Entries {
+			if e.Attr != nil && e.Attr.Type == "directory" {
+				stack = append(stack, dir{e, path.Join(d.p, name)})
+			}
+		}
+	}
+	sort.Strings(renamed)
+	return renamed
+}
@@ -0,0 +1,264 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+type dumpProblem struct {
+	inode Ino
+	msg   string
+}
+
+// checkDump validates the invariants of dm before anything is loaded, like an offline fsck of
+// the dump. It returns the problems found, sorted by inode.
+//   - every inode and chunk ID is smaller than the next one in counters
+//   - every slice lies within its chunk
+//   - nlink of a directory is 2 plus the number of its sub-directories, and a directory
+//     has only one parent
+//   - nlink of a file is the number of its paths, which all have the same attributes
+//   - the data of a file is within its length
+//   - the dir stats of a directory, if dumped, are the ones counted from the tree under it
+func checkDump(dm *DumpedMeta) []dumpProblem {
+	var problems []dumpProblem
+	report := func(inode Ino, format string, args ...interface{}) {
+		problems = append(problems, dumpProblem{inode, fmt.Sprintf(format, args...)})
+	}
+	cs := dm.Counters
+	seen := make(map[Ino]*DumpedEntry)
+	paths := make(map[Ino]uint32)
+	var check func(e *DumpedEntry, p string)
+	check = func(e *DumpedEntry, p string) {
+		a := e.Attr
+		if a == nil {
+			report(0, "%s: no attr", p)
+			return
+		}
+		if int64(a.Inode) >= cs.NextInode {
+			report(a.Inode, "%s: inode is not smaller than next inode %d", p, cs.NextInode)
+		}
+		if a.Atimensec >= 1e9 || a.Mtimensec >= 1e9 || a.Ctimensec >= 1e9 || a.Btimensec >= 1e9 {
+			report(a.Inode, "%s: nanoseconds of times should be smaller than 1e9", p)
+		}
+		paths[a.Inode]++
+		if s := seen[a.Inode]; s != nil {
+			if a.Type == "directory" {
+				report(a.Inode, "%s: directory has more than one parent", p)
+			} else if !sameEntry(s, e) {
+				report(a.Inode, "%s: attributes are different from another path of it", p)
+			}
+			return
+		}
+		seen[a.Inode] = e
+		if a.Type == "directory" {
+			var dirs uint32
+			for name, c := range e.Entries {
+				if c.Attr != nil && c.Attr.Type == "directory" {
+					dirs++
+				}
+				check(c, path.Join(p, name))
+			}
+			if a.Nlink != dirs+2 {
+				report(a.Inode, "%s: nlink is %d, but it has %d sub-directories", p, a.Nlink, dirs)
+			}
+			return
+		}
+		if e.DirStats != nil {
+			report(a.Inode, "%s: %s should have no dir stats", p, a.Type)
+		}
+		for _, c := range e.Chunks {
+			ss := make([]*slice, 0, len(c.Slices))
+			for _, s := range c.Slices {
+				if s.Chunkid >= uint64(cs.NextChunk) {
+					report(a.Inode, "%s: chunk %d of slice is not smaller than next chunk %d", p, s.Chunkid, cs.NextChunk)
+				}
+				if uint64(s.Pos)+uint64(s.Len) > ChunkSize || uint64(s.Off)+uint64(s.Len) > uint64(s.Size) {
+					report(a.Inode, "%s: slice %+v is out of range", p, *s)
+				}
+				if n := newSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len); n != nil {
+					ss = append(ss, n)
+				}
+			}
+			var pos, end uint64
+			for _, s := range buildSlice(ss) {
+				pos += uint64(s.Len)
+				if s.Chunkid > 0 {
+					end = pos
+				}
+			}
+			if end > 0 && uint64(c.Index)*ChunkSize+end > a.Length {
+				report(a.Inode, "%s: data of chunk %d ends at %d, beyond length %d", p, c.Index, uint64(c.Index)*ChunkSize+end, a.Length)
+			}
+		}
+	}
+	check(dm.FSTree, "/")
+	checkDirStats(dm.FSTree, "/", report)
+	for inode, e := range seen {
+		if e.Attr.Type != "directory" && e.Attr.Nlink != paths[inode] {
+			report(inode, "nlink is %d, but it has %d paths", e.Attr.Nlink, paths[inode])
+		}
+	}
+	for _, d := range dm.DelFiles {
+		if int64(d.Inode) >= cs.NextInode {
+			report(d.Inode, "file to be deleted is not smaller than next inode %d", cs.NextInode)
+		}
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].inode < problems[j].inode })
+	return problems
+}
+
+// fixNlinks sets nlink of every entry in dm to the one counted from the tree, like checkDump
+// expects: 2 plus the number of sub-directories for a directory, the number of paths for a file,
+// and 1 for others. It returns the inodes fixed, sorted by inode.
+func fixNlinks(dm *DumpedMeta) []dumpProblem {
+	type visit struct {
+		p string
+		e *DumpedEntry
+	}
+	var visits []visit
+	paths := make(map[Ino]uint32)
+	stack := []visit{{"/", dm.FSTree}}
+	for len(stack) > 0 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if v.e.Attr == nil { // reported by checkDump, and skipped or refused by the load
+			continue
+		}
+		visits = append(visits, v)
+		paths[v.e.Attr.Inode]++
+		for name, c := range v.e.Entries {
+			stack = append(stack, visit{path.Join(v.p, name), c})
+		}
+	}
+	type fix struct {
+		p          string // the first one of its paths
+		old, nlink uint32
+	}
+	fixes := make(map[Ino]*fix)
+	for _, v := range visits {
+		a := v.e.Attr
+		nlink := uint32(1)
+		switch a.Type {
+		case "directory":
+			nlink = 2
+			for _, c := range v.e.Entries {
+				if c.Attr != nil && c.Attr.Type == "directory" {
+					nlink++
+				}
+			}
+		case "regular":
+			nlink = paths[a.Inode]
+		}
+		if a.Nlink == nlink {
+			continue
+		}
+		if f := fixes[a.Inode]; f == nil {
+			fixes[a.Inode] = &fix{v.p, a.Nlink, nlink}
+		} else if v.p < f.p {
+			f.p = v.p
+		}
+		a.Nlink = nlink
+	}
+	fixed := make([]dumpProblem, 0, len(fixes))
+	for inode, f := range fixes {
+		fixed = append(fixed, dumpProblem{inode, fmt.Sprintf("%s: nlink %d is fixed to %d", f.p, f.old, f.nlink)})
+	}
+	sort.Slice(fixed, func(i, j int) bool { return fixed[i].inode < fixed[j].inode })
+	return fixed
+}
+
+// checkCoverage returns the files in dm whose slices don't cover their length, sorted by inode.
+// A range of a file is covered by any slice over it, including a hole of chunk ID 0, so the
+// overlapping slices are fine. A range covered by nothing reads as zeros, which is expected for
+// a sparse file written beyond its end, but not otherwise. A dump without slices is skipped.
+func checkCoverage(dm *DumpedMeta) []dumpProblem {
+	if dm.NoData {
+		logger.Warnf("The dump has no slices of files, their coverage is not checked")
+		return nil
+	}
+	files := make(map[Ino]*DumpedEntry)
+	paths := make(map[Ino]string) // the first one of its paths
+	type visit struct {
+		p string
+		e *DumpedEntry
+	}
+	stack := []visit{{"/", dm.FSTree}}
+	for len(stack) > 0 {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		a := v.e.Attr
+		if a == nil {
+			continue
+		}
+		if a.Type == "regular" {
+			if p, ok := paths[a.Inode]; !ok || v.p < p {
+				files[a.Inode], paths[a.Inode] = v.e, v.p
+			}
+		}
+		for name, c := range v.e.Entries {
+			stack = append(stack, visit{path.Join(v.p, name), c})
+		}
+	}
+	var problems []dumpProblem
+	for inode, e := range files {
+		gaps := coverageGaps(e)
+		if len(gaps) == 0 {
+			continue
+		}
+		var missing uint64
+		for _, g := range gaps {
+			missing += g[1] - g[0]
+		}
+		problems = append(problems, dumpProblem{inode, fmt.Sprintf("%s: %d bytes of length %d in %d ranges are not covered by any slice, the first one is [%d, %d)",
+			paths[inode], missing, e.Attr.Length, len(gaps), gaps[0][0], gaps[0][1])})
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].inode < problems[j].inode })
+	return problems
+}
+
+// coverageGaps returns the ranges of the file e within its length not covered by any slice, in
+// the offsets of the file, ordered by offset.
+func coverageGaps(e *DumpedEntry) [][2]uint64 {
+	var ranges [][2]uint64
+	for _, c := range e.Chunks {
+		for _, s := range c.Slices {
+			start := uint64(c.Index)*ChunkSize + uint64(s.Pos)
+			ranges = append(ranges, [2]uint64{start, start + uint64(s.Len)})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	var gaps [][2]uint64
+	var pos uint64 // covered up to
+	length := e.Attr.Length
+	for _, r := range ranges {
+		if r[0] >= length {
+			break
+		}
+		if r[0] > pos {
+			gaps = append(gaps, [2]uint64{pos, r[0]})
+		}
+		if r[1] > pos {
+			pos = r[1]
+		}
+	}
+	if pos < length {
+		gaps = append(gaps, [2]uint64{pos, length})
+	}
+	return gaps
+}
@@ -0,0 +1,98 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+)
+
+// Every dump ends with a CRC64 of all the serialized bytes before it, not including
+// the compression. It's the last field of the top-level object in JSON, a trailer
+// after the gob stream in binary, and the last line in ndjson.
+const (
+	jsonChecksum   = ",\n" + jsonIndent + "\"Checksum\": \"%s\"\n}\n"
+	binaryChecksum = "JFSCRC64" // followed by the checksum in big endian
+	ndjsonChecksum = "{\"Checksum\":\"%s\"}\n"
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+func newChecksum() hash.Hash64 { return crc64.New(crcTable) }
+
+func formatChecksum(sum uint64) string { return fmt.Sprintf("%016x", sum) }
+
+// checksumReader hashes everything read through it except the last n bytes, which are
+// kept in tail, so that the checksum can be verified after the whole dump is read.
+type checksumReader struct {
+	r    io.Reader
+	h    hash.Hash64
+	n    int
+	tail []byte
+}
+
+// newChecksumReader returns a reader of a dump in format, which is json, binary or ndjson.
+func newChecksumReader(r io.Reader, format string) *checksumReader {
+	var n int
+	switch format {
+	case "binary":
+		n = len(binaryChecksum) + 8
+	case "ndjson":
+		n = len(fmt.Sprintf(ndjsonChecksum, formatChecksum(0)))
+	default:
+		n = len(fmt.Sprintf(jsonChecksum, formatChecksum(0)))
+	}
+	return &checksumReader{r: r, h: newChecksum(), n: n}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.tail = append(c.tail, p[:n]...)
+	if over := len(c.tail) - c.n; over > 0 {
+		_, _ = c.h.Write(c.tail[:over])
+		c.tail = append(c.tail[:0], c.tail[over:]...)
+	}
+	return n, err
+}
+
+// verify checks the checksum recorded in dm, which has been read through c to the end.
+func (c *checksumReader) verify(dm *DumpedMeta, format string) error {
+	if format == "binary" { // binary and ndjson dumps always have the trailer
+		if len(c.tail) != c.n || string(c.tail[:len(binaryChecksum)]) != binaryChecksum {
+			return fmt.Errorf("no checksum at the end of the dump, it may be truncated")
+		}
+		dm.Checksum = formatChecksum(binary.BigEndian.Uint64(c.tail[len(binaryChecksum):]))
+	} else if format == "ndjson" {
+		if dm.Checksum == "" {
+			return fmt.Errorf("no checksum at the end of the dump, it may be truncated")
+		} else if string(c.tail) != fmt.Sprintf(ndjsonChecksum, dm.Checksum) {
+			return fmt.Errorf("checksum is not at the end of the dump, it may be corrupted")
+		}
+	} else if dm.Checksum != "" && string(c.tail) != fmt.Sprintf(jsonChecksum, dm.Checksum) {
+		return fmt.Errorf("checksum is not at the end of the dump, it may be corrupted")
+	}
+	if dm.Checksum == "" {
+		logger.Warnf("No checksum in the dump, it's loaded without verification")
+		return nil
+	}
+	if sum := formatChecksum(c.h.Sum64()); sum != dm.Checksum {
+		return fmt.Errorf("checksum mismatch: %s is recorded but got %s, the dump is corrupted", dm.Checksum, sum)
+	}
+	return nil
+}
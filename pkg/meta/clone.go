@@ -0,0 +1,61 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"io"
+)
+
+// CloneMeta copies all the metadata of src into dst, which can be another engine, by piping a
+// binary dump of src into the load of dst in memory, so that nothing is staged on disk. dst
+// must be empty as for a load, or only formatted with the same block size. The secrets in the
+// setting are kept, as the dump is never written anywhere.
+func CloneMeta(src, dst Meta, dopt DumpOption, lopt LoadOption) error {
+	format, err := src.Load()
+	if err != nil {
+		return fmt.Errorf("load setting of source: %s", err)
+	}
+	if f, err := dst.Load(); err == nil {
+		if err = checkBlockSize(f, format); err != nil {
+			return err
+		}
+	}
+	if dopt.Format == "" {
+		dopt.Format = "binary"
+	}
+	dopt.KeepSecrets = true
+	if dopt.Format == "csv" || dopt.Diff != nil || dopt.Since != nil || len(dopt.InodeRange) > 0 {
+		return fmt.Errorf("only a full dump can be cloned")
+	}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := src.DumpMeta(pw, dopt)
+		_ = pw.CloseWithError(err)
+		done <- err
+	}()
+	err = dst.LoadMeta(pr, lopt)
+	_ = pr.CloseWithError(fmt.Errorf("load is stopped")) // unblocks the dump if load fails
+	derr := <-done
+	if err != nil { // it's the error of dump if dump fails first
+		return fmt.Errorf("load target: %s", err)
+	}
+	if derr != nil {
+		return fmt.Errorf("dump source: %s", derr)
+	}
+	return nil
+}
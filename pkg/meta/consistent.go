@@ -0,0 +1,156 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A dump reads the entries one by one in many transactions, so a volume being changed is dumped
+// into a tree of different moments, e.g. a file moved into a directory which has been dumped is
+// missing, or dumped twice if moved out of one not dumped yet. A consistent dump reads all the
+// metadata of the volume at one moment instead, which is only supported by the tkv engines: all
+// the keys are read in one transaction, and the dump reads from the copy in memory.
+func errConsistent(engine string) error {
+	return fmt.Errorf("a consistent dump is not supported by %s, which can only be done by a tkv engine", engine)
+}
+
+// kvSnapshot is a read-only tkvClient of the keys read from another one in a transaction.
+type kvSnapshot struct {
+	engine string
+	keys   []string // sorted
+	values map[string][]byte
+}
+
+func newKVSnapshot(client tkvClient) (*kvSnapshot, error) {
+	s := &kvSnapshot{engine: client.name()}
+	err := client.txn(func(tx kvTxn) error {
+		s.values = tx.scanValues([]byte{}, nil)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.keys = make([]string, 0, len(s.values))
+	for k := range s.values {
+		s.keys = append(s.keys, k)
+	}
+	sort.Strings(s.keys)
+	return s, nil
+}
+
+func (s *kvSnapshot) name() string {
+	return s.engine
+}
+
+func (s *kvSnapshot) txn(f func(kvTxn) error) error {
+	return f(snapshotTxn{s})
+}
+
+// snapshot returns a client of m reading a snapshot of all its keys, for a consistent dump.
+func (m *kvMeta) snapshot() (*kvMeta, error) {
+	s, err := newKVSnapshot(m.client)
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot: %s", err)
+	}
+	logger.Infof("Read a snapshot of %d keys", len(s.keys))
+	return &kvMeta{
+		conf:         m.conf,
+		fmt:          m.fmt,
+		client:       s,
+		sid:          m.sid,
+		of:           newOpenFiles(0),
+		root:         m.root,
+		symlinks:     &sync.Map{},
+		msgCallbacks: m.msgCallbacks,
+	}, nil
+}
+
+type snapshotTxn struct {
+	s *kvSnapshot
+}
+
+func (tx snapshotTxn) get(key []byte) []byte {
+	return tx.s.values[string(key)]
+}
+
+func (tx snapshotTxn) gets(keys ...[]byte) [][]byte {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = tx.get(key)
+	}
+	return values
+}
+
+func (tx snapshotTxn) scanRange(begin, end []byte) map[string][]byte {
+	keys := tx.s.keys
+	i := sort.SearchStrings(keys, string(begin))
+	ret := make(map[string][]byte)
+	for ; i < len(keys) && (len(end) == 0 || keys[i] < string(end)); i++ {
+		ret[keys[i]] = tx.s.values[keys[i]]
+	}
+	return ret
+}
+
+func (tx snapshotTxn) scanKeys(prefix []byte) [][]byte {
+	var keys [][]byte
+	for k := range tx.scanValues(prefix, nil) {
+		keys = append(keys, []byte(k))
+	}
+	return keys
+}
+
+func (tx snapshotTxn) scanValues(prefix []byte, filter func(k, v []byte) bool) map[string][]byte {
+	keys := tx.s.keys
+	ret := make(map[string][]byte)
+	for i := sort.SearchStrings(keys, string(prefix)); i < len(keys) && strings.HasPrefix(keys[i], string(prefix)); i++ {
+		if v := tx.s.values[keys[i]]; filter == nil || filter([]byte(keys[i]), v) {
+			ret[keys[i]] = v
+		}
+	}
+	return ret
+}
+
+func (tx snapshotTxn) exist(prefix []byte) bool {
+	i := sort.SearchStrings(tx.s.keys, string(prefix))
+	return i < len(tx.s.keys) && strings.HasPrefix(tx.s.keys[i], string(prefix))
+}
+
+func (tx snapshotTxn) set(key, value []byte) {
+	panic("write into a snapshot")
+}
+
+func (tx snapshotTxn) append(key []byte, value []byte) []byte {
+	panic("write into a snapshot")
+}
+
+func (tx snapshotTxn) incrBy(key []byte, value int64) int64 {
+	if value != 0 {
+		panic("write into a snapshot")
+	}
+	var v int64
+	if buf := tx.get(key); len(buf) > 0 {
+		v = parseCounter(buf)
+	}
+	return v
+}
+
+func (tx snapshotTxn) dels(keys ...[]byte) {
+	panic("write into a snapshot")
+}
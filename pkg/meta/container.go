@@ -0,0 +1,176 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// A container holds snapshots of volumes, each of which is a complete dump in any format, one
+// after another, followed by a directory of them in JSON and a trailer. All the integers are
+// big endian:
+//
+//	header     magic "JFSSNAP1"
+//	snapshots  the dumps, as they're written by DumpMeta, and the unused directories
+//	directory  a JSON array of DumpSnapshot, in the order they're appended
+//	trailer    offset of the directory uint64, size of it uint64, magic "JFSSNAP1"
+//
+// A snapshot is read by the trailer and the directory at the end, and then its own section,
+// so the other ones are never read. A new one is written after the trailer, followed by the new
+// directory and trailer, so the container is still valid if it fails, and the old directory is
+// left unused between the snapshots. Snapshots are not deduplicated, compress them to save space.
+const (
+	containerMagic       = "JFSSNAP1"
+	containerTrailerSize = 24
+)
+
+// DumpSnapshot is a dump in a container.
+type DumpSnapshot struct {
+	Name   string `json:"name"`
+	Time   int64  `json:"time"`   // when it's dumped, in nanoseconds
+	Offset int64  `json:"offset"` // of the dump in the container
+	Size   int64  `json:"size"`
+}
+
+// ContainerFile is a file of snapshots, like os.File.
+type ContainerFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// ReadSnapshots reads the directory of snapshots in the container r, which is size bytes.
+func ReadSnapshots(r io.ReaderAt, size int64) ([]*DumpSnapshot, error) {
+	if size < int64(len(containerMagic))+containerTrailerSize {
+		return nil, fmt.Errorf("not a container of snapshots")
+	}
+	buf := make([]byte, containerTrailerSize)
+	if _, err := r.ReadAt(buf[:len(containerMagic)], 0); err != nil {
+		return nil, err
+	}
+	if string(buf[:len(containerMagic)]) != containerMagic {
+		return nil, fmt.Errorf("not a container of snapshots")
+	}
+	if _, err := r.ReadAt(buf, size-containerTrailerSize); err != nil {
+		return nil, err
+	}
+	if string(buf[16:]) != containerMagic {
+		return nil, fmt.Errorf("no trailer in the container, it may be truncated")
+	}
+	off, n := int64(binary.BigEndian.Uint64(buf)), int64(binary.BigEndian.Uint64(buf[8:]))
+	if off < int64(len(containerMagic)) || off+n != size-containerTrailerSize {
+		return nil, fmt.Errorf("invalid directory of snapshots at %d (%d bytes)", off, n)
+	}
+	data := make([]byte, n)
+	if _, err := r.ReadAt(data, off); err != nil {
+		return nil, err
+	}
+	var snapshots []*DumpSnapshot
+	if err := json.Unmarshal(data, &snapshots); err != nil {
+		return nil, fmt.Errorf("decode directory of snapshots: %s", err)
+	}
+	for _, s := range snapshots {
+		if s.Offset < int64(len(containerMagic)) || s.Offset+s.Size > off {
+			return nil, fmt.Errorf("snapshot %s is out of the container", s.Name)
+		}
+	}
+	return snapshots, nil
+}
+
+// OpenSnapshot returns the reader of the dump of snapshot name in the container r.
+func OpenSnapshot(r io.ReaderAt, size int64, name string) (*io.SectionReader, error) {
+	snapshots, err := ReadSnapshots(r, size)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(snapshots))
+	for _, s := range snapshots {
+		if s.Name == name {
+			return io.NewSectionReader(r, s.Offset, s.Size), nil
+		}
+		names = append(names, s.Name)
+	}
+	return nil, fmt.Errorf("no snapshot %s in the container, but %s", name, strings.Join(names, ", "))
+}
+
+// writerAt writes sequentially into w from off.
+type writerAt struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (w *writerAt) Write(p []byte) (int, error) {
+	n, err := w.w.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// AppendSnapshot appends a snapshot named name, whose dump is written by dump, into the
+// container f, which is size bytes, or empty to create a new one. f is truncated back to size
+// if it fails.
+func AppendSnapshot(f ContainerFile, size int64, name string, dump func(w io.Writer) error) (err error) {
+	if name == "" {
+		return fmt.Errorf("empty name of snapshot")
+	}
+	var snapshots []*DumpSnapshot
+	if size > 0 {
+		if snapshots, err = ReadSnapshots(f, size); err != nil {
+			return err
+		}
+		for _, s := range snapshots {
+			if s.Name == name {
+				return fmt.Errorf("snapshot %s is already in the container", name)
+			}
+		}
+	}
+	defer func() {
+		if err != nil {
+			if e := f.Truncate(size); e != nil {
+				logger.Warnf("Truncate the container back to %d bytes: %s", size, e)
+			}
+		}
+	}()
+	off := size
+	if size == 0 {
+		if _, err = f.WriteAt([]byte(containerMagic), 0); err != nil {
+			return err
+		}
+		off = int64(len(containerMagic))
+	}
+	s := &DumpSnapshot{Name: name, Time: time.Now().UnixNano(), Offset: off}
+	w := &writerAt{w: f, off: off}
+	if err = dump(w); err != nil {
+		return err
+	}
+	s.Size = w.off - off
+	data, err := json.Marshal(append(snapshots, s))
+	if err != nil {
+		return err
+	}
+	trailer := make([]byte, containerTrailerSize)
+	binary.BigEndian.PutUint64(trailer, uint64(w.off))
+	binary.BigEndian.PutUint64(trailer[8:], uint64(len(data)))
+	copy(trailer[16:], containerMagic)
+	if _, err = w.Write(append(data, trailer...)); err != nil {
+		return err
+	}
+	return f.Truncate(w.off)
+}
@@ -0,0 +1,157 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A csv dump has a header and one row for every inode, with the full path from the root of
+// the dump. A file with hard links is exported once at the first path of it. It's meant for
+// offline analysis and can't be loaded, so there is no checksum or anything else in it.
+var csvColumns = []string{"path", "inode", "type", "mode", "uid", "gid", "size", "atime", "mtime", "ctime", "nlink"}
+
+// csvValues formats the columns of an entry at path p, the size of a symlink is its target's.
+var csvValues = map[string]func(e *DumpedEntry, p string) string{
+	"path":  func(e *DumpedEntry, p string) string { return p },
+	"inode": func(e *DumpedEntry, p string) string { return strconv.FormatUint(uint64(e.Attr.Inode), 10) },
+	"type":  func(e *DumpedEntry, p string) string { return e.Attr.Type },
+	"mode":  func(e *DumpedEntry, p string) string { return fmt.Sprintf("%04o", e.Attr.Mode) },
+	"uid":   func(e *DumpedEntry, p string) string { return strconv.FormatUint(uint64(e.Attr.Uid), 10) },
+	"gid":   func(e *DumpedEntry, p string) string { return strconv.FormatUint(uint64(e.Attr.Gid), 10) },
+	"size": func(e *DumpedEntry, p string) string {
+		if e.Attr.Type == "symlink" {
+			return strconv.Itoa(len(e.Symlink))
+		}
+		return strconv.FormatUint(e.Attr.Length, 10)
+	},
+	"atime": func(e *DumpedEntry, p string) string { return csvTime(e.Attr.Atime, e.Attr.Atimensec) },
+	"mtime": func(e *DumpedEntry, p string) string { return csvTime(e.Attr.Mtime, e.Attr.Mtimensec) },
+	"ctime": func(e *DumpedEntry, p string) string { return csvTime(e.Attr.Ctime, e.Attr.Ctimensec) },
+	"nlink": func(e *DumpedEntry, p string) string { return strconv.FormatUint(uint64(e.Attr.Nlink), 10) },
+}
+
+// checkCSVFields refuses the fields which are not in csvColumns, or selected more than once.
+func checkCSVFields(fields []string) error {
+	selected := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if csvValues[f] == nil {
+			return fmt.Errorf("unknown field %q, it should be one of %s", f, strings.Join(csvColumns, ", "))
+		}
+		if selected[f] {
+			return fmt.Errorf("field %q is selected more than once", f)
+		}
+		selected[f] = true
+	}
+	return nil
+}
+
+type csvEncoder struct {
+	bw     *bufio.Writer
+	cw     *csv.Writer
+	fields []string         // columns of the attributes, csvColumns by default
+	xattrs []string         // names of xattrs exported as columns
+	dirs   []string         // path of current directory and its parents
+	linked map[Ino]struct{} // files with hard links which have been exported
+}
+
+func newCSVEncoder(bw *bufio.Writer, fields, xattrs []string) *csvEncoder {
+	if len(fields) == 0 {
+		fields = csvColumns
+	}
+	return &csvEncoder{bw: bw, cw: csv.NewWriter(bw), fields: fields, xattrs: xattrs, linked: make(map[Ino]struct{})}
+}
+
+func (c *csvEncoder) writeMeta(dm *DumpedMeta) error {
+	if dm.FSTree != nil {
+		return fmt.Errorf("invalid dumped meta: FSTree should be nil")
+	}
+	header := append([]string{}, c.fields...)
+	for _, name := range c.xattrs {
+		header = append(header, "xattr:"+name)
+	}
+	return c.cw.Write(header)
+}
+
+func (c *csvEncoder) path(e *DumpedEntry) string {
+	if len(c.dirs) == 0 {
+		return "/"
+	}
+	return path.Join(c.dirs[len(c.dirs)-1], e.Name)
+}
+
+func csvTime(sec int64, nsec uint32) string {
+	return time.Unix(sec, int64(nsec)).UTC().Format(time.RFC3339Nano)
+}
+
+func (c *csvEncoder) writeRow(e *DumpedEntry, p string) error {
+	row := make([]string, 0, len(c.fields)+len(c.xattrs))
+	for _, f := range c.fields {
+		row = append(row, csvValues[f](e, p))
+	}
+	for _, name := range c.xattrs {
+		var value string
+		for _, x := range e.Xattrs {
+			if x.Name == name {
+				value = x.Value
+				break
+			}
+		}
+		row = append(row, value)
+	}
+	return c.cw.Write(row)
+}
+
+func (c *csvEncoder) writeEntry(e *DumpedEntry) error {
+	if e.Attr.Type == "directory" {
+		if err := c.beginDir(e, 0); err != nil {
+			return err
+		}
+		return c.endDir()
+	}
+	if e.Attr.Nlink > 1 {
+		if _, ok := c.linked[e.Attr.Inode]; ok {
+			return nil
+		}
+		c.linked[e.Attr.Inode] = struct{}{}
+	}
+	return c.writeRow(e, c.path(e))
+}
+
+func (c *csvEncoder) beginDir(e *DumpedEntry, n int) error {
+	p := c.path(e)
+	c.dirs = append(c.dirs, p)
+	return c.writeRow(e, p)
+}
+
+func (c *csvEncoder) endDir() error {
+	c.dirs = c.dirs[:len(c.dirs)-1]
+	return nil
+}
+
+func (c *csvEncoder) finish() error {
+	c.cw.Flush()
+	if err := c.cw.Error(); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
@@ -0,0 +1,139 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import "fmt"
+
+// SliceStore reads and writes the contents of slices in the object storage of a volume, by
+// which the data of files is embedded into a dump, so that it can be restored without the
+// object storage of the source.
+type SliceStore interface {
+	// ReadSlice returns the whole contents of a slice, which are size bytes.
+	ReadSlice(id uint64, size uint32) ([]byte, error)
+	// WriteSlice writes the contents of a slice, replacing the existing ones.
+	WriteSlice(id uint64, data []byte) error
+}
+
+// dataEncoder fills the data of slices into the entries written through it, they're dropped
+// once written, so that only the data of one file is in memory.
+type dataEncoder struct {
+	dumpEncoder
+	store SliceStore
+	limit int64 // of all the data, 0 for no limit
+	size  int64
+	seen  map[uint64]struct{}
+}
+
+func newDataEncoder(enc dumpEncoder, store SliceStore, limit int64) *dataEncoder {
+	return &dataEncoder{dumpEncoder: enc, store: store, limit: limit, seen: make(map[uint64]struct{})}
+}
+
+func (d *dataEncoder) writeEntry(e *DumpedEntry) error {
+	var filled []*DumpedSlice
+	defer func() {
+		for _, s := range filled {
+			s.Data = nil
+		}
+	}()
+	for _, c := range e.Chunks {
+		for _, s := range c.Slices {
+			if _, ok := d.seen[s.Chunkid]; ok || s.Chunkid == 0 {
+				continue
+			}
+			d.seen[s.Chunkid] = struct{}{}
+			if d.size += int64(s.Size); d.limit > 0 && d.size > d.limit {
+				return fmt.Errorf("data of files is more than %d bytes, which is too large to be dumped", d.limit)
+			}
+			data, err := d.store.ReadSlice(s.Chunkid, s.Size)
+			if err != nil {
+				return fmt.Errorf("read slice %d of inode %d: %s", s.Chunkid, e.Attr.Inode, err)
+			}
+			if len(data) != int(s.Size) {
+				return fmt.Errorf("read slice %d of inode %d: %d bytes are expected, but got %d", s.Chunkid, e.Attr.Inode, s.Size, len(data))
+			}
+			s.Data = data
+			filled = append(filled, s)
+		}
+	}
+	return d.dumpEncoder.writeEntry(e)
+}
+
+// checkDataOption validates the option of a dump with data, its size is guarded by the
+// used space in counters, which is known before anything is dumped.
+func checkDataOption(dm *DumpedMeta, root Ino, opt DumpOption) error {
+	if opt.NoData || opt.Since != nil || opt.Diff != nil || len(opt.InodeRange) > 0 || opt.Format == "csv" {
+		return fmt.Errorf("data of files can only be embedded into a full dump")
+	}
+	if dm.Counters == nil {
+		return nil
+	}
+	used := dm.Counters.UsedSpace
+	if root == 1 && opt.MaxDataSize > 0 && used > opt.MaxDataSize {
+		return fmt.Errorf("used space of the volume is %d bytes, which is more than %d bytes to be dumped with data", used, opt.MaxDataSize)
+	}
+	logger.Warnf("Data of files is embedded into the dump (%d bytes used in the volume), which is only practical for small volumes", used)
+	return nil
+}
+
+// loadData writes the data embedded in dm into the storage opened by opt.Data, before any
+// metadata is loaded, so that no loaded file refers to a missing slice. The data is dropped
+// after written.
+func loadData(dm *DumpedMeta, opt LoadOption) error {
+	if opt.Data == nil || opt.DryRun != nil {
+		if dm.WithData && opt.DryRun == nil {
+			logger.Warnf("Data of files in the dump is not loaded, the slices should be in the object storage already")
+		}
+		return nil
+	}
+	if !dm.WithData {
+		return fmt.Errorf("the dump has no data of files to be loaded")
+	}
+	if opt.Remap != "" || opt.ApplyDelta {
+		return fmt.Errorf("data of files can only be loaded by a full load")
+	}
+	store, err := opt.Data(dm.Setting)
+	if err != nil {
+		return fmt.Errorf("open storage: %s", err)
+	}
+	var slices []*DumpedSlice
+	var walk func(e *DumpedEntry)
+	walk = func(e *DumpedEntry) {
+		for _, c := range e.Chunks {
+			for _, s := range c.Slices {
+				if s.Data != nil {
+					slices = append(slices, s)
+				}
+			}
+		}
+		for _, c := range e.Entries {
+			walk(c)
+		}
+	}
+	walk(dm.FSTree)
+	bar := newProgress("Load data progress: ", int64(len(slices)), opt.ProgressInterval, opt.Progress)
+	defer bar.Done()
+	for _, s := range slices {
+		if len(s.Data) != int(s.Size) {
+			return fmt.Errorf("slice %d has %d bytes of data, but its size is %d", s.Chunkid, len(s.Data), s.Size)
+		}
+		if err = store.WriteSlice(s.Chunkid, s.Data); err != nil {
+			return fmt.Errorf("write slice %d: %s", s.Chunkid, err)
+		}
+		s.Data = nil
+		bar.Incr(1)
+	}
+	return nil
+}
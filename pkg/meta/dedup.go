@@ -0,0 +1,200 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// dedupFiles finds the files in dm with the same contents, and points the slices of each of
+// them at the ones of the first file walked to, as if it's cloned from it. Files are the same
+// if they have the same length and layout of slices, and the contents of the slices read from
+// the storage opened by opt.Dedup, or the data embedded in the dump, are the same. Only the
+// files with the same length as another one are read. The slices are still shared after the
+// files are modified, since the loaded references of them are counted as usual. The ones not
+// referenced any more are left in the object storage, to be deleted by gc.
+func dedupFiles(dm *DumpedMeta, opt LoadOption) error {
+	if opt.Dedup == nil || opt.DryRun != nil || dm.FSTree == nil {
+		return nil
+	}
+	if opt.Remap != "" || opt.ApplyDelta || opt.Phase != "" {
+		return fmt.Errorf("files can only be deduplicated by a full load")
+	}
+	var files []*DumpedEntry
+	links := make(map[Ino][]*DumpedEntry) // the other entries of hard linked files
+	lengths := make(map[uint64]int)
+	embedded := make(map[uint64][]byte)
+	stack := []*DumpedEntry{dm.FSTree}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		names := make([]string, 0, len(e.Entries))
+		for name := range e.Entries {
+			names = append(names, name)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(names))) // the same files are found first every time
+		for _, name := range names {
+			stack = append(stack, e.Entries[name])
+		}
+		if e.Attr == nil || e.Attr.Type != "regular" {
+			continue
+		}
+		if _, ok := links[e.Attr.Inode]; ok {
+			links[e.Attr.Inode] = append(links[e.Attr.Inode], e)
+			continue
+		}
+		links[e.Attr.Inode] = nil
+		files = append(files, e)
+		if e.Attr.Length > 0 {
+			lengths[e.Attr.Length]++
+		}
+		for _, c := range e.Chunks {
+			for _, s := range c.Slices {
+				if s.Data != nil {
+					embedded[s.Chunkid] = s.Data
+				}
+			}
+		}
+	}
+	referenced := func() map[uint64]uint32 {
+		slices := make(map[uint64]uint32)
+		for _, e := range files {
+			for _, c := range e.Chunks {
+				for _, s := range c.Slices {
+					if s.Chunkid > 0 {
+						slices[s.Chunkid] = s.Size
+					}
+				}
+			}
+		}
+		return slices
+	}
+	before := referenced()
+
+	var store SliceStore
+	hashes := make(map[uint64][sha256.Size]byte) // of the contents of the read slices
+	hash := func(s *DumpedSlice) ([sha256.Size]byte, error) {
+		if h, ok := hashes[s.Chunkid]; ok {
+			return h, nil
+		}
+		data := embedded[s.Chunkid]
+		if data == nil {
+			if store == nil {
+				var err error
+				if store, err = opt.Dedup(dm.Setting); err != nil {
+					return [sha256.Size]byte{}, fmt.Errorf("open storage: %s", err)
+				}
+			}
+			var err error
+			if data, err = store.ReadSlice(s.Chunkid, s.Size); err != nil {
+				return [sha256.Size]byte{}, fmt.Errorf("read slice %d: %s", s.Chunkid, err)
+			}
+		}
+		if len(data) != int(s.Size) {
+			return [sha256.Size]byte{}, fmt.Errorf("slice %d has %d bytes, but its size is %d", s.Chunkid, len(data), s.Size)
+		}
+		h := sha256.Sum256(data)
+		hashes[s.Chunkid] = h
+		return h, nil
+	}
+
+	var candidates int
+	for _, e := range files {
+		if e.Attr.Length > 0 && lengths[e.Attr.Length] > 1 {
+			candidates++
+		}
+	}
+	bar := newProgress("Dedup progress: ", int64(candidates), opt.ProgressInterval, opt.Progress)
+	defer bar.Done()
+	firsts := make(map[[sha256.Size]byte]*DumpedEntry) // by the contents and layout
+	var deduped int
+	buf := make([]byte, 16)
+	for _, e := range files {
+		if e.Attr.Length == 0 || lengths[e.Attr.Length] < 2 {
+			continue
+		}
+		bar.Incr(1)
+		key := sha256.New()
+		binary.BigEndian.PutUint64(buf, e.Attr.Length)
+		key.Write(buf[:8])
+		for _, c := range e.Chunks {
+			binary.BigEndian.PutUint32(buf, c.Index)
+			binary.BigEndian.PutUint32(buf[4:], uint32(len(c.Slices)))
+			key.Write(buf[:8])
+			for _, s := range c.Slices {
+				binary.BigEndian.PutUint32(buf, s.Pos)
+				binary.BigEndian.PutUint32(buf[4:], s.Size)
+				binary.BigEndian.PutUint32(buf[8:], s.Off)
+				binary.BigEndian.PutUint32(buf[12:], s.Len)
+				key.Write(buf[:16])
+				if s.Chunkid == 0 { // a hole
+					key.Write([]byte{0})
+					continue
+				}
+				h, err := hash(s)
+				if err != nil {
+					return fmt.Errorf("dedup inode %d: %s", e.Attr.Inode, err)
+				}
+				key.Write([]byte{1})
+				key.Write(h[:])
+			}
+		}
+		var k [sha256.Size]byte
+		copy(k[:], key.Sum(nil))
+		first := firsts[k]
+		if first == nil {
+			firsts[k] = e
+			continue
+		}
+		for i, c := range e.Chunks {
+			for j, s := range c.Slices {
+				s.Chunkid = first.Chunks[i].Slices[j].Chunkid
+			}
+		}
+		for _, l := range links[e.Attr.Inode] {
+			l.Chunks = e.Chunks
+		}
+		deduped++
+	}
+
+	if len(embedded) > 0 { // only in the first one of every slice still referenced
+		attached := make(map[uint64]bool)
+		for _, e := range files {
+			for _, c := range e.Chunks {
+				for _, s := range c.Slices {
+					s.Data = nil
+					if data, ok := embedded[s.Chunkid]; ok && !attached[s.Chunkid] {
+						s.Data = data
+						attached[s.Chunkid] = true
+					}
+				}
+			}
+		}
+	}
+	after := referenced()
+	var slices, freed int64
+	for id, size := range before {
+		if _, ok := after[id]; !ok {
+			slices++
+			freed += int64(size)
+		}
+	}
+	logger.Infof("Deduplicated %d files (%d slices read), %d slices (%d bytes) are not referenced any more", deduped, len(hashes), slices, freed)
+	return nil
+}
@@ -0,0 +1,306 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// A delta dump carries the changes since a full dump (the base), and is applied onto
+// a database loaded from the base. Its BaseVersion is the newest change time in the
+// base, an entry changed after it is dumped in full, and a changed directory lists all
+// its children, the unchanged ones as stubs with only inode and type. Unchanged entries
+// are omitted unless they have changed descendants. Inodes of the base which are gone
+// are listed in Deleted.
+
+// deltaApplier is implemented by every metadata engine to apply a delta dump.
+type deltaApplier interface {
+	// applyEntry replaces everything stored for the inode of e with e, and changes the references
+	// to slices by the difference of the chunks. A slice not in known is referred nowhere before,
+	// it's added into known once referred.
+	applyEntry(e *DumpedEntry, known map[sliceID]bool) error
+	// removeInode removes everything stored for an inode, but not the edges to it, the references
+	// to its slices are released.
+	removeInode(inode Ino) error
+	// knownSlices removes the slices referred nowhere from slices.
+	knownSlices(slices map[sliceID]bool) error
+	// applyCounters sets the counters and files to be deleted in dm.
+	applyCounters(dm *DumpedMeta) error
+	// Load reads the setting of the volume.
+	Load() (*Format, error)
+}
+
+// sliceID identifies a slice in the references.
+type sliceID struct {
+	chunkid uint64
+	size    uint32
+}
+
+// refCount is the number of references to a slice in the old chunks and the new ones.
+type refCount struct {
+	old, new int64
+}
+
+// diffSlices counts the references to the slices in the chunks old and new.
+func diffSlices(old, new []*DumpedChunk) map[sliceID]*refCount {
+	diff := make(map[sliceID]*refCount)
+	count := func(chunks []*DumpedChunk, n func(r *refCount) *int64) {
+		for _, c := range chunks {
+			for _, s := range c.Slices {
+				if s.Chunkid == 0 { // a hole
+					continue
+				}
+				id := sliceID{s.Chunkid, s.Size}
+				if diff[id] == nil {
+					diff[id] = &refCount{}
+				}
+				*n(diff[id])++
+			}
+		}
+	}
+	count(old, func(r *refCount) *int64 { return &r.old })
+	count(new, func(r *refCount) *int64 { return &r.new })
+	return diff
+}
+
+// storedRefs returns the references of a slice stored as the number of them minus one as in Redis
+// and TKV, after the ones in r are replaced. stored is the one stored before, -1 if it's not stored,
+// which means the slice is referred once if it's known, otherwise it's referred nowhere. The result
+// is -1 if the slice is not referred any more, the objects of it are left to gc.
+func storedRefs(stored int64, r *refCount, known bool) int64 {
+	if stored < 0 && (known || r.old > 0) {
+		stored = 0
+	}
+	if v := stored + r.new - r.old; v >= 0 {
+		return v
+	}
+	return -1
+}
+
+// entryVersion returns the last change time of an entry in nanoseconds.
+func entryVersion(a *DumpedAttr) int64 {
+	v := a.Mtime*1e9 + int64(a.Mtimensec)
+	if c := a.Ctime*1e9 + int64(a.Ctimensec); c > v {
+		v = c
+	}
+	return v
+}
+
+// scanBase returns the version of a full dump and all the inodes in it.
+func scanBase(base *DumpedMeta) (int64, map[Ino]bool, error) {
+	if base.BaseVersion != 0 {
+		return 0, nil, fmt.Errorf("the base is a delta dump, only a full dump can be used")
+	}
+	var version int64
+	inodes := make(map[Ino]bool)
+	var scan func(e *DumpedEntry)
+	scan = func(e *DumpedEntry) {
+		if v := entryVersion(e.Attr); v > version {
+			version = v
+		}
+		inodes[e.Attr.Inode] = true
+		for _, c := range e.Entries {
+			scan(c)
+		}
+	}
+	scan(base.FSTree)
+	return version, inodes, nil
+}
+
+// pruneTree reads the tree under e, and returns the entries selected by keep in full, with
+// all the children of a selected directory and the path to every selected entry as stubs.
+// It returns nil if nothing is selected. All the inodes visited are added to seen if it's not nil.
+func pruneTree(f *entryFetcher, e *DumpedEntry, keep func(a *DumpedAttr) bool, seen map[Ino]bool,
+	showProgress func(totalIncr, currentIncr int64)) (*DumpedEntry, error) {
+	if seen != nil {
+		seen[e.Attr.Inode] = true
+	}
+	changed := keep(e.Attr)
+	if e.Attr.Type != "directory" {
+		if changed {
+			return e, nil
+		}
+		return nil, nil
+	}
+	entries, err := f.d.dumpDir(e.Attr.Inode)
+	if err != nil {
+		return nil, err
+	}
+	if showProgress != nil {
+		showProgress(int64(len(entries)), 0)
+	}
+	kept := make(map[string]*DumpedEntry)
+	done := make(chan struct{})
+	defer close(done)
+	next := f.fetch(entries, done)
+	for _, c := range entries {
+		entry, err := next()
+		if err != nil {
+			return nil, err
+		}
+		entry.Name = string(c.Name)
+		sub, err := pruneTree(f, entry, keep, seen, showProgress)
+		if err != nil {
+			return nil, err
+		}
+		if sub != nil {
+			kept[entry.Name] = sub
+		} else if changed {
+			kept[entry.Name] = &DumpedEntry{Name: entry.Name, Attr: &DumpedAttr{Inode: c.Inode, Type: entry.Attr.Type}}
+		}
+		if showProgress != nil {
+			showProgress(0, 1)
+		}
+	}
+	if !changed && len(kept) == 0 {
+		return nil, nil
+	}
+	e.Entries = kept
+	return e, nil
+}
+
+// dumpDeltaTree writes dm and the changes of tree since version, base is all inodes
+// in the base dump. Only the changes are kept in memory before they are written.
+func dumpDeltaTree(f *entryFetcher, dm *DumpedMeta, tree *DumpedEntry, enc dumpEncoder, version int64, base map[Ino]bool,
+	showProgress func(totalIncr, currentIncr int64)) error {
+	seen := make(map[Ino]bool)
+	changed := func(a *DumpedAttr) bool { return entryVersion(a) > version }
+	delta, err := pruneTree(f, tree, changed, seen, showProgress)
+	if err != nil {
+		return err
+	}
+	if delta == nil {
+		delta = &DumpedEntry{Name: tree.Name, Attr: &DumpedAttr{Inode: tree.Attr.Inode, Type: tree.Attr.Type}}
+	}
+	dm.BaseVersion = version
+	for inode := range base {
+		if !seen[inode] {
+			dm.Deleted = append(dm.Deleted, inode)
+		}
+	}
+	sort.Slice(dm.Deleted, func(i, j int) bool { return dm.Deleted[i] < dm.Deleted[j] })
+	logger.Infof("Dump changes since %s, %d inodes are deleted", time.Unix(0, version), len(dm.Deleted))
+	if err = enc.writeMeta(dm); err != nil {
+		return err
+	}
+	return writeTree(enc, delta)
+}
+
+// writeTree writes an in-memory tree with enc.
+func writeTree(enc dumpEncoder, e *DumpedEntry) error {
+	if len(e.Entries) == 0 {
+		return enc.writeEntry(e)
+	}
+	entries := make([]*DumpedEntry, 0, len(e.Entries))
+	for name, c := range e.Entries {
+		c.Name = name
+		entries = append(entries, c)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	if err := enc.beginDir(e, len(entries)); err != nil {
+		return err
+	}
+	for _, c := range entries {
+		if err := writeTree(enc, c); err != nil {
+			return err
+		}
+	}
+	return enc.endDir()
+}
+
+// applyDelta applies a delta dump onto the database of a, which is loaded from its base, so that
+// it's refused for another volume.
+func applyDelta(a deltaApplier, r io.Reader, opt LoadOption) error {
+	format, err := a.Load()
+	if err != nil {
+		return err
+	}
+	if opt.BWLimit > 0 {
+		r = newLimitedReader(r, opt.BWLimit)
+	}
+	dm, err := decodeForLoad(r, opt)
+	if err != nil {
+		return err
+	}
+	if err = checkNoData(dm, opt); err != nil {
+		return err
+	}
+	if dm.BaseVersion == 0 {
+		return fmt.Errorf("not a delta dump")
+	}
+	if dm.Setting.UUID != format.UUID {
+		return fmt.Errorf("the delta is from volume %s, but it's applied onto %s", dm.Setting.UUID, format.UUID)
+	}
+	if err = checkBlockSize(format, dm.Setting); err != nil {
+		return err
+	}
+	// the slices referred already are counted again by the stored references
+	known := make(map[sliceID]bool)
+	var collect func(e *DumpedEntry)
+	collect = func(e *DumpedEntry) {
+		if entryVersion(e.Attr) > dm.BaseVersion {
+			for id := range diffSlices(nil, e.Chunks) {
+				known[id] = true
+			}
+		}
+		for _, c := range e.Entries {
+			collect(c)
+		}
+	}
+	collect(dm.FSTree)
+	if err = a.knownSlices(known); err != nil {
+		return err
+	}
+	var applied, removed int
+	var apply func(e *DumpedEntry) error
+	apply = func(e *DumpedEntry) error {
+		for name, c := range e.Entries {
+			c.Name = name
+			c.Parent = e.Attr.Inode
+		}
+		if entryVersion(e.Attr) > dm.BaseVersion {
+			if err := a.applyEntry(e, known); err != nil {
+				return fmt.Errorf("apply inode %d: %s", e.Attr.Inode, err)
+			}
+			applied++
+		}
+		for _, c := range e.Entries {
+			if err := apply(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	dm.FSTree.Attr.Inode = 1
+	dm.FSTree.Parent = 1
+	if err = apply(dm.FSTree); err != nil {
+		return err
+	}
+	for _, inode := range dm.Deleted {
+		if err = a.removeInode(inode); err != nil {
+			return fmt.Errorf("remove inode %d: %s", inode, err)
+		}
+		removed++
+	}
+	logger.Infof("Applied %d entries and removed %d inodes", applied, removed)
+	if opt.Counters != nil {
+		*opt.Counters = *dm.Counters
+	}
+	return a.applyCounters(dm)
+}
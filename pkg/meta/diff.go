@@ -0,0 +1,179 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+)
+
+// A diff compares the live tree with a previous full dump (the golden one), and lists the
+// inodes added, removed and changed since it, instead of dumping the tree. Entries are aligned
+// by inode rather than path, so a renamed entry is a change of path, but not a removal and an
+// addition. The path of an inode is the first one of it in depth-first order, by which both
+// trees are walked.
+
+// DumpedDiff is the result of comparing the live tree with a golden dump, or two dumps by DiffDumps.
+type DumpedDiff struct {
+	Added     []*DumpedChange `json:"added"`
+	Removed   []*DumpedChange `json:"removed"`
+	Changed   []*DumpedChange `json:"changed"`
+	SizeDelta int64           `json:"sizeDelta,omitempty"` // change of the total length of files, only by DiffDumps
+}
+
+type DumpedChange struct {
+	Inode     Ino                 `json:"inode"`
+	Type      string              `json:"type"`
+	Path      string              `json:"path"`
+	From      string              `json:"from,omitempty"`      // the old path if it's moved
+	SizeDelta int64               `json:"sizeDelta,omitempty"` // change of the length of a file, only by DiffDumps
+	Fields    []*DumpedAttrChange `json:"fields,omitempty"`    // only in changed
+}
+
+type DumpedAttrChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+type goldenEntry struct {
+	attr *DumpedAttr
+	path string
+	seen bool // found in the live tree
+}
+
+// diffAttrs are the attributes compared, atime and ctime are ignored as they change without
+// anything interesting, e.g. by a read.
+var diffAttrs = []struct {
+	name  string
+	value func(a *DumpedAttr) interface{}
+}{
+	{"mode", func(a *DumpedAttr) interface{} { return a.Mode }},
+	{"uid", func(a *DumpedAttr) interface{} { return a.Uid }},
+	{"gid", func(a *DumpedAttr) interface{} { return a.Gid }},
+	{"length", func(a *DumpedAttr) interface{} { return a.Length }},
+	{"mtime", func(a *DumpedAttr) interface{} { return a.Mtime }},
+	{"mtimensec", func(a *DumpedAttr) interface{} { return a.Mtimensec }},
+	{"nlink", func(a *DumpedAttr) interface{} { return a.Nlink }},
+	{"rdev", func(a *DumpedAttr) interface{} { return a.Rdev }},
+	{"flags", func(a *DumpedAttr) interface{} { return a.Flags }},
+}
+
+// diffEncoder compares the entries written through it with the golden ones, and writes the
+// diff into w when finished.
+type diffEncoder struct {
+	w      io.Writer
+	golden map[Ino]*goldenEntry
+	dirs   []string     // path of current directory and its parents
+	linked map[Ino]bool // added files with hard links
+	diff   DumpedDiff
+}
+
+func newDiffEncoder(w io.Writer, golden *DumpedMeta) (*diffEncoder, error) {
+	if golden.BaseVersion != 0 || golden.InodeRange != nil {
+		return nil, fmt.Errorf("only a full dump can be compared with")
+	}
+	entries := make(map[Ino]*goldenEntry)
+	var scan func(e *DumpedEntry, p string)
+	scan = func(e *DumpedEntry, p string) {
+		if _, ok := entries[e.Attr.Inode]; !ok {
+			entries[e.Attr.Inode] = &goldenEntry{attr: e.Attr, path: p}
+		}
+		names := make([]string, 0, len(e.Entries))
+		for name := range e.Entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			scan(e.Entries[name], path.Join(p, name))
+		}
+	}
+	scan(golden.FSTree, "/")
+	diff := DumpedDiff{Added: []*DumpedChange{}, Removed: []*DumpedChange{}, Changed: []*DumpedChange{}}
+	return &diffEncoder{w: w, golden: entries, linked: make(map[Ino]bool), diff: diff}, nil
+}
+
+func (d *diffEncoder) writeMeta(dm *DumpedMeta) error { return nil }
+
+func (d *diffEncoder) compare(e *DumpedEntry) string {
+	p := "/"
+	if len(d.dirs) > 0 {
+		p = path.Join(d.dirs[len(d.dirs)-1], e.Name)
+	}
+	a := e.Attr
+	g := d.golden[a.Inode]
+	if g == nil {
+		if a.Type != "directory" && a.Nlink > 1 {
+			if d.linked[a.Inode] {
+				return p
+			}
+			d.linked[a.Inode] = true
+		}
+		d.diff.Added = append(d.diff.Added, &DumpedChange{Inode: a.Inode, Type: a.Type, Path: p})
+		return p
+	}
+	if g.seen {
+		return p
+	}
+	g.seen = true
+	c := &DumpedChange{Inode: a.Inode, Type: a.Type, Path: p}
+	if g.path != p && len(d.dirs) > 0 {
+		c.From = g.path
+	}
+	for _, f := range diffAttrs {
+		if o, n := f.value(g.attr), f.value(a); o != n {
+			c.Fields = append(c.Fields, &DumpedAttrChange{f.name, o, n})
+		}
+	}
+	if c.From != "" || len(c.Fields) > 0 {
+		d.diff.Changed = append(d.diff.Changed, c)
+	}
+	return p
+}
+
+func (d *diffEncoder) writeEntry(e *DumpedEntry) error {
+	d.compare(e)
+	return nil
+}
+
+func (d *diffEncoder) beginDir(e *DumpedEntry, n int) error {
+	d.dirs = append(d.dirs, d.compare(e))
+	return nil
+}
+
+func (d *diffEncoder) endDir() error {
+	d.dirs = d.dirs[:len(d.dirs)-1]
+	return nil
+}
+
+func (d *diffEncoder) finish() error {
+	for inode, g := range d.golden {
+		if !g.seen {
+			d.diff.Removed = append(d.diff.Removed, &DumpedChange{Inode: inode, Type: g.attr.Type, Path: g.path})
+		}
+	}
+	sort.Slice(d.diff.Removed, func(i, j int) bool { return d.diff.Removed[i].Path < d.diff.Removed[j].Path })
+	logger.Infof("Compared with the golden dump: %d added, %d removed and %d changed", len(d.diff.Added), len(d.diff.Removed), len(d.diff.Changed))
+	data, err := json.MarshalIndent(&d.diff, "", jsonIndent)
+	if err != nil {
+		return err
+	}
+	_, err = d.w.Write(append(data, '\n'))
+	return err
+}
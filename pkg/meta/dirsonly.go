@@ -0,0 +1,74 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+// dirsOnlyDumper drops everything but the directories, with the xattrs of them, for a skeleton
+// of the tree to plan a reorganization. The nlink of a directory is not changed, which only
+// counts its sub-directories.
+type dirsOnlyDumper struct {
+	dumper
+}
+
+func (d dirsOnlyDumper) dumpEntry(inode Ino) (*DumpedEntry, error) {
+	e, err := d.dumper.dumpEntry(inode)
+	if e != nil {
+		e.Xattrs = nil
+	}
+	return e, err
+}
+
+func (d dirsOnlyDumper) dumpDir(inode Ino) ([]*Entry, error) {
+	entries, err := d.dumper.dumpDir(inode)
+	if err != nil {
+		return nil, err
+	}
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.Attr.Typ == TypeDirectory {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
+
+// keepDirsOnly drops everything but the directories in dm, like a dump with DirsOnly, for a
+// load to recreate the skeleton of the tree. The usage in the counters is the one of the
+// directories then, every one of which takes 4096 bytes, not including the root.
+func keepDirsOnly(dm *DumpedMeta) {
+	dm.DelFiles, dm.Sustained = nil, nil
+	if dm.FSTree == nil {
+		return
+	}
+	var dirs int64
+	var walk func(e *DumpedEntry)
+	walk = func(e *DumpedEntry) {
+		dirs++
+		e.Xattrs = nil
+		for name, c := range e.Entries {
+			if c.Attr != nil && typeFromString(c.Attr.Type) != TypeDirectory {
+				delete(e.Entries, name)
+			} else {
+				walk(c)
+			}
+		}
+	}
+	walk(dm.FSTree)
+	if dm.Counters != nil {
+		dm.Counters.UsedInodes = dirs - 1
+		dm.Counters.UsedSpace = (dirs - 1) * 4096
+	}
+	logger.Infof("Load %d directories only", dirs)
+}
@@ -0,0 +1,161 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"path"
+)
+
+// DumpedDirStats is the usage of everything under a directory, excluding itself. A hard linked
+// file is counted once in every directory with any of its links under it.
+type DumpedDirStats struct {
+	Size  uint64 `json:"size"`  // total length of the files
+	Files int64  `json:"files"` // inodes other than directories
+	Dirs  int64  `json:"dirs"`
+}
+
+// dirStatsDumper adds the stats of every directory to its entry.
+type dirStatsDumper struct {
+	dumper
+	stats map[Ino]*DumpedDirStats
+}
+
+func (d dirStatsDumper) dumpEntry(inode Ino) (*DumpedEntry, error) {
+	e, err := d.dumper.dumpEntry(inode)
+	if err == nil && e.Attr.Type == "directory" {
+		e.DirStats = d.stats[inode]
+	}
+	return e, err
+}
+
+// countDirStats walks the tree under root before anything is dumped, and returns the stats of
+// every directory in it. The length of every file is read by another dumpEntry, so it takes as
+// long as the dump. Only the inodes of the directories and hard linked files are kept in memory.
+func countDirStats(d dumper, dm *DumpedMeta, root Ino, opt DumpOption) (map[Ino]*DumpedDirStats, error) {
+	var estimate int64
+	if dm.Counters != nil {
+		estimate = dm.Counters.UsedInodes + 1
+	}
+	bar := newProgress("Count dir stats progress: ", estimate, opt.ProgressInterval, opt.Progress)
+	defer bar.Done()
+	stats := map[Ino]*DumpedDirStats{root: {}}
+	parents := make(map[Ino]Ino)
+	order := []Ino{root} // parents before children
+	linked := make(map[Ino]uint64)
+	links := make(map[Ino][]Ino) // directories with the links of a hard linked file
+	bar.Incr(1)
+	for i := 0; i < len(order); i++ {
+		dir := order[i]
+		entries, err := d.dumpDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		st := stats[dir]
+		for _, e := range entries {
+			if e.Attr.Typ == TypeDirectory {
+				if _, ok := stats[e.Inode]; ok {
+					return nil, fmt.Errorf("directory %d has more than one parent", e.Inode)
+				}
+				bar.Incr(1)
+				stats[e.Inode] = &DumpedDirStats{}
+				parents[e.Inode] = dir
+				order = append(order, e.Inode)
+				st.Dirs++
+				continue
+			}
+			if _, ok := linked[e.Inode]; ok {
+				links[e.Inode] = append(links[e.Inode], dir)
+				continue
+			}
+			bar.Incr(1)
+			if e.Attr.Typ != TypeFile {
+				st.Files++
+				continue
+			}
+			de, err := d.dumpEntry(e.Inode)
+			if err != nil {
+				return nil, err
+			}
+			if de.Attr.Nlink > 1 {
+				linked[e.Inode] = de.Attr.Length
+				links[e.Inode] = append(links[e.Inode], dir)
+				continue
+			}
+			st.Files++
+			st.Size += de.Attr.Length
+		}
+	}
+	for i := len(order) - 1; i > 0; i-- {
+		st, p := stats[order[i]], stats[parents[order[i]]]
+		p.Size += st.Size
+		p.Files += st.Files
+		p.Dirs += st.Dirs
+	}
+	for inode, dirs := range links {
+		counted := make(map[Ino]bool)
+		for _, dir := range dirs {
+			for !counted[dir] {
+				counted[dir] = true
+				stats[dir].Files++
+				stats[dir].Size += linked[inode]
+				if dir == root {
+					break
+				}
+				dir = parents[dir]
+			}
+		}
+	}
+	return stats, nil
+}
+
+// checkDirStats reports the directories in the tree whose dumped stats are different from the
+// ones counted from the tree, those without stats are skipped. The stats of e are returned with
+// the inodes of the hard linked files under it.
+func checkDirStats(e *DumpedEntry, p string, report func(inode Ino, format string, args ...interface{})) (*DumpedDirStats, map[Ino]uint64) {
+	st := &DumpedDirStats{}
+	linked := make(map[Ino]uint64)
+	for name, c := range e.Entries {
+		a := c.Attr
+		if a == nil {
+			continue
+		} else if a.Type == "directory" {
+			cst, clinked := checkDirStats(c, path.Join(p, name), report)
+			st.Size += cst.Size
+			st.Files += cst.Files
+			st.Dirs += cst.Dirs + 1
+			for inode, length := range clinked {
+				linked[inode] = length
+			}
+		} else if a.Type == "regular" && a.Nlink > 1 {
+			linked[a.Inode] = a.Length
+		} else {
+			st.Files++
+			if a.Type == "regular" {
+				st.Size += a.Length
+			}
+		}
+	}
+	total := *st
+	for _, length := range linked {
+		total.Files++
+		total.Size += length
+	}
+	if e.DirStats != nil && *e.DirStats != total {
+		report(e.Attr.Inode, "%s: dir stats %+v are different from %+v under it", p, *e.DirStats, total)
+	}
+	return st, linked
+}
@@ -0,0 +1,794 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// dumper is implemented by every metadata engine to provide the reads needed by the tree walk.
+type dumper interface {
+	// dumpEntry returns everything of an inode except its children.
+	dumpEntry(inode Ino) (*DumpedEntry, error)
+	// dumpDir returns the children of a directory, only Inode, Name and Attr.Typ are required.
+	dumpDir(inode Ino) ([]*Entry, error)
+}
+
+// DumpOption specifies how the metadata is dumped.
+type DumpOption struct {
+	Format   string    // json (default), binary, ndjson or csv (export only)
+	Compact  bool      // JSON without indentation or newlines, which is smaller
+	Compress string    // none (default), gzip, zstd or lz4
+	Since    io.Reader // a previous full dump, only the changes after it are dumped if set
+	Threads  int       // number of entries read concurrently, 1 (default) to read one by one
+	// CompressLevel is the level of Compress, 0 for its default, see compressLevels for the ranges
+	CompressLevel int
+	// InodeRange is the half-open range of inodes to be dumped as a shard, all if empty
+	InodeRange []Ino
+	// NoData drops the slices of files, only the tree structure and attributes are dumped
+	NoData bool
+	// DirsOnly drops everything but the directories, for a skeleton of the tree, see
+	// dirsOnlyDumper. Only for a full dump
+	DirsOnly bool
+	// Fields are the attributes exported as columns in csv format, in csvColumns, all by default
+	Fields []string
+	// Xattrs are the names of xattrs exported as columns in csv format
+	Xattrs []string
+	// Stat is filled with a summary of the dump if set
+	Stat *DumpStat
+	// Encrypt encrypts the dump by the key if set, it also decrypts the base dump in Since
+	Encrypt *DumpKey
+	// Diff is a previous full dump to be compared with, the differences are dumped in JSON instead
+	Diff io.Reader
+	// ProgressInterval is the refresh interval of the progress, which is also logged by it when
+	// stderr is not a terminal, see utils.NewProgress
+	ProgressInterval time.Duration
+	// Progress is called with the finished and total items of every stage if set, named by the
+	// title of its progress, e.g. "Dump dir", every ProgressInterval (a second by default) and
+	// once more when the stage is done
+	Progress func(stage string, current, total int64)
+	// Context cancels the dump if set, e.g. by a timeout, which fails with its error once it's done.
+	// The entries are checked whenever they're read, and the dump before it's flushed.
+	Context context.Context
+	// BWLimit limits the bytes of the dump written per second if set, after it's compressed and encrypted
+	BWLimit int64
+	// Counters is filled with the counters in the dump if set
+	Counters *DumpedCounters
+	// Data embeds the contents of slices read from it into a full dump if set, the dump fails
+	// if the used space or the data is more than MaxDataSize, 0 for no limit
+	Data        SliceStore
+	MaxDataSize int64
+	// Exclude drops the entries matching any of the patterns, and Include keeps only the files
+	// matching one of them, excludes take precedence, see dumpFilter for the patterns
+	Exclude []string
+	Include []string
+	// KeepSecrets keeps the credentials of the object storage and the encryption key in the
+	// setting, which are redacted by default, for a trusted local backup
+	KeepSecrets bool
+	// Orphans is filled with the inodes which no directory refers to if set, and AdoptOrphans
+	// dumps them in a new directory lost+found under the root, see findOrphans. Both need a full
+	// dump of the volume, and keep all the inodes in the tree in memory to find them
+	Orphans      *[]*DumpedOrphan
+	AdoptOrphans bool
+	// VerifyData checks the blocks of the slices in the object storage by it before dumping if
+	// set, of VerifySample of them, all if 0. The dump is marked as partial if any is missing,
+	// and MissingData is filled with the files whose data is missing if set, see verifyData
+	VerifyData   SliceVerifier
+	VerifySample float64
+	MissingData  *[]*DumpedMissingData
+	// CaseCollisions is filled with the entries whose names differ only by case from a sibling
+	// if set, which collide on a case-insensitive target, see foldName
+	CaseCollisions *[]*DumpedCaseCollision
+	// DirStats dumps the usage under every directory with it, which is counted by a walk of the
+	// tree before dumping, see countDirStats. It's only for a full dump
+	DirStats bool
+	// Locks dumps the locks held by all the sessions of the volume, for audit only, see DumpedLock
+	Locks bool
+	// Index is written with an index of the paths of the entries to their inodes and offsets in
+	// the dump if set, see index.go for its layout
+	Index io.Writer
+	// Consistent reads all the metadata at one moment, instead of every entry when it's dumped,
+	// which keeps a copy of it in memory. It's only supported by the tkv engines, see errConsistent
+	Consistent bool
+	// Manifest is written with the sorted keys of the objects referred to by the slices in a full
+	// or shard dump if set, for the lifecycle policies of the object storage, see manifest.go
+	Manifest io.Writer
+	// SkipEmptyFiles drops the files of zero length, and SkipEmptyDirs the directories with
+	// nothing left under them after everything else is dropped, including the ones excluded.
+	// They're decided by a walk of the tree before dumping, see findEmpty. Only for a full dump
+	SkipEmptyFiles bool
+	SkipEmptyDirs  bool
+	// StandardEscape writes the names in JSON and ndjson as is, quoted by the standard escaping
+	// of JSON instead of %XX, for the tools not knowing it, see escapeStandard
+	StandardEscape bool
+	// StringBignums writes the counters and the ids of slices in JSON and ndjson as strings, for
+	// the tools decoding a number into a double, which is not exact above 2^53, see bignum.go
+	StringBignums bool
+	// Roots dumps the trees under the directories at the paths in it instead of the one under
+	// the root, named by their keys, into Roots but not FSTree, see roots.go. Only for a full
+	// dump in JSON
+	Roots map[string]string
+	// ReadFrom is a client of a replica of the engine to read the tree from if set, while the
+	// setting and the counters are read from the primary, see dumpSource. Not for Consistent
+	ReadFrom Meta
+	// EntryHash writes a hash of the metadata of every entry into it, which is checked by load
+	// with CheckEntries to find the entries corrupted in the dump, see entryHash. Not for csv
+	EntryHash bool
+	// Estimate dumps a sample of the first entries into nowhere instead, and is filled with the
+	// projected size and time of the dump, see DumpEstimate. Only for a full dump without walks
+	// of the tree before dumping, and the counters of the whole volume are used for a subtree
+	Estimate *DumpEstimate
+}
+
+// filtered tells if some entries may be dropped by Exclude, Include, the skipping of empty ones
+// or DirsOnly.
+func (opt DumpOption) filtered() bool {
+	return len(opt.Exclude) > 0 || len(opt.Include) > 0 || opt.SkipEmptyFiles || opt.SkipEmptyDirs || opt.DirsOnly
+}
+
+// dumpEncoder serializes the entries produced by the tree walk, in depth-first order.
+type dumpEncoder interface {
+	// writeMeta writes everything in dm except FSTree, which must be nil.
+	writeMeta(dm *DumpedMeta) error
+	// writeEntry writes an entry which has no children.
+	writeEntry(e *DumpedEntry) error
+	// beginDir writes a directory, its n children are written before the matching endDir.
+	beginDir(e *DumpedEntry, n int) error
+	endDir() error
+	// finish completes the dump with its checksum and flushes all buffered data.
+	finish() error
+}
+
+func newDumpEncoder(w io.Writer, opt DumpOption) (dumpEncoder, error) {
+	if opt.Format != "csv" && (len(opt.Xattrs) > 0 || len(opt.Fields) > 0) {
+		return nil, fmt.Errorf("xattr and field columns are only for csv format")
+	}
+	if err := checkCSVFields(opt.Fields); err != nil {
+		return nil, err
+	}
+	if opt.Compact && (opt.Format != "" && opt.Format != "json" || opt.Diff != nil) {
+		return nil, fmt.Errorf("compact is only for a dump in JSON, ndjson is always compact")
+	}
+	if opt.StandardEscape && (opt.Format != "" && opt.Format != "json" && opt.Format != "ndjson" || opt.Diff != nil) {
+		return nil, fmt.Errorf("standard JSON escaping is only for a dump in JSON or ndjson")
+	}
+	if opt.StringBignums && (opt.Format != "" && opt.Format != "json" && opt.Format != "ndjson" || opt.Diff != nil) {
+		return nil, fmt.Errorf("bignums as strings are only for a dump in JSON or ndjson")
+	}
+	if opt.Diff != nil {
+		if opt.Format != "" && opt.Format != "json" || opt.Since != nil || len(opt.InodeRange) > 0 {
+			return nil, fmt.Errorf("a diff is always in JSON, and can't be a delta or shard dump")
+		}
+		golden, err := decodeDump(opt.Diff, false, opt.Encrypt)
+		if err != nil {
+			return nil, fmt.Errorf("load golden dump: %s", err)
+		}
+		return newDiffEncoder(w, golden)
+	}
+	switch opt.Format {
+	case "", "json":
+		return &jsonEncoder{w: w, h: newChecksum(), depth: 1, first: true, compact: opt.Compact, escape: nameEscaper(opt), roots: len(opt.Roots) > 0}, nil
+	case "binary":
+		return newBinaryEncoder(w), nil
+	case "ndjson":
+		return newNDJSONEncoder(w, nameEscaper(opt)), nil
+	case "csv":
+		if opt.Since != nil || len(opt.InodeRange) > 0 {
+			return nil, fmt.Errorf("csv format is not supported for delta or shard dumps")
+		}
+		return newCSVEncoder(bufio.NewWriterSize(w, jsonWriteSize), opt.Fields, opt.Xattrs), nil
+	default:
+		return nil, fmt.Errorf("unknown dump format: %s", opt.Format)
+	}
+}
+
+type jsonEncoder struct {
+	w     io.Writer
+	h     hash.Hash64 // of everything written through bw
+	bw    *bufio.Writer
+	depth int
+	first bool // no entry has been written in current directory
+	// compact writes no indentation or newlines, except the ones around the checksum, so that
+	// it's found at the same offset to the end as a pretty dump
+	compact bool
+	escape  func(string) string // of names, see nameEscaper
+	// roots writes the top directory as Roots of the named roots without attrs, see rootsDumper,
+	// whose children are one level deeper than the top
+	roots bool
+	// bignums writes the ids of slices as strings, set by writeMeta from the dump
+	bignums bool
+}
+
+func (j *jsonEncoder) writeMeta(dm *DumpedMeta) (err error) {
+	j.bignums = dm.Bignums == bignumsString
+	j.bw, err = dm.writeJsonWithOutTree(io.MultiWriter(j.w, j.h), j.compact)
+	return
+}
+
+func (j *jsonEncoder) sep() error {
+	if j.first {
+		j.first = false
+		return nil
+	}
+	_, err := j.bw.WriteString(",")
+	return err
+}
+
+func (j *jsonEncoder) writeEntry(e *DumpedEntry) error {
+	if err := j.sep(); err != nil {
+		return err
+	}
+	return e.writeJSON(j.bw, j.depth, j.compact, j.escape, j.bignums)
+}
+
+func (j *jsonEncoder) beginDir(e *DumpedEntry, n int) error {
+	if err := j.sep(); err != nil {
+		return err
+	}
+	if j.roots && j.depth == 1 {
+		nl, prefix, _, colon := jsonLayout(j.depth, j.compact)
+		j.depth++
+		j.first = true
+		_, err := j.bw.WriteString(fmt.Sprintf("%s%s\"Roots\"%s{", nl, prefix, colon))
+		return err
+	}
+	if err := e.writeJsonWithOutEntry(j.bw, j.depth, j.compact, j.escape); err != nil {
+		return err
+	}
+	j.depth += 2
+	j.first = true
+	return nil
+}
+
+func (j *jsonEncoder) endDir() error {
+	if j.roots && j.depth == 2 {
+		j.depth--
+		j.first = false
+		nl, prefix, _, _ := jsonLayout(j.depth, j.compact)
+		_, err := j.bw.WriteString(nl + prefix + "}")
+		return err
+	}
+	j.depth -= 2
+	j.first = false
+	nl, prefix, fieldPrefix, _ := jsonLayout(j.depth, j.compact)
+	_, err := j.bw.WriteString(fmt.Sprintf("%s%s}%s%s}", nl, fieldPrefix, nl, prefix))
+	return err
+}
+
+func (j *jsonEncoder) finish() error {
+	if err := j.bw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(j.w, jsonChecksum, formatChecksum(j.h.Sum64()))
+	return err
+}
+
+// noDataDumper drops the slices of files, for a dump of the tree structure only.
+type noDataDumper struct {
+	dumper
+}
+
+func (d noDataDumper) dumpEntry(inode Ino) (*DumpedEntry, error) {
+	e, err := d.dumper.dumpEntry(inode)
+	if e != nil {
+		e.Chunks = nil
+	}
+	return e, err
+}
+
+// redactedSecret replaces a secret in the setting of a dump, like the one of Format.RemoveSecret.
+const redactedSecret = "removed"
+
+// redactSecrets returns a copy of format with the secrets which are set redacted, the others
+// are kept, e.g. the block size needed by a load.
+func redactSecrets(format *Format) *Format {
+	f := *format
+	for _, s := range []*string{&f.AccessKey, &f.SecretKey, &f.EncryptKey} {
+		if *s != "" {
+			*s = redactedSecret
+		}
+	}
+	return &f
+}
+
+// countSubtree replaces the usage in cs with the one of the tree under root kept by the
+// filter in opt, so that a dump of a sub-directory or a filtered one only accounts what is dumped.
+func countSubtree(m Meta, root Ino, cs *DumpedCounters, opt DumpOption) error {
+	if opt.Estimate != nil { // the walk of the subtree is what an estimate is to avoid
+		logger.Warnf("The dump is estimated by the counters of the whole volume, which may be more than dumped")
+		return nil
+	}
+	f, err := newDumpFilter(opt.Exclude, opt.Include)
+	if err != nil {
+		return err
+	}
+	if f == nil && (opt.SkipEmptyFiles || opt.SkipEmptyDirs || len(opt.Roots) > 0) {
+		f = &dumpFilter{} // counts a hard linked file once, like findEmpty, even in several roots
+	}
+	roots := map[string]Ino{"": root}
+	if len(opt.Roots) > 0 {
+		if roots, err = lookupRoots(m, opt.Roots); err != nil {
+			return err
+		}
+	}
+	var summary Summary
+	linked := make(map[Ino]bool)
+	for name, inode := range roots {
+		var st syscall.Errno
+		if f != nil { // the paths of the named roots start with their names, see rootsDumper
+			st = f.summary(m, inode, name, len(opt.Include) == 0, linked, &summary)
+		} else {
+			st = GetSummary(m, Background, inode, &summary)
+		}
+		if st != 0 {
+			return fmt.Errorf("summary of subtree: %s", st)
+		}
+	}
+	cs.UsedSpace = int64(summary.Size) - 4096*int64(len(roots)) // the roots
+	cs.UsedInodes = int64(summary.Files+summary.Dirs) - int64(len(roots))
+	if opt.DirsOnly {
+		cs.UsedSpace = 4096 * (int64(summary.Dirs) - int64(len(roots)))
+		cs.UsedInodes = int64(summary.Dirs) - int64(len(roots))
+	}
+	return nil
+}
+
+// entryFetcher reads entries of a directory with dumpEntry concurrently, and returns them in order.
+type entryFetcher struct {
+	d   dumper
+	sem chan struct{} // shared by all directories to limit the concurrency, nil to read one by one
+}
+
+func newEntryFetcher(d dumper, threads int) *entryFetcher {
+	f := &entryFetcher{d: d}
+	if threads > 1 {
+		f.sem = make(chan struct{}, threads)
+	}
+	return f
+}
+
+type fetchedEntry struct {
+	e   *DumpedEntry
+	err error
+}
+
+// fetch returns a function which returns the entries of children one by one, at most cap(sem)
+// of them are read ahead. It should be called once for every child until an error is returned,
+// or done is closed.
+func (f *entryFetcher) fetch(children []*Entry, done <-chan struct{}) func() (*DumpedEntry, error) {
+	if f.sem == nil {
+		var i int
+		return func() (*DumpedEntry, error) {
+			i++
+			return f.d.dumpEntry(children[i-1].Inode)
+		}
+	}
+	ahead := make(chan chan fetchedEntry, cap(f.sem))
+	go func() {
+		for _, c := range children {
+			select {
+			case f.sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			r := make(chan fetchedEntry, 1)
+			go func(inode Ino) {
+				e, err := f.d.dumpEntry(inode)
+				<-f.sem
+				r <- fetchedEntry{e, err}
+			}(c.Inode)
+			select {
+			case ahead <- r:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() (*DumpedEntry, error) {
+		r := <-<-ahead
+		return r.e, r.err
+	}
+}
+
+// newProgress starts the progress of a stage, which is also reported to notify if set.
+func newProgress(title string, estimate int64, interval time.Duration, notify func(stage string, current, total int64)) *utils.Progress {
+	bar := utils.NewProgress(title, estimate, interval)
+	if notify != nil {
+		stage := strings.TrimSuffix(title, " progress: ")
+		bar.Notify(func(current, total int64) { notify(stage, current, total) })
+	}
+	return bar
+}
+
+// dumpSustained adds the sustained inodes in dm to the files to be deleted, with their slices
+// but without attrs. The sessions keeping them are gone in a loaded volume, so they are cleaned
+// as deleted files there, and their space is not counted. dm.Sustained is kept as is. A file
+// expires at its ctime, which is when it was unlinked.
+func dumpSustained(d dumper, dm *DumpedMeta) {
+	deleted := make(map[Ino]bool, len(dm.DelFiles))
+	for _, f := range dm.DelFiles {
+		deleted[f.Inode] = true
+	}
+	for _, ss := range dm.Sustained {
+		for _, inode := range ss.Inodes {
+			if deleted[inode] {
+				continue
+			}
+			e, err := d.dumpEntry(inode)
+			if err != nil { // the file may be closed and deleted meanwhile
+				logger.Warnf("Dump sustained inode %d of session %d: %s", inode, ss.Sid, err)
+				continue
+			}
+			dm.DelFiles = append(dm.DelFiles, &DumpedDelFile{inode, e.Attr.Length, e.Attr.Ctime, e.Chunks})
+			deleted[inode] = true
+		}
+	}
+}
+
+// sortDeleted orders the sessions with their sustained inodes and the files to be deleted in
+// dm, which are read in random order from some engines, so that a volume is always dumped
+// into the same bytes if nothing is changed.
+func sortDeleted(dm *DumpedMeta) {
+	sort.Slice(dm.Sustained, func(i, j int) bool { return dm.Sustained[i].Sid < dm.Sustained[j].Sid })
+	for _, ss := range dm.Sustained {
+		sort.Slice(ss.Inodes, func(i, j int) bool { return ss.Inodes[i] < ss.Inodes[j] })
+	}
+	sort.Slice(dm.DelFiles, func(i, j int) bool { return dm.DelFiles[i].Inode < dm.DelFiles[j].Inode })
+}
+
+// dumpTree writes dm followed by the tree under root into w. Entries are written as soon
+// as they are read, so only the current path and the children of its directories are kept
+// in memory, no matter how large the tree is.
+func dumpTree(d dumper, dm *DumpedMeta, root Ino, w io.Writer, opt DumpOption) error {
+	start := time.Now()
+	var sampled *offsetWriter // of an estimate, nothing is written into w or anywhere else
+	withData := opt.Data != nil
+	if opt.Estimate != nil {
+		if err := checkEstimateOption(opt); err != nil {
+			return err
+		}
+		if opt.Estimate.Sample <= 0 {
+			opt.Estimate.Sample = defaultEstimateSample
+		}
+		sampled = &offsetWriter{w: ioutil.Discard}
+		w = sampled
+		opt.Index, opt.Manifest, opt.Data = nil, nil, nil
+	}
+	if opt.BWLimit > 0 {
+		w = newLimitedWriter(w, opt.BWLimit)
+	}
+	if opt.Context != nil {
+		w = &ctxWriter{w, opt.Context}
+	}
+	ew, err := newEncryptWriter(w, opt.Encrypt)
+	if err != nil {
+		return err
+	}
+	cw, err := newCompressWriter(ew, opt.Compress, opt.CompressLevel)
+	if err != nil {
+		return err
+	}
+	ow := &offsetWriter{w: cw}
+	enc, err := newDumpEncoder(ow, opt) // buffered above the compressor
+	if err != nil {
+		return err
+	}
+	if opt.Index != nil {
+		if enc, err = newIndexEncoder(enc, ow, opt.Index, opt); err != nil {
+			return err
+		}
+	}
+	if opt.Stat != nil {
+		enc = newStatEncoder(enc, opt.Stat)
+	}
+	if opt.CaseCollisions != nil {
+		enc = newCaseEncoder(enc, opt.CaseCollisions)
+	}
+	var sample *sampleEncoder
+	if opt.Estimate != nil {
+		sample = &sampleEncoder{dumpEncoder: enc, n: opt.Estimate.Sample}
+		enc = sample
+	}
+	if opt.EntryHash {
+		if opt.Format == "csv" {
+			return fmt.Errorf("no hash of entries in csv format")
+		}
+		enc = hashEncoder{enc}
+	}
+	dm.Version = dumpVersion
+	dm.Header = newDumpHeader()
+	if opt.StandardEscape {
+		dm.Escape = escapeStandard
+	}
+	if opt.StringBignums {
+		dm.Bignums = bignumsString
+	}
+	if !opt.KeepSecrets && dm.Setting != nil {
+		dm.Setting = redactSecrets(dm.Setting)
+	}
+	engine := d
+	if opt.Context != nil {
+		d = ctxDumper{d, opt.Context}
+	}
+	if len(opt.Roots) > 0 {
+		if err = checkRootsOption(opt); err != nil {
+			return err
+		}
+		rd, err := newRootsDumper(d, root, opt.Roots)
+		if err != nil {
+			return err
+		}
+		d, root = rd, rootsIno
+	}
+	if opt.DirsOnly {
+		if len(opt.InodeRange) > 0 || opt.Since != nil || opt.Diff != nil {
+			return fmt.Errorf("directories only can only be dumped in a full dump")
+		}
+		d = dirsOnlyDumper{d}
+		dm.DirsOnly = true
+		dm.Sustained, dm.DelFiles = nil, nil
+	}
+	walked := d // the engine checked for the context
+	if opt.NoData {
+		d = noDataDumper{d}
+		dm.NoData = true
+	}
+	filter, err := newDumpFilter(opt.Exclude, opt.Include)
+	if err != nil {
+		return err
+	} else if filter != nil {
+		d = newFilterDumper(d, filter, root)
+	}
+	var pruned map[Ino]bool
+	if opt.SkipEmptyFiles || opt.SkipEmptyDirs {
+		if len(opt.InodeRange) > 0 || opt.Since != nil || opt.Diff != nil {
+			return fmt.Errorf("empty entries can only be skipped in a full dump")
+		}
+		pd := d
+		if filter != nil { // it forgets the listed directories, a new one for another walk
+			pd = newFilterDumper(walked, filter, root)
+		}
+		if pruned, err = findEmpty(pd, dm, root, opt); err != nil {
+			return err
+		}
+		d = pruneDumper{d, pruned}
+		if dm.Counters != nil {
+			pruneCounters(dm.Counters, pruned)
+		}
+	}
+	if opt.Counters != nil && dm.Counters != nil {
+		*opt.Counters = *dm.Counters
+	}
+	if opt.Data != nil {
+		if err = checkDataOption(dm, root, opt); err != nil {
+			return err
+		}
+		enc = newDataEncoder(enc, opt.Data, opt.MaxDataSize)
+		dm.WithData = true
+	}
+	dumpSustained(d, dm)
+	sortDeleted(dm)
+	if opt.Manifest != nil {
+		if err = checkManifestOption(opt); err != nil {
+			return err
+		}
+		if enc, err = newManifestEncoder(enc, opt.Manifest, dm); err != nil {
+			return err
+		}
+	}
+	if opt.Orphans != nil || opt.AdoptOrphans {
+		orphans, err := findOrphans(engine, dm, root, opt)
+		if err != nil {
+			return err
+		}
+		if opt.AdoptOrphans && len(orphans) > 0 {
+			if d, err = newOrphanDumper(d, dm, root, orphans); err != nil {
+				return err
+			}
+		}
+		if opt.Orphans != nil {
+			*opt.Orphans = orphans
+		}
+	}
+	if opt.VerifyData != nil {
+		if err = checkVerifyOption(opt); err != nil {
+			return err
+		}
+		vd := d
+		if filter != nil { // it forgets the listed directories, a new one for another walk
+			vd = pruneDumper{newFilterDumper(walked, filter, root), pruned}
+		}
+		missing, err := verifyData(vd, dm, root, opt)
+		if err != nil {
+			return err
+		}
+		if opt.MissingData != nil {
+			*opt.MissingData = missing
+		}
+	}
+	if opt.DirStats {
+		if len(opt.InodeRange) > 0 || opt.Since != nil || opt.Diff != nil {
+			return fmt.Errorf("dir stats can only be dumped in a full dump")
+		}
+		sd := d
+		if filter != nil {
+			sd = pruneDumper{newFilterDumper(walked, filter, root), pruned}
+		}
+		stats, err := countDirStats(sd, dm, root, opt)
+		if err != nil {
+			return err
+		}
+		d = dirStatsDumper{d, stats}
+	}
+	var version int64
+	var base map[Ino]bool
+	if len(opt.InodeRange) > 0 {
+		if len(opt.InodeRange) != 2 || opt.InodeRange[0] >= opt.InodeRange[1] {
+			return fmt.Errorf("invalid inode range: %v", opt.InodeRange)
+		}
+		if opt.Since != nil {
+			return fmt.Errorf("a delta dump can't be sharded")
+		}
+		dm.InodeRange = opt.InodeRange
+	} else if opt.Since != nil {
+		bm, err := decodeDump(opt.Since, false, opt.Encrypt)
+		if err != nil {
+			return fmt.Errorf("load base dump: %s", err)
+		}
+		if version, base, err = scanBase(bm); err != nil {
+			return err
+		}
+	} else if err = enc.writeMeta(dm); err != nil {
+		return err
+	}
+	tree, err := d.dumpEntry(root)
+	if err != nil {
+		return err
+	}
+	tree.Name = "FSTree"
+
+	var total int64 = 1 // root
+	var estimate int64
+	if dm.Counters != nil {
+		estimate = dm.Counters.UsedInodes + 1
+	}
+	bar := newProgress("Dump dir progress: ", estimate, opt.ProgressInterval, opt.Progress)
+	bar.Incr(1)
+	showProgress := func(totalIncr, currentIncr int64) {
+		total += totalIncr
+		bar.SetTotal(total)
+		bar.Incr(currentIncr)
+	}
+	f := newEntryFetcher(d, opt.Threads)
+	if base != nil {
+		err = dumpDeltaTree(f, dm, tree, enc, version, base, showProgress)
+	} else if dm.InodeRange != nil {
+		err = dumpShardTree(f, dm, tree, enc, showProgress)
+	} else {
+		err = dumpDir(f, tree, enc, showProgress)
+	}
+	if err == errSampled {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if bar.Current() != total && sample == nil {
+		logger.Warnf("Dumped %d / total %d, some entries are not dumped", bar.Current(), total)
+	}
+	bar.Done()
+	if err = enc.finish(); err != nil {
+		return err
+	}
+	if err = cw.Close(); err != nil {
+		return err
+	}
+	if err = ew.Close(); err != nil {
+		return err
+	}
+	if sample != nil {
+		opt.Estimate.project(sample.written, sampled.n, time.Since(start), dm.Counters, withData)
+	}
+	return nil
+}
+
+// dumpFrame is a directory being dumped by dumpDir, whose children after the i-th are not yet.
+type dumpFrame struct {
+	entries []*Entry
+	next    func() (*DumpedEntry, error)
+	done    chan struct{}
+	i       int
+}
+
+// dumpDir writes tree and everything under it in depth-first order, the children of every
+// directory are sorted by name. The directories being dumped are kept in a stack but not the
+// goroutine stack, so that the depth of the tree is only bounded by the memory.
+func dumpDir(f *entryFetcher, tree *DumpedEntry, enc dumpEncoder, showProgress func(totalIncr, currentIncr int64)) error {
+	var stack []*dumpFrame
+	defer func() {
+		for _, d := range stack {
+			close(d.done)
+		}
+	}()
+	// begin writes dir, and pushes it into the stack unless it's empty
+	begin := func(dir *DumpedEntry) (bool, error) {
+		entries, err := f.d.dumpDir(dir.Attr.Inode)
+		if err != nil {
+			return false, err
+		}
+		if showProgress != nil {
+			showProgress(int64(len(entries)), 0)
+		}
+		if len(entries) == 0 {
+			return false, enc.writeEntry(dir)
+		}
+		sort.Slice(entries, func(i, j int) bool { return string(entries[i].Name) < string(entries[j].Name) })
+		if err = enc.beginDir(dir, len(entries)); err != nil {
+			return false, err
+		}
+		done := make(chan struct{})
+		stack = append(stack, &dumpFrame{entries: entries, next: f.fetch(entries, done), done: done})
+		return true, nil
+	}
+	if _, err := begin(tree); err != nil {
+		return err
+	}
+	for len(stack) > 0 {
+		d := stack[len(stack)-1]
+		if d.i == len(d.entries) {
+			stack = stack[:len(stack)-1]
+			close(d.done)
+			if err := enc.endDir(); err != nil {
+				return err
+			}
+			if len(stack) > 0 && showProgress != nil { // the directory is done in its parent
+				showProgress(0, 1)
+			}
+			continue
+		}
+		e := d.entries[d.i]
+		d.i++
+		entry, err := d.next()
+		if err != nil {
+			return err
+		}
+		entry.Name = string(e.Name)
+		pushed := false
+		if e.Attr.Typ == TypeDirectory {
+			pushed, err = begin(entry)
+		} else {
+			err = enc.writeEntry(entry)
+		}
+		if err != nil {
+			return err
+		}
+		if !pushed && showProgress != nil {
+			showProgress(0, 1)
+		}
+	}
+	return nil
+}
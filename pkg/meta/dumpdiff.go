@@ -0,0 +1,198 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DiffDumps compares two full dumps without any volume, e.g. the backups of two days, and lists
+// the entries added, removed and changed in the dump to since the one from, with the change of
+// the total length of files. Unlike a diff with the live tree, the entries are aligned by path,
+// so a renamed entry is removed at the old path and added at the new one, and a hard linked file
+// is compared at each of its paths. An entry of another type at the same path is removed and
+// added too. Both dumps are read entry by entry at the same time, which are in depth-first order
+// with the names sorted in every directory, as written by DumpMeta, so only the diff and the
+// hard linked files are kept in memory.
+func DiffDumps(from, to *DumpReader) (*DumpedDiff, error) {
+	for _, r := range []*DumpReader{from, to} {
+		if r.Meta.BaseVersion != 0 || r.Meta.InodeRange != nil {
+			return nil, fmt.Errorf("only full dumps can be compared")
+		}
+	}
+	oc, nc := &diffCursor{r: from, linked: make(map[Ino]bool)}, &diffCursor{r: to, linked: make(map[Ino]bool)}
+	if err := oc.next(); err != nil {
+		return nil, err
+	}
+	if err := nc.next(); err != nil {
+		return nil, err
+	}
+	diff := &DumpedDiff{Added: []*DumpedChange{}, Removed: []*DumpedChange{}, Changed: []*DumpedChange{}}
+	removed := func(e *DumpedEntry, p string) {
+		diff.Removed = append(diff.Removed, &DumpedChange{Inode: e.Attr.Inode, Type: e.Attr.Type, Path: p, SizeDelta: -fileLength(e.Attr)})
+	}
+	added := func(e *DumpedEntry, p string) {
+		diff.Added = append(diff.Added, &DumpedChange{Inode: e.Attr.Inode, Type: e.Attr.Type, Path: p, SizeDelta: fileLength(e.Attr)})
+	}
+	for oc.e != nil || nc.e != nil {
+		var c int
+		if oc.e == nil {
+			c = 1
+		} else if nc.e != nil {
+			c = comparePaths(oc.p, nc.p)
+		} else {
+			c = -1
+		}
+		switch {
+		case c < 0:
+			removed(oc.e, oc.p)
+		case c > 0:
+			added(nc.e, nc.p)
+		case oc.e.Attr.Type != nc.e.Attr.Type:
+			removed(oc.e, oc.p)
+			added(nc.e, nc.p)
+		default:
+			if ch := compareEntries(oc.e, nc.e, nc.p); ch != nil {
+				diff.Changed = append(diff.Changed, ch)
+			}
+		}
+		if c <= 0 {
+			if err := oc.next(); err != nil {
+				return nil, err
+			}
+		}
+		if c >= 0 {
+			if err := nc.next(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	diff.SizeDelta = nc.size - oc.size
+	logger.Infof("Compared the dumps: %d added, %d removed and %d changed", len(diff.Added), len(diff.Removed), len(diff.Changed))
+	return diff, nil
+}
+
+// diffCursor is the current entry of a dump being compared, e is nil after the last one. The
+// length of every file read is added into size, a hard linked one only once.
+type diffCursor struct {
+	r      *DumpReader
+	e      *DumpedEntry
+	p      string
+	size   int64
+	linked map[Ino]bool
+}
+
+func (c *diffCursor) next() error {
+	e, p, err := c.r.Next()
+	if err == io.EOF {
+		c.e = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if c.e != nil && comparePaths(c.p, p) >= 0 {
+		return fmt.Errorf("%s is not after %s in the dump, the entries are not sorted", p, c.p)
+	}
+	c.e, c.p = e, p
+	if a := e.Attr; a.Nlink > 1 && a.Type == "regular" {
+		if c.linked[a.Inode] {
+			return nil
+		}
+		c.linked[a.Inode] = true
+	}
+	c.size += fileLength(e.Attr)
+	return nil
+}
+
+// comparePaths compares two paths by their names one by one, which is the depth-first order of
+// a dump, e.g. "/a/b" is before "/a.c", since "a" is before "a.c".
+func comparePaths(a, b string) int {
+	a, b = strings.TrimPrefix(a, "/"), strings.TrimPrefix(b, "/")
+	for a != "" && b != "" {
+		var na, nb string
+		na, a = cutName(a)
+		nb, b = cutName(b)
+		if na != nb {
+			return strings.Compare(na, nb)
+		}
+	}
+	if a == b {
+		return 0
+	} else if a == "" {
+		return -1
+	}
+	return 1
+}
+
+func cutName(p string) (name, rest string) {
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+func fileLength(a *DumpedAttr) int64 {
+	if a.Type != "regular" {
+		return 0
+	}
+	return int64(a.Length)
+}
+
+// compareEntries returns the change of an entry of the same type at p, or nil if nothing of it is
+// changed. Besides diffAttrs, the inode, the target of a symlink and the xattrs are compared.
+func compareEntries(o, n *DumpedEntry, p string) *DumpedChange {
+	c := &DumpedChange{Inode: n.Attr.Inode, Type: n.Attr.Type, Path: p, SizeDelta: fileLength(n.Attr) - fileLength(o.Attr)}
+	if o.Attr.Inode != n.Attr.Inode {
+		c.Fields = append(c.Fields, &DumpedAttrChange{"inode", o.Attr.Inode, n.Attr.Inode})
+	}
+	for _, f := range diffAttrs {
+		if ov, nv := f.value(o.Attr), f.value(n.Attr); ov != nv {
+			c.Fields = append(c.Fields, &DumpedAttrChange{f.name, ov, nv})
+		}
+	}
+	if o.Symlink != n.Symlink {
+		c.Fields = append(c.Fields, &DumpedAttrChange{"symlink", o.Symlink, n.Symlink})
+	}
+	if ox, nx := xattrMap(o.Xattrs), xattrMap(n.Xattrs); !equalXattrs(ox, nx) {
+		c.Fields = append(c.Fields, &DumpedAttrChange{"xattrs", ox, nx})
+	}
+	if len(c.Fields) == 0 {
+		return nil
+	}
+	return c
+}
+
+func xattrMap(xattrs []*DumpedXattr) map[string]string {
+	m := make(map[string]string, len(xattrs))
+	for _, x := range xattrs {
+		m[x.Name] = x.Value
+	}
+	return m
+}
+
+func equalXattrs(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
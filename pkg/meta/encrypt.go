@@ -0,0 +1,225 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// An encrypted dump starts with a header of encryptMagic, the KDF (0 for a raw key, or
+// log2(N) of scrypt with r=8 and p=1), a salt of 16 bytes and a nonce prefix of 4 bytes.
+// The (compressed) dump follows in chunks of at most encryptChunkSize bytes, every chunk is
+// sealed by AES-256-GCM as the length of ciphertext (4 bytes in big endian) and ciphertext.
+// The nonce of a chunk is the prefix followed by its index, and the header and whether it's
+// the last chunk are authenticated with it, so the chunks can't be reordered or truncated.
+const (
+	encryptMagic     = "JFSCRYPT"
+	encryptHeaderLen = len(encryptMagic) + 1 + 16 + 4
+	encryptChunkSize = 64 << 10
+	scryptLogN       = 15
+)
+
+// DumpKey is the secret to encrypt or decrypt a dump, either a passphrase or a raw key of 32 bytes.
+type DumpKey struct {
+	Passphrase string
+	Key        []byte
+}
+
+var errNoDumpKey = errors.New("the dump is encrypted, please provide the passphrase or key")
+
+func (k *DumpKey) aead(kdf byte, salt []byte) (cipher.AEAD, error) {
+	key := k.Key
+	if kdf == 0 {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("the key should be 32 bytes, but got %d", len(key))
+		}
+	} else {
+		if k.Passphrase == "" {
+			return nil, fmt.Errorf("the dump is encrypted with a passphrase, but it's not provided")
+		}
+		var err error
+		if key, err = scrypt.Key([]byte(k.Passphrase), salt, 1<<kdf, 8, 1, 32); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptNonce(prefix []byte, index uint64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[4:], index)
+	return nonce
+}
+
+func encryptAD(header []byte, last bool) []byte {
+	ad := append([]byte{}, header...)
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	index  uint64
+	buf    []byte
+}
+
+// newEncryptWriter returns a writer encrypting everything written into w by key, it must
+// be closed to write the last chunk, but w is left open.
+func newEncryptWriter(w io.Writer, key *DumpKey) (io.WriteCloser, error) {
+	if key == nil {
+		return nopWriteCloser{w}, nil
+	}
+	header := make([]byte, encryptHeaderLen)
+	copy(header, encryptMagic)
+	if _, err := rand.Read(header[len(encryptMagic)+1:]); err != nil {
+		return nil, err
+	}
+	if key.Key == nil {
+		header[len(encryptMagic)] = scryptLogN
+	}
+	aead, err := key.aead(header[len(encryptMagic)], header[len(encryptMagic)+1:encryptHeaderLen-4])
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, header: header, buf: make([]byte, 0, encryptChunkSize)}, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(make([]byte, 4, 4+len(e.buf)+e.aead.Overhead()), encryptNonce(e.header[encryptHeaderLen-4:], e.index),
+		e.buf, encryptAD(e.header, last))
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if len(e.buf) == encryptChunkSize {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(e.buf[len(e.buf):encryptChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) Close() error { return e.seal(true) }
+
+type decryptReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	index  uint64
+	buf    []byte // decrypted but not read
+	last   bool
+	err    error // kept to be returned by every Read, a chunk can't be read again
+}
+
+// newDecryptReader returns a reader of the decrypted stream if br is encrypted, or br itself.
+// Any chunk failed to be authenticated is an error, the dump is never decrypted to garbage.
+func newDecryptReader(br *bufio.Reader, key *DumpKey) (io.Reader, error) {
+	if magic, _ := br.Peek(len(encryptMagic)); string(magic) != encryptMagic {
+		return br, nil
+	}
+	if key == nil {
+		return nil, errNoDumpKey
+	}
+	header := make([]byte, encryptHeaderLen)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("read header of encrypted dump: %s", err)
+	}
+	aead, err := key.aead(header[len(encryptMagic)], header[len(encryptMagic)+1:encryptHeaderLen-4])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: br, aead: aead, header: header}, nil
+}
+
+func (d *decryptReader) open() error {
+	var size [4]byte
+	if _, err := io.ReadFull(d.r, size[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("the encrypted dump is truncated")
+		}
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > uint32(encryptChunkSize+d.aead.Overhead()) {
+		return fmt.Errorf("invalid size of encrypted chunk %d: %d", d.index, n)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return fmt.Errorf("the encrypted dump is truncated")
+	}
+	nonce := encryptNonce(d.header[encryptHeaderLen-4:], d.index)
+	var err error
+	if d.buf, err = d.aead.Open(nil, nonce, sealed, encryptAD(d.header, false)); err != nil {
+		if d.buf, err = d.aead.Open(nil, nonce, sealed, encryptAD(d.header, true)); err != nil {
+			return fmt.Errorf("authentication of encrypted chunk %d failed, the key is wrong or the dump is corrupted", d.index)
+		}
+		d.last = true
+	}
+	d.index++
+	return nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.last {
+			if n, _ := d.r.Read(make([]byte, 1)); n > 0 {
+				return 0, fmt.Errorf("unexpected data after the last encrypted chunk")
+			}
+			return 0, io.EOF
+		}
+		if d.err == nil {
+			d.err = d.open()
+		}
+		if d.err != nil {
+			return 0, d.err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
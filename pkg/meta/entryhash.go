@@ -0,0 +1,119 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// entryHash returns the SHA-256 of the metadata of e in hex: its attr, symlink, xattrs and
+// chunks, but not its children, which are hashed by their own entries, nor its name, so a
+// renamed entry is not found. The xattrs are sorted by name and the data of slices is left out,
+// so the hash is the same however the entry is written into a dump or read back from it. It's
+// not keyed, so it finds the entries corrupted in a dump, but not the ones tampered with, whose
+// hashes can be computed again.
+func entryHash(e *DumpedEntry) string {
+	xattrs := append([]*DumpedXattr(nil), e.Xattrs...)
+	sort.SliceStable(xattrs, func(i, j int) bool { return xattrs[i].Name < xattrs[j].Name })
+	chunks := make([]*DumpedChunk, len(e.Chunks))
+	for i, c := range e.Chunks {
+		slices := make([]*DumpedSlice, len(c.Slices))
+		for j, s := range c.Slices {
+			copied := *s
+			copied.Data = nil
+			slices[j] = &copied
+		}
+		chunks[i] = &DumpedChunk{c.Index, slices}
+	}
+	data, err := json.Marshal(struct {
+		Attr    *DumpedAttr
+		Symlink string
+		Xattrs  []*DumpedXattr
+		Chunks  []*DumpedChunk
+	}{e.Attr, e.Symlink, xattrs, chunks})
+	if err != nil {
+		panic(err) // never fails for these types
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashEncoder sets the hash of every entry before it's written, see entryHash.
+type hashEncoder struct {
+	dumpEncoder
+}
+
+func (h hashEncoder) writeEntry(e *DumpedEntry) error {
+	e.Hash = entryHash(e)
+	return h.dumpEncoder.writeEntry(e)
+}
+
+func (h hashEncoder) beginDir(e *DumpedEntry, n int) error {
+	e.Hash = entryHash(e)
+	return h.dumpEncoder.beginDir(e, n)
+}
+
+// checkEntries checks the hash of every entry in dm, which must be dumped with them, and
+// reports the ones corrupted in the dump, whose metadata doesn't match the hash, or added into
+// it without one.
+func checkEntries(dm *DumpedMeta) error {
+	trees := make(map[string]*DumpedEntry, len(dm.Roots)+1)
+	if dm.FSTree != nil {
+		trees["/"] = dm.FSTree
+	}
+	for name, e := range dm.Roots {
+		trees[name+":/"] = e
+	}
+	var total, hashed int
+	var corrupted []string
+	var walk func(p string, e *DumpedEntry)
+	walk = func(p string, e *DumpedEntry) {
+		total++
+		if e.Hash == "" {
+			corrupted = append(corrupted, fmt.Sprintf("%s: no hash", p))
+		} else if e.Attr == nil {
+			corrupted = append(corrupted, fmt.Sprintf("%s: no attr", p))
+		} else if sum := entryHash(e); sum != e.Hash {
+			hashed++
+			corrupted = append(corrupted, fmt.Sprintf("%s (inode %d): hash %s is recorded but got %s", p, e.Attr.Inode, e.Hash, sum))
+		} else {
+			hashed++
+		}
+		for name, c := range e.Entries {
+			walk(path.Join(p, name), c)
+		}
+	}
+	for p, e := range trees {
+		walk(p, e)
+	}
+	if hashed == 0 && total > 0 {
+		return fmt.Errorf("no hash of entries in the dump, it should be dumped with per-entry hashes")
+	}
+	sort.Strings(corrupted)
+	for _, c := range corrupted {
+		logger.Warnf("Corrupted entry %s", c)
+	}
+	if len(corrupted) > 0 {
+		return fmt.Errorf("%d of %d entries are corrupted in the dump, nothing is loaded", len(corrupted), total)
+	}
+	logger.Infof("Checked the hashes of %d entries", total)
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+)
+
+// A name can be any bytes, but a JSON string can only be UTF-8, invalid bytes are replaced
+// by U+FFFD silently. So names are escaped in JSON and ndjson dumps since escapeVersion, a
+// name of valid UTF-8 without '%' is kept as is, otherwise every '%' and every byte not in
+// a valid UTF-8 sequence is replaced by %XX. Binary dumps keep the raw bytes.
+const escapeVersion = 6
+
+// escape returns a clean name as is, which it checks by a scan of bytes first, since almost all
+// names are ASCII without '%'. Only the rest of a name from its first special byte is decoded.
+func escape(name string) string {
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c == '%' {
+			return escapeFrom(name, i)
+		} else if c >= utf8.RuneSelf {
+			if rest := name[i:]; utf8.ValidString(rest) && strings.IndexByte(rest, '%') < 0 {
+				return name
+			}
+			return escapeFrom(name, i)
+		}
+	}
+	return name
+}
+
+const upperHex = "0123456789ABCDEF"
+
+// escapeFrom escapes name, the bytes before i have nothing to be escaped.
+func escapeFrom(name string, i int) string {
+	var b strings.Builder
+	b.Grow(len(name) + 8)
+	b.WriteString(name[:i])
+	for i < len(name) {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		if r == '%' || r == utf8.RuneError && size == 1 { // a valid U+FFFD is 3 bytes
+			b.WriteByte('%')
+			b.WriteByte(upperHex[name[i]>>4])
+			b.WriteByte(upperHex[name[i]&0xF])
+		} else {
+			b.WriteString(name[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// unescape reverses escape, a '%' not followed by two hex digits is kept as is.
+func unescape(s string) string {
+	if !strings.ContainsRune(s, '%') {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+3 <= len(s) {
+			if c, err := hex.DecodeString(s[i+1 : i+3]); err == nil {
+				b = append(b, c[0])
+				i += 2
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// unescapeTree unescapes the names of all the entries under e by unescape, which are decoded from JSON.
+func unescapeTree(e *DumpedEntry, unescape func(string) string) {
+	stack := []*DumpedEntry{e}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if len(e.Entries) == 0 {
+			continue
+		}
+		entries := make(map[string]*DumpedEntry, len(e.Entries))
+		for name, c := range e.Entries {
+			c.Name = unescape(name)
+			entries[c.Name] = c
+			stack = append(stack, c)
+		}
+		e.Entries = entries
+	}
+}
+
+// Some tools can't read the %XX escaping, so DumpOption.StandardEscape writes every name of valid
+// UTF-8 as is instead, which is quoted by the standard escaping of encoding/json, as anything else
+// in the dump; such a dump has escapeStandard in Escape since escapeStandardVersion. A name which
+// is not valid UTF-8 can't be in a JSON string, it's in URL-safe base64 after base64NameTag
+// instead, which has no '/' to be split in a path. The tag starts with a NUL, which is never in
+// a name in a file system, a name with the tag is in base64 too anyway.
+const (
+	escapeStandard        = "json"
+	escapeStandardVersion = 8
+	base64NameTag         = "\x00base64:"
+)
+
+// escapeJSON returns name as is if it's valid UTF-8, otherwise it's tagged in base64.
+func escapeJSON(name string) string {
+	if utf8.ValidString(name) && !strings.HasPrefix(name, base64NameTag) {
+		return name
+	}
+	return base64NameTag + base64.URLEncoding.EncodeToString([]byte(name))
+}
+
+// unescapeJSON reverses escapeJSON for a name or every name in a path, a tagged name of invalid
+// base64 is kept as is.
+func unescapeJSON(s string) string {
+	if !strings.Contains(s, base64NameTag) {
+		return s
+	}
+	names := strings.Split(s, "/")
+	for i, name := range names {
+		if !strings.HasPrefix(name, base64NameTag) {
+			continue
+		}
+		if b, err := base64.URLEncoding.DecodeString(name[len(base64NameTag):]); err == nil {
+			names[i] = string(b)
+		}
+	}
+	return strings.Join(names, "/")
+}
+
+// nameEscaper returns the function to escape the names in a dump by opt.
+func nameEscaper(opt DumpOption) func(string) string {
+	if opt.StandardEscape {
+		return escapeJSON
+	}
+	return escape
+}
+
+// nameUnescaper returns the function to unescape the names decoded from a dump of dm, which must
+// be called before dm is upgraded, or nil if the names are not escaped.
+func nameUnescaper(dm *DumpedMeta) func(string) string {
+	if dm.Escape == escapeStandard {
+		return unescapeJSON
+	} else if dm.Version >= escapeVersion {
+		return unescape
+	}
+	return nil
+}
+
+// jsonString quotes s as a JSON string, with <, > and & kept for readability.
+func jsonString(s string) string {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
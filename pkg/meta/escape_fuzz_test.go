@@ -0,0 +1,40 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+// go test -run none -fuzz FuzzEscape ./pkg/meta
+func FuzzEscape(f *testing.F) {
+	for _, name := range escapeNames {
+		f.Add([]byte(name))
+	}
+	f.Fuzz(func(t *testing.T, name []byte) {
+		escaped := escape(string(name))
+		if !utf8.ValidString(escaped) {
+			t.Fatalf("escape %q: %q is not valid UTF-8", name, escaped)
+		}
+		if got := unescape(escaped); got != string(name) {
+			t.Fatalf("escape %q: %q -> %q", name, escaped, got)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DumpEstimate is the projection of a dump from a sample of it: the first Sample entries are
+// dumped as usual, with the same format, compression, encryption and threads, but into nowhere,
+// and the size and time of the whole dump are projected from their average per entry and the
+// used inodes in the counters. The first entries in depth-first order may not be typical of the
+// rest, e.g. a tree of small directories and another one of large files, so a larger sample
+// gives a better estimate.
+type DumpEstimate struct {
+	Sample   int64         // entries to be sampled, 1000 by default
+	Sampled  int64         // entries dumped in the sample, the whole tree if there are fewer
+	Entries  int64         // entries in the dump projected by the counters
+	Bytes    int64         // written by the sample, after compression and encryption
+	Elapsed  time.Duration // by the sample
+	Size     int64         // projected size of the dump, with the used space for the data if any
+	Duration time.Duration // projected time of the dump
+}
+
+const defaultEstimateSample = 1000
+
+// errSampled stops the walk of a dump once the sample of an estimate is taken.
+var errSampled = errors.New("sampled")
+
+// checkEstimateOption refuses the options of a dump which walk the tree before dumping, which is
+// what an estimate is to avoid, or which don't write a dump.
+func checkEstimateOption(opt DumpOption) error {
+	if opt.Since != nil || opt.Diff != nil || len(opt.InodeRange) > 0 {
+		return fmt.Errorf("only a full dump can be estimated")
+	}
+	if opt.Orphans != nil || opt.AdoptOrphans || opt.VerifyData != nil || opt.DirStats || opt.SkipEmptyFiles || opt.SkipEmptyDirs {
+		return fmt.Errorf("a dump walking the tree before dumping can't be estimated")
+	}
+	return nil
+}
+
+// sampleEncoder stops the dump with errSampled after n entries are written.
+type sampleEncoder struct {
+	dumpEncoder
+	n, written int64
+}
+
+func (s *sampleEncoder) writeEntry(e *DumpedEntry) error {
+	if s.written >= s.n {
+		return errSampled
+	}
+	s.written++
+	return s.dumpEncoder.writeEntry(e)
+}
+
+func (s *sampleEncoder) beginDir(e *DumpedEntry, n int) error {
+	if s.written >= s.n {
+		return errSampled
+	}
+	s.written++
+	return s.dumpEncoder.beginDir(e, n)
+}
+
+// project fills the estimate with the sample, which wrote bytes in elapsed. The used space in cs
+// is added to the size if withData, the data is not read by the sample.
+func (est *DumpEstimate) project(sampled, bytes int64, elapsed time.Duration, cs *DumpedCounters, withData bool) {
+	est.Sampled, est.Bytes, est.Elapsed = sampled, bytes, elapsed
+	est.Entries = sampled
+	if cs != nil && cs.UsedInodes+1 > sampled && sampled == est.Sample {
+		est.Entries = cs.UsedInodes + 1 // and the root
+	}
+	est.Size, est.Duration = bytes, elapsed
+	if sampled > 0 {
+		est.Size = bytes * est.Entries / sampled
+		est.Duration = time.Duration(float64(elapsed) * float64(est.Entries) / float64(sampled))
+	}
+	if withData && cs != nil {
+		est.Size += cs.UsedSpace
+	}
+}
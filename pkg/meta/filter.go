@@ -0,0 +1,242 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A pattern of DumpOption.Exclude and Include is matched against the path of an entry relative
+// to the dumped root, like "d1/f11". A glob without '/' matches the name at any depth, e.g.
+// "*.tmp", otherwise it matches the whole path, in which "*" and "?" never match a '/' and "**"
+// matches any number of directories, e.g. "**/node_modules/**" matches node_modules at any depth
+// and everything under it. A pattern with prefix "re:" is a regular expression matched against
+// the path, it's not anchored unless "^" or "$" is used.
+//
+// An entry matching any exclude is dropped, with the whole subtree under it for a directory, even
+// if it matches an include. If there are includes, a file is kept only if it or a directory above
+// it matches one of them; other directories are still walked and kept, so that the path to every
+// included file is dumped.
+type dumpFilter struct {
+	exclude, include []func(p string) bool
+}
+
+// newDumpFilter compiles the patterns, nil is returned if there is none.
+func newDumpFilter(exclude, include []string) (*dumpFilter, error) {
+	if len(exclude) == 0 && len(include) == 0 {
+		return nil, nil
+	}
+	f := &dumpFilter{}
+	for _, ps := range []struct {
+		patterns []string
+		matchers *[]func(p string) bool
+	}{{exclude, &f.exclude}, {include, &f.include}} {
+		for _, p := range ps.patterns {
+			m, err := compilePattern(p)
+			if err != nil {
+				return nil, err
+			}
+			*ps.matchers = append(*ps.matchers, m)
+		}
+	}
+	return f, nil
+}
+
+func compilePattern(p string) (func(p string) bool, error) {
+	if strings.HasPrefix(p, "re:") {
+		re, err := regexp.Compile(p[3:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", p, err)
+		}
+		return re.MatchString, nil
+	}
+	if p = strings.TrimPrefix(p, "/"); p == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	if !strings.Contains(p, "/") {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", p, err)
+		}
+		return func(s string) bool {
+			ok, _ := path.Match(p, path.Base(s))
+			return ok
+		}, nil
+	}
+	re, err := globToRegexp(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %s", p, err)
+	}
+	return re.MatchString, nil
+}
+
+// globToRegexp converts a glob of a whole path to an anchored regular expression.
+func globToRegexp(p string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], "**/"): // zero or more directories
+			b.WriteString("(.*/)?")
+			i += 2
+		case p[i:] == "/**": // the directory itself and everything under it
+			b.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(p[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("unclosed [")
+			}
+			class := p[i+1 : i+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += j
+		case c == '\\' && i+1 < len(p):
+			i++
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func matchAny(matchers []func(p string) bool, p string) bool {
+	for _, m := range matchers {
+		if m(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// match tells if the entry at p is dumped, and whether it's included, for a directory the
+// entries under it are included too. An entry under an included directory is only checked
+// against the excludes.
+func (f *dumpFilter) match(p string, isDir, underIncluded bool) (keep bool, included bool) {
+	if matchAny(f.exclude, p) {
+		return false, false
+	}
+	if underIncluded || len(f.include) == 0 || matchAny(f.include, p) {
+		return true, true
+	}
+	return isDir, false
+}
+
+// filteredDir is a directory kept by dumpFilter, whose children are not listed yet.
+type filteredDir struct {
+	path     string
+	included bool
+}
+
+// filterDumper drops the children of directories excluded by the filter when they are listed,
+// so an excluded subtree is never read. Every directory is listed once by the tree walk, so only
+// the ones kept but not listed yet are remembered.
+type filterDumper struct {
+	dumper
+	f    *dumpFilter
+	mu   sync.Mutex
+	dirs map[Ino]filteredDir
+}
+
+func newFilterDumper(d dumper, f *dumpFilter, root Ino) *filterDumper {
+	return &filterDumper{dumper: d, f: f, dirs: map[Ino]filteredDir{root: {included: len(f.include) == 0}}}
+}
+
+func (d *filterDumper) dumpDir(inode Ino) ([]*Entry, error) {
+	entries, err := d.dumper.dumpDir(inode)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dir := d.dirs[inode]
+	delete(d.dirs, inode)
+	kept := entries[:0]
+	for _, e := range entries {
+		p := path.Join(dir.path, string(e.Name))
+		isDir := e.Attr.Typ == TypeDirectory
+		keep, included := d.f.match(p, isDir, dir.included)
+		if !keep {
+			continue
+		}
+		if isDir {
+			d.dirs[e.Inode] = filteredDir{p, included}
+		}
+		kept = append(kept, e)
+	}
+	return kept, nil
+}
+
+// summary is GetSummary of the entries under inode at p kept by the filter, inode itself is not
+// checked. A file with hard links is counted once, they're added into linked.
+func (f *dumpFilter) summary(m Meta, inode Ino, p string, included bool, linked map[Ino]bool, summary *Summary) syscall.Errno {
+	var attr Attr
+	if st := m.GetAttr(Background, inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ != TypeDirectory {
+		return GetSummary(m, Background, inode, summary)
+	}
+	var entries []*Entry
+	if st := m.Readdir(Background, inode, 1, &entries); st != 0 {
+		return st
+	}
+	for _, e := range entries {
+		if e.Inode == inode || len(e.Name) == 2 && bytes.Equal(e.Name, []byte("..")) {
+			continue
+		}
+		cp := path.Join(p, string(e.Name))
+		isDir := e.Attr.Typ == TypeDirectory
+		keep, inc := f.match(cp, isDir, included)
+		if !keep {
+			continue
+		}
+		if isDir {
+			if st := f.summary(m, e.Inode, cp, inc, linked, summary); st != 0 {
+				return st
+			}
+			continue
+		}
+		if e.Attr.Nlink > 1 {
+			if linked[e.Inode] {
+				continue
+			}
+			linked[e.Inode] = true
+		}
+		summary.Files++
+		summary.Length += e.Attr.Length
+		summary.Size += uint64(align4K(e.Attr.Length))
+	}
+	summary.Dirs++
+	summary.Size += 4096
+	return 0
+}
@@ -0,0 +1,100 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// IDMap maps the uids or gids of the loaded entries, e.g. of a dump from a cluster where the
+// users have different ids, like rsync --usermap.
+type IDMap struct {
+	// IDs maps a dumped id to the loaded one, several ids can be mapped to the same one
+	IDs map[uint32]uint32
+	// Default is the one every id not in IDs is mapped to if set, or they're kept as is
+	Default *uint32
+}
+
+// ParseIDMap reads a map of ids, one "SRC:DST" in every line, SRC can be "*" for the default
+// of the unmapped ids. Empty lines and the ones starting with "#" are ignored.
+func ParseIDMap(r io.Reader) (*IDMap, error) {
+	m := &IDMap{IDs: make(map[uint32]uint32)}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ps := strings.Split(line, ":")
+		if len(ps) != 2 {
+			return nil, fmt.Errorf("line %d: %q is not SRC:DST", n, line)
+		}
+		dst, err := strconv.ParseUint(strings.TrimSpace(ps[1]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid id %q", n, ps[1])
+		}
+		id := uint32(dst)
+		if src := strings.TrimSpace(ps[0]); src == "*" {
+			if m.Default != nil {
+				return nil, fmt.Errorf("line %d: default is mapped again", n)
+			}
+			m.Default = &id
+		} else if v, err := strconv.ParseUint(src, 10, 32); err != nil {
+			return nil, fmt.Errorf("line %d: invalid id %q", n, ps[0])
+		} else if _, ok := m.IDs[uint32(v)]; ok {
+			return nil, fmt.Errorf("line %d: id %d is mapped again", n, v)
+		} else {
+			m.IDs[uint32(v)] = id
+		}
+	}
+	return m, s.Err()
+}
+
+// Map returns the id mapped from id, m can be nil to keep all of them.
+func (m *IDMap) Map(id uint32) uint32 {
+	if m == nil {
+		return id
+	}
+	if v, ok := m.IDs[id]; ok {
+		return v
+	}
+	if m.Default != nil {
+		return *m.Default
+	}
+	return id
+}
+
+// mapOwners maps the owners of all the entries in dm by opt.UidMap and opt.GidMap.
+func mapOwners(dm *DumpedMeta, opt LoadOption) {
+	if dm.FSTree == nil || opt.UidMap == nil && opt.GidMap == nil {
+		return
+	}
+	var walk func(e *DumpedEntry)
+	walk = func(e *DumpedEntry) {
+		if e.Attr != nil {
+			e.Attr.Uid = opt.UidMap.Map(e.Attr.Uid)
+			e.Attr.Gid = opt.GidMap.Map(e.Attr.Gid)
+		}
+		for _, c := range e.Entries {
+			walk(c)
+		}
+	}
+	walk(dm.FSTree)
+}
@@ -0,0 +1,347 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+	"sort"
+)
+
+// An index of a dump maps the path of every entry in it to its inode and the offset of its
+// record in the dump, and back from an inode to its paths. All the integers are big endian:
+//
+//	header   magic "JFSINDEX", version uint32 (1), format uint32 (0 for JSON, 1 for ndjson),
+//	         count uint64, size of paths uint64 (32 bytes)
+//	paths    count records of 28 bytes sorted by path, each of which is the offset of the
+//	         path in the pool uint64, length of the path uint32, inode uint64, offset uint64
+//	inodes   count positions uint64 of the records in paths, sorted by inode and then path
+//	pool     the paths, "/" for the root and "/d1/f11" for others, not escaped
+//	crc32    IEEE of everything above uint32
+//
+// The offset is the position in the dump after it's decrypted and decompressed, which is the
+// one in the file for a plain dump. In JSON the record starts with the key of the entry at the
+// first byte after it which is not a ',' or white space, or it's the FSTree for the root; in
+// ndjson it's the line of the entry. A hard linked file has one record for each of its paths.
+const (
+	indexMagic      = "JFSINDEX"
+	indexVersion    = 1
+	indexHeaderSize = 32
+	indexRecordSize = 28
+)
+
+// IndexEntry is a record in an index of a dump.
+type IndexEntry struct {
+	Path   string
+	Inode  Ino
+	Offset int64
+}
+
+// offsetWriter counts the bytes written through it.
+type offsetWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	o.n += int64(n)
+	return n, err
+}
+
+// bufferedEncoder is an encoder which buffers what's written before it reaches the writer.
+type bufferedEncoder interface {
+	buffered() int
+}
+
+func (j *jsonEncoder) buffered() int {
+	if j.bw == nil {
+		return 0
+	}
+	return j.bw.Buffered()
+}
+
+func (n *ndjsonEncoder) buffered() int { return n.bw.Buffered() }
+
+// indexEncoder records the path, inode and offset of every entry written through it, and writes
+// them as an index when finished. It must wrap the encoder writing into ow directly, so that the
+// offset is the bytes written into ow and buffered in it. All records are kept in memory until
+// they're sorted.
+type indexEncoder struct {
+	dumpEncoder
+	ow      *offsetWriter
+	w       io.Writer // of the index
+	format  uint32
+	dirs    []string // path of current directory and its parents
+	entries []IndexEntry
+}
+
+func newIndexEncoder(enc dumpEncoder, ow *offsetWriter, w io.Writer, opt DumpOption) (*indexEncoder, error) {
+	var format uint32
+	switch opt.Format {
+	case "", "json":
+	case "ndjson":
+		format = 1
+	default: // gob values can't be decoded without the types before them
+		return nil, fmt.Errorf("an index is only for a dump in JSON or ndjson")
+	}
+	if opt.Diff != nil {
+		return nil, fmt.Errorf("a diff can't be indexed")
+	}
+	if _, ok := enc.(bufferedEncoder); !ok {
+		return nil, fmt.Errorf("entries of %T can't be indexed", enc)
+	}
+	return &indexEncoder{dumpEncoder: enc, ow: ow, w: w, format: format}, nil
+}
+
+func (x *indexEncoder) add(e *DumpedEntry) string {
+	p := "/"
+	if len(x.dirs) > 0 {
+		p = path.Join(x.dirs[len(x.dirs)-1], e.Name)
+	}
+	if e.Attr.Nlink > 0 { // not stubs in delta dumps or placeholders in shards
+		offset := x.ow.n + int64(x.dumpEncoder.(bufferedEncoder).buffered())
+		x.entries = append(x.entries, IndexEntry{p, Ino(e.Attr.Inode), offset})
+	}
+	return p
+}
+
+func (x *indexEncoder) writeEntry(e *DumpedEntry) error {
+	x.add(e)
+	return x.dumpEncoder.writeEntry(e)
+}
+
+func (x *indexEncoder) beginDir(e *DumpedEntry, n int) error {
+	x.dirs = append(x.dirs, x.add(e))
+	return x.dumpEncoder.beginDir(e, n)
+}
+
+func (x *indexEncoder) endDir() error {
+	x.dirs = x.dirs[:len(x.dirs)-1]
+	return x.dumpEncoder.endDir()
+}
+
+func (x *indexEncoder) finish() error {
+	if err := x.dumpEncoder.finish(); err != nil {
+		return err
+	}
+	return writeIndex(x.w, x.entries, x.format)
+}
+
+func writeIndex(w io.Writer, entries []IndexEntry, format uint32) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	byInode := make([]uint64, len(entries))
+	for i := range byInode {
+		byInode[i] = uint64(i)
+	}
+	sort.SliceStable(byInode, func(i, j int) bool { return entries[byInode[i]].Inode < entries[byInode[j]].Inode })
+	var pool int
+	for _, e := range entries {
+		pool += len(e.Path)
+	}
+
+	h := crc32.NewIEEE()
+	bw := bufio.NewWriterSize(io.MultiWriter(w, h), jsonWriteSize)
+	buf := make([]byte, indexHeaderSize)
+	copy(buf, indexMagic)
+	binary.BigEndian.PutUint32(buf[8:], indexVersion)
+	binary.BigEndian.PutUint32(buf[12:], format)
+	binary.BigEndian.PutUint64(buf[16:], uint64(len(entries)))
+	binary.BigEndian.PutUint64(buf[24:], uint64(pool))
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+	var off uint64
+	buf = buf[:indexRecordSize]
+	for _, e := range entries {
+		binary.BigEndian.PutUint64(buf, off)
+		binary.BigEndian.PutUint32(buf[8:], uint32(len(e.Path)))
+		binary.BigEndian.PutUint64(buf[12:], uint64(e.Inode))
+		binary.BigEndian.PutUint64(buf[20:], uint64(e.Offset))
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+		off += uint64(len(e.Path))
+	}
+	buf = buf[:8]
+	for _, i := range byInode {
+		binary.BigEndian.PutUint64(buf, i)
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		if _, err := bw.WriteString(e.Path); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	buf = buf[:4]
+	binary.BigEndian.PutUint32(buf, h.Sum32())
+	_, err := w.Write(buf)
+	return err
+}
+
+// DumpIndex reads an index of a dump written by DumpOption.Index, only the records looked up
+// are read.
+type DumpIndex struct {
+	r      io.ReaderAt
+	size   int64
+	count  int
+	pool   int64 // offset of the pool
+	Format string
+}
+
+// OpenIndex checks the header and size of the index in r, which is size bytes.
+func OpenIndex(r io.ReaderAt, size int64) (*DumpIndex, error) {
+	buf := make([]byte, indexHeaderSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("read header: %s", err)
+	}
+	if string(buf[:8]) != indexMagic {
+		return nil, fmt.Errorf("not an index of dump")
+	}
+	if v := binary.BigEndian.Uint32(buf[8:]); v != indexVersion {
+		return nil, fmt.Errorf("unsupported version of index: %d", v)
+	}
+	x := &DumpIndex{r: r, size: size, Format: "json"}
+	switch binary.BigEndian.Uint32(buf[12:]) {
+	case 0:
+	case 1:
+		x.Format = "ndjson"
+	default:
+		return nil, fmt.Errorf("unknown format of indexed dump: %d", binary.BigEndian.Uint32(buf[12:]))
+	}
+	count, pool := binary.BigEndian.Uint64(buf[16:]), binary.BigEndian.Uint64(buf[24:])
+	if count > uint64(size)/(indexRecordSize+8) {
+		return nil, fmt.Errorf("index of %d records is truncated", count)
+	}
+	x.count = int(count)
+	x.pool = indexHeaderSize + int64(count)*(indexRecordSize+8)
+	if x.pool+int64(pool)+4 != size {
+		return nil, fmt.Errorf("index should be %d bytes, but got %d", x.pool+int64(pool)+4, size)
+	}
+	return x, nil
+}
+
+// Len returns the number of records in the index.
+func (x *DumpIndex) Len() int {
+	return x.count
+}
+
+// Entry returns the i-th record ordered by path.
+func (x *DumpIndex) Entry(i int) (*IndexEntry, error) {
+	if i < 0 || i >= x.count {
+		return nil, fmt.Errorf("record %d is out of %d", i, x.count)
+	}
+	buf := make([]byte, indexRecordSize)
+	if _, err := x.r.ReadAt(buf, indexHeaderSize+int64(i)*indexRecordSize); err != nil {
+		return nil, err
+	}
+	off, n := int64(binary.BigEndian.Uint64(buf)), int64(binary.BigEndian.Uint32(buf[8:]))
+	if x.pool+off+n > x.size-4 {
+		return nil, fmt.Errorf("path of record %d is out of the index", i)
+	}
+	p := make([]byte, n)
+	if _, err := x.r.ReadAt(p, x.pool+off); err != nil {
+		return nil, err
+	}
+	return &IndexEntry{string(p), Ino(binary.BigEndian.Uint64(buf[12:])), int64(binary.BigEndian.Uint64(buf[20:]))}, nil
+}
+
+func (x *DumpIndex) inodeEntry(i int) (*IndexEntry, error) {
+	buf := make([]byte, 8)
+	if _, err := x.r.ReadAt(buf, indexHeaderSize+int64(x.count)*indexRecordSize+int64(i)*8); err != nil {
+		return nil, err
+	}
+	return x.Entry(int(binary.BigEndian.Uint64(buf)))
+}
+
+// search returns the first one in n records for which f is true by binary search, like
+// sort.Search, and any error reading the records.
+func search(n int, f func(i int) (bool, error)) (int, error) {
+	var err error
+	i := sort.Search(n, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var ok bool
+		ok, err = f(i)
+		return ok
+	})
+	return i, err
+}
+
+// Lookup returns the record of path, nil if it's not in the index.
+func (x *DumpIndex) Lookup(p string) (*IndexEntry, error) {
+	var e *IndexEntry
+	i, err := search(x.count, func(i int) (bool, error) {
+		e, err := x.Entry(i)
+		return err == nil && e.Path >= p, err
+	})
+	if err != nil || i == x.count {
+		return nil, err
+	}
+	if e, err = x.Entry(i); err != nil || e.Path != p {
+		return nil, err
+	}
+	return e, nil
+}
+
+// LookupInode returns the records of inode, ordered by path, more than one for a hard linked file.
+func (x *DumpIndex) LookupInode(inode Ino) ([]*IndexEntry, error) {
+	i, err := search(x.count, func(i int) (bool, error) {
+		e, err := x.inodeEntry(i)
+		return err == nil && e.Inode >= inode, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var entries []*IndexEntry
+	for ; i < x.count; i++ {
+		e, err := x.inodeEntry(i)
+		if err != nil {
+			return nil, err
+		}
+		if e.Inode != inode {
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Verify reads the whole index to check its checksum.
+func (x *DumpIndex) Verify() error {
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, io.NewSectionReader(x.r, 0, x.size-4)); err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	if _, err := x.r.ReadAt(buf, x.size-4); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(buf) != h.Sum32() {
+		return fmt.Errorf("checksum of the index mismatched")
+	}
+	return nil
+}
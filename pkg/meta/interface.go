@@ -304,8 +304,17 @@ type Meta interface {
 	// OnMsg add a callback for the given message type.
 	OnMsg(mtype uint32, cb MsgCallback)
 
-	DumpMeta(w io.Writer) error
-	LoadMeta(r io.Reader) error
+	// DumpMeta dumps the tree under root of the meta service into w.
+	DumpMeta(w io.Writer, opt DumpOption) error
+	// LoadMeta loads a dump in any supported format into an empty meta service, resumes
+	// an interrupted load into it, or loads it with new inodes into a non-empty one.
+	LoadMeta(r io.Reader, opt LoadOption) error
+	// WalkTree calls visit with every entry under root and its path relative to root, like "/"
+	// for root and "/d1/f11", depth first in the order of names, as they're dumped. A hard link is
+	// visited at every path of it. The entries are read when they're visited, the children of a
+	// directory are not filled into it, and visit returns SkipDir to skip them. Any other error
+	// returned by visit stops the walk, and is returned.
+	WalkTree(root Ino, visit func(path string, e *DumpedEntry) error) error
 }
 
 func removePassword(uri string) string {
@@ -0,0 +1,184 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"unicode/utf8"
+)
+
+// jsonTokens is what jsonKey, expectDelim and skipJSON need, which json.Decoder has too.
+type jsonTokens interface {
+	Token() (json.Token, error)
+	More() bool
+}
+
+// jsonScanner reads JSON by tokens like json.Decoder, but there is no limit of nesting, which
+// json.Decoder has even for tokens, so a tree as deep as it is can be read with an explicit stack.
+// A value read by Decode is buffered and left to json.Unmarshal, which is for the small ones, e.g.
+// attr of an entry. The commas and colons are skipped as spaces.
+type jsonScanner struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newJSONScanner(r io.Reader) *jsonScanner {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &jsonScanner{r: br}
+}
+
+// peek returns the first byte of the next token, which is left in the reader.
+func (s *jsonScanner) peek() (byte, error) {
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			continue
+		}
+		return c, s.r.UnreadByte()
+	}
+}
+
+// More tells if there is another element in the current object or array.
+func (s *jsonScanner) More() bool {
+	c, err := s.peek()
+	return err == nil && c != '}' && c != ']'
+}
+
+// Token returns the next token as json.Decoder does: a json.Delim, string, float64, bool or nil.
+func (s *jsonScanner) Token() (json.Token, error) {
+	c, err := s.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case '{', '[', '}', ']':
+		_, _ = s.r.ReadByte()
+		return json.Delim(c), nil
+	}
+	raw, err := s.scalar()
+	if err != nil {
+		return nil, err
+	}
+	if c == '"' && bytes.IndexByte(raw, '\\') < 0 && utf8.Valid(raw) {
+		return string(raw[1 : len(raw)-1]), nil
+	}
+	var t json.Token
+	if err = json.Unmarshal(raw, &t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Decode reads the next value and decodes it into v by json.Unmarshal.
+func (s *jsonScanner) Decode(v interface{}) error {
+	c, err := s.peek()
+	if err != nil {
+		return err
+	}
+	var raw []byte
+	if c == '{' || c == '[' {
+		raw, err = s.composite()
+	} else {
+		raw, err = s.scalar()
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// scalar reads a string, number or literal as is into buf.
+func (s *jsonScanner) scalar() ([]byte, error) {
+	c, err := s.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	s.buf = append(s.buf[:0], c)
+	if c == '"' {
+		var escaped bool
+		for {
+			if c, err = s.r.ReadByte(); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			s.buf = append(s.buf, c)
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				return s.buf, nil
+			}
+		}
+	}
+	for {
+		if c, err = s.r.ReadByte(); err == io.EOF {
+			return s.buf, nil
+		} else if err != nil {
+			return nil, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n', ',', ':', '}', ']':
+			return s.buf, s.r.UnreadByte()
+		}
+		s.buf = append(s.buf, c)
+	}
+}
+
+// composite reads an object or array as is into buf.
+func (s *jsonScanner) composite() ([]byte, error) {
+	s.buf = s.buf[:0]
+	var depth int
+	var inString, escaped bool
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		s.buf = append(s.buf, c)
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			escaped = c == '\\'
+			inString = c != '"'
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			if depth--; depth == 0 {
+				return s.buf, nil
+			}
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
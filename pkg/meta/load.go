@@ -0,0 +1,857 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoadOption specifies how a dump is loaded.
+type LoadOption struct {
+	// Resume continues an interrupted load after the last inode in its checkpoint.
+	Resume bool
+	// ApplyDelta applies a delta dump onto the database loaded from its base.
+	ApplyDelta bool
+	// SkipChecksum loads a dump without verifying its checksum, to recover what's left in a corrupted one.
+	SkipChecksum bool
+	// CheckEntries checks the hash of every entry in a dump with EntryHash, and refuses it if any
+	// entry is corrupted, see checkEntries.
+	CheckEntries bool
+	// Shards are the other shards or dumps of the same volume to be merged with the one being loaded.
+	Shards []io.Reader
+	// PreferNewest picks the one with the newest ctime if an inode is different in the merged dumps.
+	PreferNewest bool
+	// Remap loads the dump into a directory at this path of a non-empty volume, with new inodes.
+	// It's created with the missing parents, or the dump is grafted into it if exists, see remapEntries.
+	Remap string
+	// TagOriginal keeps the inode of every entry in the dump in an xattr of it with Remap, see tagOriginal.
+	TagOriginal bool
+	// FixNlink sets nlink of every entry to the one counted from the dump, the ones fixed are logged.
+	FixNlink bool
+	// ResolveCase renames the entries whose names differ only by case from a sibling with a
+	// numeric suffix, see resolveCase, the ones renamed are logged.
+	ResolveCase bool
+	// Only loads the directory at this path of the dump as the root, or into Remap if set, the
+	// entries out of it are skipped when decoded.
+	Only string
+	// Root loads the named root of a dump with them as the root, which is needed by such a dump,
+	// before Only is applied, see selectRoot
+	Root string
+	// MetadataOnly allows a dump without the slices of files, which read as zeros after loaded.
+	MetadataOnly bool
+	// Shadow loads the files as empty ones, with their lengths in an xattr, for a volume to list
+	// and search the files without their data, see shadowFiles. It also allows a dump without data.
+	Shadow bool
+	// DirsOnly loads only the directories in the dump, for an empty skeleton of the tree, see
+	// keepDirsOnly. It also allows a dump without data.
+	DirsOnly bool
+	// AttrsOnly restores the mode, owner and times of the entries in a non-empty volume from the
+	// dump, matched by AttrsMatch, MatchPath (default) or MatchInode, see loadAttrsOnly. It also
+	// allows a dump without data.
+	AttrsOnly  bool
+	AttrsMatch string
+	// Key decrypts an encrypted dump, which is detected automatically.
+	Key *DumpKey
+	// Check validates the dump before loading it, and refuses it if any problem is found unless Force is set.
+	// Force also loads a dump into a volume without enough space or inodes under its quota by
+	// Remap, see checkCapacity.
+	Check bool
+	Force bool
+	// CheckCoverage validates that the slices of every file cover its length like Check, see
+	// checkCoverage. It can be used with or without Check.
+	CheckCoverage bool
+	// ProgressInterval is the refresh interval of the progress, like the one in DumpOption.
+	ProgressInterval time.Duration
+	// DryRun validates the dump and fills it with what would be loaded if set, nothing is written.
+	DryRun *LoadSummary
+	// Progress is called with the progress of every stage if set, like the one in DumpOption.
+	Progress func(stage string, current, total int64)
+	// Context cancels the load if set, like the one in DumpOption. It's checked between the
+	// transactions, so none of them is left half written. A full load writes the entries in
+	// batches with the checkpoint, and the setting in the last one, so a canceled one is never
+	// mounted with a partial tree, and it can be resumed. Other loads stop between entries, like
+	// they fail for any other error.
+	Context context.Context
+	// BWLimit limits the bytes of the dump and the shards read per second if set, each of them by
+	// its own, before they're decompressed and decrypted. It doesn't limit the writes into the
+	// database, which follow after the whole dump is read.
+	BWLimit int64
+	// KeepCounters loads the usage in the dumped counters, instead of the one counted from the
+	// loaded entries, a difference between them is warned anyway. It's only for a full load.
+	KeepCounters bool
+	// Counters is filled with the counters of the loaded entries if set, the next IDs are as
+	// in a dump of the volume. For a delta dump, they're the ones applied.
+	Counters *DumpedCounters
+	// Strict validates the dump against DumpSchema and DumpHeader, and refuses it if any problem is
+	// found, e.g. an unknown field, which is ignored otherwise. A binary dump has its header checked
+	// only. It's slower and needs more memory, so it's better skipped for trusted dumps.
+	Strict bool
+	// Data opens the storage of the volume in the dumped setting, into which the data embedded
+	// in a dump with data is written before the metadata is loaded.
+	Data func(setting *Format) (SliceStore, error)
+	// Dedup opens the storage of the volume in the dumped setting if set, from which the slices of
+	// the files with the same length are read, and the files with the same contents share the
+	// slices of the first one of them after loaded. It's only for a full load.
+	Dedup func(setting *Format) (SliceStore, error)
+	// AccessKey, SecretKey and EncryptKey supply the secrets redacted from the setting of a dump,
+	// a full load refuses a dump with any secret redacted but not supplied, since the volume can't
+	// be used without it. The ones not redacted are kept as dumped.
+	AccessKey  string
+	SecretKey  string
+	EncryptKey string
+	// UidMap and GidMap map the owners of the loaded entries if set, before they're written
+	UidMap, GidMap *IDMap
+	// SymlinkRewrites rewrite the prefixes of absolute symlink targets, the first matching one is used
+	SymlinkRewrites []SymlinkRewrite
+	// ResetTimes sets the atime, mtime and ctime of all the loaded entries to the time of the
+	// load, and ResetAtime only the atime, see resetTimes
+	ResetTimes bool
+	ResetAtime bool
+	// Phase splits a full load into two, for a volume to be online as soon as possible: "live"
+	// loads everything but the files to be deleted, and "trash" adds them into the volume loaded
+	// from the same dump by the live phase later, which can be done again safely. Both are loaded
+	// if it's empty (default). There is no trash of deleted files yet, they are the only files not live.
+	Phase string
+	// Threads is the number of batches of entries written concurrently by a full load, 1 (default)
+	// to write them one by one.
+	Threads int
+	// ContinueOnError skips the entries failing the validation of a full load with the ones under
+	// them, e.g. an invalid nlink, an inode conflict or a missing attr, instead of failing it. They
+	// are logged, and the load returns SkippedEntries after the rest is loaded.
+	ContinueOnError bool
+}
+
+// LoadSummary is what a load would apply to the database, found by a dry run.
+type LoadSummary struct {
+	Dumped    *DumpedCounters // recorded in the dump
+	Inodes    int64           // inodes to be created, not including the root
+	Space     int64           // used space to be added
+	DelFiles  int             // files to be deleted
+	Sustained int             // inodes kept by sessions
+	Warnings  []string        // problems which would fail the load
+}
+
+// decodeDump reads a whole dump into memory, the format, compression and encryption are detected
+// automatically, an encrypted dump is decrypted by key. The checksum is verified after everything
+// is read unless skipChecksum is set, so nothing is applied from a corrupted dump.
+func decodeDump(r io.Reader, skipChecksum bool, key *DumpKey) (*DumpedMeta, error) {
+	dm, _, err := decodeDumpStrict(r, skipChecksum, key, false, "")
+	return dm, err
+}
+
+// plainDump decompresses and decrypts the dump in r, and detects its format, which is json,
+// ndjson or binary. The closers should be closed after the plain dump is read, even if it fails.
+func plainDump(r io.Reader, key *DumpKey) (br *bufio.Reader, format string, closers []io.Closer, err error) {
+	br = bufio.NewReaderSize(r, jsonWriteSize)
+	decompress := func() error {
+		dr, err := newDecompressReader(br)
+		if err != nil {
+			return err
+		}
+		if dr != io.Reader(br) {
+			if c, ok := dr.(io.Closer); ok {
+				closers = append(closers, c)
+			}
+			br = bufio.NewReaderSize(dr, jsonWriteSize)
+		}
+		return nil
+	}
+	// a dump compressed by a tool like gzip after dumped is decompressed before decrypted
+	if err = decompress(); err != nil {
+		return
+	}
+	er, err := newDecryptReader(br, key)
+	if err != nil {
+		return
+	}
+	if er != io.Reader(br) {
+		br = bufio.NewReaderSize(er, jsonWriteSize)
+	}
+	if err = decompress(); err != nil {
+		return
+	}
+	format = "json"
+	if magic, e := br.Peek(len(binaryMagic)); e == nil && string(magic) == binaryMagic {
+		format = "binary"
+	} else if prefix, e := br.Peek(len(ndjsonPrefix)); e == nil && string(prefix) == ndjsonPrefix {
+		format = "ndjson"
+	} else if prefix, _ := br.Peek(16); notJSON(prefix) {
+		err = fmt.Errorf("unknown format of the dump, which starts with %q", prefix)
+	}
+	return
+}
+
+// decodeDumpStrict decodes a dump like decodeDump, and validates it against DumpSchema if strict
+// is set, for which the whole plain dump is kept in memory. The problems found are returned.
+// The entries out of the subtree at only are skipped if it's not empty, see keepPath.
+func decodeDumpStrict(r io.Reader, skipChecksum bool, key *DumpKey, strict bool, only string) (*DumpedMeta, []string, error) {
+	br, format, closers, err := plainDump(r, key)
+	defer func() {
+		for _, c := range closers {
+			_ = c.Close()
+		}
+	}()
+	if err != nil {
+		return nil, nil, err
+	}
+	var raw *bytes.Buffer
+	if strict && format != "binary" {
+		raw = &bytes.Buffer{}
+		br = bufio.NewReaderSize(io.TeeReader(br, raw), jsonWriteSize)
+	}
+	var cr *checksumReader
+	if !skipChecksum {
+		cr = newChecksumReader(br, format)
+		br = bufio.NewReaderSize(cr, jsonWriteSize)
+	}
+	dm := &DumpedMeta{}
+	if format == "binary" {
+		if dm, err = decodeBinary(br, only); err != nil {
+			return nil, nil, err
+		}
+	} else if format == "ndjson" {
+		if dm, err = decodeNDJSON(br, only); err != nil {
+			return nil, nil, err
+		}
+	} else if dm, err = decodeJSON(br, only); err != nil {
+		return nil, nil, err
+	}
+	if format == "json" {
+		unescape := nameUnescaper(dm)
+		if err = upgradeDump(dm); err != nil {
+			return nil, nil, err
+		}
+		if unescape != nil && dm.FSTree != nil {
+			unescapeTree(dm.FSTree, unescape)
+		}
+		if unescape != nil && dm.Roots != nil {
+			roots := &DumpedEntry{Entries: dm.Roots}
+			unescapeTree(roots, unescape)
+			dm.Roots = roots.Entries
+		}
+	}
+	if cr != nil || raw != nil {
+		if _, err = io.Copy(ioutil.Discard, br); err != nil {
+			return nil, nil, err
+		}
+	}
+	if cr != nil {
+		if err = cr.verify(dm, format); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !strict {
+		return dm, nil, nil
+	}
+	problems := checkHeader(dm.Header)
+	if raw != nil {
+		ps, err := validateDump(raw.Bytes(), format)
+		if err != nil {
+			return nil, nil, err
+		}
+		problems = append(problems, ps...)
+	}
+	return dm, problems, nil
+}
+
+// notJSON tells if a dump starting with prefix can't be in JSON.
+func notJSON(prefix []byte) bool {
+	t := bytes.TrimLeft(prefix, " \t\r\n")
+	return len(t) > 0 && t[0] != '{'
+}
+
+// decodeForLoad decodes a dump to be loaded, it's refused if any problem is found by a strict
+// load, they're only warnings of a dry run.
+func decodeForLoad(r io.Reader, opt LoadOption) (*DumpedMeta, error) {
+	dm, problems, err := decodeDumpStrict(r, opt.SkipChecksum, opt.Key, opt.Strict, opt.Only)
+	if err != nil {
+		return nil, err
+	}
+	if opt.CheckEntries {
+		if err = checkEntries(dm); err != nil {
+			return nil, err
+		}
+	}
+	if err = selectRoot(dm, opt.Root); err != nil {
+		return nil, err
+	}
+	if opt.DryRun != nil {
+		opt.DryRun.Warnings = append(opt.DryRun.Warnings, problems...)
+		return dm, nil
+	}
+	for _, p := range problems {
+		logger.Warnf("Schema: %s", p)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%d problems are found against the schema of the dump, nothing is loaded", len(problems))
+	}
+	mapOwners(dm, opt)
+	rewriteSymlinks(dm, opt)
+	resetTimes(dm, opt, time.Now())
+	return dm, nil
+}
+
+// readDump decodes the dump to be loaded, all the shards or dumps to be merged are merged.
+func readDump(r io.Reader, opt LoadOption) (*DumpedMeta, error) {
+	if opt.Phase != "" && opt.Phase != "live" && opt.Phase != "trash" {
+		return nil, fmt.Errorf("unknown phase of load: %s", opt.Phase)
+	}
+	if opt.Only != "" && (opt.Only == "/" || path.Clean("/"+opt.Only) != opt.Only) {
+		return nil, fmt.Errorf("invalid path of subtree: %s", opt.Only)
+	}
+	if opt.BWLimit > 0 {
+		r = newLimitedReader(r, opt.BWLimit)
+	}
+	if opt.Context != nil {
+		r = &ctxReader{r, opt.Context}
+	}
+	dm, err := decodeForLoad(r, opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Only != "" {
+		if err = extractSubtree(dm, opt); err != nil {
+			return nil, err
+		}
+	}
+	if dm.InodeRange != nil || len(opt.Shards) > 0 {
+		dms := []*DumpedMeta{dm}
+		for i, s := range opt.Shards {
+			if opt.BWLimit > 0 {
+				s = newLimitedReader(s, opt.BWLimit)
+			}
+			if opt.Context != nil {
+				s = &ctxReader{s, opt.Context}
+			}
+			if dm, err = decodeForLoad(s, opt); err != nil {
+				return nil, fmt.Errorf("decode shard %d: %s", i+2, err)
+			}
+			dms = append(dms, dm)
+		}
+		if dm, err = mergeShards(dms, opt.PreferNewest); err != nil {
+			return nil, err
+		}
+	}
+	if opt.DirsOnly {
+		keepDirsOnly(dm)
+	} else if dm.DirsOnly {
+		logger.Infof("The dump has only directories, no file is loaded")
+	}
+	if opt.ResolveCase {
+		renamed := resolveCase(dm.FSTree)
+		for _, r := range renamed {
+			logger.Warnf("Renamed %s", r)
+		}
+		logger.Infof("Renamed %d entries colliding by case", len(renamed))
+	}
+	if opt.FixNlink {
+		fixed := fixNlinks(dm)
+		for _, p := range fixed {
+			logger.Warnf("Inode %d: %s", p.inode, p.msg)
+		}
+		logger.Infof("Fixed nlink of %d inodes", len(fixed))
+	}
+	if opt.Check || opt.CheckCoverage {
+		var problems []dumpProblem
+		if opt.Check {
+			problems = checkDump(dm)
+		}
+		if opt.CheckCoverage {
+			problems = append(problems, checkCoverage(dm)...)
+			sort.SliceStable(problems, func(i, j int) bool { return problems[i].inode < problems[j].inode })
+		}
+		for _, p := range problems {
+			logger.Warnf("Inode %d: %s", p.inode, p.msg)
+		}
+		if len(problems) > 0 && !opt.Force {
+			return nil, fmt.Errorf("%d problems are found in the dump, nothing is loaded", len(problems))
+		} else if len(problems) > 0 {
+			logger.Warnf("%d problems are found in the dump, it's loaded anyway", len(problems))
+		} else {
+			logger.Infof("No problem is found in the dump")
+		}
+	}
+	if err = checkNoData(dm, opt); err != nil {
+		return nil, err
+	}
+	if opt.Shadow {
+		shadowFiles(dm)
+	}
+	if len(dm.Locks) > 0 {
+		logger.Infof("%d locks held when dumped are not loaded, they should be acquired again by the clients", len(dm.Locks))
+	}
+	if dm.Partial {
+		logger.Warnf("The dump is partial, data of some files was missing in the object storage when dumped")
+	}
+	if opt.Remap == "" && opt.Phase != "trash" && !opt.AttrsOnly { // the setting is not loaded
+		if missing := restoreSecrets(dm.Setting, opt); len(missing) > 0 && opt.DryRun != nil {
+			opt.DryRun.Warnings = append(opt.DryRun.Warnings, fmt.Sprintf("%s redacted from the dump must be supplied", strings.Join(missing, ", ")))
+		} else if len(missing) > 0 {
+			return nil, fmt.Errorf("%s redacted from the dump must be supplied to load it", strings.Join(missing, ", "))
+		}
+	}
+	if err = dedupFiles(dm, opt); err != nil {
+		return nil, err
+	}
+	return dm, loadData(dm, opt)
+}
+
+// restoreSecrets replaces the secrets redacted from format by the ones supplied in opt, the
+// names of the ones not supplied are returned.
+func restoreSecrets(format *Format, opt LoadOption) []string {
+	var missing []string
+	for _, s := range []struct {
+		name     string
+		dumped   *string
+		supplied string
+	}{
+		{"access key", &format.AccessKey, opt.AccessKey},
+		{"secret key", &format.SecretKey, opt.SecretKey},
+		{"encrypt key", &format.EncryptKey, opt.EncryptKey},
+	} {
+		if *s.dumped != redactedSecret {
+			continue
+		}
+		if s.supplied == "" {
+			missing = append(missing, s.name)
+		} else {
+			*s.dumped = s.supplied
+		}
+	}
+	return missing
+}
+
+// dryRunLoad reads the dump in r and validates it like a real load, but the problems are only
+// collected as warnings in opt.DryRun, together with the counts which would be loaded.
+func dryRunLoad(r io.Reader, opt LoadOption, notEmpty bool) error {
+	s := opt.DryRun
+	if notEmpty {
+		s.Warnings = append(s.Warnings, "the database is not empty")
+	}
+	check, coverage := opt.Check, opt.CheckCoverage
+	opt.Check, opt.CheckCoverage = false, false
+	dm, err := readDump(r, opt)
+	if err != nil {
+		return err
+	}
+	if dm.BaseVersion != 0 {
+		return fmt.Errorf("a delta dump can only be applied onto a loaded database")
+	}
+	if check {
+		for _, p := range checkDump(dm) {
+			s.Warnings = append(s.Warnings, fmt.Sprintf("inode %d: %s", p.inode, p.msg))
+		}
+	}
+	if coverage {
+		for _, p := range checkCoverage(dm) {
+			s.Warnings = append(s.Warnings, fmt.Sprintf("inode %d: %s", p.inode, p.msg))
+		}
+	}
+	dm.FSTree.Attr.Inode = 1
+	reported := make(map[string]bool) // an inode conflicting at many places is reported once
+	if err = collectEntry(nil, dm.FSTree, make(map[Ino]*DumpedEntry), nil, func(e *DumpedEntry, err error) {
+		key := err.Error()
+		var conflict *InodeConflictError
+		if errors.As(err, &conflict) {
+			key = fmt.Sprintf("inode conflict: %d", conflict.Inode)
+		}
+		if !reported[key] {
+			reported[key] = true
+			s.Warnings = append(s.Warnings, err.Error())
+		}
+	}); err != nil {
+		return err
+	}
+	cs := computeCounters(dm.FSTree)
+	s.Dumped, s.Inodes, s.Space = dm.Counters, cs.UsedInodes, cs.UsedSpace
+	s.DelFiles = len(dm.DelFiles)
+	for _, ss := range dm.Sustained {
+		s.Sustained += len(ss.Inodes)
+	}
+	warnOverQuota(dm.Setting, &cs)
+	return nil
+}
+
+// loadTrashPhase reads the dump in r, and adds its files to be deleted by load into the volume
+// m, which should be loaded from the same dump by the live phase. load should skip or overwrite
+// the ones added before, so that it can be done again.
+func loadTrashPhase(m Meta, r io.Reader, opt LoadOption, load func(dels []*DumpedDelFile) error) error {
+	format, err := m.Load()
+	if err != nil {
+		return fmt.Errorf("load setting: %s, the live phase should be loaded first", err)
+	}
+	dm, err := readDump(r, opt)
+	if err != nil {
+		return err
+	}
+	if dm.BaseVersion != 0 {
+		return fmt.Errorf("a delta dump can only be applied onto a loaded database")
+	}
+	if dm.Setting.UUID != format.UUID {
+		return fmt.Errorf("the dump is from volume %s, but it's loaded into %s", dm.Setting.UUID, format.UUID)
+	}
+	if err = load(dm.DelFiles); err != nil {
+		return err
+	}
+	logger.Infof("Loaded %d files to be deleted", len(dm.DelFiles))
+	return nil
+}
+
+// checkBlockSize refuses to load slices dumped from a volume of block size dumped into one of
+// format, since the objects of a slice are named by its blocks, and can't be found with another
+// block size. The files should be copied by a client to change the block size.
+func checkBlockSize(format, dumped *Format) error {
+	if format.BlockSize != dumped.BlockSize {
+		return fmt.Errorf("block size of target is %d KiB, but it's %d KiB in source, slices can't be loaded into it, please copy the files instead",
+			format.BlockSize, dumped.BlockSize)
+	}
+	return nil
+}
+
+// checkNoData refuses a metadata-only dump unless it's allowed by opt.
+func checkNoData(dm *DumpedMeta, opt LoadOption) error {
+	if dm.NoData && !opt.MetadataOnly && !opt.Shadow && !opt.DirsOnly && !opt.AttrsOnly {
+		return fmt.Errorf("the dump has no data of files, it can only be loaded as metadata only")
+	}
+	return nil
+}
+
+// loadEntries loads the collected entries one by one by load, with the progress shown.
+func loadEntries(entries []*DumpedEntry, opt LoadOption, load func(e *DumpedEntry) error) error {
+	bar := newProgress("Load entries progress: ", int64(len(entries)), opt.ProgressInterval, opt.Progress)
+	defer bar.Done()
+	for _, e := range entries {
+		if err := ctxErr(opt.Context); err != nil {
+			return err
+		}
+		if err := load(e); err != nil {
+			return err
+		}
+		bar.Incr(1)
+	}
+	return nil
+}
+
+// loadBatchSize is the number of entries written in a transaction by a full load.
+const loadBatchSize = 100
+
+// loadBatches loads the collected entries of a full load by opt.Threads workers. Every entry is
+// prepared by prepare in order, which counts it into the loaded counters and returns what to be
+// written for it, or nil if it was loaded before the checkpoint; so no counter is shared by the
+// workers. The prepared ones are committed in batches, each by commit in a transaction together
+// with the checkpoint.
+//
+// The batches are committed out of order, so the checkpoint written is the last inode of the
+// batches all committed before, and the entries after it are written again by a resumed load,
+// which commit should overwrite. The entries of an unfinished load are never read, so it doesn't
+// matter whether a directory is committed before its children.
+func loadBatches(entries []*DumpedEntry, opt LoadOption, prepare func(e *DumpedEntry) (interface{}, error),
+	commit func(batch []interface{}, ckpt Ino) error) error {
+	bar := newProgress("Load entries progress: ", int64(len(entries)), opt.ProgressInterval, opt.Progress)
+	defer bar.Done()
+	threads := opt.Threads
+	if threads < 1 {
+		threads = 1
+	}
+
+	type batch struct {
+		seq    int
+		last   Ino
+		writes []interface{}
+	}
+	var mu sync.Mutex
+	var werr error
+	var next int                   // seq of the first batch not committed
+	var mark Ino                   // last inode of the batches all committed
+	committed := make(map[int]Ino) // last inodes of the batches committed after next
+	failed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return werr
+	}
+
+	batches := make(chan *batch, threads)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				mu.Lock()
+				ckpt := mark
+				if b.seq == next { // the checkpoint is committed with the batch
+					ckpt = b.last
+				}
+				stop := werr != nil
+				mu.Unlock()
+				if stop {
+					continue
+				}
+				err := commit(b.writes, ckpt)
+				mu.Lock()
+				if err != nil {
+					if werr == nil {
+						werr = err
+					}
+				} else {
+					committed[b.seq] = b.last
+					for l, ok := committed[next]; ok; l, ok = committed[next] {
+						delete(committed, next)
+						mark = l
+						next++
+					}
+				}
+				mu.Unlock()
+				if err == nil {
+					bar.Incr(int64(len(b.writes)))
+				}
+			}
+		}()
+	}
+
+	var err error
+	cur := &batch{}
+	for _, e := range entries {
+		if err = failed(); err != nil {
+			break
+		}
+		if err = ctxErr(opt.Context); err != nil { // the committed batches are resumed later
+			break
+		}
+		var w interface{}
+		if w, err = prepare(e); err != nil {
+			break
+		}
+		if w == nil {
+			if cur.seq == 0 && len(cur.writes) == 0 { // loaded before, as a prefix of entries
+				mark = e.Attr.Inode
+			}
+			bar.Incr(1)
+			continue
+		}
+		cur.writes = append(cur.writes, w)
+		cur.last = e.Attr.Inode
+		if len(cur.writes) == loadBatchSize {
+			batches <- cur
+			cur = &batch{seq: cur.seq + 1}
+		}
+	}
+	if err == nil && len(cur.writes) > 0 {
+		batches <- cur
+	}
+	close(batches)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+// keepNextCounters raises the next IDs counted from the loaded entries to the dumped ones minus
+// offset, which are larger if not everything is loaded, e.g. slices are not in a metadata-only
+// dump, so that no ID used in the object storage is reused.
+func keepNextCounters(dumped, loaded *DumpedCounters, offset int64) {
+	if n := dumped.NextInode - offset; n > loaded.NextInode {
+		loaded.NextInode = n
+	}
+	if n := dumped.NextChunk - offset; n > loaded.NextChunk {
+		loaded.NextChunk = n
+	}
+	if n := dumped.NextSession - offset; n > loaded.NextSession {
+		loaded.NextSession = n
+	}
+}
+
+// checkUsage warns if the usage counted from the loaded entries differs from the dumped one,
+// e.g. the counters drifted in the dumped volume, the counted one is loaded unless keep is set.
+func checkUsage(dumped, loaded *DumpedCounters, keep bool) {
+	if dumped.UsedSpace == loaded.UsedSpace && dumped.UsedInodes == loaded.UsedInodes {
+		return
+	}
+	logger.Warnf("Usage counted from the dump is %d bytes and %d inodes, but it's %d bytes and %d inodes in the dumped counters",
+		loaded.UsedSpace, loaded.UsedInodes, dumped.UsedSpace, dumped.UsedInodes)
+	if keep {
+		logger.Warnf("The dumped usage is kept, it's still wrong if the counters of the dumped volume drifted")
+		loaded.UsedSpace, loaded.UsedInodes = dumped.UsedSpace, dumped.UsedInodes
+	} else {
+		logger.Warnf("The counted usage is loaded, which fixes the drift of the dumped counters")
+	}
+}
+
+// reportCounters logs the dumped and loaded counters, the loaded ones are also filled into
+// opt.Counters with the next IDs plus offset, which is the one given to keepNextCounters.
+func reportCounters(dumped, loaded *DumpedCounters, offset int64, opt LoadOption) {
+	logger.Infof("Dumped counters: %+v", *dumped)
+	logger.Infof("Loaded counters: %+v", *loaded)
+	if cs := opt.Counters; cs != nil {
+		*cs = *loaded
+		cs.NextInode += offset
+		cs.NextChunk += offset
+		cs.NextSession += offset
+	}
+}
+
+// dumpUpgrades convert the layouts of older dumps into the current one, in the order of versions.
+// Each of them converts the dumps older than its version, before the entries are decoded, so
+// only the header can be changed. The ones converted while decoding, e.g. the escaped names,
+// are not here.
+var dumpUpgrades = []struct {
+	version int
+	desc    string
+	upgrade func(dm *DumpedMeta)
+}{
+	{1, "drop the time of the last cleanup of slices", func(dm *DumpedMeta) {
+		// an old dump may have the time in seconds when the slices of the dumped volume were
+		// cleaned up last, which means nothing for the loaded volume, it's 0 in any dump since
+		if dm.Counters != nil {
+			dm.Counters.NextCleanupSlices = 0
+		}
+	}},
+}
+
+// upgradeDump refuses a dump newer than this binary, and upgrades an older one to dumpVersion.
+func upgradeDump(dm *DumpedMeta) error {
+	if dm.Version > dumpVersion {
+		return fmt.Errorf("the dump is in format version %d, but only %d or older is supported, please upgrade JuiceFS", dm.Version, dumpVersion)
+	}
+	for _, u := range dumpUpgrades {
+		if dm.Version < u.version {
+			logger.Debugf("Upgrade the dump of version %d: %s", dm.Version, u.desc)
+			u.upgrade(dm)
+		}
+	}
+	dm.Version = dumpVersion
+	return nil
+}
+
+// warnOverQuota warns if the usage counted from the loaded tree exceeds the quota of the volume.
+// It's the only quota, which is kept in the setting, there are no quotas of directories.
+func warnOverQuota(format *Format, cs *DumpedCounters) {
+	if format.Capacity > 0 && cs.UsedSpace > int64(format.Capacity) {
+		logger.Warnf("Used space %d exceeds the capacity %d of volume %s, nothing can be written until some files are deleted",
+			cs.UsedSpace, format.Capacity, format.Name)
+	}
+	if format.Inodes > 0 && cs.UsedInodes > int64(format.Inodes) {
+		logger.Warnf("Used inodes %d exceeds the limit %d of volume %s, no file can be created until some are deleted",
+			cs.UsedInodes, format.Inodes, format.Name)
+	}
+}
+
+// checkCapacity refuses to load the tree in dm into the non-empty volume m if its usage is more
+// than the space or the inodes available under the quota of the volume, unless Force is set, in
+// which case it's loaded with a warning. Nothing is checked without a quota, e.g. a volume on an
+// object storage without a hard limit. The usage is counted like computeCounters, and the used
+// space of the volume is aligned to 64 KiB like StatFS.
+func checkCapacity(m Meta, format *Format, dm *DumpedMeta, opt LoadOption) error {
+	if format.Capacity == 0 && format.Inodes == 0 {
+		return nil
+	}
+	var total, avail, iused, iavail uint64
+	if st := m.StatFS(Background, &total, &avail, &iused, &iavail); st != 0 {
+		return fmt.Errorf("statfs: %s", st)
+	}
+	cs := computeCounters(dm.FSTree)
+	var problems []string
+	if format.Capacity > 0 && uint64(cs.UsedSpace) > avail {
+		problems = append(problems, fmt.Sprintf("the dump needs %d bytes, but only %d of the capacity %d are available in volume %s",
+			cs.UsedSpace, avail, format.Capacity, format.Name))
+	}
+	if format.Inodes > 0 && uint64(cs.UsedInodes) > iavail {
+		problems = append(problems, fmt.Sprintf("the dump needs %d inodes, but only %d of the limit %d are available in volume %s",
+			cs.UsedInodes, iavail, format.Inodes, format.Name))
+	}
+	if len(problems) == 0 {
+		return nil
+	} else if !opt.Force {
+		return fmt.Errorf("%s, nothing is loaded", strings.Join(problems, "; "))
+	}
+	for _, p := range problems {
+		logger.Warnf("Quota: %s, it's loaded anyway", p)
+	}
+	return nil
+}
+
+// collectEntries gathers all the entries in dm by inode. They are ordered by inode, so that
+// an interrupted load can be resumed after the last loaded one. The entries skipped by
+// ContinueOnError are returned too.
+func collectEntries(dm *DumpedMeta, opt LoadOption) ([]*DumpedEntry, SkippedEntries, error) {
+	if dm.BaseVersion != 0 {
+		return nil, nil, fmt.Errorf("a delta dump can only be applied onto a loaded database")
+	}
+	if dm.FSTree == nil || dm.FSTree.Attr == nil {
+		return nil, nil, fmt.Errorf("no attr for the root of the dump")
+	}
+	var total int64 = 1 // root
+	bar := newProgress("CollectEntry progress: ", dm.Counters.UsedInodes+1, opt.ProgressInterval, opt.Progress)
+	dm.FSTree.Attr.Inode = 1
+	entries := make(map[Ino]*DumpedEntry)
+	var conflicts InodeConflicts
+	var skipped SkippedEntries
+	var failed error
+	err := collectEntry(opt.Context, dm.FSTree, entries, func(totalIncr, currentIncr int64) {
+		total += totalIncr
+		bar.SetTotal(total)
+		bar.Incr(currentIncr)
+	}, func(e *DumpedEntry, err error) { // to find all the conflicts, the first of other problems fails it
+		if opt.ContinueOnError && e != dm.FSTree {
+			s := &SkippedEntry{Path: entryPath(entries, e), Reason: err.Error(), Attr: e.Attr}
+			if e.Attr != nil {
+				s.Inode = e.Attr.Inode
+			}
+			logger.Warnf("Skip %s: %s", s.Path, s.Reason)
+			skipped = append(skipped, s)
+		} else if c, ok := err.(*InodeConflictError); ok {
+			conflicts = append(conflicts, c)
+		} else if failed == nil {
+			failed = err
+		}
+	})
+	bar.Done()
+	if err == nil {
+		err = failed
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(conflicts) == 1 {
+		return nil, nil, conflicts[0]
+	} else if len(conflicts) > 1 {
+		return nil, nil, conflicts
+	}
+	if len(skipped) > 0 {
+		logger.Warnf("Skipped %d entries failing the validation with the ones under them, the rest is loaded", len(skipped))
+	} else if bar.Current() != total {
+		logger.Warnf("Collected %d / total %d, some entries are not collected", bar.Current(), total)
+	}
+
+	sorted := make([]*DumpedEntry, 0, len(entries))
+	for _, e := range entries {
+		sorted = append(sorted, e)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Attr.Inode < sorted[j].Attr.Inode })
+	return sorted, skipped, nil
+}
@@ -0,0 +1,78 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"sort"
+)
+
+// DumpedLock is a lock held on an inode by an owner of a session when dumped, a BSD lock (flock)
+// or a range of POSIX record locks (fcntl). They're only for audit and not loaded, since the
+// sessions holding them are gone in the loaded volume, the clients lock the files again.
+type DumpedLock struct {
+	Inode Ino    `json:"inode"`
+	Sid   uint64 `json:"sid"`
+	Host  string `json:"host,omitempty"` // of the session
+	Owner uint64 `json:"owner"`
+	Kind  string `json:"kind"`          // flock or posix
+	Type  string `json:"type"`          // R or W
+	Pid   uint32 `json:"pid,omitempty"` // in the host of the session, only for posix locks
+	Start uint64 `json:"start,omitempty"`
+	End   uint64 `json:"end,omitempty"`
+}
+
+// readLocks returns the locks held by all the sessions of m, ordered by inode, session and
+// owner. A session closed meanwhile is skipped.
+func readLocks(m Meta) ([]*DumpedLock, error) {
+	sessions, err := m.ListSessions()
+	if err != nil {
+		return nil, err
+	}
+	var locks []*DumpedLock
+	for _, ss := range sessions {
+		s, err := m.GetSession(ss.Sid)
+		if err != nil {
+			logger.Warnf("Dump locks of session %d: %s", ss.Sid, err)
+			continue
+		}
+		for _, l := range s.Flocks {
+			locks = append(locks, &DumpedLock{Inode: l.Inode, Sid: s.Sid, Host: s.Hostname, Owner: l.Owner, Kind: "flock", Type: l.Ltype})
+		}
+		for _, l := range s.Plocks {
+			for _, r := range loadLocks(l.Records) {
+				typ := "R"
+				if r.ltype == F_WRLCK {
+					typ = "W"
+				}
+				locks = append(locks, &DumpedLock{l.Inode, s.Sid, s.Hostname, l.Owner, "posix", typ, r.pid, r.start, r.end})
+			}
+		}
+	}
+	sort.SliceStable(locks, func(i, j int) bool {
+		a, b := locks[i], locks[j]
+		if a.Inode != b.Inode {
+			return a.Inode < b.Inode
+		} else if a.Sid != b.Sid {
+			return a.Sid < b.Sid
+		} else if a.Owner != b.Owner {
+			return a.Owner < b.Owner
+		} else if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Start < b.Start
+	})
+	return locks, nil
+}
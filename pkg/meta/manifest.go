@@ -0,0 +1,98 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+
+	jchunk "github.com/juicedata/juicefs/pkg/chunk" // chunk is the table of sql
+)
+
+func checkManifestOption(opt DumpOption) error {
+	if opt.NoData || opt.Since != nil || opt.Diff != nil {
+		return fmt.Errorf("a chunk manifest can only be written by a full or shard dump")
+	}
+	return nil
+}
+
+// A chunk manifest lists the objects a dump depends on, so that they're kept by the lifecycle
+// policies of the object storage as long as the dump is. Every line is a block of a slice, as
+// "CHUNKID KEY", where KEY is relative to the bucket, ordered by the id and then the index of
+// the block, so that the manifests of two dumps can be compared by diff. A slice referred to by
+// several files, or several times by one, is only listed once.
+//
+// manifestEncoder collects the slices of the files written through it, and writes the manifest
+// of their blocks into w after the dump is finished.
+type manifestEncoder struct {
+	dumpEncoder
+	w          io.Writer
+	prefix     string // the name of the volume, the keys are relative to the bucket
+	bsize      int
+	hashPrefix bool
+	slices     map[uint64]uint32 // size of every slice by id
+}
+
+func newManifestEncoder(enc dumpEncoder, w io.Writer, dm *DumpedMeta) (*manifestEncoder, error) {
+	if dm.Setting == nil || dm.Setting.BlockSize <= 0 {
+		return nil, fmt.Errorf("a chunk manifest needs the block size in the setting")
+	}
+	m := &manifestEncoder{enc, w, dm.Setting.Name + "/", dm.Setting.BlockSize * 1024, dm.Setting.Partitions > 1,
+		make(map[uint64]uint32)}
+	for _, f := range dm.DelFiles { // sustained ones are loaded with their slices
+		m.add(f.Chunks)
+	}
+	return m, nil
+}
+
+func (m *manifestEncoder) add(chunks []*DumpedChunk) {
+	for _, c := range chunks {
+		for _, s := range c.Slices {
+			if s.Chunkid > 0 && s.Size > m.slices[s.Chunkid] { // not a hole
+				m.slices[s.Chunkid] = s.Size
+			}
+		}
+	}
+}
+
+func (m *manifestEncoder) writeEntry(e *DumpedEntry) error {
+	m.add(e.Chunks)
+	return m.dumpEncoder.writeEntry(e)
+}
+
+func (m *manifestEncoder) finish() error {
+	if err := m.dumpEncoder.finish(); err != nil {
+		return err
+	}
+	ids := make([]uint64, 0, len(m.slices))
+	for id := range m.slices {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	w := bufio.NewWriter(m.w)
+	for _, id := range ids {
+		size := int(m.slices[id])
+		for indx := 0; indx*m.bsize < size; indx++ {
+			key := m.prefix + jchunk.BlockKey(id, indx, size, m.bsize, m.hashPrefix)
+			if _, err := fmt.Fprintf(w, "%d %s\n", id, key); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,177 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+)
+
+// An ndjson dump has one JSON object per line: a header of everything in DumpedMeta but FSTree,
+// then one record for every path in depth-first order, which is a DumpedEntry with its full path
+// but without children, and the checksum as the last line. A file with hard links has a record
+// at each of its paths, of which the names are escaped as in JSON. Every record can be processed
+// on its own, the tree is rebuilt from the paths when it's loaded. The header is compact, by
+// which it's told from a JSON dump.
+const ndjsonPrefix = `{"`
+
+type ndjsonRecord struct {
+	Path string `json:"path,omitempty"`
+	*DumpedEntry
+	Checksum string `json:",omitempty"` // only in the last line
+}
+
+type ndjsonEncoder struct {
+	w    io.Writer
+	h    hash.Hash64 // of everything written through bw
+	bw   *bufio.Writer
+	dirs []string // path of current directory and its parents
+	// escape of names in the paths, see nameEscaper
+	escape func(string) string
+	// bignums writes the ids of slices as strings, set by writeMeta from the dump
+	bignums bool
+}
+
+func newNDJSONEncoder(w io.Writer, escape func(string) string) *ndjsonEncoder {
+	h := newChecksum()
+	return &ndjsonEncoder{w: w, h: h, bw: bufio.NewWriterSize(io.MultiWriter(w, h), jsonWriteSize), escape: escape}
+}
+
+func (n *ndjsonEncoder) writeLine(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = n.bw.Write(append(data, '\n'))
+	return err
+}
+
+func (n *ndjsonEncoder) writeMeta(dm *DumpedMeta) error {
+	if dm.FSTree != nil {
+		return fmt.Errorf("invalid dumped meta: FSTree should be nil")
+	}
+	if n.bignums = dm.Bignums == bignumsString; n.bignums {
+		return n.writeLine(toBignumMeta(dm))
+	}
+	return n.writeLine(dm)
+}
+
+func (n *ndjsonEncoder) writeRecord(e *DumpedEntry) (string, error) {
+	p := "/"
+	if len(n.dirs) > 0 {
+		p = path.Join(n.dirs[len(n.dirs)-1], n.escape(e.Name))
+	}
+	entries := e.Entries
+	e.Entries = nil
+	var err error
+	if r := (&ndjsonRecord{Path: p, DumpedEntry: e}); n.bignums {
+		err = n.writeLine(&bignumRecord{r, toBignumChunks(e.Chunks)})
+	} else {
+		err = n.writeLine(r)
+	}
+	e.Entries = entries
+	return p, err
+}
+
+func (n *ndjsonEncoder) writeEntry(e *DumpedEntry) error {
+	_, err := n.writeRecord(e)
+	return err
+}
+
+func (n *ndjsonEncoder) beginDir(e *DumpedEntry, _ int) error {
+	p, err := n.writeRecord(e)
+	n.dirs = append(n.dirs, p)
+	return err
+}
+
+func (n *ndjsonEncoder) endDir() error {
+	n.dirs = n.dirs[:len(n.dirs)-1]
+	return nil
+}
+
+func (n *ndjsonEncoder) finish() error {
+	if err := n.bw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(n.w, ndjsonChecksum, formatChecksum(n.h.Sum64()))
+	return err
+}
+
+// decodeNDJSON reads an ndjson dump and rebuilds the tree from the paths of records, the parent
+// of a record must come before it, as written by ndjsonEncoder. The records not kept by keepPath
+// for only are dropped.
+func decodeNDJSON(r io.Reader, only string) (*DumpedMeta, error) {
+	dec := json.NewDecoder(r)
+	dm := &DumpedMeta{}
+	if err := dec.Decode(dm); err != nil {
+		return nil, fmt.Errorf("decode header: %s", err)
+	}
+	unescape := nameUnescaper(dm)
+	if err := upgradeDump(dm); err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]*DumpedEntry)
+	for line := 2; ; line++ {
+		var rec ndjsonRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("decode line %d: %s", line, err)
+		}
+		if rec.DumpedEntry == nil {
+			dm.Checksum = rec.Checksum
+			continue
+		}
+		e := rec.DumpedEntry
+		p := rec.Path
+		if unescape != nil {
+			p = unescape(p)
+		}
+		if !keepPath(p, only) {
+			continue
+		}
+		if e.Attr == nil {
+			return nil, fmt.Errorf("no attr for entry %s at line %d", rec.Path, line)
+		}
+		if rec.Path == "/" {
+			if dm.FSTree != nil {
+				return nil, fmt.Errorf("duplicated root at line %d", line)
+			}
+			dm.FSTree = e
+		} else {
+			parent := dirs[path.Dir(rec.Path)]
+			if parent == nil {
+				return nil, fmt.Errorf("parent of %s is not found before line %d", rec.Path, line)
+			}
+			if e.Name = path.Base(rec.Path); unescape != nil {
+				e.Name = unescape(e.Name)
+			}
+			parent.Entries[e.Name] = e
+		}
+		if e.Attr.Type == "directory" {
+			e.Entries = make(map[string]*DumpedEntry)
+			dirs[rec.Path] = e
+		}
+	}
+	if dm.FSTree == nil {
+		return nil, fmt.Errorf("no root in the dump")
+	}
+	return dm, nil
+}
@@ -0,0 +1,283 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// keepPath tells if the entry at p is kept when only the subtree at only is loaded, which is
+// the case for the subtree and the directories on the way to it. An empty only keeps all.
+func keepPath(p, only string) bool {
+	if only == "" || p == "/" || p == only {
+		return true
+	}
+	return strings.HasPrefix(only, p+"/") || strings.HasPrefix(p, only+"/")
+}
+
+// decodeJSON decodes a dump in JSON like json.Decoder, but the trees are decoded token by token
+// by jsonScanner with an explicit stack, as deep as they are, while json.Decoder stops at 10000
+// levels of nesting, two for every directory. Only the entries kept by keepPath for only are in FSTree, the others
+// are skipped, so that they're never decoded into memory, nor is the whole dump buffered.
+func decodeJSON(r io.Reader, only string) (*DumpedMeta, error) {
+	dec := newJSONScanner(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	header := make(map[string]json.RawMessage)
+	var tree *DumpedEntry
+	var roots map[string]*DumpedEntry
+	for dec.More() {
+		key, err := jsonKey(dec)
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "FSTree":
+			var head DumpedMeta // the version and escaping are written before FSTree
+			if v, ok := header["Version"]; ok {
+				if err = json.Unmarshal(v, &head.Version); err != nil {
+					return nil, fmt.Errorf("decode version: %s", err)
+				}
+			}
+			if v, ok := header["Escape"]; ok {
+				if err = json.Unmarshal(v, &head.Escape); err != nil {
+					return nil, fmt.Errorf("decode escape: %s", err)
+				}
+			}
+			if tree, err = decodeJSONEntry(dec, "/", only, nameUnescaper(&head)); err != nil {
+				return nil, fmt.Errorf("decode tree: %s", err)
+			}
+		case "Roots":
+			roots = make(map[string]*DumpedEntry)
+			if err = expectDelim(dec, '{'); err != nil {
+				return nil, fmt.Errorf("decode roots: %s", err)
+			}
+			for dec.More() {
+				name, err := jsonKey(dec)
+				if err != nil {
+					return nil, fmt.Errorf("decode roots: %s", err)
+				}
+				if roots[name], err = decodeJSONEntry(dec, "/", "", nil); err != nil {
+					return nil, fmt.Errorf("decode root %s: %s", name, err)
+				}
+			}
+			if err = expectDelim(dec, '}'); err != nil {
+				return nil, fmt.Errorf("decode roots: %s", err)
+			}
+		default:
+			var v json.RawMessage
+			if err = dec.Decode(&v); err != nil {
+				return nil, fmt.Errorf("decode %s: %s", key, err)
+			}
+			header[key] = v
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	dm := &DumpedMeta{}
+	if err = json.Unmarshal(data, dm); err != nil {
+		return nil, err
+	}
+	dm.FSTree, dm.Roots = tree, roots
+	return dm, nil
+}
+
+// decodeJSONEntry decodes the entry at p and everything under it, the names of its entries are
+// kept as in the dump, unescape is only for the paths to be kept.
+func decodeJSONEntry(dec *jsonScanner, p, only string, unescape func(string) string) (*DumpedEntry, error) {
+	type frame struct {
+		e         *DumpedEntry
+		name      string
+		p         string // only for only, as the paths grow with depth
+		inEntries bool   // the next key is the name of a child
+	}
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	root := &DumpedEntry{}
+	stack := []*frame{{e: root, name: p, p: p}}
+	where := func() string {
+		names := make([]string, len(stack))
+		for i, f := range stack {
+			names[i] = f.name
+		}
+		return path.Join(names...)
+	}
+	for len(stack) > 0 {
+		f := stack[len(stack)-1]
+		if !dec.More() {
+			if f.inEntries {
+				f.inEntries = false
+			} else {
+				stack = stack[:len(stack)-1]
+			}
+			if err := expectDelim(dec, '}'); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		key, err := jsonKey(dec)
+		if err != nil {
+			return nil, err
+		}
+		if f.inEntries {
+			name := key
+			if unescape != nil {
+				name = unescape(key)
+			}
+			var cp string
+			if only != "" {
+				cp = path.Join(f.p, name)
+			}
+			if !keepPath(cp, only) {
+				err = skipJSON(dec)
+			} else if err = expectDelim(dec, '{'); err == nil {
+				c := &DumpedEntry{}
+				f.e.Entries[key] = c
+				stack = append(stack, &frame{e: c, name: name, p: cp})
+			}
+			if err != nil {
+				return nil, fmt.Errorf("entries of %s: %s", where(), err)
+			}
+			continue
+		}
+		switch key {
+		case "attr":
+			err = dec.Decode(&f.e.Attr)
+		case "symlink":
+			err = dec.Decode(&f.e.Symlink)
+		case "xattrs":
+			err = dec.Decode(&f.e.Xattrs)
+		case "chunks":
+			err = dec.Decode(&f.e.Chunks)
+		case "dirStats":
+			err = dec.Decode(&f.e.DirStats)
+		case "hash":
+			err = dec.Decode(&f.e.Hash)
+		case "entries":
+			if err = expectDelim(dec, '{'); err == nil {
+				f.e.Entries = make(map[string]*DumpedEntry)
+				f.inEntries = true
+			}
+		default: // ignored like json.Decoder
+			err = skipJSON(dec)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s of %s: %s", key, where(), err)
+		}
+	}
+	return root, nil
+}
+
+func jsonKey(dec jsonTokens) (string, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	key, ok := t.(string)
+	if !ok {
+		return "", fmt.Errorf("expect a key but got %v", t)
+	}
+	return key, nil
+}
+
+func expectDelim(dec jsonTokens, d json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != d {
+		return fmt.Errorf("expect %s but got %v", d, t)
+	}
+	return nil
+}
+
+// skipJSON reads the next value from dec and drops it.
+func skipJSON(dec jsonTokens) error {
+	var depth int
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// extractSubtree replaces the tree in dm by the directory at opt.Only, which becomes the root.
+// The files to be deleted and kept by sessions are dropped, as they're out of the tree. A hard
+// linked file only keeps the links in the subtree, others are dropped with their parents.
+func extractSubtree(dm *DumpedMeta, opt LoadOption) error {
+	if dm.BaseVersion != 0 {
+		return fmt.Errorf("a subtree can't be loaded from a delta dump")
+	}
+	if dm.InodeRange != nil || len(opt.Shards) > 0 {
+		return fmt.Errorf("a subtree can't be loaded from shards")
+	}
+	e := dm.FSTree
+	for _, name := range strings.Split(strings.Trim(opt.Only, "/"), "/") {
+		if e = e.Entries[name]; e == nil {
+			return fmt.Errorf("%s is not found in the dump", opt.Only)
+		}
+	}
+	if e.Attr.Type != "directory" {
+		return fmt.Errorf("%s is not a directory but %s in the dump", opt.Only, e.Attr.Type)
+	}
+	links := make(map[Ino]uint32)
+	var dropped int
+	stack := []*DumpedEntry{e}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, cc := range c.Entries {
+			stack = append(stack, cc)
+		}
+		if c.Attr.Type != "regular" || c.Attr.Nlink <= 1 {
+			continue
+		}
+		if links[c.Attr.Inode]++; links[c.Attr.Inode] == 1 {
+			dropped++ // until all the links are found
+		}
+		if links[c.Attr.Inode] == c.Attr.Nlink {
+			dropped--
+		}
+	}
+	if dropped > 0 {
+		logger.Warnf("%d hard linked files have links out of %s, which are dropped", dropped, opt.Only)
+	}
+	e.Name = ""
+	dm.FSTree, dm.DelFiles, dm.Sustained = e, nil, nil
+	logger.Infof("Only %s is loaded from the dump", opt.Only)
+	return nil
+}
@@ -0,0 +1,227 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// inodeScanner is implemented by every metadata engine to find the inodes not in the tree.
+type inodeScanner interface {
+	// scanInodes calls fn with every inode which has an attr, in any order.
+	scanInodes(fn func(inode Ino)) error
+}
+
+// DumpedOrphan is an inode which no directory refers to, e.g. left by a crashed operation,
+// which is never dumped by the tree walk, and its space is never freed.
+type DumpedOrphan struct {
+	Attr *DumpedAttr `json:"attr"`
+	// Space is counted like the used space, with all the entries under it for a directory
+	Space int64 `json:"space"`
+	// Path is where it's adopted in the dump, relative to the root, empty if not adopted
+	Path string `json:"path,omitempty"`
+}
+
+// lostFound is the name of the directory under the root the orphans are adopted into, like fsck.
+const lostFound = "lost+found"
+
+func entrySpace(e *DumpedEntry) int64 {
+	switch e.Attr.Type {
+	case "regular":
+		return align4K(e.Attr.Length)
+	case "symlink":
+		return align4K(uint64(len(e.Symlink)))
+	default:
+		return align4K(0)
+	}
+}
+
+// walkTree calls visit with every entry under the directory inode once, seen is shared to
+// visit the entries reached from another directory only once.
+func walkTree(d dumper, inode Ino, seen map[Ino]bool, visit func(e *Entry) error) error {
+	dirs := []Ino{inode}
+	for len(dirs) > 0 {
+		dir := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		entries, err := d.dumpDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if seen[e.Inode] {
+				continue
+			}
+			seen[e.Inode] = true
+			if err = visit(e); err != nil {
+				return err
+			}
+			if e.Attr.Typ == TypeDirectory {
+				dirs = append(dirs, e.Inode)
+			}
+		}
+	}
+	return nil
+}
+
+// findOrphans walks the directories under root, which must be the root of the volume, and then
+// scans all the inodes of the engine, the ones not reached by the walk are orphans, except the
+// files to be deleted in dm. Only the top ones are returned, ordered by inode, the entries under
+// an orphaned directory are counted in its space. Inodes changed after it starts are skipped,
+// since they may be created meanwhile.
+func findOrphans(d dumper, dm *DumpedMeta, root Ino, opt DumpOption) ([]*DumpedOrphan, error) {
+	s, ok := d.(inodeScanner)
+	if !ok {
+		return nil, fmt.Errorf("orphans can't be found in this metadata engine")
+	}
+	if root != 1 || opt.filtered() || len(opt.InodeRange) > 0 || opt.Since != nil {
+		return nil, fmt.Errorf("orphans can only be found by a full dump of the whole volume")
+	}
+	start := time.Now()
+	var estimate int64
+	if dm.Counters != nil {
+		estimate = dm.Counters.UsedInodes + 1
+	}
+	bar := newProgress("Find orphans progress: ", estimate, opt.ProgressInterval, opt.Progress)
+	reached := map[Ino]bool{root: true}
+	for _, f := range dm.DelFiles { // with the sustained ones
+		reached[f.Inode] = true
+	}
+	bar.Incr(1)
+	err := walkTree(d, root, reached, func(e *Entry) error { bar.Incr(1); return nil })
+	bar.Done()
+	if err != nil {
+		return nil, err
+	}
+	var candidates []Ino
+	if err := s.scanInodes(func(inode Ino) {
+		if !reached[inode] {
+			candidates = append(candidates, inode)
+		}
+	}); err != nil {
+		return nil, fmt.Errorf("scan inodes: %s", err)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+
+	var orphans []*DumpedOrphan
+	under := make(map[Ino]bool) // under an orphaned directory
+	for _, inode := range candidates {
+		e, err := d.dumpEntry(inode)
+		if err != nil {
+			logger.Warnf("Dump orphaned inode %d: %s", inode, err)
+			continue
+		}
+		if time.Unix(e.Attr.Ctime, int64(e.Attr.Ctimensec)).After(start) {
+			continue
+		}
+		o := &DumpedOrphan{Attr: e.Attr, Space: entrySpace(e)}
+		if e.Attr.Type == "directory" {
+			err = walkTree(d, inode, map[Ino]bool{inode: true}, func(c *Entry) error {
+				under[c.Inode] = true
+				ce, err := d.dumpEntry(c.Inode)
+				if err != nil {
+					return err
+				}
+				o.Space += entrySpace(ce)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		orphans = append(orphans, o)
+	}
+	top := orphans[:0]
+	for _, o := range orphans {
+		if !under[o.Attr.Inode] {
+			top = append(top, o)
+		}
+	}
+	return top, nil
+}
+
+// orphanDumper adds a new directory under the root with the orphans in it, named by their
+// inodes like "#123". Its inode is the next one in dm, which is counted in the used inodes. The
+// nlink of the root is counted from its children, which may still count an orphaned directory.
+type orphanDumper struct {
+	dumper
+	root      Ino
+	rootNlink uint32
+	attr      *DumpedAttr // of the new directory
+	name      string
+	orphans   []*DumpedOrphan
+}
+
+func newOrphanDumper(d dumper, dm *DumpedMeta, root Ino, orphans []*DumpedOrphan) (*orphanDumper, error) {
+	entries, err := d.dumpDir(root)
+	if err != nil {
+		return nil, err
+	}
+	inode := Ino(dm.Counters.NextInode)
+	name := lostFound
+	var rootNlink uint32 = 3 // with the new directory
+	for _, e := range entries {
+		if string(e.Name) == lostFound { // not to merge them into an existing directory
+			name = fmt.Sprintf("%s.%d", lostFound, inode)
+		}
+		if e.Attr.Typ == TypeDirectory {
+			rootNlink++
+		}
+	}
+	now := time.Now()
+	attr := &DumpedAttr{Inode: inode, Type: "directory", Mode: 0700, Nlink: 2,
+		Atime: now.Unix(), Mtime: now.Unix(), Ctime: now.Unix(),
+		Atimensec: uint32(now.Nanosecond()), Mtimensec: uint32(now.Nanosecond()), Ctimensec: uint32(now.Nanosecond())}
+	for _, o := range orphans {
+		o.Path = fmt.Sprintf("%s/#%d", name, o.Attr.Inode)
+		if o.Attr.Type == "directory" {
+			attr.Nlink++
+		}
+	}
+	dm.Counters.NextInode++
+	dm.Counters.UsedInodes++
+	dm.Counters.UsedSpace += align4K(0)
+	return &orphanDumper{d, root, rootNlink, attr, name, orphans}, nil
+}
+
+func (d *orphanDumper) dumpEntry(inode Ino) (*DumpedEntry, error) {
+	if inode == d.attr.Inode {
+		attr := *d.attr
+		return &DumpedEntry{Attr: &attr}, nil
+	}
+	e, err := d.dumper.dumpEntry(inode)
+	if err == nil && inode == d.root {
+		e.Attr.Nlink = d.rootNlink
+	}
+	return e, err
+}
+
+func (d *orphanDumper) dumpDir(inode Ino) ([]*Entry, error) {
+	if inode == d.attr.Inode {
+		entries := make([]*Entry, 0, len(d.orphans))
+		for _, o := range d.orphans {
+			name := fmt.Sprintf("#%d", o.Attr.Inode)
+			entries = append(entries, &Entry{Inode: o.Attr.Inode, Name: []byte(name), Attr: &Attr{Typ: typeFromString(o.Attr.Type)}})
+		}
+		return entries, nil
+	}
+	entries, err := d.dumper.dumpDir(inode)
+	if err == nil && inode == d.root {
+		entries = append(entries, &Entry{Inode: d.attr.Inode, Name: []byte(d.name), Attr: &Attr{Typ: TypeDirectory}})
+	}
+	return entries, err
+}
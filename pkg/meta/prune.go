@@ -0,0 +1,122 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import "fmt"
+
+// pruneDumper drops the children in pruned when directories are listed, whose subtrees are never
+// read then.
+type pruneDumper struct {
+	dumper
+	pruned map[Ino]bool
+}
+
+func (d pruneDumper) dumpDir(inode Ino) ([]*Entry, error) {
+	entries, err := d.dumper.dumpDir(inode)
+	if err != nil {
+		return nil, err
+	}
+	kept := entries[:0]
+	for _, e := range entries {
+		if !d.pruned[e.Inode] {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
+
+// findEmpty walks the tree under root before anything is dumped, and returns the entries to be
+// skipped by SkipEmptyFiles and SkipEmptyDirs: the files of zero length, and the directories
+// with nothing left under them, which are decided after all their children, so a directory
+// with only empty ones in it is skipped too. The root is always kept. The length of every file
+// is read by another dumpEntry, and only the inodes of the directories and hard linked files are
+// kept in memory, like countDirStats.
+func findEmpty(d dumper, dm *DumpedMeta, root Ino, opt DumpOption) (map[Ino]bool, error) {
+	var estimate int64
+	if dm.Counters != nil {
+		estimate = dm.Counters.UsedInodes + 1
+	}
+	bar := newProgress("Find empty progress: ", estimate, opt.ProgressInterval, opt.Progress)
+	defer bar.Done()
+	pruned := make(map[Ino]bool)
+	kept := map[Ino]int{root: 0} // number of children kept in every directory
+	parents := make(map[Ino]Ino)
+	order := []Ino{root}         // parents before children
+	linked := make(map[Ino]bool) // hard linked files not empty
+	var files, dirs int
+	bar.Incr(1)
+	for i := 0; i < len(order); i++ {
+		dir := order[i]
+		entries, err := d.dumpDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Attr.Typ == TypeDirectory {
+				if _, ok := kept[e.Inode]; ok {
+					return nil, fmt.Errorf("directory %d has more than one parent", e.Inode)
+				}
+				bar.Incr(1)
+				kept[e.Inode] = 0
+				parents[e.Inode] = dir
+				order = append(order, e.Inode)
+				continue
+			}
+			if !opt.SkipEmptyFiles || e.Attr.Typ != TypeFile {
+				bar.Incr(1)
+				kept[dir]++
+				continue
+			}
+			if pruned[e.Inode] {
+				continue
+			} else if linked[e.Inode] {
+				kept[dir]++
+				continue
+			}
+			bar.Incr(1)
+			de, err := d.dumpEntry(e.Inode)
+			if err != nil {
+				return nil, err
+			}
+			if de.Attr.Length == 0 {
+				pruned[e.Inode] = true
+				files++
+				continue
+			}
+			if de.Attr.Nlink > 1 {
+				linked[e.Inode] = true
+			}
+			kept[dir]++
+		}
+	}
+	for i := len(order) - 1; i > 0; i-- {
+		if opt.SkipEmptyDirs && kept[order[i]] == 0 {
+			pruned[order[i]] = true
+			dirs++
+		} else {
+			kept[parents[order[i]]]++
+		}
+	}
+	logger.Infof("Skip %d empty files and %d empty directories", files, dirs)
+	return pruned, nil
+}
+
+// pruneCounters takes the pruned entries out of the counters, every one of which is an inode of
+// 4096 bytes, as an empty file takes a block in the used space too.
+func pruneCounters(cs *DumpedCounters, pruned map[Ino]bool) {
+	cs.UsedInodes -= int64(len(pruned))
+	cs.UsedSpace -= int64(len(pruned)) * 4096
+}
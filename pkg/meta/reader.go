@@ -0,0 +1,367 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+)
+
+// DumpReader reads the entries of a dump one by one, so that a dump of any size can be analyzed
+// without loading it. It takes a dump in any format written by DumpMeta, which is decompressed
+// and decrypted like a load, but not a diff or a container of snapshots.
+type DumpReader struct {
+	// Meta has everything in the dump but FSTree, which are read before the entries. Checksum
+	// is set after the last entry is read, and so is anything after FSTree in a JSON dump.
+	Meta    *DumpedMeta
+	br      *bufio.Reader
+	cr      *checksumReader
+	format  string
+	closers []io.Closer
+	next    func() (*DumpedEntry, string, error)
+	err     error // returned by all the calls of Next after io.EOF or an error
+}
+
+// NewDumpReader reads the dump in r up to its first entry, an encrypted one is decrypted by key.
+func NewDumpReader(r io.Reader, key *DumpKey) (*DumpReader, error) {
+	br, format, closers, err := plainDump(r, key)
+	d := &DumpReader{format: format, closers: closers}
+	if err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+	d.cr = newChecksumReader(br, format)
+	d.br = bufio.NewReaderSize(d.cr, jsonWriteSize)
+	switch format {
+	case "binary":
+		err = d.openBinary()
+	case "ndjson":
+		err = d.openNDJSON()
+	default:
+		err = d.openJSON()
+	}
+	if err == nil {
+		err = upgradeDump(d.Meta)
+	}
+	if err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Next returns the next entry and its path in the dump, in depth-first order. The parent and name
+// of the entry are set, but not the entries of a directory, which are the ones coming after it
+// with its path as the prefix. It returns io.EOF after the last entry if the dump is intact, the
+// checksum of the dump is verified then.
+func (d *DumpReader) Next() (*DumpedEntry, string, error) {
+	if d.err != nil {
+		return nil, "", d.err
+	}
+	e, p, err := d.next()
+	if err == io.EOF {
+		err = d.finish()
+	}
+	if err != nil {
+		d.err = err
+		return nil, "", err
+	}
+	return e, p, nil
+}
+
+// Close releases the decompressors of the dump, but the underlying reader is left open.
+func (d *DumpReader) Close() error {
+	for _, c := range d.closers {
+		_ = c.Close()
+	}
+	d.closers = nil
+	return nil
+}
+
+// finish reads the rest of the dump and verifies its checksum, io.EOF is returned if it's fine.
+func (d *DumpReader) finish() error {
+	if _, err := io.Copy(ioutil.Discard, d.br); err != nil {
+		return err
+	}
+	if err := d.cr.verify(d.Meta, d.format); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// readerDir is a directory being read, of which the entries are not all read yet.
+type readerDir struct {
+	path  string
+	inode Ino
+	left  int // entries left in a binary dump
+}
+
+func (d *DumpReader) openBinary() error {
+	magic := make([]byte, len(binaryMagic))
+	if _, err := io.ReadFull(d.br, magic); err != nil {
+		return err
+	}
+	dec := gob.NewDecoder(d.br)
+	d.Meta = &DumpedMeta{}
+	if err := dec.Decode(d.Meta); err != nil {
+		return fmt.Errorf("decode meta: %s", err)
+	}
+	var dirs []*readerDir
+	started := false
+	d.next = func() (*DumpedEntry, string, error) {
+		for len(dirs) > 0 && dirs[len(dirs)-1].left == 0 {
+			dirs = dirs[:len(dirs)-1]
+		}
+		if started && len(dirs) == 0 {
+			return nil, "", io.EOF
+		}
+		e := &DumpedEntry{}
+		if err := dec.Decode(e); err != nil {
+			return nil, "", fmt.Errorf("decode entry: %s", err)
+		}
+		if e.Attr == nil {
+			return nil, "", fmt.Errorf("no attr for entry %s", e.Name)
+		}
+		p := "/"
+		if started {
+			parent := dirs[len(dirs)-1]
+			parent.left--
+			p, e.Parent = path.Join(parent.path, e.Name), parent.inode
+		} else {
+			started, e.Parent = true, e.Attr.Inode
+		}
+		if e.Attr.Type == "directory" {
+			var n int
+			if err := dec.Decode(&n); err != nil {
+				return nil, "", fmt.Errorf("decode entries of %s: %s", p, err)
+			}
+			dirs = append(dirs, &readerDir{p, e.Attr.Inode, n})
+		}
+		return e, p, nil
+	}
+	return nil
+}
+
+func (d *DumpReader) openNDJSON() error {
+	dec := json.NewDecoder(d.br)
+	d.Meta = &DumpedMeta{}
+	if err := dec.Decode(d.Meta); err != nil {
+		return fmt.Errorf("decode header: %s", err)
+	}
+	unescape := nameUnescaper(d.Meta)
+	var dirs []*readerDir
+	line := 1
+	d.next = func() (*DumpedEntry, string, error) {
+		for {
+			line++
+			var rec ndjsonRecord
+			if err := dec.Decode(&rec); err == io.EOF {
+				return nil, "", io.EOF
+			} else if err != nil {
+				return nil, "", fmt.Errorf("decode line %d: %s", line, err)
+			}
+			if rec.DumpedEntry == nil {
+				d.Meta.Checksum = rec.Checksum
+				continue
+			}
+			e, p := rec.DumpedEntry, rec.Path
+			if unescape != nil {
+				p = unescape(p)
+			}
+			if e.Attr == nil {
+				return nil, "", fmt.Errorf("no attr for entry %s at line %d", p, line)
+			}
+			if p == "/" {
+				if len(dirs) > 0 {
+					return nil, "", fmt.Errorf("duplicated root at line %d", line)
+				}
+				e.Parent = e.Attr.Inode
+			} else {
+				// written in depth-first order, the parent is the last one on the way to root
+				for len(dirs) > 0 && dirs[len(dirs)-1].path != path.Dir(p) {
+					dirs = dirs[:len(dirs)-1]
+				}
+				if len(dirs) == 0 {
+					return nil, "", fmt.Errorf("parent of %s is not found before line %d", p, line)
+				}
+				e.Name, e.Parent = path.Base(p), dirs[len(dirs)-1].inode
+			}
+			if e.Attr.Type == "directory" {
+				dirs = append(dirs, &readerDir{path: p, inode: e.Attr.Inode})
+			}
+			return e, p, nil
+		}
+	}
+	return nil
+}
+
+// openJSON reads the fields of a JSON dump before FSTree, the entries are read by tokens. Every
+// directory must have its entries as the last field, as written by writeJsonWithOutEntry.
+func (d *DumpReader) openJSON() error {
+	dec := newJSONScanner(d.br)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	header := make(map[string]json.RawMessage)
+	for {
+		if !dec.More() {
+			return fmt.Errorf("no FSTree in the dump")
+		}
+		key, err := jsonKey(dec)
+		if err != nil {
+			return err
+		}
+		if key == "FSTree" {
+			break
+		}
+		var v json.RawMessage
+		if err = dec.Decode(&v); err != nil {
+			return fmt.Errorf("decode %s: %s", key, err)
+		}
+		header[key] = v
+	}
+	d.Meta = &DumpedMeta{}
+	data, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, d.Meta); err != nil {
+		return err
+	}
+	unescape := nameUnescaper(d.Meta)
+
+	var dirs []*readerDir
+	started := false
+	d.next = func() (*DumpedEntry, string, error) {
+		if !started {
+			started = true
+			e, more, err := readJSONEntry(dec, "/")
+			if err != nil {
+				return nil, "", err
+			}
+			e.Parent = e.Attr.Inode
+			if more {
+				dirs = append(dirs, &readerDir{path: "/", inode: e.Attr.Inode})
+			}
+			return e, "/", nil
+		}
+		for len(dirs) > 0 {
+			parent := dirs[len(dirs)-1]
+			if !dec.More() { // the end of entries and the directory
+				if err := expectDelim(dec, '}'); err != nil {
+					return nil, "", err
+				}
+				if dec.More() {
+					key, _ := jsonKey(dec)
+					return nil, "", fmt.Errorf("%s of %s after its entries is not supported", key, parent.path)
+				}
+				if err := expectDelim(dec, '}'); err != nil {
+					return nil, "", err
+				}
+				dirs = dirs[:len(dirs)-1]
+				continue
+			}
+			name, err := jsonKey(dec)
+			if err != nil {
+				return nil, "", err
+			}
+			if unescape != nil {
+				name = unescape(name)
+			}
+			p := path.Join(parent.path, name)
+			e, more, err := readJSONEntry(dec, p)
+			if err != nil {
+				return nil, "", err
+			}
+			e.Name, e.Parent = name, parent.inode
+			if more {
+				dirs = append(dirs, &readerDir{path: p, inode: e.Attr.Inode})
+			}
+			return e, p, nil
+		}
+		// the fields after FSTree, e.g. Checksum
+		for dec.More() {
+			key, err := jsonKey(dec)
+			if err != nil {
+				return nil, "", err
+			}
+			switch key {
+			case "Checksum":
+				err = dec.Decode(&d.Meta.Checksum)
+			default:
+				err = skipJSON(dec)
+			}
+			if err != nil {
+				return nil, "", fmt.Errorf("decode %s: %s", key, err)
+			}
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return nil, "", err
+		}
+		return nil, "", io.EOF
+	}
+	return nil
+}
+
+// readJSONEntry reads the fields of the entry at p up to its entries, more tells if they follow.
+// Otherwise the whole entry is read.
+func readJSONEntry(dec *jsonScanner, p string) (e *DumpedEntry, more bool, err error) {
+	if err = expectDelim(dec, '{'); err != nil {
+		return
+	}
+	e = &DumpedEntry{}
+	for dec.More() {
+		var key string
+		if key, err = jsonKey(dec); err != nil {
+			return
+		}
+		switch key {
+		case "attr":
+			err = dec.Decode(&e.Attr)
+		case "symlink":
+			err = dec.Decode(&e.Symlink)
+		case "xattrs":
+			err = dec.Decode(&e.Xattrs)
+		case "chunks":
+			err = dec.Decode(&e.Chunks)
+		case "dirStats":
+			err = dec.Decode(&e.DirStats)
+		case "entries":
+			more = true
+			err = expectDelim(dec, '{')
+		default: // ignored like json.Decoder
+			err = skipJSON(dec)
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("%s of %s: %s", key, p, err)
+		}
+		if more {
+			break
+		}
+	}
+	if e.Attr == nil {
+		return nil, false, fmt.Errorf("no attr for entry %s", p)
+	}
+	if !more {
+		err = expectDelim(dec, '}')
+	}
+	return
+}
@@ -70,6 +70,7 @@ const delfiles = "delfiles"
 const allSessions = "sessions"
 const sessionInfos = "sessionInfos"
 const sliceRefs = "sliceRef"
+const loadCheckpoint = "loadCheckpoint"
 
 type redisMeta struct {
 	sync.Mutex
@@ -2904,7 +2905,7 @@ func (m *redisMeta) dumpEntry(inode Ino) (*DumpedEntry, error) {
 				ss := readSlices(vals)
 				slices := make([]*DumpedSlice, 0, len(ss))
 				for _, s := range ss {
-					slices = append(slices, &DumpedSlice{s.pos, s.chunkid, s.size, s.off, s.len})
+					slices = append(slices, &DumpedSlice{s.pos, s.chunkid, s.size, s.off, s.len, nil})
 				}
 				e.Chunks = append(e.Chunks, &DumpedChunk{indx, slices})
 			}
@@ -2923,36 +2924,41 @@ func (m *redisMeta) dumpEntry(inode Ino) (*DumpedEntry, error) {
 	}
 }
 
-func (m *redisMeta) dumpDir(inode Ino, showProgress func(totalIncr, currentIncr int64)) (map[string]*DumpedEntry, error) {
-	ctx := Background
-	keys, err := m.rdb.HGetAll(ctx, m.entryKey(inode)).Result()
+func (m *redisMeta) dumpDir(inode Ino) ([]*Entry, error) {
+	keys, err := m.rdb.HGetAll(Background, m.entryKey(inode)).Result()
 	if err != nil {
 		return nil, err
 	}
-	if showProgress != nil {
-		showProgress(int64(len(keys)), 0)
-	}
-	entries := make(map[string]*DumpedEntry)
+	entries := make([]*Entry, 0, len(keys))
 	for k, v := range keys {
 		typ, inode := m.parseEntry([]byte(v))
-		entry, err := m.dumpEntry(inode)
+		entries = append(entries, &Entry{Inode: inode, Name: []byte(k), Attr: &Attr{Typ: typ}})
+	}
+	return entries, nil
+}
+
+func (m *redisMeta) scanInodes(fn func(inode Ino)) error {
+	var cursor uint64
+	for {
+		keys, c, err := m.rdb.Scan(Background, cursor, "i*", 10000).Result()
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if typ == TypeDirectory {
-			if entry.Entries, err = m.dumpDir(inode, showProgress); err != nil {
-				return nil, err
+		for _, k := range keys {
+			if inode, err := strconv.ParseUint(k[1:], 10, 64); err == nil {
+				fn(Ino(inode))
 			}
 		}
-		entries[k] = entry
-		if showProgress != nil {
-			showProgress(0, 1)
+		if cursor = c; cursor == 0 {
+			return nil
 		}
 	}
-	return entries, nil
 }
 
-func (m *redisMeta) DumpMeta(w io.Writer) error {
+func (m *redisMeta) DumpMeta(w io.Writer, opt DumpOption) error {
+	if opt.Consistent {
+		return errConsistent(m.Name())
+	}
 	ctx := Background
 	zs, err := m.rdb.ZRangeWithScores(ctx, delfiles, 0, -1).Result()
 	if err != nil {
@@ -2966,30 +2972,9 @@ func (m *redisMeta) DumpMeta(w io.Writer) error {
 		}
 		inode, _ := strconv.ParseUint(parts[0], 10, 64)
 		length, _ := strconv.ParseUint(parts[1], 10, 64)
-		dels = append(dels, &DumpedDelFile{Ino(inode), length, int64(z.Score)})
-	}
-
-	tree, err := m.dumpEntry(m.root)
-	if err != nil {
-		return err
+		dels = append(dels, &DumpedDelFile{Ino(inode), length, int64(z.Score), nil})
 	}
 
-	var total int64 = 1 // root
-	progress, bar := utils.NewDynProgressBar("Dump dir progress: ", false)
-	bar.Increment()
-	if tree.Entries, err = m.dumpDir(m.root, func(totalIncr, currentIncr int64) {
-		total += totalIncr
-		bar.SetTotal(total, false)
-		bar.IncrInt64(currentIncr)
-	}); err != nil {
-		return err
-	}
-	if bar.Current() != total {
-		logger.Warnf("Dumped %d / total %d, some entries are not dumped", bar.Current(), total)
-	}
-	bar.SetTotal(0, true) // FIXME: current != total
-	progress.Wait()
-
 	format, err := m.Load()
 	if err != nil {
 		return err
@@ -3025,105 +3010,229 @@ func (m *redisMeta) DumpMeta(w io.Writer) error {
 	}
 
 	dm := &DumpedMeta{
-		format,
-		&DumpedCounters{
+		Setting: format,
+		Counters: &DumpedCounters{
 			UsedSpace:   cs[0],
 			UsedInodes:  cs[1],
 			NextInode:   cs[2] + 1, // Redis counter is 1 smaller than sql/tkv
 			NextChunk:   cs[3] + 1,
 			NextSession: cs[4] + 1,
 		},
-		sessions,
-		dels,
-		tree,
+		Sustained: sessions,
+		DelFiles:  dels,
+	}
+	if opt.Locks {
+		if dm.Locks, err = readLocks(m); err != nil {
+			return err
+		}
+	}
+	src, err := dumpSource(m, dm.Counters, opt)
+	if err != nil {
+		return err
+	}
+	if m.root != 1 || opt.filtered() || len(opt.Roots) > 0 {
+		if err = countSubtree(src, m.root, dm.Counters, opt); err != nil {
+			return err
+		}
 	}
-	return dm.writeJSON(w)
+	return dumpTree(src, dm, m.root, w, opt)
 }
 
-func collectEntry(e *DumpedEntry, entries map[Ino]*DumpedEntry, showProgress func(totalIncr, currentIncr int64)) error {
-	typ := typeFromString(e.Attr.Type)
-	inode := e.Attr.Inode
-	if showProgress != nil {
-		if typ == TypeDirectory {
-			showProgress(int64(len(e.Entries)), 1)
-		} else {
-			showProgress(0, 1)
+// InodeConflictError is an inode found at two places of a dump, which can't be one inode, e.g.
+// a directory with another name, or a file and a symlink. The first place is the collected one.
+type InodeConflictError struct {
+	Inode   Ino
+	Types   [2]string // types of the two entries, e.g. "directory" and "regular"
+	Paths   [2]string // paths of the two entries relative to the dumped root, like "/d1/f11"
+	Parents [2]Ino
+}
+
+func (e *InodeConflictError) Error() string {
+	return fmt.Sprintf("inode conflict: %d, %s %s (parent %d) and %s %s (parent %d)", e.Inode,
+		e.Types[0], e.Paths[0], e.Parents[0], e.Types[1], e.Paths[1], e.Parents[1])
+}
+
+// InodeConflicts are all the inode conflicts found in a dump.
+type InodeConflicts []*InodeConflictError
+
+func (cs InodeConflicts) Error() string {
+	msgs := make([]string, len(cs))
+	for i, c := range cs {
+		msgs[i] = c.Error()
+	}
+	return fmt.Sprintf("%d inode conflicts: %s", len(cs), strings.Join(msgs, "; "))
+}
+
+// SkippedEntry is an entry of a dump skipped by a load with ContinueOnError, with the entries
+// under it.
+type SkippedEntry struct {
+	Inode  Ino         `json:"inode"` // 0 if the entry has no attr
+	Path   string      `json:"path"`  // relative to the dumped root, like the ones of InodeConflictError
+	Reason string      `json:"reason"`
+	Attr   *DumpedAttr `json:"attr,omitempty"` // as in the dump, nil if it has none
+}
+
+// SkippedEntries are all the entries skipped by a load, which is returned after the rest of the
+// dump is loaded.
+type SkippedEntries []*SkippedEntry
+
+func (s SkippedEntries) Error() string {
+	return fmt.Sprintf("%d entries are skipped, the rest of the dump is loaded", len(s))
+}
+
+// orNil returns nil if nothing is skipped, otherwise s.
+func (s SkippedEntries) orNil() error {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+}
+
+// entryPath returns the path of e by the names of its parents collected in entries, "/" for
+// the root of the tree.
+func entryPath(entries map[Ino]*DumpedEntry, e *DumpedEntry) string {
+	var names []string
+	for {
+		p, ok := entries[e.Parent]
+		if !ok || p == e {
+			break
 		}
+		names = append(names, e.Name)
+		e = p
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
 	}
+	return "/" + strings.Join(names, "/")
+}
 
-	if exist, ok := entries[inode]; ok {
-		attr := e.Attr
-		eattr := exist.Attr
-		if typ != TypeFile || typeFromString(eattr.Type) != TypeFile {
-			return fmt.Errorf("inode conflict: %d", inode)
+// collectEntry gathers e and all the entries under it by inode, with nlink and parent fixed.
+// A problem of the tree fails it, or it's passed to warn with the entry if set and the walk goes
+// on without the entry, which is removed from its parent. The tree is walked with a stack of the
+// entries to be visited, so that its depth is only bounded by the memory. It stops with the error
+// of ctx once it's done, ctx can be nil.
+//
+// A hard linked file is collected at the link of the newest ctime, whose parent is kept as the
+// parent of the inode. All its links have the same attrs in a dump written by DumpMeta, so the
+// entries are visited in the depth-first order of the dump with the names sorted, and the first
+// link wins a tie, the same one in every load.
+func collectEntry(ctx context.Context, e *DumpedEntry, entries map[Ino]*DumpedEntry, showProgress func(totalIncr, currentIncr int64), warn func(e *DumpedEntry, err error)) error {
+	fail := func(e *DumpedEntry, err error) error {
+		if warn == nil {
+			return err
 		}
-		eattr.Nlink++
-		if eattr.Ctime*1e9+int64(eattr.Ctimensec) < attr.Ctime*1e9+int64(attr.Ctimensec) {
-			attr.Nlink = eattr.Nlink
-			entries[inode] = e
+		warn(e, err)
+		if p := entries[e.Parent]; p != nil && p != e && p.Entries[e.Name] == e {
+			delete(p.Entries, e.Name)
+			if e.Attr != nil && e.Attr.Type == "directory" {
+				p.Attr.Nlink--
+			}
 		}
 		return nil
 	}
-	entries[inode] = e
-
-	if typ == TypeFile {
-		e.Attr.Nlink = 1 // reset
-	} else if typ == TypeDirectory {
-		if inode == 1 { // root inode
-			e.Parent = 1
+	stack := []*DumpedEntry{e}
+	for n := 0; len(stack) > 0; n++ {
+		if n%1024 == 0 {
+			if err := ctxErr(ctx); err != nil {
+				return err
+			}
 		}
-		e.Attr.Nlink = 2
-		for name, child := range e.Entries {
-			child.Name = name
-			child.Parent = inode
-			if typeFromString(child.Attr.Type) == TypeDirectory {
-				e.Attr.Nlink++
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if e.Attr == nil {
+			if err := fail(e, fmt.Errorf("no attr for entry %s", entryPath(entries, e))); err != nil {
+				return err
 			}
-			if err := collectEntry(child, entries, showProgress); err != nil {
+			continue
+		}
+		switch e.Attr.Type {
+		case "regular", "directory", "symlink", "fifo", "blockdev", "chardev", "socket":
+		default:
+			if err := fail(e, fmt.Errorf("unknown type %q of inode %d", e.Attr.Type, e.Attr.Inode)); err != nil {
 				return err
 			}
+			continue
+		}
+		typ := typeFromString(e.Attr.Type)
+		inode := e.Attr.Inode
+		if showProgress != nil {
+			if typ == TypeDirectory {
+				showProgress(int64(len(e.Entries)), 1)
+			} else {
+				showProgress(0, 1)
+			}
+		}
+
+		if exist, ok := entries[inode]; ok {
+			attr := e.Attr
+			eattr := exist.Attr
+			if typ != TypeFile || typeFromString(eattr.Type) != TypeFile {
+				if err := fail(e, &InodeConflictError{inode, [2]string{eattr.Type, attr.Type},
+					[2]string{entryPath(entries, exist), entryPath(entries, e)}, [2]Ino{exist.Parent, e.Parent}}); err != nil {
+					return err
+				}
+				continue
+			}
+			eattr.Nlink++
+			if eattr.Ctime*1e9+int64(eattr.Ctimensec) < attr.Ctime*1e9+int64(attr.Ctimensec) {
+				attr.Nlink = eattr.Nlink
+				entries[inode] = e
+			}
+			continue
+		}
+		if typ != TypeFile && typ != TypeDirectory && e.Attr.Nlink != 1 { // nlink should be 1 for other types
+			if err := fail(e, fmt.Errorf("invalid nlink %d for inode %d type %s", e.Attr.Nlink, inode, e.Attr.Type)); err != nil {
+				return err
+			}
+			continue
+		}
+		entries[inode] = e
+
+		if typ == TypeFile {
+			e.Attr.Nlink = 1 // reset
+		} else if typ == TypeDirectory {
+			if inode == 1 { // root inode
+				e.Parent = 1
+			}
+			e.Attr.Nlink = 2
+			names := make([]string, 0, len(e.Entries))
+			for name := range e.Entries {
+				names = append(names, name)
+			}
+			sort.Sort(sort.Reverse(sort.StringSlice(names))) // popped in order
+			for _, name := range names {
+				child := e.Entries[name]
+				child.Name = name
+				child.Parent = inode
+				if child.Attr != nil && child.Attr.Type == "directory" {
+					e.Attr.Nlink++
+				}
+				stack = append(stack, child)
+			}
 		}
-	} else if e.Attr.Nlink != 1 { // nlink should be 1 for other types
-		return fmt.Errorf("invalid nlink %d for inode %d type %s", e.Attr.Nlink, inode, e.Attr.Type)
 	}
 	return nil
 }
 
+// loadEntry writes e together with the checkpoint in a transaction, it's counted in cs and refs.
 func (m *redisMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[string]int) error {
+	return m.commitEntries([]interface{}{m.prepareEntry(e, cs, refs)}, e.Attr.Inode)
+}
+
+// prepareEntry counts e in cs and refs, and returns the function adding the writes of it into a
+// pipeline, which can be called in another goroutine.
+func (m *redisMeta) prepareEntry(e *DumpedEntry, cs *DumpedCounters, refs map[string]int) func(p redis.Pipeliner) {
 	inode := e.Attr.Inode
 	logger.Debugf("Loading entry inode %d name %s", inode, e.Name)
-	ctx := Background
 	attr := loadAttr(e.Attr)
 	attr.Parent = e.Parent
-	p := m.rdb.Pipeline()
 	if attr.Typ == TypeFile {
 		attr.Length = e.Attr.Length
-		for _, c := range e.Chunks {
-			if len(c.Slices) == 0 {
-				continue
-			}
-			slices := make([]string, 0, len(c.Slices))
-			for _, s := range c.Slices {
-				slices = append(slices, string(marshalSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len)))
-				refs[m.sliceKey(s.Chunkid, s.Size)]++
-				if cs.NextChunk < int64(s.Chunkid) {
-					cs.NextChunk = int64(s.Chunkid)
-				}
-			}
-			p.RPush(ctx, m.chunkKey(inode, c.Index), slices)
-		}
+		m.countChunks(e.Chunks, cs, refs)
 	} else if attr.Typ == TypeDirectory {
 		attr.Length = 4 << 10
-		if len(e.Entries) > 0 {
-			dentries := make(map[string]interface{})
-			for _, c := range e.Entries {
-				dentries[c.Name] = m.packEntry(typeFromString(c.Attr.Type), c.Attr.Inode)
-			}
-			p.HSet(ctx, m.entryKey(inode), dentries)
-		}
 	} else if attr.Typ == TypeSymlink {
 		attr.Length = uint64(len(e.Symlink))
-		p.Set(ctx, m.symKey(inode), e.Symlink, 0)
 	}
 	if inode > 1 {
 		cs.UsedSpace += align4K(attr.Length)
@@ -3133,66 +3242,415 @@ func (m *redisMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[strin
 		cs.NextInode = int64(inode)
 	}
 
-	if len(e.Xattrs) > 0 {
-		xattrs := make(map[string]interface{})
-		for _, x := range e.Xattrs {
-			xattrs[x.Name] = x.Value
+	return func(p redis.Pipeliner) {
+		ctx := Background
+		switch attr.Typ {
+		case TypeFile:
+			m.loadChunks(p, inode, e.Chunks)
+		case TypeDirectory:
+			if len(e.Entries) > 0 {
+				dentries := make(map[string]interface{})
+				for _, c := range e.Entries {
+					dentries[c.Name] = m.packEntry(typeFromString(c.Attr.Type), c.Attr.Inode)
+				}
+				p.HSet(ctx, m.entryKey(inode), dentries)
+			}
+		case TypeSymlink:
+			p.Set(ctx, m.symKey(inode), e.Symlink, 0)
+		}
+		if len(e.Xattrs) > 0 {
+			xattrs := make(map[string]interface{})
+			for _, x := range e.Xattrs {
+				xattrs[x.Name] = x.Value
+			}
+			p.HSet(ctx, m.xattrKey(inode), xattrs)
 		}
-		p.HSet(ctx, m.xattrKey(inode), xattrs)
+		p.Set(ctx, m.inodeKey(inode), m.marshal(attr), 0)
+	}
+}
+
+// commitEntries writes the entries prepared by prepareEntry together with ckpt in a transaction.
+func (m *redisMeta) commitEntries(batch []interface{}, ckpt Ino) error {
+	p := m.rdb.TxPipeline()
+	for _, w := range batch {
+		w.(func(p redis.Pipeliner))(p)
 	}
-	p.Set(ctx, m.inodeKey(inode), m.marshal(attr), 0)
+	p.Set(Background, loadCheckpoint, uint64(ckpt), 0)
+	_, err := p.Exec(Background)
+	return err
+}
+
+// countChunks counts the slices in chunks into refs and cs.
+func (m *redisMeta) countChunks(chunks []*DumpedChunk, cs *DumpedCounters, refs map[string]int) {
+	for _, c := range chunks {
+		for _, s := range c.Slices {
+			refs[m.sliceKey(s.Chunkid, s.Size)]++
+			if cs.NextChunk <= int64(s.Chunkid) {
+				cs.NextChunk = int64(s.Chunkid) + 1
+			}
+		}
+	}
+}
+
+// loadChunks adds the chunks of inode into p, replacing the ones written by an interrupted load.
+func (m *redisMeta) loadChunks(p redis.Pipeliner, inode Ino, chunks []*DumpedChunk) {
+	for _, c := range chunks {
+		if len(c.Slices) == 0 {
+			continue
+		}
+		slices := make([]string, 0, len(c.Slices))
+		for _, s := range c.Slices {
+			slices = append(slices, string(marshalSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len)))
+		}
+		p.Del(Background, m.chunkKey(inode, c.Index))
+		p.RPush(Background, m.chunkKey(inode, c.Index), slices)
+	}
+}
+
+func (m *redisMeta) removeInode(inode Ino) error {
+	return m.replaceInode(inode, nil, nil)
+}
+
+// replaceInode replaces everything stored for inode with e, or removes it if e is nil, the
+// references to slices are changed by the difference of the chunks in the same transaction.
+func (m *redisMeta) replaceInode(inode Ino, e *DumpedEntry, known map[sliceID]bool) error {
+	ctx := Background
+	st := m.txn(ctx, func(tx *redis.Tx) error {
+		var keys []string
+		var old []*DumpedChunk
+		a, err := tx.Get(ctx, m.inodeKey(inode)).Bytes()
+		if err == nil {
+			attr := &Attr{}
+			m.parseAttr(a, attr)
+			keys = append(keys, m.inodeKey(inode), m.xattrKey(inode))
+			switch attr.Typ {
+			case TypeFile:
+				for indx := uint32(0); uint64(indx)*ChunkSize < attr.Length; indx++ {
+					vals, err := tx.LRange(ctx, m.chunkKey(inode, indx), 0, 1000000).Result()
+					if err != nil {
+						return err
+					}
+					c := &DumpedChunk{Index: indx}
+					for _, s := range readSlices(vals) {
+						c.Slices = append(c.Slices, &DumpedSlice{Chunkid: s.chunkid, Size: s.size})
+					}
+					old = append(old, c)
+					keys = append(keys, m.chunkKey(inode, indx))
+				}
+			case TypeDirectory:
+				keys = append(keys, m.entryKey(inode))
+			case TypeSymlink:
+				keys = append(keys, m.symKey(inode))
+			}
+		} else if err != redis.Nil {
+			return err
+		}
+		var chunks []*DumpedChunk
+		if e != nil && typeFromString(e.Attr.Type) == TypeFile {
+			chunks = e.Chunks
+		}
+		refs := make(map[string]int64)
+		for id, r := range diffSlices(old, chunks) {
+			if r.new == r.old {
+				continue
+			}
+			k := m.sliceKey(id.chunkid, id.size)
+			stored, err := tx.HGet(ctx, sliceRefs, k).Int64()
+			if err == redis.Nil {
+				stored = -1
+			} else if err != nil {
+				return err
+			}
+			if v := storedRefs(stored, r, known[id]); v != stored && (stored >= 0 || v != 0) {
+				refs[k] = v
+			}
+			if r.new > 0 {
+				known[id] = true
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			if len(keys) > 0 {
+				p.Del(ctx, keys...)
+			}
+			if e != nil {
+				m.prepareEntry(e, &DumpedCounters{}, make(map[string]int))(p)
+			}
+			for k, v := range refs {
+				if v < 0 {
+					p.HDel(ctx, sliceRefs, k)
+				} else {
+					p.HSet(ctx, sliceRefs, k, v)
+				}
+			}
+			return nil
+		})
+		return err
+	}, m.inodeKey(inode), sliceRefs)
+	if st != 0 {
+		return st
+	}
+	return nil
+}
+
+// knownSlices looks up the slices in sliceRefs, where a slice referred only once has no key. Such a
+// slice is known if it's below nextchunk, which is loaded above all the slices, otherwise it's new
+// in the delta. One allocated before the base but written after it is counted once more, which is
+// safe as the objects are left to gc.
+func (m *redisMeta) knownSlices(slices map[sliceID]bool) error {
+	if len(slices) == 0 {
+		return nil
+	}
+	ctx := Background
+	next, err := m.rdb.Get(ctx, "nextchunk").Uint64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	ids := make([]sliceID, 0, len(slices))
+	keys := make([]string, 0, len(slices))
+	for id := range slices {
+		ids = append(ids, id)
+		keys = append(keys, m.sliceKey(id.chunkid, id.size))
+	}
+	for i := 0; i < len(keys); i += 1000 {
+		j := i + 1000
+		if j > len(keys) {
+			j = len(keys)
+		}
+		vals, err := m.rdb.HMGet(ctx, sliceRefs, keys[i:j]...).Result()
+		if err != nil {
+			return err
+		}
+		for k, v := range vals {
+			if id := ids[i+k]; v == nil && id.chunkid >= next {
+				delete(slices, id)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *redisMeta) raiseNextCounters(cs *DumpedCounters) error {
+	ctx := Background
+	next := map[string]int64{"nextinode": cs.NextInode, "nextchunk": cs.NextChunk, "nextsession": cs.NextSession}
+	keys := []string{"nextinode", "nextchunk", "nextsession"}
+	st := m.txn(ctx, func(tx *redis.Tx) error {
+		values, err := tx.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		raised := make(map[string]interface{})
+		for i, k := range keys {
+			var v int64
+			if s, ok := values[i].(string); ok {
+				if v, err = strconv.ParseInt(s, 10, 64); err != nil {
+					return fmt.Errorf("invalid %s: %q", k, s)
+				}
+			}
+			if next[k] > v {
+				raised[k] = next[k]
+			}
+		}
+		if len(raised) == 0 {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.MSet(ctx, raised)
+			return nil
+		})
+		return err
+	}, keys...)
+	if st != 0 {
+		return st
+	}
+	return nil
+}
+
+func (m *redisMeta) graftDir(inode Ino, e *DumpedEntry) error {
+	ctx := Background
+	st := m.txn(ctx, func(tx *redis.Tx) error {
+		a, err := tx.Get(ctx, m.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		attr := &Attr{}
+		m.parseAttr(a, attr)
+		if attr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		dentries := make(map[string]interface{}, len(e.Entries))
+		for _, c := range e.Entries {
+			if err = tx.HGet(ctx, m.entryKey(inode), c.Name).Err(); err == nil {
+				return fmt.Errorf("%s exists in the destination", c.Name)
+			} else if err != redis.Nil {
+				return err
+			}
+			typ := typeFromString(c.Attr.Type)
+			if typ == TypeDirectory {
+				attr.Nlink++
+			}
+			dentries[c.Name] = m.packEntry(typ, c.Attr.Inode)
+		}
+		now := time.Now()
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			if len(dentries) > 0 {
+				p.HSet(ctx, m.entryKey(inode), dentries)
+			}
+			p.Set(ctx, m.inodeKey(inode), m.marshal(attr), 0)
+			return nil
+		})
+		return err
+	}, m.inodeKey(inode), m.entryKey(inode))
+	if st != 0 {
+		return st
+	}
+	return nil
+}
+
+func (m *redisMeta) applyEntry(e *DumpedEntry, known map[sliceID]bool) error {
+	return m.replaceInode(e.Attr.Inode, e, known)
+}
+
+func (m *redisMeta) applyCounters(dm *DumpedMeta) error {
+	ctx := Background
+	p := m.rdb.TxPipeline()
+	p.MSet(ctx, map[string]interface{}{
+		usedSpace:     dm.Counters.UsedSpace,
+		totalInodes:   dm.Counters.UsedInodes,
+		"nextinode":   dm.Counters.NextInode,
+		"nextchunk":   dm.Counters.NextChunk,
+		"nextsession": dm.Counters.NextSession,
+	})
+	for _, d := range dm.DelFiles {
+		p.ZAdd(ctx, delfiles, &redis.Z{Score: float64(d.Expire), Member: m.toDelete(d.Inode, d.Length)})
+	}
+	p.Del(ctx, loadCheckpoint) // written by loadEntry
 	_, err := p.Exec(ctx)
 	return err
 }
 
-func (m *redisMeta) LoadMeta(r io.Reader) error {
+// loadDelFiles writes the files to be deleted, overwriting the ones written before.
+func (m *redisMeta) loadDelFiles(p redis.Pipeliner, dels []*DumpedDelFile) {
+	if len(dels) == 0 {
+		return
+	}
+	zs := make([]*redis.Z, 0, len(dels))
+	for _, d := range dels {
+		m.loadChunks(p, d.Inode, d.Chunks)
+		zs = append(zs, &redis.Z{
+			Score:  float64(d.Expire),
+			Member: m.toDelete(d.Inode, d.Length),
+		})
+	}
+	p.ZAdd(Background, delfiles, zs...)
+}
+
+func (m *redisMeta) WalkTree(root Ino, visit func(path string, e *DumpedEntry) error) error {
+	return walkEntries(m, m.checkRoot(root), visit)
+}
+
+func (m *redisMeta) LoadMeta(r io.Reader, opt LoadOption) error {
 	ctx := Background
 	dbsize, err := m.rdb.DBSize(ctx).Result()
 	if err != nil {
 		return err
 	}
+	if opt.DryRun != nil {
+		return dryRunLoad(r, opt, dbsize > 0)
+	}
+	if opt.AttrsOnly {
+		if dbsize == 0 {
+			return fmt.Errorf("Database %s is empty, there is no attr to be restored", m.Name())
+		}
+		return loadAttrsOnly(m, r, opt)
+	}
+	if opt.ApplyDelta {
+		if dbsize == 0 {
+			return fmt.Errorf("Database %s is empty, load the base dump first", m.Name())
+		}
+		return applyDelta(m, r, opt)
+	}
+	if opt.Phase == "trash" {
+		if dbsize == 0 {
+			return fmt.Errorf("Database %s is empty, load the live phase first", m.Name())
+		}
+		return loadTrashPhase(m, r, opt, func(dels []*DumpedDelFile) error {
+			p := m.rdb.TxPipeline()
+			m.loadDelFiles(p, dels)
+			_, err := p.Exec(ctx)
+			return err
+		})
+	}
+	if opt.Remap != "" {
+		refs := make(map[string]int)
+		cs, err := loadRemapped(m, r, opt, 1, func(e *DumpedEntry, cs *DumpedCounters) error {
+			return m.loadEntry(e, cs, refs)
+		})
+		if err != nil {
+			return err
+		}
+		p := m.rdb.TxPipeline()
+		p.IncrBy(ctx, usedSpace, cs.UsedSpace)
+		p.IncrBy(ctx, totalInodes, cs.UsedInodes)
+		for k, v := range refs {
+			p.HIncrBy(ctx, sliceRefs, k, int64(v))
+		}
+		p.Del(ctx, loadCheckpoint)
+		_, err = p.Exec(ctx)
+		return err
+	}
+	var ckpt uint64
 	if dbsize > 0 {
-		return fmt.Errorf("Database %s is not empty", m.Name())
+		if !opt.Resume {
+			return fmt.Errorf("Database %s is not empty", m.Name())
+		}
+		if ckpt, err = m.rdb.Get(ctx, loadCheckpoint).Uint64(); err == redis.Nil {
+			return fmt.Errorf("Database %s is not empty and has no checkpoint to resume from", m.Name())
+		} else if err != nil {
+			return err
+		}
+		logger.Infof("Resume loading after inode %d", ckpt)
 	}
 
-	dec := json.NewDecoder(r)
-	dm := &DumpedMeta{}
-	if err = dec.Decode(dm); err != nil {
+	dm, err := readDump(r, opt)
+	if err != nil {
 		return err
 	}
 	format, err := json.MarshalIndent(dm.Setting, "", "")
 	if err != nil {
 		return err
 	}
-
-	var total int64 = 1 // root
-	progress, bar := utils.NewDynProgressBar("CollectEntry progress: ", false)
-	dm.FSTree.Attr.Inode = 1
-	entries := make(map[Ino]*DumpedEntry)
-	if err = collectEntry(dm.FSTree, entries, func(totalIncr, currentIncr int64) {
-		total += totalIncr
-		bar.SetTotal(total, false)
-		bar.IncrInt64(currentIncr)
-	}); err != nil {
+	entries, skipped, err := collectEntries(dm, opt)
+	if err != nil {
 		return err
 	}
-	if bar.Current() != total {
-		logger.Warnf("Collected %d / total %d, some entries are not collected", bar.Current(), total)
-	}
-	bar.SetTotal(0, true) // FIXME: current != total
-	progress.Wait()
 
 	counters := &DumpedCounters{}
 	refs := make(map[string]int)
-	for _, entry := range entries {
-		if err = m.loadEntry(entry, counters, refs); err != nil {
-			return err
+	if err = loadBatches(entries, opt, func(e *DumpedEntry) (interface{}, error) {
+		w := m.prepareEntry(e, counters, refs)
+		if uint64(e.Attr.Inode) <= ckpt {
+			return nil, nil
 		}
+		return w, nil
+	}, m.commitEntries); err != nil {
+		return err
 	}
-	logger.Infof("Dumped counters: %+v", *dm.Counters)
-	logger.Infof("Loaded counters: %+v", *counters)
+	p := m.rdb.TxPipeline()
+	for _, d := range dm.DelFiles { // no attr, only the slices to be cleaned with the file
+		m.countChunks(d.Chunks, counters, refs) // counted by the live phase to keep the slices
+	}
+	if opt.Phase != "live" {
+		m.loadDelFiles(p, dm.DelFiles)
+	}
+	checkUsage(dm.Counters, counters, opt.KeepCounters)
+	keepNextCounters(dm.Counters, counters, 1) // Redis counter is 1 smaller than sql/tkv
+	reportCounters(dm.Counters, counters, 1, opt)
+	warnOverQuota(dm.Setting, counters)
 
-	p := m.rdb.Pipeline()
 	p.Set(ctx, "setting", format, 0)
 	cs := make(map[string]interface{})
 	cs[usedSpace] = counters.UsedSpace
@@ -3201,16 +3659,6 @@ func (m *redisMeta) LoadMeta(r io.Reader) error {
 	cs["nextchunk"] = counters.NextChunk
 	cs["nextsession"] = counters.NextSession
 	p.MSet(ctx, cs)
-	if len(dm.DelFiles) > 0 {
-		zs := make([]*redis.Z, 0, len(dm.DelFiles))
-		for _, d := range dm.DelFiles {
-			zs = append(zs, &redis.Z{
-				Score:  float64(d.Expire),
-				Member: m.toDelete(d.Inode, d.Length),
-			})
-		}
-		p.ZAdd(ctx, delfiles, zs...)
-	}
 	slices := make(map[string]interface{})
 	for k, v := range refs {
 		if v > 1 {
@@ -3220,6 +3668,9 @@ func (m *redisMeta) LoadMeta(r io.Reader) error {
 	if len(slices) > 0 {
 		p.HSet(ctx, sliceRefs, slices)
 	}
-	_, err = p.Exec(ctx)
-	return err
+	p.Del(ctx, loadCheckpoint)
+	if _, err = p.Exec(ctx); err != nil {
+		return err
+	}
+	return skipped.orNil()
 }
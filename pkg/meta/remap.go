@@ -0,0 +1,214 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// remapper is implemented by every metadata engine to load a dump into a non-empty volume.
+type remapper interface {
+	Meta
+	nextInode() (Ino, error)
+	removeInode(inode Ino) error
+	// graftDir adds the dentries of the children of e into the existing directory inode, and
+	// increases its nlink by the sub-directories of them and updates its mtime and ctime, in
+	// a transaction.
+	graftDir(inode Ino, e *DumpedEntry) error
+	// raiseNextCounters sets each of the next IDs of the volume to the one in cs if it's larger,
+	// in the convention of the engine like the loaded counters, see keepNextCounters.
+	raiseNextCounters(cs *DumpedCounters) error
+}
+
+// remapEntries grafts the tree in dm at path, and assigns new inodes to all the entries in it.
+// The missing directories in path are created, and the root of the tree gets the inode of the
+// last one; or if it exists, the children of the root are added into it, which must not have
+// any of them, and the directory keeps its attr and xattrs. Hard links of a file still share
+// one inode. It returns the entries to be loaded, a directory or symlink which appears more
+// than once in dm becomes independent copies, and the root if the directory exists, which is
+// grafted into it by graftDir after the entries are loaded, so that it's untouched if the load
+// fails. The entries are tagged with their inodes in dm if tag is set, see tagOriginal.
+func remapEntries(m remapper, dm *DumpedMeta, path string, tag bool) ([]*DumpedEntry, *DumpedEntry, error) {
+	if dm.BaseVersion != 0 {
+		return nil, nil, fmt.Errorf("a delta dump can't be loaded with new inodes")
+	}
+	if _, err := m.Load(); err != nil {
+		return nil, nil, fmt.Errorf("load setting: %s", err)
+	}
+	ctx := Background
+	names := strings.Split(strings.Trim(path, "/"), "/")
+	if names[0] == "" {
+		return nil, nil, fmt.Errorf("can't load into the root of a non-empty volume")
+	}
+	parent, root := Ino(0), Ino(1)
+	attr := &Attr{}
+	var existed bool
+	for i, name := range names {
+		parent = root
+		st := m.Lookup(ctx, parent, name, &root, attr)
+		if st == syscall.ENOENT {
+			st = m.Mkdir(ctx, parent, name, 0755, 0, 0, &root, attr)
+		} else if st == 0 && i == len(names)-1 {
+			existed = true
+		}
+		if st != 0 {
+			return nil, nil, fmt.Errorf("create %s in %s: %s", name, path, st)
+		}
+		if attr.Typ != TypeDirectory {
+			return nil, nil, fmt.Errorf("%s in %s is not a directory", name, path)
+		}
+	}
+	if existed {
+		if err := checkGraft(m, dm.FSTree, root); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	files := make(map[Ino]Ino)
+	var remap func(e *DumpedEntry) error
+	remap = func(e *DumpedEntry) error {
+		if tag {
+			tagOriginal(e)
+		}
+		isFile := typeFromString(e.Attr.Type) == TypeFile
+		if inode, ok := files[e.Attr.Inode]; ok && isFile {
+			e.Attr.Inode = inode
+			return nil
+		}
+		inode, err := m.nextInode()
+		if err != nil {
+			return err
+		}
+		if isFile {
+			files[e.Attr.Inode] = inode
+		}
+		e.Attr.Inode = inode
+		for _, c := range e.Entries {
+			if err = remap(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, c := range dm.FSTree.Entries {
+		if err := remap(c); err != nil {
+			return nil, nil, fmt.Errorf("allocate inode: %s", err)
+		}
+	}
+	dm.FSTree.Attr.Inode = root
+	dm.FSTree.Parent = parent
+	collected := make(map[Ino]*DumpedEntry)
+	if err := collectEntry(nil, dm.FSTree, collected, nil, nil); err != nil {
+		return nil, nil, err
+	}
+	if existed {
+		delete(collected, root)
+	}
+	entries := make([]*DumpedEntry, 0, len(collected))
+	for _, e := range collected {
+		entries = append(entries, e)
+	}
+	logger.Infof("Load %d inodes into %s (inode %d)", len(entries), path, root)
+	if existed {
+		return entries, dm.FSTree, nil
+	}
+	// the new directory is replaced by the root of the tree
+	return entries, nil, m.removeInode(root)
+}
+
+// origInodeXattr is the xattr of a remapped entry with its inode in the dump, in decimal.
+const origInodeXattr = "user.juicefs.orig_inode"
+
+// tagOriginal sets the xattr origInodeXattr of e to its inode, replacing the one in the dump,
+// e.g. of a volume restored with the tags before.
+func tagOriginal(e *DumpedEntry) {
+	setXattr(e, origInodeXattr, strconv.FormatUint(uint64(e.Attr.Inode), 10))
+}
+
+// checkGraft checks that none of the children of tree is in the existing directory inode.
+func checkGraft(m remapper, tree *DumpedEntry, inode Ino) error {
+	var children []*Entry
+	if st := m.Readdir(Background, inode, 0, &children); st != 0 {
+		return fmt.Errorf("readdir %d: %s", inode, st)
+	}
+	for _, c := range children {
+		if tree.Entries[string(c.Name)] != nil {
+			return fmt.Errorf("%s exists in the destination", c.Name)
+		}
+	}
+	return nil
+}
+
+// loadRemapped loads the dump in r into a new directory at opt.Remap of a non-empty volume
+// by load, and returns the usage of the loaded entries, not including the new directory
+// which has been counted. The references of slices should be added by the caller.
+//
+// Each next ID of the volume is raised to the dumped one minus offset, as keepNextCounters,
+// before any inode is allocated, so that the new inodes are above all the dumped ones, and
+// then to the ones counted from the loaded entries, so that no chunk id of a loaded slice
+// is allocated again by the volume, even if the dumped counters drifted.
+func loadRemapped(m remapper, r io.Reader, opt LoadOption, offset int64, load func(e *DumpedEntry, cs *DumpedCounters) error) (*DumpedCounters, error) {
+	dm, err := readDump(r, opt)
+	if err != nil {
+		return nil, err
+	}
+	format, err := m.Load()
+	if err != nil {
+		return nil, err
+	}
+	if err = checkBlockSize(format, dm.Setting); err != nil {
+		return nil, err
+	}
+	if err = checkCapacity(m, format, dm, opt); err != nil {
+		return nil, err
+	}
+	if dm.Counters != nil {
+		next := &DumpedCounters{}
+		keepNextCounters(dm.Counters, next, offset)
+		if err = m.raiseNextCounters(next); err != nil {
+			return nil, fmt.Errorf("raise counters: %s", err)
+		}
+	}
+	entries, graft, err := remapEntries(m, dm, opt.Remap, opt.TagOriginal)
+	if err != nil {
+		return nil, err
+	}
+	cs := &DumpedCounters{}
+	if err = loadEntries(entries, opt, func(e *DumpedEntry) error { return load(e, cs) }); err != nil {
+		return nil, err
+	}
+	if graft != nil {
+		if err = m.graftDir(graft.Attr.Inode, graft); err != nil {
+			return nil, fmt.Errorf("graft into %s: %s", opt.Remap, err)
+		}
+	}
+	if err = m.raiseNextCounters(cs); err != nil {
+		return nil, fmt.Errorf("raise counters: %s", err)
+	}
+	if graft == nil { // the new directory is loaded again
+		cs.UsedSpace -= 4 << 10
+		cs.UsedInodes--
+	}
+	logger.Infof("Loaded counters: %+v", *cs)
+	if opt.Counters != nil {
+		*opt.Counters = *cs
+	}
+	return cs, nil
+}
@@ -0,0 +1,67 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import "fmt"
+
+// A dump may read the tree from a replica of the metadata engine instead of the primary to keep
+// the load off it, e.g. a Redis replica or a MySQL read replica, while the setting, the counters,
+// the sessions and the files to be deleted are still read from the primary, which is the point
+// the dump is consistent with. The replication of the engines is asynchronous, so the replica may
+// lag behind the primary: the entries changed in the lag are dumped as they were, and the ones
+// created are missing. The used inodes of both are compared before dumping to warn about it.
+
+// dumpEngine is an engine which the tree can be dumped from.
+type dumpEngine interface {
+	Meta
+	dumper
+}
+
+// dumpSource returns the engine to read the tree from, which is the replica in opt.ReadFrom if
+// set, or m itself. The replica must be of the same engine and volume as m, and cs is the
+// counters read from m.
+func dumpSource(m dumpEngine, cs *DumpedCounters, opt DumpOption) (dumpEngine, error) {
+	if opt.ReadFrom == nil {
+		return m, nil
+	}
+	if opt.Consistent {
+		return nil, fmt.Errorf("a consistent dump can't read from a replica")
+	}
+	r, ok := opt.ReadFrom.(dumpEngine)
+	if !ok || r.Name() != m.Name() {
+		return nil, fmt.Errorf("the replica is not of engine %s", m.Name())
+	}
+	pf, err := m.Load()
+	if err != nil {
+		return nil, err
+	}
+	rf, err := r.Load()
+	if err != nil {
+		return nil, fmt.Errorf("load setting from replica: %s", err)
+	}
+	if rf.UUID != pf.UUID {
+		return nil, fmt.Errorf("the replica is of volume %s (%s), not %s (%s)", rf.Name, rf.UUID, pf.Name, pf.UUID)
+	}
+	logger.Warnf("Read the tree from the replica, which may lag behind the primary: the entries changed in the lag are dumped as they were")
+	var totalspace, availspace, iused, iavail uint64
+	if st := r.StatFS(Background, &totalspace, &availspace, &iused, &iavail); st != 0 {
+		return nil, fmt.Errorf("statfs replica: %s", st)
+	}
+	if int64(iused) != cs.UsedInodes {
+		logger.Warnf("The replica has %d inodes used but the primary %d, it's behind or changed since", iused, cs.UsedInodes)
+	}
+	return r, nil
+}
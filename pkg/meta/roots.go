@@ -0,0 +1,166 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A dump with named roots has the trees under some directories of the volume in Roots, named by
+// DumpOption.Roots, instead of the whole tree in FSTree, e.g. the logical roots exported to
+// different users, and any of them can be loaded as the root of a volume by LoadOption.Root. The
+// roots are walked as the children of a directory which doesn't exist, rootsIno, which is written
+// as Roots without attrs, so that everything on the tree walk works as usual, with the paths
+// starting with the names of the roots. A file linked in several roots is dumped in all of them.
+
+// rootsIno is the directory of the named roots in the tree walk, which is never a real inode.
+const rootsIno Ino = 0
+
+// rootsDumper lists the named roots as the children of rootsIno.
+type rootsDumper struct {
+	dumper
+	roots []*Entry
+}
+
+// newRootsDumper looks up the directories at the paths in roots under root, by their names.
+func newRootsDumper(d dumper, root Ino, roots map[string]string) (*rootsDumper, error) {
+	names := make([]string, 0, len(roots))
+	for name := range roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rd := &rootsDumper{dumper: d}
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid name of root: %q", name)
+		}
+		inode, err := lookupDir(d, root, roots[name])
+		if err != nil {
+			return nil, fmt.Errorf("root %s: %s", name, err)
+		}
+		rd.roots = append(rd.roots, &Entry{Inode: inode, Name: []byte(name), Attr: &Attr{Typ: TypeDirectory}})
+	}
+	return rd, nil
+}
+
+// lookupDir returns the directory at path p under root, which is found in the entries of every
+// directory on the way, as a dumper can't look up a name.
+func lookupDir(d dumper, root Ino, p string) (Ino, error) {
+	inode := root
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		entries, err := d.dumpDir(inode)
+		if err != nil {
+			return 0, err
+		}
+		var found *Entry
+		for _, e := range entries {
+			if string(e.Name) == name {
+				found = e
+				break
+			}
+		}
+		if found == nil {
+			return 0, fmt.Errorf("%s is not found", p)
+		}
+		if found.Attr.Typ != TypeDirectory {
+			return 0, fmt.Errorf("%s is not a directory", p)
+		}
+		inode = found.Inode
+	}
+	return inode, nil
+}
+
+func (d *rootsDumper) dumpEntry(inode Ino) (*DumpedEntry, error) {
+	if inode == rootsIno { // no nlink like a stub, so it's not counted as a directory, see statEncoder
+		return &DumpedEntry{Attr: &DumpedAttr{Inode: rootsIno, Type: "directory"}}, nil
+	}
+	return d.dumper.dumpEntry(inode)
+}
+
+func (d *rootsDumper) dumpDir(inode Ino) ([]*Entry, error) {
+	if inode == rootsIno {
+		return append([]*Entry(nil), d.roots...), nil // sorted in place by the walk
+	}
+	return d.dumper.dumpDir(inode)
+}
+
+// checkRootsOption returns an error if the named roots can't be dumped with the other options.
+func checkRootsOption(opt DumpOption) error {
+	if opt.Format != "" && opt.Format != "json" || opt.Diff != nil || opt.Since != nil || len(opt.InodeRange) > 0 {
+		return fmt.Errorf("named roots can only be dumped in a full dump in JSON")
+	}
+	if opt.Orphans != nil || opt.AdoptOrphans || opt.Index != nil {
+		return fmt.Errorf("named roots can't be dumped with orphans or an index")
+	}
+	return nil
+}
+
+// lookupRoots returns the inodes of the directories at the paths in roots of m, by their names.
+func lookupRoots(m Meta, roots map[string]string) (map[string]Ino, error) {
+	inodes := make(map[string]Ino, len(roots))
+	for name, p := range roots {
+		inode, err := lookupSubdir(m, p)
+		if err != nil {
+			return nil, fmt.Errorf("root %s: %s", name, err)
+		}
+		inodes[name] = inode
+	}
+	return inodes, nil
+}
+
+// selectRoot replaces the tree in dm by the root of the name, which becomes the root of the
+// volume. A dump with named roots can't be loaded without one of them. The usage in the counters
+// is of all the roots, so it's replaced by the one counted from the selected one.
+func selectRoot(dm *DumpedMeta, name string) error {
+	if name == "" {
+		if dm.Roots != nil {
+			return fmt.Errorf("the dump has named roots %s, one of them should be chosen to be loaded", strings.Join(rootNames(dm), ", "))
+		}
+		return nil
+	}
+	if dm.Roots == nil {
+		return fmt.Errorf("the dump has no named roots")
+	}
+	e := dm.Roots[name]
+	if e == nil {
+		return fmt.Errorf("root %s is not found in the dump, which has %s", name, strings.Join(rootNames(dm), ", "))
+	}
+	if e.Attr == nil || e.Attr.Type != "directory" {
+		return fmt.Errorf("root %s is not a directory in the dump", name)
+	}
+	e.Name = ""
+	dm.FSTree, dm.Roots = e, nil
+	if dm.Counters != nil {
+		cs := computeCounters(e)
+		dm.Counters.UsedSpace, dm.Counters.UsedInodes = cs.UsedSpace, cs.UsedInodes
+	}
+	logger.Infof("Root %s is loaded from the dump", name)
+	return nil
+}
+
+func rootNames(dm *DumpedMeta) []string {
+	names := make([]string, 0, len(dm.Roots))
+	for name := range dm.Roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
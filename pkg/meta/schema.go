@@ -0,0 +1,445 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/version"
+)
+
+// DumpSchema is the JSON Schema of a dump in JSON, the header of an ndjson dump is the same
+// without FSTree, followed by records in definitions/record and the checksum. A strict load
+// validates a dump against it, with the subset of JSON Schema used here only.
+const DumpSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "JuiceFS metadata dump",
+  "type": "object",
+  "required": ["Setting", "Counters"],
+  "additionalProperties": false,
+  "properties": {
+    "Version": {"$ref": "#/definitions/uint"},
+    "Header": {"$ref": "#/definitions/header"},
+    "Setting": {"$ref": "#/definitions/setting"},
+    "Counters": {"$ref": "#/definitions/counters"},
+    "Sustained": {"type": ["array", "null"], "items": {"$ref": "#/definitions/sustained"}},
+    "DelFiles": {"type": ["array", "null"], "items": {"$ref": "#/definitions/delfile"}},
+    "Locks": {"type": ["array", "null"], "items": {"$ref": "#/definitions/lock"}},
+    "BaseVersion": {"type": "integer"},
+    "Deleted": {"type": ["array", "null"], "items": {"$ref": "#/definitions/uint"}},
+    "InodeRange": {"type": ["array", "null"], "items": {"$ref": "#/definitions/uint"}},
+    "NoData": {"type": "boolean"},
+    "DirsOnly": {"type": "boolean"},
+    "WithData": {"type": "boolean"},
+    "Escape": {"type": "string"},
+    "Partial": {"type": "boolean"},
+    "Bignums": {"enum": ["string"]},
+    "FSTree": {"$ref": "#/definitions/entry"},
+    "Roots": {"type": "object", "additionalProperties": {"$ref": "#/definitions/entry"}},
+    "Checksum": {"type": "string"}
+  },
+  "definitions": {
+    "uint": {"type": "integer", "minimum": 0},
+    "bignum": {"type": ["integer", "string"], "pattern": "^-?[0-9]+$"},
+    "ubignum": {"type": ["integer", "string"], "minimum": 0, "pattern": "^[0-9]+$"},
+    "header": {
+      "type": "object",
+      "required": ["Name", "Fields"],
+      "additionalProperties": false,
+      "properties": {
+        "Name": {"type": "string"},
+        "Producer": {"type": "string"},
+        "Fields": {"type": "array", "items": {"type": "string"}}
+      }
+    },
+    "setting": {
+      "type": "object",
+      "required": ["Name", "UUID", "Storage", "Bucket", "BlockSize"],
+      "additionalProperties": false,
+      "properties": {
+        "Name": {"type": "string"},
+        "UUID": {"type": "string"},
+        "Storage": {"type": "string"},
+        "Bucket": {"type": "string"},
+        "AccessKey": {"type": "string"},
+        "SecretKey": {"type": "string"},
+        "BlockSize": {"$ref": "#/definitions/uint"},
+        "Compression": {"type": "string"},
+        "Shards": {"$ref": "#/definitions/uint"},
+        "Partitions": {"$ref": "#/definitions/uint"},
+        "Capacity": {"$ref": "#/definitions/uint"},
+        "Inodes": {"$ref": "#/definitions/uint"},
+        "EncryptKey": {"type": "string"}
+      }
+    },
+    "counters": {
+      "type": "object",
+      "required": ["usedSpace", "usedInodes", "nextInodes", "nextChunk", "nextSession"],
+      "additionalProperties": false,
+      "properties": {
+        "usedSpace": {"$ref": "#/definitions/bignum"},
+        "usedInodes": {"$ref": "#/definitions/bignum"},
+        "nextInodes": {"$ref": "#/definitions/bignum"},
+        "nextChunk": {"$ref": "#/definitions/bignum"},
+        "nextSession": {"$ref": "#/definitions/bignum"},
+        "nextCleanupSlices": {"$ref": "#/definitions/bignum"}
+      }
+    },
+    "sustained": {
+      "type": "object",
+      "required": ["sid", "inodes"],
+      "additionalProperties": false,
+      "properties": {
+        "sid": {"$ref": "#/definitions/uint"},
+        "inodes": {"type": ["array", "null"], "items": {"$ref": "#/definitions/uint"}}
+      }
+    },
+    "delfile": {
+      "type": "object",
+      "required": ["inode", "length", "expire"],
+      "additionalProperties": false,
+      "properties": {
+        "inode": {"$ref": "#/definitions/uint"},
+        "length": {"$ref": "#/definitions/uint"},
+        "expire": {"type": "integer"},
+        "chunks": {"type": "array", "items": {"$ref": "#/definitions/chunk"}}
+      }
+    },
+    "lock": {
+      "type": "object",
+      "required": ["inode", "sid", "owner", "kind", "type"],
+      "additionalProperties": false,
+      "properties": {
+        "inode": {"$ref": "#/definitions/uint"},
+        "sid": {"$ref": "#/definitions/uint"},
+        "host": {"type": "string"},
+        "owner": {"$ref": "#/definitions/uint"},
+        "kind": {"enum": ["flock", "posix"]},
+        "type": {"enum": ["R", "W"]},
+        "pid": {"$ref": "#/definitions/uint"},
+        "start": {"$ref": "#/definitions/uint"},
+        "end": {"$ref": "#/definitions/uint"}
+      }
+    },
+    "attr": {
+      "type": "object",
+      "required": ["inode", "type", "mode", "uid", "gid", "atime", "mtime", "ctime", "nlink", "length"],
+      "additionalProperties": false,
+      "properties": {
+        "inode": {"$ref": "#/definitions/uint"},
+        "type": {"enum": ["regular", "directory", "symlink", "fifo", "blockdev", "chardev", "socket"]},
+        "mode": {"$ref": "#/definitions/uint"},
+        "uid": {"$ref": "#/definitions/uint"},
+        "gid": {"$ref": "#/definitions/uint"},
+        "atime": {"type": "integer"},
+        "mtime": {"type": "integer"},
+        "ctime": {"type": "integer"},
+        "atimensec": {"$ref": "#/definitions/uint"},
+        "mtimensec": {"$ref": "#/definitions/uint"},
+        "ctimensec": {"$ref": "#/definitions/uint"},
+        "nlink": {"$ref": "#/definitions/uint"},
+        "length": {"$ref": "#/definitions/uint"},
+        "rdev": {"$ref": "#/definitions/uint"},
+        "flags": {"$ref": "#/definitions/uint"},
+        "btime": {"type": "integer"},
+        "btimensec": {"$ref": "#/definitions/uint"}
+      }
+    },
+    "xattr": {
+      "type": "object",
+      "required": ["name", "value"],
+      "additionalProperties": false,
+      "properties": {
+        "name": {"type": "string"},
+        "value": {"type": "string"},
+        "encoding": {"enum": ["base64"]}
+      }
+    },
+    "slice": {
+      "type": "object",
+      "required": ["pos", "chunkid", "size", "off", "len"],
+      "additionalProperties": false,
+      "properties": {
+        "pos": {"$ref": "#/definitions/uint"},
+        "chunkid": {"$ref": "#/definitions/ubignum"},
+        "size": {"$ref": "#/definitions/uint"},
+        "off": {"$ref": "#/definitions/uint"},
+        "len": {"$ref": "#/definitions/uint"},
+        "data": {"type": "string"}
+      }
+    },
+    "chunk": {
+      "type": "object",
+      "required": ["index", "slices"],
+      "additionalProperties": false,
+      "properties": {
+        "index": {"$ref": "#/definitions/uint"},
+        "slices": {"type": ["array", "null"], "items": {"$ref": "#/definitions/slice"}}
+      }
+    },
+    "entry": {
+      "type": "object",
+      "required": ["attr"],
+      "additionalProperties": false,
+      "properties": {
+        "attr": {"$ref": "#/definitions/attr"},
+        "symlink": {"type": "string"},
+        "xattrs": {"type": "array", "items": {"$ref": "#/definitions/xattr"}},
+        "chunks": {"type": "array", "items": {"$ref": "#/definitions/chunk"}},
+        "dirStats": {"$ref": "#/definitions/dirStats"},
+        "hash": {"type": "string", "pattern": "^[0-9a-f]{64}$"},
+        "entries": {"type": "object", "additionalProperties": {"$ref": "#/definitions/entry"}}
+      }
+    },
+    "record": {
+      "type": "object",
+      "required": ["path", "attr"],
+      "additionalProperties": false,
+      "properties": {
+        "path": {"type": "string"},
+        "attr": {"$ref": "#/definitions/attr"},
+        "symlink": {"type": "string"},
+        "xattrs": {"type": "array", "items": {"$ref": "#/definitions/xattr"}},
+        "chunks": {"type": "array", "items": {"$ref": "#/definitions/chunk"}},
+        "dirStats": {"$ref": "#/definitions/dirStats"},
+        "hash": {"type": "string", "pattern": "^[0-9a-f]{64}$"}
+      }
+    },
+    "dirStats": {
+      "type": "object",
+      "required": ["size", "files", "dirs"],
+      "additionalProperties": false,
+      "properties": {
+        "size": {"$ref": "#/definitions/uint"},
+        "files": {"$ref": "#/definitions/uint"},
+        "dirs": {"$ref": "#/definitions/uint"}
+      }
+    }
+  }
+}
+`
+
+// dumpName is the name in the header of every dump written by JuiceFS.
+const dumpName = "juicefs-dump"
+
+// DumpHeader describes the dump it's in, so that a dump of an incompatible version or fork can
+// be told, even in binary format which has no schema.
+type DumpHeader struct {
+	Name     string   // always dumpName
+	Producer string   // the binary which wrote the dump
+	Fields   []string // top-level fields of DumpedMeta known by the producer
+}
+
+// dumpFields are the names of the top-level fields of a dump in JSON.
+var dumpFields = jsonFields(reflect.TypeOf(DumpedMeta{}))
+
+func jsonFields(t reflect.Type) []string {
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; tag != "" {
+			name = tag
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+func newDumpHeader() *DumpHeader {
+	return &DumpHeader{Name: dumpName, Producer: "juicefs " + version.Version(), Fields: dumpFields}
+}
+
+// checkHeader returns the problems in the header of a dump, a dump without header is written by an
+// older version, which is fine.
+func checkHeader(h *DumpHeader) []string {
+	if h == nil {
+		return nil
+	}
+	if h.Name != dumpName {
+		return []string{fmt.Sprintf("/Header/Name: %q is not a dump of JuiceFS", h.Name)}
+	}
+	known := make(map[string]bool)
+	for _, f := range dumpFields {
+		known[f] = true
+	}
+	var problems []string
+	for _, f := range h.Fields {
+		if !known[f] {
+			problems = append(problems, fmt.Sprintf("/Header/Fields: %s is unknown, the dump may be written by an incompatible version (%s)", f, h.Producer))
+		}
+	}
+	return problems
+}
+
+// validateDump returns the problems of a plain dump in data against DumpSchema, a binary dump
+// is not validated.
+func validateDump(data []byte, format string) ([]string, error) {
+	var root map[string]interface{}
+	d := json.NewDecoder(strings.NewReader(DumpSchema))
+	d.UseNumber()
+	if err := d.Decode(&root); err != nil {
+		return nil, fmt.Errorf("invalid schema: %s", err)
+	}
+	v := &schemaValidator{root: root}
+	switch format {
+	case "json":
+		value, err := decodeValue(data)
+		if err != nil {
+			return nil, err
+		}
+		v.validate(root, value, "")
+	case "ndjson":
+		s := bufio.NewScanner(bytes.NewReader(data))
+		s.Buffer(nil, 1<<30)
+		record := v.resolve("#/definitions/record")
+		for line := 1; s.Scan(); line++ {
+			value, err := decodeValue(s.Bytes())
+			if err != nil {
+				return nil, fmt.Errorf("decode line %d: %s", line, err)
+			}
+			v.prefix = fmt.Sprintf("line %d: ", line)
+			if line == 1 {
+				v.validate(root, value, "")
+			} else if obj, ok := value.(map[string]interface{}); ok && len(obj) == 1 && obj["Checksum"] != nil {
+				continue
+			} else {
+				v.validate(record, value, "")
+			}
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return v.problems, nil
+}
+
+func decodeValue(data []byte) (interface{}, error) {
+	var value interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	err := d.Decode(&value)
+	return value, err
+}
+
+// schemaValidator validates a decoded JSON value with type, enum, minimum, properties, required,
+// additionalProperties, items and $ref to definitions of JSON Schema, others are ignored.
+type schemaValidator struct {
+	root     map[string]interface{}
+	prefix   string // of every problem, e.g. the line in ndjson
+	problems []string
+}
+
+func (v *schemaValidator) resolve(ref string) map[string]interface{} {
+	s := v.root
+	for _, name := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		s, _ = s[name].(map[string]interface{})
+	}
+	return s
+}
+
+func (v *schemaValidator) problem(path, format string, args ...interface{}) {
+	if path == "" {
+		path = "/"
+	}
+	v.problems = append(v.problems, v.prefix+path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *schemaValidator) validate(s map[string]interface{}, value interface{}, path string) {
+	if ref, ok := s["$ref"].(string); ok {
+		s = v.resolve(ref)
+	}
+	if t, ok := s["type"]; ok && !matchType(t, value) {
+		v.problem(path, "should be %v", t)
+		return
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		var found bool
+		for _, e := range enum {
+			found = found || e == value
+		}
+		if !found {
+			v.problem(path, "%v should be one of %v", value, enum)
+		}
+	}
+	if min, ok := s["minimum"].(json.Number); ok {
+		if n, ok := value.(json.Number); ok && strings.HasPrefix(n.String(), "-") && !strings.HasPrefix(min.String(), "-") {
+			v.problem(path, "%s should be at least %s", n, min)
+		}
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		required, _ := s["required"].([]interface{})
+		for _, r := range required {
+			if _, ok := value[r.(string)]; !ok {
+				v.problem(path, "%s is required", r)
+			}
+		}
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		props, _ := s["properties"].(map[string]interface{})
+		for _, k := range keys {
+			p := path + "/" + k
+			if ps, ok := props[k].(map[string]interface{}); ok {
+				v.validate(ps, value[k], p)
+			} else if as, ok := s["additionalProperties"].(map[string]interface{}); ok {
+				v.validate(as, value[k], p)
+			} else if s["additionalProperties"] == false {
+				v.problem(p, "unknown field")
+			}
+		}
+	case []interface{}:
+		if items, ok := s["items"].(map[string]interface{}); ok {
+			for i, c := range value {
+				v.validate(items, c, fmt.Sprintf("%s/%d", path, i))
+			}
+		}
+	}
+}
+
+func matchType(t interface{}, value interface{}) bool {
+	if ts, ok := t.([]interface{}); ok {
+		for _, t := range ts {
+			if matchType(t, value) {
+				return true
+			}
+		}
+		return false
+	}
+	switch value := value.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case string:
+		return t == "string"
+	case json.Number:
+		return t == "number" || t == "integer" && !strings.ContainsAny(value.String(), ".eE")
+	case []interface{}:
+		return t == "array"
+	case map[string]interface{}:
+		return t == "object"
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import "strconv"
+
+// origSizeXattr is the xattr of a file in a shadow volume with its length in the dump, in decimal.
+const origSizeXattr = "user.juicefs.orig_size"
+
+// shadowFiles makes all the files in dm empty for a shadow volume, which has the tree and the
+// attrs of the dumped one for listing and searching, but no data. The length of every file is
+// kept in origSizeXattr, and its slices are dropped, so are the files to be deleted.
+func shadowFiles(dm *DumpedMeta) {
+	dm.DelFiles, dm.Sustained = nil, nil
+	if dm.FSTree == nil {
+		return
+	}
+	done := make(map[*DumpedEntry]bool) // the links of a file may share one entry
+	var walk func(e *DumpedEntry)
+	walk = func(e *DumpedEntry) {
+		if e.Attr != nil && typeFromString(e.Attr.Type) == TypeFile && !done[e] {
+			done[e] = true
+			setXattr(e, origSizeXattr, strconv.FormatUint(e.Attr.Length, 10))
+			e.Attr.Length = 0
+			e.Chunks = nil
+		}
+		for _, c := range e.Entries {
+			walk(c)
+		}
+	}
+	walk(dm.FSTree)
+}
+
+// setXattr sets the xattr name of e to value, replacing the one in the dump.
+func setXattr(e *DumpedEntry, name, value string) {
+	for _, x := range e.Xattrs {
+		if x.Name == name {
+			x.Value = value
+			return
+		}
+	}
+	e.Xattrs = append(e.Xattrs, &DumpedXattr{name, value})
+}
@@ -0,0 +1,248 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// A shard dump carries the entries with inodes in InodeRange (half-open), and the paths to
+// them. A directory in the shard lists all its children, the ones outside of the shard as
+// placeholders with only inode and type like the stubs in a delta dump. The placeholders are
+// resolved when all the shards are merged, so loading a shard alone gives an incomplete tree.
+// The usage in the counters of a shard only counts the entries in it.
+
+var allInodes = []Ino{0, math.MaxUint64}
+
+func inShard(r []Ino, inode Ino) bool {
+	return inode >= r[0] && inode < r[1]
+}
+
+// countShard replaces the usage in cs with the one of the entries in r under root, not
+// including root itself, so that the usage of all the shards adds up to the one dumped.
+func countShard(root *DumpedEntry, r []Ino, cs *DumpedCounters) {
+	u := countUsage(root, r)
+	cs.UsedSpace, cs.UsedInodes = u.UsedSpace, u.UsedInodes
+}
+
+// computeCounters returns the usage of the entries under root, not including root itself, which
+// is counted like the engines do: a file takes its length rounded up to 4 KiB, a symlink the
+// length of its target rounded up, and others 4 KiB, a hard linked file is counted once. Only
+// UsedSpace and UsedInodes are set. It keeps no state out of the call, so the same tree can be
+// counted concurrently.
+func computeCounters(root *DumpedEntry) DumpedCounters {
+	return countUsage(root, allInodes)
+}
+
+func countUsage(root *DumpedEntry, r []Ino) DumpedCounters {
+	var cs DumpedCounters
+	seen := map[Ino]bool{root.Attr.Inode: true}
+	stack := []*DumpedEntry{root}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if inode := e.Attr.Inode; inShard(r, inode) && !seen[inode] {
+			seen[inode] = true
+			cs.UsedSpace += entrySpace(e)
+			cs.UsedInodes++
+		}
+		for _, c := range e.Entries {
+			stack = append(stack, c)
+		}
+	}
+	return cs
+}
+
+// dumpShardTree writes dm and the entries of tree in dm.InodeRange, files to be deleted and
+// sustained inodes are also sharded. Only the entries in the shard are kept in memory before
+// they are written.
+func dumpShardTree(f *entryFetcher, dm *DumpedMeta, tree *DumpedEntry, enc dumpEncoder,
+	showProgress func(totalIncr, currentIncr int64)) error {
+	delFiles := dm.DelFiles[:0]
+	for _, d := range dm.DelFiles {
+		if inShard(dm.InodeRange, d.Inode) {
+			delFiles = append(delFiles, d)
+		}
+	}
+	dm.DelFiles = delFiles
+	locks := dm.Locks[:0]
+	for _, l := range dm.Locks {
+		if inShard(dm.InodeRange, l.Inode) {
+			locks = append(locks, l)
+		}
+	}
+	dm.Locks = locks
+	sustained := dm.Sustained[:0]
+	for _, s := range dm.Sustained {
+		inodes := s.Inodes[:0]
+		for _, inode := range s.Inodes {
+			if inShard(dm.InodeRange, inode) {
+				inodes = append(inodes, inode)
+			}
+		}
+		if len(inodes) > 0 {
+			s.Inodes = inodes
+			sustained = append(sustained, s)
+		}
+	}
+	dm.Sustained = sustained
+	shard, err := pruneTree(f, tree, func(a *DumpedAttr) bool { return inShard(dm.InodeRange, a.Inode) }, nil, showProgress)
+	if err != nil {
+		return err
+	}
+	if shard == nil {
+		shard = &DumpedEntry{Name: tree.Name, Attr: &DumpedAttr{Inode: tree.Attr.Inode, Type: tree.Attr.Type}}
+	}
+	countShard(shard, dm.InodeRange, dm.Counters)
+	logger.Infof("Dump inodes in [%d, %d)", dm.InodeRange[0], dm.InodeRange[1])
+	if err = enc.writeMeta(dm); err != nil {
+		return err
+	}
+	return writeTree(enc, shard)
+}
+
+// sameEntry returns whether a and b are the same except their names and children.
+func sameEntry(a, b *DumpedEntry) bool {
+	return *a.Attr == *b.Attr && a.Symlink == b.Symlink && reflect.DeepEqual(a.Xattrs, b.Xattrs) && reflect.DeepEqual(a.Chunks, b.Chunks)
+}
+
+// mergeEntry merges src of shard i in r into dst, the inodes in r are resolved by i. An inode
+// resolved differently by another shard is a conflict, unless preferNewest picks the one with
+// the newer ctime.
+func mergeEntry(dst, src *DumpedEntry, i int, r []Ino, resolved map[Ino]int, preferNewest bool) error {
+	if dst.Attr.Inode != src.Attr.Inode {
+		logger.Warnf("Inode of %s is %d in one shard but %d in another, the former is kept", src.Name, dst.Attr.Inode, src.Attr.Inode)
+		return nil
+	}
+	inode := src.Attr.Inode
+	if inShard(r, inode) {
+		replace := true
+		if j := resolved[inode]; j != 0 && j != i && !sameEntry(dst, src) {
+			if !preferNewest {
+				return fmt.Errorf("inode %d is different in dump %d and %d", inode, j, i)
+			}
+			a, b := dst.Attr, src.Attr
+			replace = a.Ctime*1e9+int64(a.Ctimensec) < b.Ctime*1e9+int64(b.Ctimensec)
+		}
+		if replace {
+			entries := dst.Entries
+			*dst = *src
+			dst.Entries = entries
+			resolved[inode] = i
+		}
+	}
+	for name, c := range src.Entries {
+		d, ok := dst.Entries[name]
+		if !ok {
+			if dst.Entries == nil {
+				dst.Entries = make(map[string]*DumpedEntry)
+			}
+			d = &DumpedEntry{Name: name, Attr: &DumpedAttr{Inode: c.Attr.Inode, Type: c.Attr.Type}}
+			dst.Entries[name] = d
+		}
+		c.Name = name
+		if err := mergeEntry(d, c, i, r, resolved, preferNewest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolvePlaceholders replaces the placeholders of directories left in the tree under e with
+// empty directories owned by root, and removes other placeholders. It returns the number of them.
+func resolvePlaceholders(e *DumpedEntry, resolved map[Ino]int) int {
+	var missing int
+	if resolved[e.Attr.Inode] == 0 {
+		now := time.Now()
+		e.Attr = &DumpedAttr{Inode: e.Attr.Inode, Type: e.Attr.Type, Mode: 0755, Atime: now.Unix(), Mtime: now.Unix(), Ctime: now.Unix(), Nlink: 2}
+		missing++
+	}
+	for name, c := range e.Entries {
+		if c.Attr.Type == "directory" {
+			missing += resolvePlaceholders(c, resolved)
+		} else if resolved[c.Attr.Inode] == 0 {
+			delete(e.Entries, name)
+			missing++
+		}
+	}
+	return missing
+}
+
+// mergeShards merges the shards of a dump into one, a shard can be merged alone. A full dump
+// is taken as a shard of all inodes, so that dumps of different parts of a volume can also be
+// merged. The usage in counters is summed up, and the largest next IDs are kept.
+func mergeShards(dms []*DumpedMeta, preferNewest bool) (*DumpedMeta, error) {
+	dm := dms[0]
+	tree := &DumpedEntry{Name: "FSTree", Attr: &DumpedAttr{Inode: dm.FSTree.Attr.Inode, Type: dm.FSTree.Attr.Type}}
+	resolved := make(map[Ino]int) // by the index of dump from 1
+	sustained := make(map[uint64]*DumpedSustained)
+	for _, ss := range dm.Sustained {
+		sustained[ss.Sid] = ss
+	}
+	for i, s := range dms {
+		if s.BaseVersion != 0 {
+			return nil, fmt.Errorf("dump %d is a delta dump, which can't be merged", i+1)
+		}
+		if s.Setting.UUID != dm.Setting.UUID {
+			return nil, fmt.Errorf("dump %d is from volume %s but not %s", i+1, s.Setting.UUID, dm.Setting.UUID)
+		}
+		r := s.InodeRange
+		if r == nil {
+			r = allInodes
+		}
+		if err := mergeEntry(tree, s.FSTree, i+1, r, resolved, preferNewest); err != nil {
+			return nil, err
+		}
+		dm.NoData = dm.NoData || s.NoData
+		dm.Partial = dm.Partial || s.Partial
+		if i == 0 {
+			continue
+		}
+		cs, c := dm.Counters, s.Counters
+		cs.UsedSpace += c.UsedSpace
+		cs.UsedInodes += c.UsedInodes
+		if c.NextInode > cs.NextInode {
+			cs.NextInode = c.NextInode
+		}
+		if c.NextChunk > cs.NextChunk {
+			cs.NextChunk = c.NextChunk
+		}
+		if c.NextSession > cs.NextSession {
+			cs.NextSession = c.NextSession
+		}
+		dm.DelFiles = append(dm.DelFiles, s.DelFiles...)
+		dm.Locks = append(dm.Locks, s.Locks...)
+		for _, ss := range s.Sustained {
+			if d := sustained[ss.Sid]; d != nil {
+				d.Inodes = append(d.Inodes, ss.Inodes...)
+			} else {
+				sustained[ss.Sid] = ss
+				dm.Sustained = append(dm.Sustained, ss)
+			}
+		}
+	}
+	if missing := resolvePlaceholders(tree, resolved); missing > 0 {
+		logger.Warnf("%d placeholders are not resolved by the %d dumps, the loaded tree is incomplete", missing, len(dms))
+	} else {
+		logger.Infof("Merged %d dumps with %d inodes", len(dms), len(resolved))
+	}
+	dm.FSTree = tree
+	dm.InodeRange = nil
+	return dm, nil
+}
@@ -30,7 +30,6 @@ import (
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/juicedata/juicefs/pkg/utils"
 	_ "github.com/lib/pq"
 	"github.com/mattn/go-sqlite3"
 	_ "github.com/mattn/go-sqlite3"
@@ -574,6 +573,17 @@ func (m *dbMeta) txn(f func(s *xorm.Session) error) error {
 	return err
 }
 
+// splitMicros splits a time in microseconds into seconds and nanoseconds, the seconds are
+// rounded down for a time before 1970, so that the nanoseconds are never negative.
+func splitMicros(us int64) (int64, uint32) {
+	sec, usec := us/1e6, us%1e6
+	if usec < 0 {
+		sec--
+		usec += 1e6
+	}
+	return sec, uint32(usec * 1000)
+}
+
 func (m *dbMeta) parseAttr(n *node, attr *Attr) {
 	if attr == nil {
 		return
@@ -583,12 +593,9 @@ func (m *dbMeta) parseAttr(n *node, attr *Attr) {
 	attr.Flags = n.Flags
 	attr.Uid = n.Uid
 	attr.Gid = n.Gid
-	attr.Atime = n.Atime / 1e6
-	attr.Atimensec = uint32(n.Atime % 1e6 * 1000)
-	attr.Mtime = n.Mtime / 1e6
-	attr.Mtimensec = uint32(n.Mtime % 1e6 * 1000)
-	attr.Ctime = n.Ctime / 1e6
-	attr.Ctimensec = uint32(n.Ctime % 1e6 * 1000)
+	attr.Atime, attr.Atimensec = splitMicros(n.Atime)
+	attr.Mtime, attr.Mtimensec = splitMicros(n.Mtime)
+	attr.Ctime, attr.Ctimensec = splitMicros(n.Ctime)
 	attr.Nlink = n.Nlink
 	attr.Length = n.Length
 	attr.Rdev = n.Rdev
@@ -2519,7 +2526,7 @@ func (m *dbMeta) dumpEntry(inode Ino) (*DumpedEntry, error) {
 				ss := readSliceBuf(c.Slices)
 				slices := make([]*DumpedSlice, 0, len(ss))
 				for _, s := range ss {
-					slices = append(slices, &DumpedSlice{s.pos, s.chunkid, s.size, s.off, s.len})
+					slices = append(slices, &DumpedSlice{s.pos, s.chunkid, s.size, s.off, s.len, nil})
 				}
 				e.Chunks = append(e.Chunks, &DumpedChunk{indx, slices})
 			}
@@ -2539,64 +2546,38 @@ func (m *dbMeta) dumpEntry(inode Ino) (*DumpedEntry, error) {
 	})
 }
 
-func (m *dbMeta) dumpDir(inode Ino, showProgress func(totalIncr, currentIncr int64)) (map[string]*DumpedEntry, error) {
+func (m *dbMeta) dumpDir(inode Ino) ([]*Entry, error) {
 	var edges []edge
 	if err := m.engine.Find(&edges, &edge{Parent: inode}); err != nil {
 		return nil, err
 	}
-	if showProgress != nil {
-		showProgress(int64(len(edges)), 0)
-	}
-	entries := make(map[string]*DumpedEntry)
+	entries := make([]*Entry, 0, len(edges))
 	for _, e := range edges {
-		entry, err := m.dumpEntry(e.Inode)
-		if err != nil {
-			return nil, err
-		}
-		if e.Type == TypeDirectory {
-			if entry.Entries, err = m.dumpDir(e.Inode, showProgress); err != nil {
-				return nil, err
-			}
-		}
-		entries[e.Name] = entry
-		if showProgress != nil {
-			showProgress(0, 1)
-		}
+		entries = append(entries, &Entry{Inode: e.Inode, Name: []byte(e.Name), Attr: &Attr{Typ: e.Type}})
 	}
 	return entries, nil
 }
 
-func (m *dbMeta) DumpMeta(w io.Writer) error {
+func (m *dbMeta) scanInodes(fn func(inode Ino)) error {
+	return m.engine.Table(&node{}).Cols("inode").Iterate(new(node), func(_ int, bean interface{}) error {
+		fn(bean.(*node).Inode)
+		return nil
+	})
+}
+
+func (m *dbMeta) DumpMeta(w io.Writer, opt DumpOption) error {
+	if opt.Consistent {
+		return errConsistent(m.Name())
+	}
 	var drows []delfile
 	if err := m.engine.Find(&drows); err != nil {
 		return err
 	}
 	dels := make([]*DumpedDelFile, 0, len(drows))
 	for _, row := range drows {
-		dels = append(dels, &DumpedDelFile{row.Inode, row.Length, row.Expire})
+		dels = append(dels, &DumpedDelFile{row.Inode, row.Length, row.Expire, nil})
 	}
 
-	tree, err := m.dumpEntry(m.root)
-	if err != nil {
-		return err
-	}
-
-	var total int64 = 1 // root
-	progress, bar := utils.NewDynProgressBar("Dump dir progress: ", false)
-	bar.Increment()
-	if tree.Entries, err = m.dumpDir(m.root, func(totalIncr, currentIncr int64) {
-		total += totalIncr
-		bar.SetTotal(total, false)
-		bar.IncrInt64(currentIncr)
-	}); err != nil {
-		return err
-	}
-	if bar.Current() != total {
-		logger.Warnf("Dumped %d / total %d, some entries are not dumped", bar.Current(), total)
-	}
-	bar.SetTotal(0, true)
-	progress.Wait()
-
 	format, err := m.Load()
 	if err != nil {
 		return err
@@ -2636,16 +2617,59 @@ func (m *dbMeta) DumpMeta(w io.Writer) error {
 	}
 
 	dm := DumpedMeta{
-		format,
-		counters,
-		sessions,
-		dels,
-		tree,
+		Setting:   format,
+		Counters:  counters,
+		Sustained: sessions,
+		DelFiles:  dels,
+	}
+	if opt.Locks {
+		if dm.Locks, err = readLocks(m); err != nil {
+			return err
+		}
+	}
+	src, err := dumpSource(m, dm.Counters, opt)
+	if err != nil {
+		return err
 	}
-	return dm.writeJSON(w)
+	if m.root != 1 || opt.filtered() || len(opt.Roots) > 0 {
+		if err = countSubtree(src, m.root, dm.Counters, opt); err != nil {
+			return err
+		}
+	}
+	return dumpTree(src, &dm, m.root, w, opt)
 }
 
+// loadChunks returns the chunks of inode to be inserted, the slices are counted in refs and cs.
+func (m *dbMeta) loadChunks(inode Ino, dumped []*DumpedChunk, cs *DumpedCounters, refs map[uint64]*chunkRef) []*chunk {
+	chunks := make([]*chunk, 0, len(dumped))
+	for _, c := range dumped {
+		if len(c.Slices) == 0 {
+			continue
+		}
+		slices := make([]byte, 0, sliceBytes*len(c.Slices))
+		for _, s := range c.Slices {
+			slices = append(slices, marshalSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len)...)
+			if refs[s.Chunkid] == nil {
+				refs[s.Chunkid] = &chunkRef{s.Chunkid, s.Size, 1}
+			} else {
+				refs[s.Chunkid].Refs++
+			}
+			if cs.NextChunk <= int64(s.Chunkid) {
+				cs.NextChunk = int64(s.Chunkid) + 1
+			}
+		}
+		chunks = append(chunks, &chunk{inode, c.Index, slices})
+	}
+	return chunks
+}
+
+// loadEntry inserts e together with the checkpoint in a transaction, it's counted in cs and refs.
 func (m *dbMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*chunkRef) error {
+	return m.commitEntries([]interface{}{m.prepareEntry(e, cs, refs)}, e.Attr.Inode)
+}
+
+// prepareEntry counts e in cs and refs, and returns the beans of it to be inserted.
+func (m *dbMeta) prepareEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*chunkRef) []interface{} {
 	inode := e.Attr.Inode
 	logger.Debugf("Loading entry inode %d name %s", inode, e.Name)
 	attr := e.Attr
@@ -2656,35 +2680,17 @@ func (m *dbMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*
 		Uid:    attr.Uid,
 		Gid:    attr.Gid,
 		Atime:  attr.Atime*1e6 + int64(attr.Atimensec)/1e3,
-		Mtime:  attr.Mtime*1e6 + int64(attr.Atimensec)/1e3,
-		Ctime:  attr.Ctime*1e6 + int64(attr.Atimensec)/1e3,
+		Mtime:  attr.Mtime*1e6 + int64(attr.Mtimensec)/1e3,
+		Ctime:  attr.Ctime*1e6 + int64(attr.Ctimensec)/1e3,
 		Nlink:  attr.Nlink,
 		Rdev:   attr.Rdev,
+		Flags:  attr.Flags,
 		Parent: e.Parent,
 	} // Length not set
 	var beans []interface{}
 	if n.Type == TypeFile {
 		n.Length = attr.Length
-		chunks := make([]*chunk, 0, len(e.Chunks))
-		for _, c := range e.Chunks {
-			if len(c.Slices) == 0 {
-				continue
-			}
-			slices := make([]byte, 0, sliceBytes*len(c.Slices))
-			for _, s := range c.Slices {
-				slices = append(slices, marshalSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len)...)
-				if refs[s.Chunkid] == nil {
-					refs[s.Chunkid] = &chunkRef{s.Chunkid, s.Size, 1}
-				} else {
-					refs[s.Chunkid].Refs++
-				}
-				if cs.NextChunk <= int64(s.Chunkid) {
-					cs.NextChunk = int64(s.Chunkid) + 1
-				}
-			}
-			chunks = append(chunks, &chunk{inode, c.Index, slices})
-		}
-		if len(chunks) > 0 {
+		if chunks := m.loadChunks(inode, e.Chunks, cs, refs); len(chunks) > 0 {
 			beans = append(beans, chunks)
 		}
 	} else if n.Type == TypeDirectory {
@@ -2720,19 +2726,313 @@ func (m *dbMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*
 		}
 		beans = append(beans, xattrs)
 	}
-	beans = append(beans, n)
-	s := m.engine.NewSession()
-	defer s.Close()
-	return mustInsert(s, beans...)
+	return append(beans, n)
+}
+
+// commitEntries inserts the beans prepared by prepareEntry together with ckpt in a transaction.
+func (m *dbMeta) commitEntries(batch []interface{}, ckpt Ino) error {
+	return m.txn(func(s *xorm.Session) error {
+		for _, w := range batch {
+			if err := mustInsert(s, w.([]interface{})...); err != nil {
+				return err
+			}
+		}
+		updated, err := s.Cols("value").Update(&counter{Value: int64(ckpt)}, &counter{Name: loadCheckpoint})
+		if err != nil || updated > 0 {
+			return err
+		}
+		if ok, err := s.Get(&counter{Name: loadCheckpoint}); err != nil || ok { // not changed
+			return err
+		}
+		return mustInsert(s, &counter{loadCheckpoint, int64(ckpt)})
+	})
+}
+
+// cleanLoaded deletes what's written after the checkpoint ckpt by an interrupted load, which
+// commits the entries out of order, so that they can be inserted again.
+func (m *dbMeta) cleanLoaded(ckpt uint64) error {
+	return m.txn(func(s *xorm.Session) error {
+		for _, bean := range []interface{}{new(node), new(chunk), new(symlink), new(xattr)} {
+			if _, err := s.Where("inode > ?", ckpt).Delete(bean); err != nil {
+				return err
+			}
+		}
+		_, err := s.Where("parent > ?", ckpt).Delete(new(edge))
+		return err
+	})
+}
+
+func (m *dbMeta) removeInode(inode Ino) error {
+	return m.replaceInode(inode, nil)
+}
+
+// replaceInode replaces everything stored for inode with e, or removes it if e is nil, the
+// references to slices are changed by the difference of the chunks in the same transaction.
+func (m *dbMeta) replaceInode(inode Ino, e *DumpedEntry) error {
+	return m.txn(func(s *xorm.Session) error {
+		var rows []chunk
+		if err := s.Find(&rows, &chunk{Inode: inode}); err != nil {
+			return err
+		}
+		old := make([]*DumpedChunk, 0, len(rows))
+		for _, c := range rows {
+			dc := &DumpedChunk{Index: c.Indx}
+			for _, sl := range readSliceBuf(c.Slices) {
+				dc.Slices = append(dc.Slices, &DumpedSlice{Chunkid: sl.chunkid, Size: sl.size})
+			}
+			old = append(old, dc)
+		}
+		for _, bean := range []interface{}{&node{Inode: inode}, &chunk{Inode: inode}, &symlink{Inode: inode},
+			&xattr{Inode: inode}, &edge{Parent: inode}} {
+			if _, err := s.Delete(bean); err != nil {
+				return err
+			}
+		}
+		var chunks []*DumpedChunk
+		if e != nil {
+			if err := mustInsert(s, m.prepareEntry(e, &DumpedCounters{}, make(map[uint64]*chunkRef))...); err != nil {
+				return err
+			}
+			if typeFromString(e.Attr.Type) == TypeFile {
+				chunks = e.Chunks
+			}
+		}
+		// every slice referred is in chunk_ref, with the number of references
+		for id, r := range diffSlices(old, chunks) {
+			if r.new == r.old {
+				continue
+			}
+			ref := &chunkRef{Chunkid: id.chunkid}
+			ok, err := s.Get(ref)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				if r.new < r.old { // not referred before, nothing to release
+					continue
+				}
+				err = mustInsert(s, &chunkRef{id.chunkid, id.size, int(r.new - r.old)})
+			} else if ref.Refs+int(r.new-r.old) > 0 {
+				_, err = s.Exec("update jfs_chunk_ref set refs=refs+? where chunkid=?", r.new-r.old, id.chunkid)
+			} else { // the objects are left to gc
+				_, err = s.Exec("delete from jfs_chunk_ref where chunkid=?", id.chunkid)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// knownSlices keeps the slices in chunk_ref.
+func (m *dbMeta) knownSlices(slices map[sliceID]bool) error {
+	return m.txn(func(s *xorm.Session) error {
+		for id := range slices {
+			if ok, err := s.Get(&chunkRef{Chunkid: id.chunkid}); err != nil {
+				return err
+			} else if !ok {
+				delete(slices, id)
+			}
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) raiseNextCounters(cs *DumpedCounters) error {
+	m.freeMu.Lock()
+	defer m.freeMu.Unlock()
+	m.freeInodes, m.freeChunks = freeID{}, freeID{} // allocated again above the raised ones
+	return m.txn(func(s *xorm.Session) error {
+		for name, v := range map[string]int64{"nextInode": cs.NextInode, "nextChunk": cs.NextChunk, "nextSession": cs.NextSession} {
+			if _, err := s.Exec("UPDATE jfs_counter SET value=? WHERE name=? AND value<?", v, name, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) graftDir(inode Ino, e *DumpedEntry) error {
+	return m.txn(func(s *xorm.Session) error {
+		n := node{Inode: inode}
+		ok, err := s.Get(&n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if n.Type != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		edges := make([]*edge, 0, len(e.Entries))
+		for _, c := range e.Entries {
+			if ok, err = s.Get(&edge{Parent: inode, Name: c.Name}); err != nil {
+				return err
+			} else if ok {
+				return fmt.Errorf("%s exists in the destination", c.Name)
+			}
+			typ := typeFromString(c.Attr.Type)
+			if typ == TypeDirectory {
+				n.Nlink++
+			}
+			edges = append(edges, &edge{Parent: inode, Name: c.Name, Inode: c.Attr.Inode, Type: typ})
+		}
+		if len(edges) > 0 {
+			if err = mustInsert(s, edges); err != nil {
+				return err
+			}
+		}
+		now := time.Now().UnixNano() / 1e3
+		n.Mtime = now
+		n.Ctime = now
+		_, err = s.Cols("nlink", "mtime", "ctime").Update(&n, &node{Inode: inode})
+		return err
+	})
+}
+
+func (m *dbMeta) applyEntry(e *DumpedEntry, known map[sliceID]bool) error {
+	return m.replaceInode(e.Attr.Inode, e)
 }
 
-func (m *dbMeta) LoadMeta(r io.Reader) error {
+func (m *dbMeta) applyCounters(dm *DumpedMeta) error {
+	return m.txn(func(s *xorm.Session) error {
+		for _, c := range []counter{
+			{"usedSpace", dm.Counters.UsedSpace},
+			{"totalInodes", dm.Counters.UsedInodes},
+			{"nextInode", dm.Counters.NextInode},
+			{"nextChunk", dm.Counters.NextChunk},
+			{"nextSession", dm.Counters.NextSession},
+		} {
+			if _, err := s.Cols("value").Update(&counter{Value: c.Value}, &counter{Name: c.Name}); err != nil {
+				return err
+			}
+		}
+		for _, d := range dm.DelFiles {
+			if ok, err := s.Get(&delfile{Inode: d.Inode}); err != nil {
+				return err
+			} else if !ok {
+				if err = mustInsert(s, &delfile{d.Inode, d.Length, d.Expire}); err != nil {
+					return err
+				}
+			}
+		}
+		_, err := s.Delete(&counter{Name: loadCheckpoint}) // written by loadEntry
+		return err
+	})
+}
+
+// loadDelFiles writes the files to be deleted into a loaded volume, the ones written before are
+// skipped, with their chunks overwritten.
+func (m *dbMeta) loadDelFiles(dels []*DumpedDelFile) error {
+	return m.txn(func(s *xorm.Session) error {
+		for _, d := range dels {
+			if ok, err := s.Get(&delfile{Inode: d.Inode}); err != nil {
+				return err
+			} else if !ok {
+				if err = mustInsert(s, &delfile{d.Inode, d.Length, d.Expire}); err != nil {
+					return err
+				}
+			}
+			if _, err := s.Delete(&chunk{Inode: d.Inode}); err != nil {
+				return err
+			}
+			chunks := m.loadChunks(d.Inode, d.Chunks, &DumpedCounters{}, make(map[uint64]*chunkRef))
+			if len(chunks) > 0 {
+				if err := mustInsert(s, chunks); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) WalkTree(root Ino, visit func(path string, e *DumpedEntry) error) error {
+	return walkEntries(m, m.checkRoot(root), visit)
+}
+
+func (m *dbMeta) LoadMeta(r io.Reader, opt LoadOption) error {
 	tables, err := m.engine.DBMetas()
 	if err != nil {
 		return err
 	}
+	if opt.DryRun != nil {
+		return dryRunLoad(r, opt, len(tables) > 0)
+	}
+	if opt.AttrsOnly {
+		if len(tables) == 0 {
+			return fmt.Errorf("Database %s is empty, there is no attr to be restored", m.Name())
+		}
+		return loadAttrsOnly(m, r, opt)
+	}
+	if opt.ApplyDelta {
+		if len(tables) == 0 {
+			return fmt.Errorf("Database %s is empty, load the base dump first", m.Name())
+		}
+		return applyDelta(m, r, opt)
+	}
+	if opt.Phase == "trash" {
+		if len(tables) == 0 {
+			return fmt.Errorf("Database %s is empty, load the live phase first", m.Name())
+		}
+		return loadTrashPhase(m, r, opt, m.loadDelFiles)
+	}
+	if opt.Remap != "" {
+		refs := make(map[uint64]*chunkRef)
+		cs, err := loadRemapped(m, r, opt, 0, func(e *DumpedEntry, cs *DumpedCounters) error {
+			return m.loadEntry(e, cs, refs)
+		})
+		if err != nil {
+			return err
+		}
+		return m.txn(func(s *xorm.Session) error {
+			for name, v := range map[string]int64{"usedSpace": cs.UsedSpace, "totalInodes": cs.UsedInodes} {
+				if _, err := s.Exec("UPDATE jfs_counter SET value=value+? WHERE name=?", v, name); err != nil {
+					return err
+				}
+			}
+			for _, ref := range refs {
+				if n, err := s.Exec("update jfs_chunk_ref set refs=refs+? where chunkid = ? AND size = ?", ref.Refs, ref.Chunkid, ref.Size); err != nil {
+					return err
+				} else if affected, _ := n.RowsAffected(); affected == 0 {
+					if err = mustInsert(s, ref); err != nil {
+						return err
+					}
+				}
+			}
+			_, err := s.Delete(&counter{Name: loadCheckpoint})
+			return err
+		})
+	}
+	var ckpt uint64
 	if len(tables) > 0 {
-		return fmt.Errorf("Database %s is not empty", m.Name())
+		if !opt.Resume {
+			return fmt.Errorf("Database %s is not empty", m.Name())
+		}
+		c := counter{Name: loadCheckpoint}
+		if ok, err := m.engine.Get(&c); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("Database %s is not empty and has no checkpoint to resume from", m.Name())
+		}
+		ckpt = uint64(c.Value)
+		logger.Infof("Resume loading after inode %d", ckpt)
+	}
+	// decode and collect before creating the tables, so that the database is left empty if it fails
+	dm, err := readDump(r, opt)
+	if err != nil {
+		return err
+	}
+	format, err := json.MarshalIndent(dm.Setting, "", "")
+	if err != nil {
+		return err
+	}
+
+	entries, skipped, err := collectEntries(dm, opt)
+	if err != nil {
+		return err
 	}
 	if err = m.engine.Sync2(new(setting), new(counter)); err != nil {
 		return fmt.Errorf("create table setting, counter: %s", err)
@@ -2750,48 +3050,38 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 		return fmt.Errorf("create table flock, plock: %s", err)
 	}
 
-	dec := json.NewDecoder(r)
-	dm := &DumpedMeta{}
-	if err = dec.Decode(dm); err != nil {
-		return err
-	}
-	format, err := json.MarshalIndent(dm.Setting, "", "")
-	if err != nil {
-		return err
-	}
-
-	var total int64 = 1 // root
-	progress, bar := utils.NewDynProgressBar("CollectEntry progress: ", false)
-	dm.FSTree.Attr.Inode = 1
-	entries := make(map[Ino]*DumpedEntry)
-	if err = collectEntry(dm.FSTree, entries, func(totalIncr, currentIncr int64) {
-		total += totalIncr
-		bar.SetTotal(total, false)
-		bar.IncrInt64(currentIncr)
-	}); err != nil {
-		return err
-	}
-	if bar.Current() != total {
-		logger.Warnf("Collected %d / total %d, some entries are not collected", bar.Current(), total)
-	}
-	bar.SetTotal(0, true)
-	progress.Wait()
-
 	counters := &DumpedCounters{
 		NextInode:   2,
 		NextChunk:   1,
 		NextSession: 1,
 	}
 	refs := make(map[uint64]*chunkRef)
-	for _, entry := range entries {
-		if err = m.loadEntry(entry, counters, refs); err != nil {
+	if ckpt > 0 {
+		if err = m.cleanLoaded(ckpt); err != nil {
 			return err
 		}
+	} else if err = m.commitEntries(nil, 0); err != nil { // not inserted concurrently by the workers
+		return err
+	}
+	if err = loadBatches(entries, opt, func(e *DumpedEntry) (interface{}, error) {
+		w := m.prepareEntry(e, counters, refs)
+		if uint64(e.Attr.Inode) <= ckpt {
+			return nil, nil
+		}
+		return w, nil
+	}, m.commitEntries); err != nil {
+		return err
 	}
-	logger.Infof("Dumped counters: %+v", *dm.Counters)
-	logger.Infof("Loaded counters: %+v", *counters)
+	var delChunks []*chunk // no node, only the slices to be cleaned with the file
+	for _, d := range dm.DelFiles {
+		delChunks = append(delChunks, m.loadChunks(d.Inode, d.Chunks, counters, refs)...)
+	}
+	checkUsage(dm.Counters, counters, opt.KeepCounters)
+	keepNextCounters(dm.Counters, counters, 0)
+	reportCounters(dm.Counters, counters, 0, opt)
+	warnOverQuota(dm.Setting, counters)
 
-	beans := make([]interface{}, 0, 4) // setting, counter, delfile, chunkRef
+	beans := make([]interface{}, 0, 5) // setting, counter, delfile, chunk, chunkRef
 	beans = append(beans, &setting{"format", string(format)})
 	cs := make([]*counter, 0, 6)
 	cs = append(cs, &counter{"usedSpace", counters.UsedSpace})
@@ -2801,13 +3091,16 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 	cs = append(cs, &counter{"nextSession", counters.NextSession})
 	cs = append(cs, &counter{"nextCleanupSlices", 0})
 	beans = append(beans, cs)
-	if len(dm.DelFiles) > 0 {
+	if len(dm.DelFiles) > 0 && opt.Phase != "live" {
 		dels := make([]*delfile, 0, len(dm.DelFiles))
 		for _, d := range dm.DelFiles {
 			dels = append(dels, &delfile{d.Inode, d.Length, d.Expire})
 		}
 		beans = append(beans, dels)
 	}
+	if len(delChunks) > 0 && opt.Phase != "live" { // refs are counted by the live phase to keep the slices
+		beans = append(beans, delChunks)
+	}
 	if len(refs) > 0 {
 		cks := make([]*chunkRef, 0, len(refs))
 		for _, v := range refs {
@@ -2815,7 +3108,13 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 		}
 		beans = append(beans, cks)
 	}
-	s := m.engine.NewSession()
-	defer s.Close()
-	return mustInsert(s, beans...)
+	if err = m.txn(func(s *xorm.Session) error {
+		if _, err := s.Delete(&counter{Name: loadCheckpoint}); err != nil {
+			return err
+		}
+		return mustInsert(s, beans...)
+	}); err != nil {
+		return err
+	}
+	return skipped.orNil()
 }
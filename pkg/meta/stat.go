@@ -0,0 +1,118 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"path"
+	"sort"
+)
+
+// DumpStat is a summary of what is dumped, computed while the tree is walked.
+type DumpStat struct {
+	Top          int              `json:"-"`      // number of largest and oldest files to be kept, set by the caller
+	Inodes       map[string]int64 `json:"inodes"` // by type
+	UsedSpace    int64            `json:"usedSpace"`
+	HardLinked   int64            `json:"hardLinked"` // inodes with nlink > 1
+	DelFiles     int              `json:"delFiles"`
+	DeepestPath  string           `json:"deepestPath"`
+	Depth        int              `json:"depth"`
+	LargestFiles []*DumpStatFile  `json:"largestFiles"`
+	OldestFiles  []*DumpStatFile  `json:"oldestFiles"` // by mtime
+}
+
+type DumpStatFile struct {
+	Path  string `json:"path"`
+	Inode Ino    `json:"inode"`
+	Size  uint64 `json:"size"`
+	Mtime int64  `json:"mtime"` // in seconds
+}
+
+// statEncoder fills st with the entries written through it.
+type statEncoder struct {
+	dumpEncoder
+	st     *DumpStat
+	dirs   []string // path of current directory and its parents
+	linked map[Ino]struct{}
+}
+
+func newStatEncoder(enc dumpEncoder, st *DumpStat) *statEncoder {
+	st.Inodes = make(map[string]int64)
+	return &statEncoder{dumpEncoder: enc, st: st, linked: make(map[Ino]struct{})}
+}
+
+func (s *statEncoder) writeMeta(dm *DumpedMeta) error {
+	s.st.UsedSpace = dm.Counters.UsedSpace
+	s.st.DelFiles = len(dm.DelFiles)
+	return s.dumpEncoder.writeMeta(dm)
+}
+
+func (s *statEncoder) count(e *DumpedEntry) string {
+	p := "/"
+	if len(s.dirs) > 0 {
+		p = path.Join(s.dirs[len(s.dirs)-1], e.Name)
+	}
+	a := e.Attr
+	if a.Nlink == 0 { // stubs in delta dumps and placeholders in shards
+		return p
+	}
+	if len(s.dirs) > s.st.Depth {
+		s.st.Depth, s.st.DeepestPath = len(s.dirs), p
+	}
+	if a.Type != "directory" && a.Nlink > 1 {
+		if _, ok := s.linked[a.Inode]; ok {
+			return p
+		}
+		s.linked[a.Inode] = struct{}{}
+		s.st.HardLinked++
+	}
+	s.st.Inodes[a.Type]++
+	if a.Type == "regular" && s.st.Top > 0 {
+		f := &DumpStatFile{p, a.Inode, a.Length, a.Mtime}
+		s.st.LargestFiles = keepTop(s.st.LargestFiles, f, s.st.Top, func(a, b *DumpStatFile) bool { return a.Size > b.Size })
+		s.st.OldestFiles = keepTop(s.st.OldestFiles, f, s.st.Top, func(a, b *DumpStatFile) bool { return a.Mtime < b.Mtime })
+	}
+	return p
+}
+
+// keepTop inserts f into files sorted by before, and keeps the first top of them.
+func keepTop(files []*DumpStatFile, f *DumpStatFile, top int, before func(a, b *DumpStatFile) bool) []*DumpStatFile {
+	if len(files) >= top && !before(f, files[len(files)-1]) {
+		return files
+	}
+	i := sort.Search(len(files), func(i int) bool { return before(f, files[i]) })
+	files = append(files, nil)
+	copy(files[i+1:], files[i:])
+	files[i] = f
+	if len(files) > top {
+		files = files[:top]
+	}
+	return files
+}
+
+func (s *statEncoder) writeEntry(e *DumpedEntry) error {
+	s.count(e)
+	return s.dumpEncoder.writeEntry(e)
+}
+
+func (s *statEncoder) beginDir(e *DumpedEntry, n int) error {
+	s.dirs = append(s.dirs, s.count(e))
+	return s.dumpEncoder.beginDir(e, n)
+}
+
+func (s *statEncoder) endDir() error {
+	s.dirs = s.dirs[:len(s.dirs)-1]
+	return s.dumpEncoder.endDir()
+}
@@ -0,0 +1,106 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/DataDog/zstd"
+	"github.com/pierrec/lz4"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+
+	// not supported, they're detected for a clear error
+	otherMagics = map[string][]byte{
+		"bzip2": []byte("BZh"),
+		"xz":    {0xfd, 0x37, 0x7a, 0x58},
+		"zip":   {0x50, 0x4b, 0x03, 0x04},
+	}
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressLevels are the ranges of levels supported by the compression algorithms, from the
+// fastest to the smallest. The level of lz4 is the depth of its high compression mode, and 0 is
+// its fast mode, which is the default.
+var compressLevels = map[string][2]int{
+	"gzip": {gzip.BestSpeed, gzip.BestCompression},
+	"zstd": {zstd.BestSpeed, zstd.BestCompression},
+	"lz4":  {0, 1 << 16},
+}
+
+// newCompressWriter returns a writer compressing everything written into w at level, 0 for the
+// default of algr, it must be closed to flush the compressed stream, but w is left open.
+func newCompressWriter(w io.Writer, algr string, level int) (io.WriteCloser, error) {
+	if levels, ok := compressLevels[algr]; ok && level != 0 && (level < levels[0] || level > levels[1]) {
+		return nil, fmt.Errorf("invalid level %d of %s, which should be in [%d, %d]", level, algr, levels[0], levels[1])
+	}
+	switch algr {
+	case "", "none":
+		if level != 0 {
+			return nil, fmt.Errorf("a compression level needs a compression algorithm")
+		}
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "zstd":
+		if level == 0 {
+			level = zstd.DefaultCompression
+		}
+		return zstd.NewWriterLevel(w, level), nil
+	case "lz4":
+		zw := lz4.NewWriter(w)
+		zw.Header.CompressionLevel = level
+		return zw, nil
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm: %s", algr)
+	}
+}
+
+// newDecompressReader detects the compression of br by its magic number,
+// and returns a reader of the decompressed stream.
+func newDecompressReader(br *bufio.Reader) (io.Reader, error) {
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		return zstd.NewReader(br), nil
+	case bytes.HasPrefix(magic, lz4Magic):
+		return lz4.NewReader(br), nil
+	}
+	for name, m := range otherMagics {
+		if bytes.HasPrefix(magic, m) {
+			return nil, fmt.Errorf("the dump is compressed by %s, which is not supported, please decompress it first", name)
+		}
+	}
+	return br, nil
+}
@@ -0,0 +1,84 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SymlinkRewrite replaces the prefix Old of absolute symlink targets by New, e.g. when a volume
+// is mounted at a new path. Old matches whole path elements only, so "/data" matches "/data"
+// and "/data/x" but not "/database".
+type SymlinkRewrite struct {
+	Old, New string
+}
+
+// ParseSymlinkRewrite parses "OLD=NEW", both of which must be absolute paths.
+func ParseSymlinkRewrite(s string) (SymlinkRewrite, error) {
+	ps := strings.SplitN(s, "=", 2)
+	if len(ps) != 2 || !strings.HasPrefix(ps[0], "/") || !strings.HasPrefix(ps[1], "/") {
+		return SymlinkRewrite{}, fmt.Errorf("%q is not OLD=NEW of absolute paths", s)
+	}
+	old := strings.TrimRight(ps[0], "/")
+	if old == "" {
+		return SymlinkRewrite{}, fmt.Errorf("the root can't be rewritten: %q", s)
+	}
+	return SymlinkRewrite{old, strings.TrimRight(ps[1], "/")}, nil
+}
+
+func (r SymlinkRewrite) rewrite(target string) (string, bool) {
+	if target == r.Old {
+		if r.New == "" {
+			return "/", true
+		}
+		return r.New, true
+	}
+	if strings.HasPrefix(target, r.Old+"/") {
+		return r.New + target[len(r.Old):], true
+	}
+	return target, false
+}
+
+// rewriteSymlinks rewrites the targets of the absolute symlinks in dm by the first matching one
+// in opt.SymlinkRewrites, relative ones are kept. A target is matched after it's decoded, and the
+// rest of it after the prefix is kept byte by byte.
+func rewriteSymlinks(dm *DumpedMeta, opt LoadOption) {
+	if dm.FSTree == nil || len(opt.SymlinkRewrites) == 0 {
+		return
+	}
+	var n int
+	stack := []*DumpedEntry{dm.FSTree}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, c := range e.Entries {
+			stack = append(stack, c)
+		}
+		if e.Attr == nil || e.Attr.Type != "symlink" || !strings.HasPrefix(e.Symlink, "/") {
+			continue
+		}
+		for _, r := range opt.SymlinkRewrites {
+			if target, ok := r.rewrite(e.Symlink); ok {
+				e.Symlink = target
+				e.Attr.Length = uint64(len(target))
+				n++
+				break
+			}
+		}
+	}
+	logger.Infof("Rewrite targets of %d symlinks", n)
+}
@@ -0,0 +1,43 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import "time"
+
+// resetTimes sets the times of all the entries in dm to now in seconds, with the nanoseconds
+// zeroed, e.g. for a test volume seeded from a production dump to look freshly created. Only
+// the atime is set by opt.ResetAtime, and all of them by opt.ResetTimes. It only changes what is
+// loaded, nothing is written into a dump.
+func resetTimes(dm *DumpedMeta, opt LoadOption, now time.Time) {
+	if dm.FSTree == nil || !opt.ResetTimes && !opt.ResetAtime {
+		return
+	}
+	sec := now.Unix()
+	var walk func(e *DumpedEntry)
+	walk = func(e *DumpedEntry) {
+		if a := e.Attr; a != nil {
+			a.Atime, a.Atimensec = sec, 0
+			if opt.ResetTimes {
+				a.Mtime, a.Mtimensec = sec, 0
+				a.Ctime, a.Ctimensec = sec, 0
+			}
+		}
+		for _, c := range e.Entries {
+			walk(c)
+		}
+	}
+	walk(dm.FSTree)
+}
@@ -638,7 +638,7 @@ func (m *kvMeta) getSession(sid uint64, detail bool) (*Session, error) {
 			ls := unmarshalFlock(v)
 			for o, l := range ls {
 				if o.sid == sid {
-					s.Flocks = append(s.Flocks, Flock{inode, o.sid, string(l)})
+					s.Flocks = append(s.Flocks, Flock{inode, o.owner, string(l)})
 				}
 			}
 		}
@@ -651,7 +651,7 @@ func (m *kvMeta) getSession(sid uint64, detail bool) (*Session, error) {
 			ls := unmarshalPlock(v)
 			for o, l := range ls {
 				if o.sid == sid {
-					s.Plocks = append(s.Plocks, Plock{inode, o.sid, l})
+					s.Plocks = append(s.Plocks, Plock{inode, o.owner, l})
 				}
 			}
 		}
@@ -2353,7 +2353,7 @@ func (m *kvMeta) dumpEntry(inode Ino) (*DumpedEntry, error) {
 				ss := readSliceBuf(v)
 				slices := make([]*DumpedSlice, 0, len(ss))
 				for _, s := range ss {
-					slices = append(slices, &DumpedSlice{s.pos, s.chunkid, s.size, s.off, s.len})
+					slices = append(slices, &DumpedSlice{s.pos, s.chunkid, s.size, s.off, s.len, nil})
 				}
 				e.Chunks = append(e.Chunks, &DumpedChunk{indx, slices})
 			}
@@ -2369,35 +2369,41 @@ func (m *kvMeta) dumpEntry(inode Ino) (*DumpedEntry, error) {
 	})
 }
 
-func (m *kvMeta) dumpDir(inode Ino, showProgress func(totalIncr, currentIncr int64)) (map[string]*DumpedEntry, error) {
+func (m *kvMeta) dumpDir(inode Ino) ([]*Entry, error) {
 	vals, err := m.scanValues(m.entryKey(inode, ""), nil)
 	if err != nil {
 		return nil, err
 	}
-	if showProgress != nil {
-		showProgress(int64(len(vals)), 0)
-	}
-	entries := make(map[string]*DumpedEntry)
+	entries := make([]*Entry, 0, len(vals))
 	for k, v := range vals {
-		typ, inode := m.parseEntry([]byte(v))
-		entry, err := m.dumpEntry(inode)
-		if err != nil {
-			return nil, err
-		}
-		if typ == TypeDirectory {
-			if entry.Entries, err = m.dumpDir(inode, showProgress); err != nil {
-				return nil, err
-			}
-		}
-		entries[k[10:]] = entry // "A" + inode + "D"
-		if showProgress != nil {
-			showProgress(0, 1)
-		}
+		typ, inode := m.parseEntry(v)
+		entries = append(entries, &Entry{Inode: inode, Name: []byte(k[10:]), Attr: &Attr{Typ: typ}}) // "A" + inode + "D"
 	}
 	return entries, nil
 }
 
-func (m *kvMeta) DumpMeta(w io.Writer) error {
+func (m *kvMeta) scanInodes(fn func(inode Ino)) error {
+	klen := 1 + 8 + 1
+	vals, err := m.scanValues(m.fmtKey("A"), func(k, v []byte) bool {
+		return len(k) == klen && k[klen-1] == 'I'
+	})
+	if err != nil {
+		return err
+	}
+	for k := range vals {
+		fn(m.decodeInode([]byte(k)[1:9]))
+	}
+	return nil
+}
+
+func (m *kvMeta) DumpMeta(w io.Writer, opt DumpOption) error {
+	if opt.Consistent {
+		snap, err := m.snapshot()
+		if err != nil {
+			return err
+		}
+		m = snap
+	}
 	vals, err := m.scanValues(m.fmtKey("D"), nil)
 	if err != nil {
 		return err
@@ -2409,30 +2415,9 @@ func (m *kvMeta) DumpMeta(w io.Writer) error {
 			return fmt.Errorf("invalid delfileKey: %s", k)
 		}
 		inode := m.decodeInode(b.Get(8))
-		dels = append(dels, &DumpedDelFile{inode, b.Get64(), m.parseInt64(v)})
-	}
-
-	tree, err := m.dumpEntry(m.root)
-	if err != nil {
-		return err
+		dels = append(dels, &DumpedDelFile{inode, b.Get64(), m.parseInt64(v), nil})
 	}
 
-	var total int64 = 1 //root
-	progress, bar := utils.NewDynProgressBar("Dump dir progress: ", false)
-	bar.Increment()
-	if tree.Entries, err = m.dumpDir(m.root, func(totalIncr, currentIncr int64) {
-		total += totalIncr
-		bar.SetTotal(total, false)
-		bar.IncrInt64(currentIncr)
-	}); err != nil {
-		return err
-	}
-	if bar.Current() != total {
-		logger.Warnf("Dumped %d / total %d, some entries are not dumped", bar.Current(), total)
-	}
-	bar.SetTotal(0, true)
-	progress.Wait()
-
 	format, err := m.Load()
 	if err != nil {
 		return err
@@ -2477,84 +2462,341 @@ func (m *kvMeta) DumpMeta(w io.Writer) error {
 	}
 
 	dm := DumpedMeta{
-		format,
-		&DumpedCounters{
+		Setting: format,
+		Counters: &DumpedCounters{
 			UsedSpace:   cs[0],
 			UsedInodes:  cs[1],
 			NextInode:   cs[2],
 			NextChunk:   cs[3],
 			NextSession: cs[4],
 		},
-		sessions,
-		dels,
-		tree,
+		Sustained: sessions,
+		DelFiles:  dels,
+	}
+	if opt.Locks {
+		if dm.Locks, err = readLocks(m); err != nil {
+			return err
+		}
+	}
+	src, err := dumpSource(m, dm.Counters, opt)
+	if err != nil {
+		return err
 	}
-	return dm.writeJSON(w)
+	if m.root != 1 || opt.filtered() || len(opt.Roots) > 0 {
+		if err = countSubtree(src, m.root, dm.Counters, opt); err != nil {
+			return err
+		}
+	}
+	return dumpTree(src, &dm, m.root, w, opt)
 }
 
+// loadEntry sets e together with the checkpoint in a transaction, it's counted in cs and refs.
 func (m *kvMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[string]int64) error {
+	return m.commitEntries([]interface{}{m.prepareEntry(e, cs, refs)}, e.Attr.Inode)
+}
+
+// prepareEntry counts e in cs and refs, and returns the function setting it in a transaction,
+// which can be called in another goroutine.
+func (m *kvMeta) prepareEntry(e *DumpedEntry, cs *DumpedCounters, refs map[string]int64) func(tx kvTxn) {
 	inode := e.Attr.Inode
 	logger.Debugf("Loading entry inode %d name %s", inode, e.Name)
 	attr := loadAttr(e.Attr)
 	attr.Parent = e.Parent
-	return m.txn(func(tx kvTxn) error {
-		if attr.Typ == TypeFile {
-			attr.Length = e.Attr.Length
-			for _, c := range e.Chunks {
-				if len(c.Slices) == 0 {
-					continue
-				}
-				slices := make([]byte, 0, sliceBytes*len(c.Slices))
-				for _, s := range c.Slices {
-					slices = append(slices, marshalSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len)...)
-					refs[string(m.sliceKey(s.Chunkid, s.Size))]++
-					if cs.NextChunk <= int64(s.Chunkid) {
-						cs.NextChunk = int64(s.Chunkid) + 1
-					}
-				}
-				tx.set(m.chunkKey(inode, c.Index), slices)
-			}
-		} else if attr.Typ == TypeDirectory {
-			attr.Length = 4 << 10
+	if attr.Typ == TypeFile {
+		attr.Length = e.Attr.Length
+		m.countSlices(e.Chunks, cs, refs)
+	} else if attr.Typ == TypeDirectory {
+		attr.Length = 4 << 10
+	} else if attr.Typ == TypeSymlink {
+		attr.Length = uint64(len(e.Symlink))
+	}
+	if inode > 1 {
+		cs.UsedSpace += align4K(attr.Length)
+		cs.UsedInodes += 1
+	}
+	if cs.NextInode <= int64(inode) {
+		cs.NextInode = int64(inode) + 1
+	}
+
+	return func(tx kvTxn) {
+		switch attr.Typ {
+		case TypeFile:
+			m.setChunks(tx, inode, e.Chunks)
+		case TypeDirectory:
 			for _, c := range e.Entries {
 				tx.set(m.entryKey(inode, c.Name), m.packEntry(typeFromString(c.Attr.Type), c.Attr.Inode))
 			}
-		} else if attr.Typ == TypeSymlink {
-			attr.Length = uint64(len(e.Symlink))
+		case TypeSymlink:
 			tx.set(m.symKey(inode), []byte(e.Symlink))
 		}
-		if inode > 1 {
-			cs.UsedSpace += align4K(attr.Length)
-			cs.UsedInodes += 1
+		for _, x := range e.Xattrs {
+			tx.set(m.xattrKey(inode, x.Name), []byte(x.Value))
+		}
+		tx.set(m.inodeKey(inode), m.marshal(attr))
+	}
+}
+
+// commitEntries sets the entries prepared by prepareEntry together with ckpt in a transaction.
+func (m *kvMeta) commitEntries(batch []interface{}, ckpt Ino) error {
+	return m.txn(func(tx kvTxn) error {
+		for _, w := range batch {
+			w.(func(tx kvTxn))(tx)
 		}
-		if cs.NextInode <= int64(inode) {
-			cs.NextInode = int64(inode) + 1
+		tx.set(m.counterKey(loadCheckpoint), packCounter(int64(ckpt)))
+		return nil
+	})
+}
+
+// countSlices counts the slices in chunks into refs and cs.
+func (m *kvMeta) countSlices(chunks []*DumpedChunk, cs *DumpedCounters, refs map[string]int64) {
+	for _, c := range chunks {
+		for _, s := range c.Slices {
+			refs[string(m.sliceKey(s.Chunkid, s.Size))]++
+			if cs.NextChunk <= int64(s.Chunkid) {
+				cs.NextChunk = int64(s.Chunkid) + 1
+			}
 		}
+	}
+}
 
-		for _, x := range e.Xattrs {
-			tx.set(m.xattrKey(inode, x.Name), []byte(x.Value))
+// setChunks writes the chunks of inode in tx.
+func (m *kvMeta) setChunks(tx kvTxn, inode Ino, chunks []*DumpedChunk) {
+	for _, c := range chunks {
+		if len(c.Slices) == 0 {
+			continue
+		}
+		slices := make([]byte, 0, sliceBytes*len(c.Slices))
+		for _, s := range c.Slices {
+			slices = append(slices, marshalSlice(s.Pos, s.Chunkid, s.Size, s.Off, s.Len)...)
+		}
+		tx.set(m.chunkKey(inode, c.Index), slices)
+	}
+}
+
+func (m *kvMeta) removeInode(inode Ino) error {
+	return m.replaceInode(inode, nil, nil)
+}
+
+// replaceInode replaces everything stored for inode with e, or removes it if e is nil, the
+// references to slices are changed by the difference of the chunks in the same transaction.
+func (m *kvMeta) replaceInode(inode Ino, e *DumpedEntry, known map[sliceID]bool) error {
+	return m.txn(func(tx kvTxn) error {
+		var old []*DumpedChunk
+		for _, v := range tx.scanValues(m.fmtKey("A", inode, "C"), nil) {
+			c := &DumpedChunk{}
+			for _, s := range readSliceBuf(v) {
+				c.Slices = append(c.Slices, &DumpedSlice{Chunkid: s.chunkid, Size: s.size})
+			}
+			old = append(old, c)
+		}
+		var chunks []*DumpedChunk
+		if e != nil && typeFromString(e.Attr.Type) == TypeFile {
+			chunks = e.Chunks
+		}
+		refs := make(map[string]int64)
+		for id, r := range diffSlices(old, chunks) {
+			if r.new == r.old {
+				continue
+			}
+			k := m.sliceKey(id.chunkid, id.size)
+			stored := int64(-1)
+			if buf := tx.get(k); buf != nil {
+				stored = parseCounter(buf)
+			}
+			if v := storedRefs(stored, r, known[id]); v != stored && (stored >= 0 || v != 0) {
+				refs[string(k)] = v
+			}
+			if r.new > 0 {
+				known[id] = true
+			}
+		}
+		tx.dels(tx.scanKeys(m.fmtKey("A", inode))...)
+		if e != nil {
+			m.prepareEntry(e, &DumpedCounters{}, make(map[string]int64))(tx)
+		}
+		for k, v := range refs {
+			if v < 0 {
+				tx.dels([]byte(k))
+			} else {
+				tx.set([]byte(k), packCounter(v))
+			}
+		}
+		return nil
+	})
+}
+
+// knownSlices scans the chunks of all files, the files to be deleted included.
+func (m *kvMeta) knownSlices(slices map[sliceID]bool) error {
+	if len(slices) == 0 {
+		return nil
+	}
+	// AiiiiiiiiCnnnn     file chunks
+	klen := 1 + 8 + 1 + 4
+	chunks, err := m.scanValues(m.fmtKey("A"), func(k, v []byte) bool {
+		return len(k) == klen && k[1+8] == 'C'
+	})
+	if err != nil {
+		return err
+	}
+	referred := make(map[sliceID]bool)
+	for _, v := range chunks {
+		for _, s := range readSliceBuf(v) {
+			if id := (sliceID{s.chunkid, s.size}); slices[id] {
+				referred[id] = true
+			}
+		}
+	}
+	for id := range slices {
+		if !referred[id] {
+			delete(slices, id)
+		}
+	}
+	return nil
+}
+
+func (m *kvMeta) raiseNextCounters(cs *DumpedCounters) error {
+	m.freeMu.Lock()
+	defer m.freeMu.Unlock()
+	m.freeInodes, m.freeChunks = freeID{}, freeID{} // allocated again above the raised ones
+	return m.txn(func(tx kvTxn) error {
+		for name, v := range map[string]int64{"nextInode": cs.NextInode, "nextChunk": cs.NextChunk, "nextSession": cs.NextSession} {
+			if cur := tx.incrBy(m.counterKey(name), 0); v > cur {
+				tx.incrBy(m.counterKey(name), v-cur)
+			}
 		}
+		return nil
+	})
+}
+
+func (m *kvMeta) graftDir(inode Ino, e *DumpedEntry) error {
+	return m.txn(func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		attr := &Attr{}
+		m.parseAttr(a, attr)
+		if attr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		for _, c := range e.Entries {
+			if tx.get(m.entryKey(inode, c.Name)) != nil {
+				return fmt.Errorf("%s exists in the destination", c.Name)
+			}
+			typ := typeFromString(c.Attr.Type)
+			if typ == TypeDirectory {
+				attr.Nlink++
+			}
+			tx.set(m.entryKey(inode, c.Name), m.packEntry(typ, c.Attr.Inode))
+		}
+		now := time.Now()
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
 		tx.set(m.inodeKey(inode), m.marshal(attr))
 		return nil
 	})
 }
 
-func (m *kvMeta) LoadMeta(r io.Reader) error {
+func (m *kvMeta) applyEntry(e *DumpedEntry, known map[sliceID]bool) error {
+	return m.replaceInode(e.Attr.Inode, e, known)
+}
+
+func (m *kvMeta) applyCounters(dm *DumpedMeta) error {
+	return m.txn(func(tx kvTxn) error {
+		tx.set(m.counterKey(usedSpace), packCounter(dm.Counters.UsedSpace))
+		tx.set(m.counterKey(totalInodes), packCounter(dm.Counters.UsedInodes))
+		tx.set(m.counterKey("nextInode"), packCounter(dm.Counters.NextInode))
+		tx.set(m.counterKey("nextChunk"), packCounter(dm.Counters.NextChunk))
+		tx.set(m.counterKey("nextSession"), packCounter(dm.Counters.NextSession))
+		for _, d := range dm.DelFiles {
+			tx.set(m.delfileKey(d.Inode, d.Length), m.packInt64(d.Expire))
+		}
+		tx.dels(m.counterKey(loadCheckpoint)) // written by loadEntry
+		return nil
+	})
+}
+
+// loadDelFiles writes the files to be deleted, overwriting the ones written before.
+func (m *kvMeta) loadDelFiles(tx kvTxn, dels []*DumpedDelFile) {
+	for _, d := range dels {
+		tx.set(m.delfileKey(d.Inode, d.Length), m.packInt64(d.Expire))
+		m.setChunks(tx, d.Inode, d.Chunks) // no attr, only the slices to be cleaned with the file
+	}
+}
+
+func (m *kvMeta) WalkTree(root Ino, visit func(path string, e *DumpedEntry) error) error {
+	return walkEntries(m, m.checkRoot(root), visit)
+}
+
+func (m *kvMeta) LoadMeta(r io.Reader, opt LoadOption) error {
 	var exist bool
+	var ckpt []byte
 	err := m.txn(func(tx kvTxn) error {
 		exist = tx.exist(m.fmtKey())
+		ckpt = tx.get(m.counterKey(loadCheckpoint))
 		return nil
 	})
 	if err != nil {
 		return err
 	}
+	if opt.DryRun != nil {
+		return dryRunLoad(r, opt, exist)
+	}
+	if opt.AttrsOnly {
+		if !exist {
+			return fmt.Errorf("Database %s is empty, there is no attr to be restored", m.Name())
+		}
+		return loadAttrsOnly(m, r, opt)
+	}
+	if opt.ApplyDelta {
+		if !exist {
+			return fmt.Errorf("Database %s is empty, load the base dump first", m.Name())
+		}
+		return applyDelta(m, r, opt)
+	}
+	if opt.Phase == "trash" {
+		if !exist {
+			return fmt.Errorf("Database %s is empty, load the live phase first", m.Name())
+		}
+		return loadTrashPhase(m, r, opt, func(dels []*DumpedDelFile) error {
+			return m.txn(func(tx kvTxn) error {
+				m.loadDelFiles(tx, dels)
+				return nil
+			})
+		})
+	}
+	if opt.Remap != "" {
+		refs := make(map[string]int64)
+		cs, err := loadRemapped(m, r, opt, 0, func(e *DumpedEntry, cs *DumpedCounters) error {
+			return m.loadEntry(e, cs, refs)
+		})
+		if err != nil {
+			return err
+		}
+		return m.txn(func(tx kvTxn) error {
+			tx.incrBy(m.counterKey(usedSpace), cs.UsedSpace)
+			tx.incrBy(m.counterKey(totalInodes), cs.UsedInodes)
+			for k, v := range refs {
+				tx.incrBy([]byte(k), v)
+			}
+			tx.dels(m.counterKey(loadCheckpoint))
+			return nil
+		})
+	}
 	if exist {
-		return fmt.Errorf("Database %s is not empty", m.Name())
+		if !opt.Resume {
+			return fmt.Errorf("Database %s is not empty", m.Name())
+		}
+		if ckpt == nil {
+			return fmt.Errorf("Database %s is not empty and has no checkpoint to resume from", m.Name())
+		}
+		logger.Infof("Resume loading after inode %d", parseCounter(ckpt))
 	}
 
-	dec := json.NewDecoder(r)
-	dm := &DumpedMeta{}
-	if err := dec.Decode(dm); err != nil {
+	dm, err := readDump(r, opt)
+	if err != nil {
 		return err
 	}
 	format, err := json.MarshalIndent(dm.Setting, "", "")
@@ -2562,22 +2804,10 @@ func (m *kvMeta) LoadMeta(r io.Reader) error {
 		return err
 	}
 
-	var total int64 = 1 // root
-	progress, bar := utils.NewDynProgressBar("CollectEntry progress: ", false)
-	dm.FSTree.Attr.Inode = 1
-	entries := make(map[Ino]*DumpedEntry)
-	if err = collectEntry(dm.FSTree, entries, func(totalIncr, currentIncr int64) {
-		total += totalIncr
-		bar.SetTotal(total, false)
-		bar.IncrInt64(currentIncr)
-	}); err != nil {
+	entries, skipped, err := collectEntries(dm, opt)
+	if err != nil {
 		return err
 	}
-	if bar.Current() != total {
-		logger.Warnf("Collected %d / total %d, some entries are not collected", bar.Current(), total)
-	}
-	bar.SetTotal(0, true)
-	progress.Wait()
 
 	counters := &DumpedCounters{
 		NextInode:   2,
@@ -2585,29 +2815,42 @@ func (m *kvMeta) LoadMeta(r io.Reader) error {
 		NextSession: 1,
 	}
 	refs := make(map[string]int64)
-	for _, entry := range entries {
-		if err = m.loadEntry(entry, counters, refs); err != nil {
-			return err
+	if err = loadBatches(entries, opt, func(e *DumpedEntry) (interface{}, error) {
+		w := m.prepareEntry(e, counters, refs)
+		if int64(e.Attr.Inode) <= parseCounter(ckpt) {
+			return nil, nil
 		}
+		return w, nil
+	}, m.commitEntries); err != nil {
+		return err
 	}
-	logger.Infof("Dumped counters: %+v", *dm.Counters)
-	logger.Infof("Loaded counters: %+v", *counters)
+	for _, d := range dm.DelFiles {
+		m.countSlices(d.Chunks, counters, refs)
+	}
+	checkUsage(dm.Counters, counters, opt.KeepCounters)
+	keepNextCounters(dm.Counters, counters, 0)
+	reportCounters(dm.Counters, counters, 0, opt)
+	warnOverQuota(dm.Setting, counters)
 
-	return m.txn(func(tx kvTxn) error {
+	if err = m.txn(func(tx kvTxn) error {
 		tx.set(m.fmtKey("setting"), format)
 		tx.set(m.counterKey(usedSpace), packCounter(counters.UsedSpace))
 		tx.set(m.counterKey(totalInodes), packCounter(counters.UsedInodes))
 		tx.set(m.counterKey("nextInode"), packCounter(counters.NextInode))
 		tx.set(m.counterKey("nextChunk"), packCounter(counters.NextChunk))
 		tx.set(m.counterKey("nextSession"), packCounter(counters.NextSession))
-		for _, d := range dm.DelFiles {
-			tx.set(m.delfileKey(d.Inode, d.Length), m.packInt64(d.Expire))
+		if opt.Phase != "live" { // refs are counted by the live phase to keep the slices
+			m.loadDelFiles(tx, dm.DelFiles)
 		}
 		for k, v := range refs {
 			if v > 1 {
 				tx.set([]byte(k), packCounter(v-1))
 			}
 		}
+		tx.dels(m.counterKey(loadCheckpoint))
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
+	return skipped.orNil()
 }
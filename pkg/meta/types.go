@@ -17,11 +17,13 @@ package meta
 
 import (
 	"bufio"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
@@ -39,9 +41,10 @@ type DumpedCounters struct {
 }
 
 type DumpedDelFile struct {
-	Inode  Ino    `json:"inode"`
-	Length uint64 `json:"length"`
-	Expire int64  `json:"expire"`
+	Inode  Ino            `json:"inode"`
+	Length uint64         `json:"length"`
+	Expire int64          `json:"expire"`
+	Chunks []*DumpedChunk `json:"chunks,omitempty"` // only for sustained inodes, see dumpSustained
 }
 
 type DumpedSustained struct {
@@ -58,75 +61,148 @@ type DumpedAttr struct {
 	Atime     int64  `json:"atime"`
 	Mtime     int64  `json:"mtime"`
 	Ctime     int64  `json:"ctime"`
-	Atimensec uint32 `json:"atimensec"`
+	Atimensec uint32 `json:"atimensec"` // always written even if zero, see dumpAttr
 	Mtimensec uint32 `json:"mtimensec"`
 	Ctimensec uint32 `json:"ctimensec"`
 	Nlink     uint32 `json:"nlink"`
 	Length    uint64 `json:"length"`
-	Rdev      uint32 `json:"rdev,omitempty"`
+	Rdev      uint32 `json:"rdev,omitempty"`  // of a device, 0 is omitted and loaded as 0 too
+	Flags     uint8  `json:"flags,omitempty"` // as stored by the engine, e.g. immutable or append-only
+	// Btime is the birth time of the inode, which is not kept by any engine yet, so it's never
+	// dumped and ignored when loaded. It's accepted for the dumps written by other tools.
+	Btime     int64  `json:"btime,omitempty"`
+	Btimensec uint32 `json:"btimensec,omitempty"`
 }
 
+// DumpedSlice is a slice of a chunk at Pos, with Len bytes from Off of the data of Chunkid. A slice
+// of Chunkid 0 is a hole written explicitly, e.g. by truncate or fallocate, which has no object and
+// reads as zeros over the slices before it.
 type DumpedSlice struct {
 	Pos     uint32 `json:"pos"`
 	Chunkid uint64 `json:"chunkid"`
 	Size    uint32 `json:"size"`
 	Off     uint32 `json:"off"`
 	Len     uint32 `json:"len"`
+	// Data is the whole contents of the slice in a dump with data, only in the first one of the
+	// same Chunkid, which is decompressed and decrypted, see SliceStore
+	Data []byte `json:"data,omitempty"`
 }
 
+// DumpedChunk is a chunk of a file with its slices in the order they are written, of which a
+// later one wins where they overlap. A range within the length of the file covered by no slice is
+// a hole too, e.g. skipped by a write beyond the end or the chunks added by truncate, not an error:
+// a file is sparse as it is dumped, and loaded with the same slices, with no zeros written for them.
+// Such ranges are reported by checkCoverage, to tell them from the slices lost.
 type DumpedChunk struct {
 	Index  uint32         `json:"index"`
 	Slices []*DumpedSlice `json:"slices"`
 }
 
+// DumpedXattr is an xattr of an entry. A binary value, which is not valid UTF-8 or has NULs,
+// is in base64 in JSON, marked by "encoding", and any other value is kept as is to be readable.
 type DumpedXattr struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
 }
 
+type jsonXattr struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"` // base64, or empty for a value as is
+}
+
+func (x *DumpedXattr) MarshalJSON() ([]byte, error) {
+	j := jsonXattr{Name: x.Name, Value: x.Value}
+	if !utf8.ValidString(x.Value) || strings.IndexByte(x.Value, 0) >= 0 {
+		j.Value = base64.StdEncoding.EncodeToString([]byte(x.Value))
+		j.Encoding = "base64"
+	}
+	return json.Marshal(&j)
+}
+
+func (x *DumpedXattr) UnmarshalJSON(data []byte) error {
+	var j jsonXattr
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	switch j.Encoding {
+	case "":
+	case "base64":
+		v, err := base64.StdEncoding.DecodeString(j.Value)
+		if err != nil {
+			return fmt.Errorf("decode value of xattr %s: %s", j.Name, err)
+		}
+		j.Value = string(v)
+	default:
+		return fmt.Errorf("unknown encoding of xattr %s: %s", j.Name, j.Encoding)
+	}
+	x.Name, x.Value = j.Name, j.Value
+	return nil
+}
+
 type DumpedEntry struct {
-	Name    string                  `json:"-"`
-	Parent  Ino                     `json:"-"`
-	Attr    *DumpedAttr             `json:"attr"`
-	Symlink string                  `json:"symlink,omitempty"`
-	Xattrs  []*DumpedXattr          `json:"xattrs,omitempty"`
-	Chunks  []*DumpedChunk          `json:"chunks,omitempty"`
-	Entries map[string]*DumpedEntry `json:"entries,omitempty"`
-}
-
-func (de *DumpedEntry) writeJSON(bw *bufio.Writer, depth int) error {
-	prefix := strings.Repeat(jsonIndent, depth)
-	fieldPrefix := prefix + jsonIndent
+	Name     string                  `json:"-"`
+	Parent   Ino                     `json:"-"`
+	Attr     *DumpedAttr             `json:"attr"`
+	Symlink  string                  `json:"symlink,omitempty"`
+	Xattrs   []*DumpedXattr          `json:"xattrs,omitempty"`
+	Chunks   []*DumpedChunk          `json:"chunks,omitempty"`
+	DirStats *DumpedDirStats         `json:"dirStats,omitempty"` // of a directory, only if dumped with DirStats
+	Hash     string                  `json:"hash,omitempty"`     // of the metadata, only if dumped with EntryHash, see entryHash
+	Entries  map[string]*DumpedEntry `json:"entries,omitempty"`
+}
+
+// jsonLayout returns the whitespace of an entry at depth in JSON, which is none in a compact dump.
+func jsonLayout(depth int, compact bool) (nl, prefix, fieldPrefix, colon string) {
+	if compact {
+		return "", "", "", ":"
+	}
+	prefix = strings.Repeat(jsonIndent, depth)
+	return "\n", prefix, prefix + jsonIndent, ": "
+}
+
+// writeJSON writes de and its children, with the ids of slices as strings if bignums, see bignum.go.
+func (de *DumpedEntry) writeJSON(bw *bufio.Writer, depth int, compact bool, escape func(string) string, bignums bool) error {
+	nl, prefix, fieldPrefix, colon := jsonLayout(depth, compact)
 	write := func(s string) {
 		if _, err := bw.WriteString(s); err != nil {
 			panic(err)
 		}
 	}
-	write(fmt.Sprintf("\n%s\"%s\": {", prefix, de.Name))
+	write(fmt.Sprintf("%s%s%s%s{", nl, prefix, jsonString(escape(de.Name)), colon))
 	data, err := json.Marshal(de.Attr)
 	if err != nil {
 		return err
 	}
-	write(fmt.Sprintf("\n%s\"attr\": %s", fieldPrefix, data))
+	write(fmt.Sprintf("%s%s\"attr\"%s%s", nl, fieldPrefix, colon, data))
 	if len(de.Symlink) > 0 {
-		write(fmt.Sprintf(",\n%s\"symlink\": \"%s\"", fieldPrefix, de.Symlink))
+		write(fmt.Sprintf(",%s%s\"symlink\"%s%s", nl, fieldPrefix, colon, jsonString(de.Symlink)))
 	}
 	if len(de.Xattrs) > 0 {
 		if data, err = json.Marshal(de.Xattrs); err != nil {
 			return err
 		}
-		write(fmt.Sprintf(",\n%s\"xattrs\": %s", fieldPrefix, data))
+		write(fmt.Sprintf(",%s%s\"xattrs\"%s%s", nl, fieldPrefix, colon, data))
 	}
-	if len(de.Chunks) == 1 {
-		if data, err = json.Marshal(de.Chunks); err != nil {
+	if de.DirStats != nil {
+		if data, err = json.Marshal(de.DirStats); err != nil {
 			return err
 		}
-		write(fmt.Sprintf(",\n%s\"chunks\": %s", fieldPrefix, data))
+		write(fmt.Sprintf(",%s%s\"dirStats\"%s%s", nl, fieldPrefix, colon, data))
+	}
+	if de.Hash != "" {
+		write(fmt.Sprintf(",%s%s\"hash\"%s\"%s\"", nl, fieldPrefix, colon, de.Hash))
+	}
+	if len(de.Chunks) == 1 || compact && len(de.Chunks) > 1 {
+		if data, err = json.Marshal(jsonChunks(de.Chunks, bignums)); err != nil {
+			return err
+		}
+		write(fmt.Sprintf(",%s%s\"chunks\"%s%s", nl, fieldPrefix, colon, data))
 	} else if len(de.Chunks) > 1 {
 		chunkPrefix := fieldPrefix + jsonIndent
 		write(fmt.Sprintf(",\n%s\"chunks\": [", fieldPrefix))
 		for i, c := range de.Chunks {
-			if data, err = json.Marshal(c); err != nil {
+			if data, err = json.Marshal(jsonChunk(c, bignums)); err != nil {
 				return err
 			}
 			write(fmt.Sprintf("\n%s%s", chunkPrefix, data))
@@ -143,50 +219,128 @@ func (de *DumpedEntry) writeJSON(bw *bufio.Writer, depth int) error {
 			entries = append(entries, v)
 		}
 		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
-		write(fmt.Sprintf(",\n%s\"entries\": {", fieldPrefix))
+		write(fmt.Sprintf(",%s%s\"entries\"%s{", nl, fieldPrefix, colon))
 		for i, e := range entries {
-			if err = e.writeJSON(bw, depth+2); err != nil {
+			if err = e.writeJSON(bw, depth+2, compact, escape, bignums); err != nil {
 				return err
 			}
 			if i != len(entries)-1 {
 				write(",")
 			}
 		}
-		write(fmt.Sprintf("\n%s}", fieldPrefix))
+		write(fmt.Sprintf("%s%s}", nl, fieldPrefix))
 	}
-	write(fmt.Sprintf("\n%s}", prefix))
+	write(fmt.Sprintf("%s%s}", nl, prefix))
 	return nil
 }
 
+// writeJsonWithOutEntry writes a directory up to the opening of its "entries",
+// so that the children can be streamed right after it.
+func (de *DumpedEntry) writeJsonWithOutEntry(bw *bufio.Writer, depth int, compact bool, escape func(string) string) error {
+	nl, prefix, fieldPrefix, colon := jsonLayout(depth, compact)
+	write := func(s string) {
+		if _, err := bw.WriteString(s); err != nil {
+			panic(err)
+		}
+	}
+	write(fmt.Sprintf("%s%s%s%s{", nl, prefix, jsonString(escape(de.Name)), colon))
+	data, err := json.Marshal(de.Attr)
+	if err != nil {
+		return err
+	}
+	write(fmt.Sprintf("%s%s\"attr\"%s%s", nl, fieldPrefix, colon, data))
+	if len(de.Xattrs) > 0 {
+		if data, err = json.Marshal(de.Xattrs); err != nil {
+			return err
+		}
+		write(fmt.Sprintf(",%s%s\"xattrs\"%s%s", nl, fieldPrefix, colon, data))
+	}
+	if de.DirStats != nil {
+		if data, err = json.Marshal(de.DirStats); err != nil {
+			return err
+		}
+		write(fmt.Sprintf(",%s%s\"dirStats\"%s%s", nl, fieldPrefix, colon, data))
+	}
+	if de.Hash != "" {
+		write(fmt.Sprintf(",%s%s\"hash\"%s\"%s\"", nl, fieldPrefix, colon, de.Hash))
+	}
+	write(fmt.Sprintf(",%s%s\"entries\"%s{", nl, fieldPrefix, colon))
+	return nil
+}
+
+// dumpVersion is the version of the dump format written by this binary. It must be increased
+// whenever a dump can't be loaded correctly by an older binary, which would ignore unknown
+// fields silently, and upgradeDump should convert a dump of an older version.
+//
+//	0: before the version is recorded, JSON only
+//	1: Version, binary format, compression, checksum and delta dumps
+//	2: shard dumps
+//	3: metadata-only dumps
+//	4: ndjson format, of which only the header would be read by an older binary
+//	5: flags of inodes
+//	6: names escaped in JSON and ndjson, see escape.go
+//	7: binary values of xattrs in base64
+//	8: standard JSON escaping of names, see escapeStandard
+const dumpVersion = 8
+
 type DumpedMeta struct {
-	Setting   *Format
-	Counters  *DumpedCounters
-	Sustained []*DumpedSustained
-	DelFiles  []*DumpedDelFile
-	FSTree    *DumpedEntry `json:",omitempty"`
+	Version     int         `json:",omitempty"`
+	Header      *DumpHeader `json:",omitempty"` // describes the dump for other tools, see schema.go
+	Setting     *Format
+	Counters    *DumpedCounters
+	Sustained   []*DumpedSustained
+	DelFiles    []*DumpedDelFile
+	Locks       []*DumpedLock           `json:",omitempty"` // only if dumped with locks, see locks.go
+	BaseVersion int64                   `json:",omitempty"` // only for delta dumps, see delta.go
+	Deleted     []Ino                   `json:",omitempty"` // inodes of the base removed in a delta dump
+	InodeRange  []Ino                   `json:",omitempty"` // only for shard dumps, see shard.go
+	NoData      bool                    `json:",omitempty"` // the slices of files are not dumped
+	DirsOnly    bool                    `json:",omitempty"` // only the directories are dumped, see dirsonly.go
+	WithData    bool                    `json:",omitempty"` // the contents of slices are dumped, see data.go
+	Escape      string                  `json:",omitempty"` // escapeStandard if the names are not %XX escaped, see escape.go
+	Partial     bool                    `json:",omitempty"` // data of some files is missing, see verify.go
+	Bignums     string                  `json:",omitempty"` // bignumsString if the counters and ids of slices are strings, see bignum.go
+	FSTree      *DumpedEntry            `json:",omitempty"`
+	Roots       map[string]*DumpedEntry `json:",omitempty"` // named trees instead of FSTree, see roots.go
+	Checksum    string                  `json:",omitempty"` // written after FSTree, see checksum.go
 }
 
-func (dm *DumpedMeta) writeJSON(w io.Writer) error {
-	tree := dm.FSTree
-	dm.FSTree = nil
-	data, err := json.MarshalIndent(dm, "", jsonIndent)
+// writeJsonWithOutTree writes everything but FSTree, leaving the top-level object
+// open for the tree to be streamed into the returned writer. A compact one still starts
+// with "{" in its own line, by which it's told from an ndjson dump.
+func (dm *DumpedMeta) writeJsonWithOutTree(w io.Writer, compact bool) (*bufio.Writer, error) {
+	if dm.FSTree != nil {
+		return nil, fmt.Errorf("invalid dumped meta: FSTree should be nil")
+	}
+	var v interface{} = dm
+	if dm.Bignums == bignumsString {
+		v = toBignumMeta(dm)
+	}
+	var data []byte
+	var err error
+	if compact {
+		data, err = json.Marshal(v)
+	} else {
+		data, err = json.MarshalIndent(v, "", jsonIndent)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	bw := bufio.NewWriterSize(w, jsonWriteSize)
-	if _, err = bw.Write(append(data[:len(data)-2], ',')); err != nil { // delete \n}
-		return err
+	if compact {
+		data = append([]byte("{\n"), data[1:len(data)-1]...) // delete }
+	} else {
+		data = data[:len(data)-2] // delete \n}
 	}
-	tree.Name = "FSTree"
-	if err = tree.writeJSON(bw, 1); err != nil {
-		return err
-	}
-	if _, err = bw.WriteString("\n}\n"); err != nil {
-		return err
+	if _, err = bw.Write(append(data, ',')); err != nil {
+		return nil, err
 	}
-	return bw.Flush()
+	return bw, nil
 }
 
+// dumpAttr converts a to be dumped. The nanoseconds of times are always written even if zero,
+// which is as precise as Redis and TKV, a time is exact after a round trip of them. The SQL
+// engine only keeps microseconds, the rest is dropped when a dump is loaded into it.
 func dumpAttr(a *Attr) *DumpedAttr {
 	d := &DumpedAttr{
 		Type:      typeToString(a.Typ),
@@ -201,6 +355,7 @@ func dumpAttr(a *Attr) *DumpedAttr {
 		Ctimensec: a.Ctimensec,
 		Nlink:     a.Nlink,
 		Rdev:      a.Rdev,
+		Flags:     a.Flags,
 	}
 	if a.Typ == TypeFile {
 		d.Length = a.Length
@@ -210,7 +365,7 @@ func dumpAttr(a *Attr) *DumpedAttr {
 
 func loadAttr(d *DumpedAttr) *Attr {
 	return &Attr{
-		// Flags:     0,
+		Flags:     d.Flags,
 		Typ:       typeFromString(d.Type),
 		Mode:      d.Mode,
 		Uid:       d.Uid,
@@ -0,0 +1,137 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"path"
+)
+
+// SliceVerifier checks the blocks of slices in the object storage of a volume without reading
+// them, by which a dump tells the files whose data is lost.
+type SliceVerifier interface {
+	// MissingBlocks returns the keys of the blocks of a slice of size bytes which are not found.
+	MissingBlocks(id uint64, size uint32) ([]string, error)
+}
+
+// DumpedMissingData is a file in a dump some of whose slices miss blocks in the object storage.
+type DumpedMissingData struct {
+	Inode  Ino      `json:"inode"`
+	Path   string   `json:"path"` // the first one walked to, relative to the dumped root
+	Slices []uint64 `json:"slices"`
+	Blocks []string `json:"blocks"`
+}
+
+// sampled tells if the slice id is verified when only rate of them are, in (0, 1]. They're
+// chosen by the ids, so that the same slices are verified every time.
+func sampled(id uint64, rate float64) bool {
+	if rate <= 0 || rate >= 1 {
+		return true
+	}
+	h := id * 0x9E3779B97F4A7C15 // Fibonacci hashing spreads consecutive ids
+	return float64(h>>11)/(1<<53) < rate
+}
+
+func checkVerifyOption(opt DumpOption) error {
+	if opt.NoData || opt.DirsOnly || opt.Since != nil || opt.Diff != nil || opt.Format == "csv" {
+		return fmt.Errorf("data of files can only be verified by a full or shard dump")
+	}
+	if opt.VerifySample < 0 || opt.VerifySample > 1 {
+		return fmt.Errorf("sample rate of verified slices should be in (0, 1]: %g", opt.VerifySample)
+	}
+	return nil
+}
+
+// verifyData walks the tree under root before anything is dumped, and checks the blocks of
+// the slices of every file by opt.VerifyData, or sampled ones by opt.VerifySample. The dump is
+// marked as partial if any block is missing, so it's known before the header is written. A
+// slice shared by several files is only checked once, but every one of them is reported.
+func verifyData(d dumper, dm *DumpedMeta, root Ino, opt DumpOption) ([]*DumpedMissingData, error) {
+	var estimate int64
+	if dm.Counters != nil {
+		estimate = dm.Counters.UsedInodes + 1
+	}
+	bar := newProgress("Verify data progress: ", estimate, opt.ProgressInterval, opt.Progress)
+	defer bar.Done()
+	type dir struct {
+		inode Ino
+		path  string
+	}
+	var missing []*DumpedMissingData
+	checked := make(map[uint64][]string) // missing blocks of the checked slices
+	seen := map[Ino]bool{root: true}
+	dirs := []dir{{root, ""}}
+	bar.Incr(1)
+	for len(dirs) > 0 {
+		p := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		entries, err := d.dumpDir(p.inode)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if seen[e.Inode] {
+				continue
+			}
+			seen[e.Inode] = true
+			bar.Incr(1)
+			ep := path.Join(p.path, string(e.Name))
+			if e.Attr.Typ == TypeDirectory {
+				dirs = append(dirs, dir{e.Inode, ep})
+				continue
+			}
+			if e.Attr.Typ != TypeFile || len(opt.InodeRange) == 2 && (e.Inode < opt.InodeRange[0] || e.Inode >= opt.InodeRange[1]) {
+				continue
+			}
+			de, err := d.dumpEntry(e.Inode)
+			if err != nil {
+				return nil, err
+			}
+			var m *DumpedMissingData
+			reported := make(map[uint64]bool)
+			for _, c := range de.Chunks {
+				for _, s := range c.Slices {
+					if s.Chunkid == 0 || reported[s.Chunkid] || !sampled(s.Chunkid, opt.VerifySample) {
+						continue
+					}
+					blocks, ok := checked[s.Chunkid]
+					if !ok {
+						if blocks, err = opt.VerifyData.MissingBlocks(s.Chunkid, s.Size); err != nil {
+							return nil, fmt.Errorf("verify slice %d of inode %d: %s", s.Chunkid, e.Inode, err)
+						}
+						checked[s.Chunkid] = blocks
+					}
+					if len(blocks) == 0 {
+						continue
+					}
+					if m == nil {
+						m = &DumpedMissingData{Inode: e.Inode, Path: ep}
+						missing = append(missing, m)
+					}
+					reported[s.Chunkid] = true
+					m.Slices = append(m.Slices, s.Chunkid)
+					m.Blocks = append(m.Blocks, blocks...)
+				}
+			}
+		}
+	}
+	logger.Infof("Verified %d slices", len(checked))
+	if len(missing) > 0 {
+		dm.Partial = true
+		logger.Warnf("Data of %d files is missing in the object storage, the dump is marked as partial", len(missing))
+	}
+	return missing, nil
+}
@@ -0,0 +1,197 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"io"
+)
+
+// VerifyOption is the option of VerifyDump.
+type VerifyOption struct {
+	// Threads is the number of entries read from the volume concurrently, see DumpOption
+	Threads int
+	// MaxMismatches is the number of mismatches kept in the result, all of them are counted
+	MaxMismatches int
+	// IgnoreIDs doesn't compare the inodes and the ids of slices, which are changed by a load
+	// with LoadOption.Remap and LoadOption.Dedup respectively
+	IgnoreIDs bool
+}
+
+// DumpedMismatch is an entry which is different in the dump and the volume at its path.
+type DumpedMismatch struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"` // missing in the volume, extra in it, or changed
+	Type string `json:"type"` // in the dump, or in the volume if it's extra
+	// Fields are the ones changed, with the old value in the dump and the new one in the volume
+	Fields []*DumpedAttrChange `json:"fields,omitempty"`
+}
+
+// DumpedVerification is the result of VerifyDump.
+type DumpedVerification struct {
+	Entries    int64             `json:"entries"` // compared at the same path
+	Total      int64             `json:"total"`   // of all the mismatches, and by kind
+	Missing    int64             `json:"missing"`
+	Extra      int64             `json:"extra"`
+	Changed    int64             `json:"changed"`
+	Mismatches []*DumpedMismatch `json:"mismatches"` // the first ones up to MaxMismatches
+}
+
+// VerifyDump compares the tree of the volume of m with a full dump in r, e.g. the one loaded into it
+// before the original volume is deleted, like DiffDumps does for two dumps: the entries are aligned
+// by path and compared by compareEntries, and so is the layout of the slices of files, but not
+// their data. The volume is dumped in the same way as the dump, e.g. without slices if it's
+// NoData, and both are read entry by entry at the same time.
+func VerifyDump(m Meta, r *DumpReader, opt VerifyOption) (*DumpedVerification, error) {
+	if r.Meta.BaseVersion != 0 || r.Meta.InodeRange != nil {
+		return nil, fmt.Errorf("only a full dump can be verified")
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close() // stops the dump if it's not finished
+	go func() {
+		_ = pw.CloseWithError(m.DumpMeta(pw, DumpOption{Format: "binary", Threads: opt.Threads, NoData: r.Meta.NoData, DirsOnly: r.Meta.DirsOnly}))
+	}()
+	live, err := NewDumpReader(pr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dump the volume: %s", err)
+	}
+	defer live.Close()
+
+	dc, lc := &diffCursor{r: r, linked: make(map[Ino]bool)}, &diffCursor{r: live, linked: make(map[Ino]bool)}
+	if err = dc.next(); err != nil {
+		return nil, err
+	}
+	if err = lc.next(); err != nil {
+		return nil, err
+	}
+	v := &DumpedVerification{Mismatches: []*DumpedMismatch{}}
+	mismatch := func(mm *DumpedMismatch) {
+		v.Total++
+		switch mm.Kind {
+		case "missing":
+			v.Missing++
+		case "extra":
+			v.Extra++
+		default:
+			v.Changed++
+		}
+		if len(v.Mismatches) < opt.MaxMismatches {
+			v.Mismatches = append(v.Mismatches, mm)
+		}
+	}
+	for dc.e != nil || lc.e != nil {
+		var c int
+		if dc.e == nil {
+			c = 1
+		} else if lc.e != nil {
+			c = comparePaths(dc.p, lc.p)
+		} else {
+			c = -1
+		}
+		switch {
+		case c < 0:
+			mismatch(&DumpedMismatch{Path: dc.p, Kind: "missing", Type: dc.e.Attr.Type})
+		case c > 0:
+			mismatch(&DumpedMismatch{Path: lc.p, Kind: "extra", Type: lc.e.Attr.Type})
+		default:
+			v.Entries++
+			if fields := verifyEntry(dc.e, lc.e, dc.p, opt.IgnoreIDs); len(fields) > 0 {
+				mismatch(&DumpedMismatch{Path: dc.p, Kind: "changed", Type: dc.e.Attr.Type, Fields: fields})
+			}
+		}
+		if c <= 0 {
+			if err = dc.next(); err != nil {
+				return nil, err
+			}
+		}
+		if c >= 0 {
+			if err = lc.next(); err != nil {
+				return nil, fmt.Errorf("dump the volume: %s", err)
+			}
+		}
+	}
+	logger.Infof("Verified %d entries with the dump: %d mismatches", v.Entries, v.Total)
+	return v, nil
+}
+
+// verifyEntry returns the fields of e in the volume different from the one d in the dump at p.
+func verifyEntry(d, e *DumpedEntry, p string, ignoreIDs bool) []*DumpedAttrChange {
+	if d.Attr.Type != e.Attr.Type {
+		return []*DumpedAttrChange{{"type", d.Attr.Type, e.Attr.Type}}
+	}
+	var fields []*DumpedAttrChange
+	if c := compareEntries(d, e, p); c != nil {
+		for _, f := range c.Fields {
+			if !ignoreIDs || f.Field != "inode" {
+				fields = append(fields, f)
+			}
+		}
+	}
+	if f := compareChunks(d.Chunks, e.Chunks, ignoreIDs); f != nil {
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// compareChunks returns the first chunk different in a and b, of which a missing one is nil, with
+// the slices as they are but their data.
+func compareChunks(a, b []*DumpedChunk, ignoreIDs bool) *DumpedAttrChange {
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		var ac, bc *DumpedChunk
+		if i < len(a) && (j == len(b) || a[i].Index <= b[j].Index) {
+			ac = a[i]
+			i++
+		}
+		if j < len(b) && (ac == nil || b[j].Index == ac.Index) {
+			bc = b[j]
+			j++
+		}
+		if ac == nil || bc == nil || !equalSlices(ac.Slices, bc.Slices, ignoreIDs) {
+			return &DumpedAttrChange{"chunks", chunkLayout(ac), chunkLayout(bc)}
+		}
+	}
+	return nil
+}
+
+// equalSlices compares the slices of two chunks, a hole is never the same as a slice of data, even
+// if the ids are ignored.
+func equalSlices(a, b []*DumpedSlice, ignoreIDs bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, s := range a {
+		t := b[i]
+		if s.Pos != t.Pos || s.Size != t.Size || s.Off != t.Off || s.Len != t.Len || (s.Chunkid == 0) != (t.Chunkid == 0) {
+			return false
+		}
+		if !ignoreIDs && s.Chunkid != t.Chunkid {
+			return false
+		}
+	}
+	return true
+}
+
+// chunkLayout returns c without the data of its slices.
+func chunkLayout(c *DumpedChunk) *DumpedChunk {
+	if c == nil {
+		return nil
+	}
+	l := &DumpedChunk{Index: c.Index, Slices: make([]*DumpedSlice, len(c.Slices))}
+	for i, s := range c.Slices {
+		l.Slices[i] = &DumpedSlice{Pos: s.Pos, Chunkid: s.Chunkid, Size: s.Size, Off: s.Off, Len: s.Len}
+	}
+	return l
+}
@@ -0,0 +1,81 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package meta
+
+import (
+	"errors"
+	"path"
+	"sort"
+)
+
+// SkipDir is returned by the visit function of WalkTree to skip the children of a directory.
+// It's the same as nil for other entries.
+var SkipDir = errors.New("skip this directory")
+
+// walkEntries visits the entries under root as they're dumped, depth first and in the order of
+// names, but the children of a directory are not filled into it. The entries are read one by
+// one from d and dropped after visited, so that only the directories being walked are in memory.
+func walkEntries(d dumper, root Ino, visit func(path string, e *DumpedEntry) error) error {
+	type dir struct {
+		path    string
+		inode   Ino
+		entries []*Entry
+	}
+	var stack []*dir
+	// enter visits e, and pushes it into the stack if it's a directory whose children are walked
+	enter := func(p string, e *DumpedEntry) error {
+		err := visit(p, e)
+		if err == SkipDir || err == nil && e.Attr.Type != "directory" {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		entries, err := d.dumpDir(e.Attr.Inode)
+		if err != nil {
+			return err
+		}
+		// reversed to be popped in order
+		sort.Slice(entries, func(i, j int) bool { return string(entries[i].Name) > string(entries[j].Name) })
+		stack = append(stack, &dir{p, e.Attr.Inode, entries})
+		return nil
+	}
+	tree, err := d.dumpEntry(root)
+	if err != nil {
+		return err
+	}
+	tree.Parent = root
+	if err = enter("/", tree); err != nil {
+		return err
+	}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		if len(p.entries) == 0 {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		c := p.entries[len(p.entries)-1]
+		p.entries = p.entries[:len(p.entries)-1]
+		e, err := d.dumpEntry(c.Inode)
+		if err != nil {
+			return err
+		}
+		e.Name, e.Parent = string(c.Name), p.inode
+		if err = enter(path.Join(p.path, e.Name), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
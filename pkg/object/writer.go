@@ -0,0 +1,155 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var writerPartSize = 32 << 20
+
+var errAborted = errors.New("upload aborted")
+
+// Writer uploads everything written into it as an object without knowing its size in
+// advance. It uploads part by part when the storage supports multipart upload, or
+// streams the data in a single Put otherwise. Nothing is left if it's aborted.
+type Writer struct {
+	store ObjectStorage
+	key   string
+	buf   []byte
+
+	upload *MultipartUpload
+	parts  []*Part
+
+	pw   *io.PipeWriter // fallback when multipart upload is not supported
+	done chan error
+}
+
+// NewWriter returns a Writer for the object specified by key.
+func NewWriter(store ObjectStorage, key string) *Writer {
+	return &Writer{store: store, key: key}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.pw != nil {
+		return w.pw.Write(p)
+	}
+	n := len(p)
+	for len(p) > 0 {
+		size := writerPartSize
+		if w.upload != nil && w.upload.MinPartSize > size {
+			size = w.upload.MinPartSize
+		}
+		if w.buf == nil {
+			w.buf = make([]byte, 0, size)
+		}
+		l := size - len(w.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		w.buf = append(w.buf, p[:l]...)
+		p = p[l:]
+		if len(w.buf) == size {
+			if err := w.flush(); err != nil {
+				return n - len(p), err
+			}
+			if w.pw != nil {
+				if _, err := w.pw.Write(p); err != nil {
+					return n - len(p), err
+				}
+				return n, nil
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush uploads the buffered data as a part, or starts the fallback Put.
+func (w *Writer) flush() error {
+	if w.upload == nil {
+		upload, err := w.store.CreateMultipartUpload(w.key)
+		if err != nil {
+			logger.Debugf("Multipart upload is not supported by %s, upload %s in a single Put: %s", w.store, w.key, err)
+			pr, pw := io.Pipe()
+			w.pw, w.done = pw, make(chan error, 1)
+			go func() {
+				err := w.store.Put(w.key, pr)
+				_ = pr.CloseWithError(err) // unblock the writer if Put returns early
+				w.done <- err
+			}()
+			buf := w.buf
+			w.buf = nil
+			_, err = w.pw.Write(buf)
+			return err
+		}
+		w.upload = upload
+	}
+	num := len(w.parts) + 1 // PartNumber starts from 1
+	if w.upload.MaxCount > 0 && num > w.upload.MaxCount {
+		return fmt.Errorf("too many parts for %s: %d", w.key, num)
+	}
+	var part *Part
+	var err error
+	for i := 0; i < 3; i++ {
+		if part, err = w.store.UploadPart(w.key, w.upload.UploadID, num, w.buf); err == nil {
+			break
+		}
+		time.Sleep(time.Second * time.Duration(i*i))
+	}
+	if err != nil {
+		return fmt.Errorf("upload part %d of %s: %s", num, w.key, err)
+	}
+	w.parts = append(w.parts, part)
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close uploads the remaining data and completes the object.
+func (w *Writer) Close() error {
+	if w.pw != nil {
+		_ = w.pw.Close()
+		return <-w.done
+	}
+	if w.upload == nil { // small enough for a single Put
+		return w.store.Put(w.key, bytes.NewReader(w.buf))
+	}
+	if len(w.buf) > 0 {
+		if err := w.flush(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	if err := w.store.CompleteUpload(w.key, w.upload.UploadID, w.parts); err != nil {
+		w.Abort()
+		return fmt.Errorf("complete upload of %s: %s", w.key, err)
+	}
+	return nil
+}
+
+// Abort discards everything uploaded so far.
+func (w *Writer) Abort() {
+	if w.pw != nil {
+		_ = w.pw.CloseWithError(errAborted)
+		<-w.done
+	} else if w.upload != nil {
+		w.store.AbortUpload(w.key, w.upload.UploadID)
+	}
+	w.buf = nil
+}
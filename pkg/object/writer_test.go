@@ -0,0 +1,106 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"testing"
+)
+
+// multipartMem is a memStore supporting multipart upload.
+type multipartMem struct {
+	ObjectStorage
+	parts map[string]map[int][]byte
+}
+
+func (m *multipartMem) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	id := fmt.Sprintf("%s-%d", key, len(m.parts))
+	m.parts[id] = make(map[int][]byte)
+	return &MultipartUpload{MinPartSize: 1, MaxCount: 100, UploadID: id}, nil
+}
+
+func (m *multipartMem) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	m.parts[uploadID][num] = append([]byte{}, body...)
+	return &Part{Num: num, Size: len(body)}, nil
+}
+
+func (m *multipartMem) AbortUpload(key string, uploadID string) {
+	delete(m.parts, uploadID)
+}
+
+func (m *multipartMem) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Num < parts[j].Num })
+	var data []byte
+	for _, p := range parts {
+		data = append(data, m.parts[uploadID][p.Num]...)
+	}
+	delete(m.parts, uploadID)
+	return m.Put(key, bytes.NewReader(data))
+}
+
+func TestWriter(t *testing.T) {
+	old := writerPartSize
+	writerPartSize = 1 << 10
+	defer func() { writerPartSize = old }()
+
+	data := make([]byte, 10<<10+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	mem, _ := newMem("", "", "")
+	mp := &multipartMem{mem, make(map[string]map[int][]byte)}
+	for _, s := range []ObjectStorage{mem, mp} {
+		for _, size := range []int{0, 100, len(data)} {
+			w := NewWriter(s, "obj")
+			for off := 0; off < size; off += 333 { // not aligned to parts
+				end := off + 333
+				if end > size {
+					end = size
+				}
+				if _, err := w.Write(data[off:end]); err != nil {
+					t.Fatalf("write: %s", err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("close: %s", err)
+			}
+			r, err := s.Get("obj", 0, -1)
+			if err != nil {
+				t.Fatalf("get: %s", err)
+			}
+			got, _ := ioutil.ReadAll(r)
+			if !bytes.Equal(got, data[:size]) {
+				t.Fatalf("upload %d bytes to %s: got %d bytes", size, s, len(got))
+			}
+			_ = s.Delete("obj")
+		}
+
+		w := NewWriter(s, "aborted")
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		w.Abort()
+		if _, err := s.Head("aborted"); err == nil {
+			t.Fatalf("aborted upload should not be visible in %s", s)
+		}
+	}
+	if len(mp.parts) != 0 {
+		t.Fatalf("uploads are not completed or aborted: %d", len(mp.parts))
+	}
+}
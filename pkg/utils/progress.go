@@ -0,0 +1,189 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	"github.com/vbauerster/mpb/v7"
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+var logger = GetLogger("juicefs")
+
+// Progress shows the progress of a long task to stderr with its rate, which is a moving
+// average, and the ETA. It's a bar on a terminal, or a log line every interval otherwise.
+type Progress struct {
+	title    string
+	interval time.Duration
+	progress *mpb.Progress
+	bar      *mpb.Bar // nil when it's not a terminal
+
+	mu       sync.Mutex
+	estimate int64 // the total known in advance
+	total    int64 // the total found so far
+	current  int64
+	rate     float64 // per second
+	last     int64   // current when the rate is updated
+	notify   func(current, total int64)
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewProgress starts the progress of a task with the estimated total, which is replaced by the
+// total found by SetTotal if it's larger. A zero interval means the default refresh rate on a
+// terminal, and no log at all otherwise.
+func NewProgress(title string, estimate int64, interval time.Duration) *Progress {
+	p := &Progress{title: title, interval: interval, estimate: estimate, done: make(chan struct{}), stopped: make(chan struct{})}
+	if isatty.IsTerminal(os.Stderr.Fd()) {
+		opts := []mpb.ContainerOption{mpb.WithWidth(64), mpb.WithOutput(os.Stderr)}
+		if interval > 0 {
+			opts = append(opts, mpb.WithRefreshRate(interval))
+		}
+		p.progress = mpb.New(opts...)
+		p.bar = p.progress.AddBar(estimate,
+			mpb.PrependDecorators(
+				decor.Name(title, decor.WCSyncWidth),
+				decor.CountersNoUnit("%d / %d"),
+			),
+			mpb.AppendDecorators(
+				decor.OnComplete(decor.Percentage(decor.WC{W: 5}), "done"),
+				decor.OnComplete(decor.Any(func(decor.Statistics) string { return p.speed() }, decor.WC{W: 32}), ""),
+			),
+		)
+	}
+	go p.update()
+	return p
+}
+
+func (p *Progress) update() {
+	defer close(p.stopped)
+	interval := p.interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	const alpha = 0.2 // weight of the latest sample, about the last 10 samples are counted
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		sample := float64(p.current-p.last) / interval.Seconds()
+		if p.last == 0 {
+			p.rate = sample
+		} else {
+			p.rate = alpha*sample + (1-alpha)*p.rate
+		}
+		p.last = p.current
+		p.mu.Unlock()
+		if p.bar == nil && p.interval > 0 {
+			current, total := p.counts()
+			logger.Infof("%s%d / %d, %s", p.title, current, total, p.speed())
+		}
+		p.notifyCounts()
+	}
+}
+
+func (p *Progress) notifyCounts() {
+	p.mu.Lock()
+	notify := p.notify
+	p.mu.Unlock()
+	if notify != nil {
+		notify(p.counts())
+	}
+}
+
+// Notify calls f with the finished items and the total every interval (a second by default),
+// and once more when it's done, e.g. to report the progress to a caller of a library.
+func (p *Progress) Notify(f func(current, total int64)) {
+	p.mu.Lock()
+	p.notify = f
+	p.mu.Unlock()
+}
+
+func (p *Progress) counts() (int64, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	total := p.total
+	if p.estimate > total {
+		total = p.estimate
+	}
+	return p.current, total
+}
+
+func (p *Progress) speed() string {
+	current, total := p.counts()
+	p.mu.Lock()
+	rate := p.rate
+	p.mu.Unlock()
+	if rate <= 0 {
+		return "-/s, ETA -"
+	}
+	eta := time.Duration(float64(total-current) / rate * float64(time.Second)).Round(time.Second)
+	if eta < 0 {
+		eta = 0
+	}
+	return fmt.Sprintf("%.1f/s, ETA %s", rate, eta)
+}
+
+// SetTotal updates the total found so far.
+func (p *Progress) SetTotal(total int64) {
+	p.mu.Lock()
+	p.total = total
+	p.mu.Unlock()
+	if p.bar != nil {
+		_, t := p.counts()
+		p.bar.SetTotal(t, false)
+	}
+}
+
+// Incr increases the finished items by n.
+func (p *Progress) Incr(n int64) {
+	p.mu.Lock()
+	p.current += n
+	p.mu.Unlock()
+	if p.bar != nil {
+		p.bar.IncrInt64(n)
+	}
+}
+
+// Current returns the finished items.
+func (p *Progress) Current() int64 {
+	current, _ := p.counts()
+	return current
+}
+
+// Done completes the progress, the total becomes the finished items.
+func (p *Progress) Done() {
+	close(p.done)
+	<-p.stopped
+	if p.bar != nil {
+		p.bar.SetTotal(p.Current(), true)
+		p.progress.Wait()
+	}
+	p.mu.Lock()
+	p.total, p.estimate = p.current, 0
+	p.mu.Unlock()
+	p.notifyCounts()
+}
@@ -0,0 +1,63 @@
+/*
+ * JuiceFS, Copyright (C) 2021 Juicedata, Inc.
+ *
+ * This program is free software: you can use, redistribute, and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3
+ * or later ("AGPL"), as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT
+ * ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+ * FITNESS FOR A PARTICULAR PURPOSE.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	p := NewProgress("test: ", 100, 10*time.Millisecond)
+	if s := p.speed(); s != "-/s, ETA -" {
+		t.Fatalf("speed before started: %s", s)
+	}
+	for i := 0; i < 5; i++ {
+		p.Incr(10)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if s := p.speed(); !strings.HasSuffix(s, "/s, ETA 0s") && !strings.HasSuffix(s, "/s, ETA 1s") {
+		t.Fatalf("speed: %s", s)
+	}
+	p.SetTotal(200)
+	if current, total := p.counts(); current != 50 || total != 200 {
+		t.Fatalf("counts: %d / %d", current, total)
+	}
+	p.Done()
+	if p.Current() != 50 {
+		t.Fatalf("current: %d", p.Current())
+	}
+}
+
+func TestProgressNotify(t *testing.T) {
+	p := NewProgress("test: ", 100, 10*time.Millisecond)
+	notified := make(chan [2]int64, 100)
+	p.Notify(func(current, total int64) { notified <- [2]int64{current, total} })
+	p.Incr(10)
+	if n := <-notified; n != [2]int64{10, 100} {
+		t.Fatalf("notified: %v", n)
+	}
+	p.Incr(10)
+	p.Done()
+	var last [2]int64
+	for len(notified) > 0 {
+		last = <-notified
+	}
+	if last != [2]int64{20, 20} {
+		t.Fatalf("notified when done: %v", last)
+	}
+}